@@ -0,0 +1,182 @@
+package cluster
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// MemoryHub is an in-process stand-in for Redis. Registries created from the same hub
+// behave like nodes of one cluster, which makes multi-node setups easy to run in tests.
+type MemoryHub struct {
+	mu      sync.RWMutex
+	owners  map[string]string            // key: unique_id, value: node_id
+	clients map[string]map[string]string // key: client_id, value: unique_id -> node_id
+	nodes   map[string]*MemoryRegistry   // key: node_id
+}
+
+// NewMemoryHub creates a new empty hub
+func NewMemoryHub() *MemoryHub {
+	return &MemoryHub{
+		owners:  make(map[string]string),
+		clients: make(map[string]map[string]string),
+		nodes:   make(map[string]*MemoryRegistry),
+	}
+}
+
+// NewRegistry creates a registry for a node attached to this hub
+func (hub *MemoryHub) NewRegistry(nodeID string) *MemoryRegistry {
+	reg := &MemoryRegistry{hub: hub, nodeID: nodeID}
+
+	hub.mu.Lock()
+	hub.nodes[nodeID] = reg
+	hub.mu.Unlock()
+
+	return reg
+}
+
+// MemoryRegistry is a Registry backed by a MemoryHub
+type MemoryRegistry struct {
+	hub     *MemoryHub
+	nodeID  string
+	mu      sync.RWMutex
+	handler func(*Envelope)
+}
+
+// NodeID returns the ID of this node
+func (r *MemoryRegistry) NodeID() string {
+	return r.nodeID
+}
+
+// RegisterDevice records this node as the owner of a device connection
+func (r *MemoryRegistry) RegisterDevice(clientID, uniqueID string) error {
+	r.hub.mu.Lock()
+	defer r.hub.mu.Unlock()
+
+	r.hub.owners[uniqueID] = r.nodeID
+	devices, exists := r.hub.clients[clientID]
+	if !exists {
+		devices = make(map[string]string)
+		r.hub.clients[clientID] = devices
+	}
+	devices[uniqueID] = r.nodeID
+	return nil
+}
+
+// UnregisterDevice removes the ownership record if this node owns the device
+func (r *MemoryRegistry) UnregisterDevice(clientID, uniqueID string) error {
+	r.hub.mu.Lock()
+	defer r.hub.mu.Unlock()
+
+	if r.hub.owners[uniqueID] != r.nodeID {
+		return nil
+	}
+	delete(r.hub.owners, uniqueID)
+
+	if devices, exists := r.hub.clients[clientID]; exists {
+		delete(devices, uniqueID)
+		if len(devices) == 0 {
+			delete(r.hub.clients, clientID)
+		}
+	}
+	return nil
+}
+
+// GetDeviceOwner returns the node that owns a device connection
+func (r *MemoryRegistry) GetDeviceOwner(uniqueID string) (string, bool, error) {
+	r.hub.mu.RLock()
+	defer r.hub.mu.RUnlock()
+
+	nodeID, exists := r.hub.owners[uniqueID]
+	if !exists || r.hub.nodes[nodeID] == nil {
+		return "", false, nil
+	}
+	return nodeID, true, nil
+}
+
+// GetClientOwners returns unique_id -> node_id for every device of a client
+func (r *MemoryRegistry) GetClientOwners(clientID string) (map[string]string, error) {
+	r.hub.mu.RLock()
+	defer r.hub.mu.RUnlock()
+
+	owners := make(map[string]string)
+	for uniqueID, nodeID := range r.hub.clients[clientID] {
+		if r.hub.nodes[nodeID] != nil {
+			owners[uniqueID] = nodeID
+		}
+	}
+	return owners, nil
+}
+
+// Publish delivers an envelope to the target node, or to every other node.
+// The envelope goes through JSON like it would over Redis.
+func (r *MemoryRegistry) Publish(env *Envelope) error {
+	env.Origin = r.nodeID
+	payload, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+
+	r.hub.mu.RLock()
+	targets := make([]*MemoryRegistry, 0, len(r.hub.nodes))
+	for nodeID, node := range r.hub.nodes {
+		if nodeID == r.nodeID {
+			continue
+		}
+		if env.Target == "" || env.Target == nodeID {
+			targets = append(targets, node)
+		}
+	}
+	r.hub.mu.RUnlock()
+
+	for _, node := range targets {
+		var copied Envelope
+		if err := json.Unmarshal(payload, &copied); err != nil {
+			return err
+		}
+		node.deliver(&copied)
+	}
+	return nil
+}
+
+// Subscribe starts delivering envelopes addressed to this node to handler
+func (r *MemoryRegistry) Subscribe(handler func(*Envelope)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handler = handler
+	return nil
+}
+
+// deliver hands an envelope to the subscribed handler asynchronously, like a pub/sub message
+func (r *MemoryRegistry) deliver(env *Envelope) {
+	r.mu.RLock()
+	handler := r.handler
+	r.mu.RUnlock()
+
+	if handler != nil {
+		go handler(env)
+	}
+}
+
+// Close detaches this node from the hub and drops every device it owned
+func (r *MemoryRegistry) Close() error {
+	r.hub.mu.Lock()
+	defer r.hub.mu.Unlock()
+
+	delete(r.hub.nodes, r.nodeID)
+	for uniqueID, nodeID := range r.hub.owners {
+		if nodeID == r.nodeID {
+			delete(r.hub.owners, uniqueID)
+		}
+	}
+	for clientID, devices := range r.hub.clients {
+		for uniqueID, nodeID := range devices {
+			if nodeID == r.nodeID {
+				delete(devices, uniqueID)
+			}
+		}
+		if len(devices) == 0 {
+			delete(r.hub.clients, clientID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	keyPrefix        = "grpcon:"
+	broadcastChannel = keyPrefix + "broadcast"
+
+	// DefaultNodeTTL is how long a node is considered alive without refreshing its key
+	DefaultNodeTTL = 30 * time.Second
+	// commandTimeout bounds dialing Redis and every command sent to it
+	commandTimeout = 5 * time.Second
+)
+
+func nodeKey(nodeID string) string     { return keyPrefix + "node:" + nodeID }
+func nodeChannel(nodeID string) string { return keyPrefix + "node:" + nodeID + ":inbox" }
+func deviceKey(uniqueID string) string { return keyPrefix + "device:" + uniqueID }
+func clientKey(clientID string) string { return keyPrefix + "client:" + clientID }
+
+// unregisterScript removes the ownership records of a device in one step, unless another node
+// took the device over since this one registered it.
+//
+//	KEYS[1] device key, KEYS[2] client key
+//	ARGV[1] unique_id,  ARGV[2] node_id
+var unregisterScript = redis.NewScript(`
+local owner = redis.call('GET', KEYS[1])
+if owner and owner ~= ARGV[2] then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+if redis.call('HGET', KEYS[2], ARGV[1]) == ARGV[2] then
+	redis.call('HDEL', KEYS[2], ARGV[1])
+end
+return 1
+`)
+
+// RedisRegistry is a Registry shared by all nodes through Redis.
+//
+// Keys:
+//
+//	grpcon:node:{node_id}       -> "1" with TTL, refreshed while the node is alive
+//	grpcon:device:{unique_id}   -> node_id owning the device
+//	grpcon:client:{client_id}   -> hash unique_id -> node_id
+//
+// Envelopes are published on grpcon:node:{node_id}:inbox or grpcon:broadcast.
+type RedisRegistry struct {
+	nodeID  string
+	nodeTTL time.Duration
+	client  *redis.Client
+
+	subMu    sync.Mutex
+	pubsub   *redis.PubSub
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+// NewRedisRegistry connects to Redis and announces this node. Other nodes consider it gone nodeTTL
+// after its last refresh, DefaultNodeTTL if nodeTTL is shorter than a second.
+func NewRedisRegistry(addr, password, nodeID string, nodeTTL time.Duration) (*RedisRegistry, error) {
+	if nodeTTL < time.Second {
+		nodeTTL = DefaultNodeTTL
+	}
+	r := &RedisRegistry{
+		nodeID:  nodeID,
+		nodeTTL: nodeTTL,
+		client: redis.NewClient(&redis.Options{
+			Addr:         addr,
+			Password:     password,
+			DialTimeout:  commandTimeout,
+			ReadTimeout:  commandTimeout,
+			WriteTimeout: commandTimeout,
+		}),
+		stopChan: make(chan struct{}),
+	}
+
+	if err := r.refreshNode(); err != nil {
+		r.client.Close()
+		return nil, err
+	}
+
+	go r.keepAlive()
+
+	slog.Info("Redis registry connected", "addr", addr, "node_id", nodeID)
+	return r, nil
+}
+
+// commandContext bounds one command, or one transaction, by commandTimeout
+func commandContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), commandTimeout)
+}
+
+// NodeID returns the ID of this node
+func (r *RedisRegistry) NodeID() string {
+	return r.nodeID
+}
+
+// refreshNode marks this node as alive for another nodeTTL
+func (r *RedisRegistry) refreshNode() error {
+	ctx, cancel := commandContext()
+	defer cancel()
+	return r.client.Set(ctx, nodeKey(r.nodeID), "1", r.nodeTTL).Err()
+}
+
+// keepAlive refreshes the node key until the registry is closed
+func (r *RedisRegistry) keepAlive() {
+	ticker := time.NewTicker(r.nodeTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.refreshNode(); err != nil {
+				slog.Error("Failed to refresh node in redis", "node_id", r.nodeID, "error", err)
+			}
+		case <-r.stopChan:
+			return
+		}
+	}
+}
+
+// isNodeAlive reports whether a node has refreshed its key recently
+func (r *RedisRegistry) isNodeAlive(ctx context.Context, nodeID string) (bool, error) {
+	if nodeID == r.nodeID {
+		return true, nil
+	}
+	n, err := r.client.Exists(ctx, nodeKey(nodeID)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// RegisterDevice records this node as the owner of a device connection. Both records are written
+// in one MULTI/EXEC transaction so other nodes never see only one of them.
+func (r *RedisRegistry) RegisterDevice(clientID, uniqueID string) error {
+	ctx, cancel := commandContext()
+	defer cancel()
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, deviceKey(uniqueID), r.nodeID, 0)
+		pipe.HSet(ctx, clientKey(clientID), uniqueID, r.nodeID)
+		return nil
+	})
+	return err
+}
+
+// UnregisterDevice removes the ownership record if this node still owns the device. The check and
+// the removal run as one script, a node registering the device meanwhile keeps its records.
+func (r *RedisRegistry) UnregisterDevice(clientID, uniqueID string) error {
+	ctx, cancel := commandContext()
+	defer cancel()
+	return unregisterScript.Run(ctx, r.client, []string{deviceKey(uniqueID), clientKey(clientID)}, uniqueID, r.nodeID).Err()
+}
+
+// GetDeviceOwner returns the live node that owns a device connection
+func (r *RedisRegistry) GetDeviceOwner(uniqueID string) (string, bool, error) {
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	nodeID, err := r.client.Get(ctx, deviceKey(uniqueID)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	alive, err := r.isNodeAlive(ctx, nodeID)
+	if err != nil || !alive {
+		return "", false, err
+	}
+	return nodeID, true, nil
+}
+
+// GetClientOwners returns unique_id -> node_id for every device of a client owned by a live node
+func (r *RedisRegistry) GetClientOwners(clientID string) (map[string]string, error) {
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	devices, err := r.client.HGetAll(ctx, clientKey(clientID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	owners := make(map[string]string)
+	alive := make(map[string]bool)
+	for uniqueID, nodeID := range devices {
+		isAlive, checked := alive[nodeID]
+		if !checked {
+			if isAlive, err = r.isNodeAlive(ctx, nodeID); err != nil {
+				return nil, err
+			}
+			alive[nodeID] = isAlive
+		}
+		if isAlive {
+			owners[uniqueID] = nodeID
+		}
+	}
+	return owners, nil
+}
+
+// Publish sends an envelope to env.Target, or to every node when Target is empty
+func (r *RedisRegistry) Publish(env *Envelope) error {
+	env.Origin = r.nodeID
+	payload, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+
+	channel := broadcastChannel
+	if env.Target != "" {
+		channel = nodeChannel(env.Target)
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	return r.client.Publish(ctx, channel, payload).Err()
+}
+
+// Subscribe starts delivering envelopes addressed to this node to handler.
+// The subscription reconnects on its own until the registry is closed.
+func (r *RedisRegistry) Subscribe(handler func(*Envelope)) error {
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	pubsub := r.client.Subscribe(ctx, nodeChannel(r.nodeID), broadcastChannel)
+	// Wait for the confirmation so a Redis that can't be reached fails here
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return err
+	}
+
+	r.subMu.Lock()
+	r.pubsub = pubsub
+	r.subMu.Unlock()
+
+	go r.readSubscription(pubsub.Channel(), handler)
+	return nil
+}
+
+// readSubscription hands pub/sub messages to handler until the subscription is closed
+func (r *RedisRegistry) readSubscription(messages <-chan *redis.Message, handler func(*Envelope)) {
+	for msg := range messages {
+		var env Envelope
+		if err := json.Unmarshal([]byte(msg.Payload), &env); err != nil {
+			slog.Warn("Dropping malformed envelope", "channel", msg.Channel, "error", err)
+			continue
+		}
+		if env.Origin == r.nodeID {
+			continue
+		}
+		handler(&env)
+	}
+}
+
+// Close stops the subscription and removes this node's key so others stop routing to it
+func (r *RedisRegistry) Close() error {
+	var err error
+	r.stopOnce.Do(func() {
+		close(r.stopChan)
+
+		r.subMu.Lock()
+		if r.pubsub != nil {
+			r.pubsub.Close()
+		}
+		r.subMu.Unlock()
+
+		ctx, cancel := commandContext()
+		defer cancel()
+		if delErr := r.client.Del(ctx, nodeKey(r.nodeID)).Err(); delErr != nil {
+			err = fmt.Errorf("failed to remove node %s from redis: %w", r.nodeID, delErr)
+		}
+		r.client.Close()
+	})
+	return err
+}
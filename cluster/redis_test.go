@@ -0,0 +1,136 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"grpcon/models"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRegistry(t *testing.T, mr *miniredis.Miniredis, nodeID string) *RedisRegistry {
+	t.Helper()
+	r, err := NewRedisRegistry(mr.Addr(), "", nodeID, 3*time.Second)
+	if err != nil {
+		t.Fatalf("NewRedisRegistry %s: %v", nodeID, err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func TestRedisRegistryOwnership(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := newTestRegistry(t, mr, "node-a")
+	b := newTestRegistry(t, mr, "node-b")
+
+	if err := a.RegisterDevice("alice", "alice_phone"); err != nil {
+		t.Fatal(err)
+	}
+	if owner, ok, err := b.GetDeviceOwner("alice_phone"); err != nil || !ok || owner != "node-a" {
+		t.Fatalf("GetDeviceOwner = %q, %v, %v, want node-a", owner, ok, err)
+	}
+	if _, ok, err := b.GetDeviceOwner("alice_tablet"); err != nil || ok {
+		t.Fatalf("GetDeviceOwner of an unknown device = %v, %v, want not found", ok, err)
+	}
+
+	// The device moves to node-b, node-a unregistering it late must not drop node-b's records
+	if err := b.RegisterDevice("alice", "alice_phone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.UnregisterDevice("alice", "alice_phone"); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _, _ := a.GetDeviceOwner("alice_phone"); owner != "node-b" {
+		t.Fatalf("owner after a stale unregister = %q, want node-b", owner)
+	}
+	if owners, err := a.GetClientOwners("alice"); err != nil || owners["alice_phone"] != "node-b" {
+		t.Fatalf("GetClientOwners = %v, %v, want alice_phone on node-b", owners, err)
+	}
+
+	if err := b.UnregisterDevice("alice", "alice_phone"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := a.GetDeviceOwner("alice_phone"); ok {
+		t.Fatal("device still owned after its owner unregistered it")
+	}
+	if owners, _ := a.GetClientOwners("alice"); len(owners) != 0 {
+		t.Fatalf("GetClientOwners after unregister = %v, want none", owners)
+	}
+}
+
+func TestRedisRegistryIgnoresDeadNodes(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := newTestRegistry(t, mr, "node-a")
+	b := newTestRegistry(t, mr, "node-b")
+
+	a.RegisterDevice("alice", "alice_phone")
+	b.RegisterDevice("alice", "alice_tablet")
+
+	// node-b stops refreshing its key
+	b.Close()
+	if owners, err := a.GetClientOwners("alice"); err != nil || len(owners) != 1 || owners["alice_phone"] != "node-a" {
+		t.Fatalf("GetClientOwners = %v, %v, want only alice_phone on node-a", owners, err)
+	}
+	if _, ok, _ := a.GetDeviceOwner("alice_tablet"); ok {
+		t.Fatal("device of a closed node still has an owner")
+	}
+
+	// A node that crashed is gone once its key expires
+	c := newTestRegistry(t, mr, "node-c")
+	c.RegisterDevice("bob", "bob_phone")
+	c.stopOnce.Do(func() {
+		close(c.stopChan)
+		c.client.Close()
+	})
+	mr.FastForward(4 * time.Second)
+	if _, ok, _ := a.GetDeviceOwner("bob_phone"); ok {
+		t.Fatal("device of an expired node still has an owner")
+	}
+}
+
+func TestRedisRegistryRelaysEnvelopes(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := newTestRegistry(t, mr, "node-a")
+	b := newTestRegistry(t, mr, "node-b")
+
+	received := make(chan *Envelope, 4)
+	for _, r := range []*RedisRegistry{a, b} {
+		if err := r.Subscribe(func(env *Envelope) { received <- env }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	next := func() *Envelope {
+		t.Helper()
+		select {
+		case env := <-received:
+			return env
+		case <-time.After(3 * time.Second):
+			t.Fatal("no envelope received")
+			return nil
+		}
+	}
+
+	notification := &models.NotificationData{ID: "n1", ClientID: "alice", Title: "title"}
+	if err := a.Publish(&Envelope{Target: "node-b", Kind: KindDevice, ClientID: "alice", DeviceID: "phone", Notification: notification}); err != nil {
+		t.Fatal(err)
+	}
+	env := next()
+	if env.Origin != "node-a" || env.Kind != KindDevice || env.DeviceID != "phone" || env.Notification.ID != "n1" {
+		t.Fatalf("relayed envelope = %+v, want the device envelope from node-a", env)
+	}
+
+	// A broadcast reaches the other node only, not its sender
+	if err := a.Publish(&Envelope{Kind: KindBroadcast, Notification: notification}); err != nil {
+		t.Fatal(err)
+	}
+	if env := next(); env.Kind != KindBroadcast || env.Origin != "node-a" {
+		t.Fatalf("broadcast envelope = %+v", env)
+	}
+	select {
+	case env := <-received:
+		t.Fatalf("unexpected envelope %+v, the sender got its own broadcast", env)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,60 @@
+package cluster
+
+import (
+	"os"
+
+	"grpcon/models"
+)
+
+// Envelope kinds describe how the receiving node should deliver the notification
+const (
+	KindClient    = "client"    // local devices of the client picked by the envelope's strategy
+	KindDevice    = "device"    // one specific device
+	KindBroadcast = "broadcast" // every local device
+	KindTopic     = "topic"     // every local device subscribed to the notification's topic
+
+	// Kinds sent by nodes that predate delivery strategies, still accepted
+	KindClientAll   = "client_all"   // all local devices of the client
+	KindClientLeast = "client_least" // local device with the least notifications
+	KindClientFirst = "client_first" // first active local device
+)
+
+// Envelope is a notification relayed from one node to another
+type Envelope struct {
+	Origin       string                   `json:"origin"`       // node that received the original request
+	Target       string                   `json:"target"`       // destination node, empty for all nodes
+	Kind         string                   `json:"kind"`         // one of the Kind* constants
+	ClientID     string                   `json:"client_id"`    // target client
+	DeviceID     string                   `json:"device_id"`    // target device for KindDevice
+	Strategy     string                   `json:"strategy"`     // delivery strategy name for KindClient
+	Notification *models.NotificationData `json:"notification"` // notification to deliver
+}
+
+// Registry tracks which node owns each device connection (client_id_device_id)
+// and relays notifications between nodes so any node can deliver to any device
+type Registry interface {
+	// NodeID returns the ID of this node
+	NodeID() string
+	// RegisterDevice records this node as the owner of a device connection
+	RegisterDevice(clientID, uniqueID string) error
+	// UnregisterDevice removes the ownership record if this node owns the device
+	UnregisterDevice(clientID, uniqueID string) error
+	// GetDeviceOwner returns the live node that owns a device connection
+	GetDeviceOwner(uniqueID string) (string, bool, error)
+	// GetClientOwners returns unique_id -> node_id for every device of a client owned by a live node
+	GetClientOwners(clientID string) (map[string]string, error)
+	// Publish sends an envelope to env.Target, or to every other node when Target is empty
+	Publish(env *Envelope) error
+	// Subscribe starts delivering envelopes addressed to this node to handler
+	Subscribe(handler func(*Envelope)) error
+	// Close releases ownership of this node and stops the subscription
+	Close() error
+}
+
+// DefaultNodeID returns the hostname, the node ID when none is configured
+func DefaultNodeID() string {
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return host
+	}
+	return "node"
+}
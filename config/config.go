@@ -0,0 +1,259 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"grpcon/logging"
+	"grpcon/models"
+)
+
+// Config holds every setting of the server. Each one is read from, in increasing priority, its
+// default, the config file, its environment variable and its command-line flag. Settings tagged
+// reload can change while the server runs, see Loader.Watch.
+type Config struct {
+	Server    Server    `config:"server"`
+	Heartbeat Heartbeat `config:"heartbeat"`
+	Delivery  Delivery  `config:"delivery"`
+	Auth      Auth      `config:"auth"`
+	TLS       TLS       `config:"tls"`
+	Cluster   Cluster   `config:"cluster"`
+	Logging   Logging   `config:"logging"`
+	Tracing   Tracing   `config:"tracing"`
+	Shutdown  Shutdown  `config:"shutdown"`
+}
+
+// Server is where the servers listen
+type Server struct {
+	GRPCPort        int    `config:"grpc_port" env:"GRPC_PORT" usage:"gRPC listen port"`
+	HTTPPort        int    `config:"http_port" env:"HTTP_PORT" usage:"HTTP gateway listen port"`
+	MetricsPublic   bool   `config:"metrics_public" env:"METRICS_PUBLIC" usage:"serve /metrics without an API key"`
+	MetricsServices string `config:"metrics_services" env:"METRICS_SERVICES" reload:"true" usage:"comma-separated service names labeled in metrics, others count as other"`
+}
+
+// Heartbeat is how streams are kept alive and when silent devices are removed
+type Heartbeat struct {
+	Interval        time.Duration `config:"interval" env:"HEARTBEAT_INTERVAL" reload:"true" usage:"time between two heartbeats on a stream"`
+	MaxFailures     int           `config:"max_failures" env:"HEARTBEAT_MAX_FAILURES" reload:"true" usage:"failed heartbeats in a row before a device is disconnected"`
+	StaleThreshold  time.Duration `config:"stale_threshold" env:"HEARTBEAT_STALE_THRESHOLD" reload:"true" usage:"time without a pong after which a device is removed"`
+	MonitorInterval time.Duration `config:"monitor_interval" env:"HEARTBEAT_MONITOR_INTERVAL" reload:"true" usage:"how often stale devices are looked for"`
+}
+
+// Delivery are the queue sizes and limits of notification delivery
+type Delivery struct {
+	SendQueueSize     int           `config:"send_queue_size" env:"SEND_QUEUE_SIZE" reload:"true" usage:"messages buffered per stream"`
+	SendQueueOverflow string        `config:"send_queue_overflow" env:"SEND_QUEUE_OVERFLOW" reload:"true" usage:"drop_oldest, drop_newest or disconnect when a send queue is full"`
+	BatchConcurrency  int           `config:"batch_concurrency" env:"BATCH_CONCURRENCY" reload:"true" usage:"clients of a batch delivered to at once"`
+	AckTimeout        time.Duration `config:"ack_timeout" env:"ACK_TIMEOUT" reload:"true" usage:"time a Connect device has to acknowledge a notification"`
+	MaxAttempts       int           `config:"max_attempts" env:"MAX_DELIVERY_ATTEMPTS" reload:"true" usage:"sends of an unacknowledged notification before giving up"`
+	InboxCapacity     int           `config:"inbox_capacity" env:"INBOX_CAPACITY" reload:"true" usage:"pending notifications kept per offline client"`
+	InboxMaxClients   int           `config:"inbox_max_clients" env:"INBOX_MAX_CLIENTS" reload:"true" usage:"clients with pending notifications at once, others' are refused"`
+	InboxTTL          time.Duration `config:"inbox_ttl" env:"INBOX_TTL" reload:"true" usage:"how long a pending notification is kept, 0 keeps it forever"`
+	MaxBatchSize      int           `config:"max_batch_size" env:"MAX_BATCH_SIZE" reload:"true" usage:"notifications one batch may hold"`
+	HistoryCapacity   int           `config:"history_capacity" env:"HISTORY_CAPACITY" reload:"true" usage:"recent notifications kept per client for replay"`
+	HistoryIdleTTL    time.Duration `config:"history_idle_ttl" env:"HISTORY_IDLE_TTL" reload:"true" usage:"how long the history of a client without devices is kept, 0 keeps it forever"`
+}
+
+// Auth are the credentials of the HTTP gateway and the gRPC API
+type Auth struct {
+	Disabled           bool          `config:"disabled" env:"GRPC_AUTH_DISABLED" usage:"accept gRPC calls without credentials"`
+	APIKey             string        `config:"api_key" env:"X_API_KEY" usage:"API key of services, added as the default key with the admin scope"`
+	APIKeysFile        string        `config:"api_keys_file" env:"API_KEYS_FILE" usage:"JSON file of scoped gateway API keys"`
+	ClientTokenSecret  string        `config:"client_token_secret" env:"CLIENT_TOKEN_SECRET" usage:"secret signing device tokens"`
+	ClientTokenTTL     time.Duration `config:"client_token_ttl" env:"CLIENT_TOKEN_TTL" usage:"how long a device token from /token is valid"`
+	JWTSecret          string        `config:"jwt_hs256_secret" env:"JWT_HS256_SECRET" usage:"secret of HS256 JWTs"`
+	JWKSFile           string        `config:"jwt_jwks_file" env:"JWT_JWKS_FILE" usage:"JWKS file of RS256/ES256 JWT keys"`
+	JWTIssuer          string        `config:"jwt_issuer" env:"JWT_ISSUER" usage:"required iss of JWTs"`
+	JWTAudience        string        `config:"jwt_audience" env:"JWT_AUDIENCE" usage:"required aud of JWTs"`
+	KeyRotationOverlap time.Duration `config:"key_rotation_overlap" env:"KEY_ROTATION_OVERLAP" usage:"how long a rotated API key keeps working when /keys/rotate doesn't say"`
+}
+
+// TLS is the certificate of both servers and how clients are authenticated with theirs
+type TLS struct {
+	CertFile       string        `config:"cert_file" env:"TLS_CERT_FILE" usage:"server certificate, enables TLS"`
+	KeyFile        string        `config:"key_file" env:"TLS_KEY_FILE" usage:"server private key"`
+	ClientCAFile   string        `config:"client_ca_file" env:"TLS_CLIENT_CA_FILE" usage:"CAs verifying client certificates"`
+	ClientCertMap  string        `config:"client_cert_map" env:"TLS_CLIENT_CERT_MAP" usage:"JSON file mapping client certificates to client IDs"`
+	ReloadInterval time.Duration `config:"reload_interval" env:"TLS_RELOAD_INTERVAL" usage:"how often the certificate files are checked for changes"`
+	ClientAuth     string        `config:"client_auth" env:"TLS_CLIENT_AUTH" usage:"none, request or require client certificates on gRPC"`
+	HTTPClientAuth string        `config:"http_client_auth" env:"HTTP_TLS_CLIENT_AUTH" usage:"none, request or require client certificates on the gateway"`
+}
+
+// Cluster is the Redis registry shared by the nodes, unused when RedisAddr is empty
+type Cluster struct {
+	RedisAddr     string        `config:"redis_addr" env:"REDIS_ADDR" usage:"Redis address, enables cluster mode"`
+	RedisPassword string        `config:"redis_password" env:"REDIS_PASSWORD" usage:"Redis password"`
+	NodeID        string        `config:"node_id" env:"NODE_ID" usage:"ID of this node, the hostname by default"`
+	NodeTTL       time.Duration `config:"node_ttl" env:"CLUSTER_NODE_TTL" usage:"time without a refresh after which the other nodes consider a node gone"`
+}
+
+// Logging is how the server logs
+type Logging struct {
+	Level           string `config:"level" env:"LOG_LEVEL" reload:"true" usage:"debug, info, warn or error"`
+	Format          string `config:"format" env:"LOG_FORMAT" usage:"text or json"`
+	HeartbeatSample int    `config:"heartbeat_sample" env:"LOG_HEARTBEAT_SAMPLE" reload:"true" usage:"log one in this many heartbeats per device, 0 for none"`
+}
+
+// Tracing is which traces are sampled and where their spans go
+type Tracing struct {
+	Exporter     string  `config:"exporter" env:"TRACING_EXPORTER" usage:"none, stdout, memory or otlp"`
+	MemorySpans  int     `config:"memory_spans" env:"TRACING_MEMORY_SPANS" usage:"spans kept by the memory exporter"`
+	SampleRatio  float64 `config:"sample_ratio" env:"TRACING_SAMPLE_RATIO" usage:"share of new traces sampled, 0 to 1, continued traces follow the caller"`
+	OTLPEndpoint string  `config:"otlp_endpoint" env:"TRACING_OTLP_ENDPOINT" usage:"host:port of the OTLP gRPC collector, OTEL_EXPORTER_OTLP_ENDPOINT by default"`
+	OTLPInsecure bool    `config:"otlp_insecure" env:"TRACING_OTLP_INSECURE" usage:"connect to the OTLP collector without TLS"`
+}
+
+// Shutdown is how long the server drains on SIGTERM and how devices are told to come back
+type Shutdown struct {
+	Timeout         time.Duration `config:"timeout" env:"SHUTDOWN_TIMEOUT" usage:"time to drain streams and stop the servers before calls are cut"`
+	ReconnectWindow time.Duration `config:"reconnect_window" env:"SHUTDOWN_RECONNECT_WINDOW" usage:"devices are told to reconnect at a random time within this window"`
+}
+
+// Default returns the configuration used when no source sets anything
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			GRPCPort:        50051,
+			HTTPPort:        8080,
+			MetricsServices: "http_gateway,grpc_publish",
+		},
+		Heartbeat: Heartbeat{
+			Interval:        30 * time.Second,
+			MaxFailures:     2,
+			StaleThreshold:  90 * time.Second,
+			MonitorInterval: 60 * time.Second,
+		},
+		Delivery: Delivery{
+			SendQueueSize:     models.DefaultSendQueueCapacity,
+			SendQueueOverflow: "drop_oldest",
+			BatchConcurrency:  16,
+			AckTimeout:        30 * time.Second,
+			MaxAttempts:       3,
+			InboxCapacity:     models.DefaultInboxCapacity,
+			InboxMaxClients:   models.DefaultInboxMaxClients,
+			InboxTTL:          models.DefaultInboxTTL,
+			MaxBatchSize:      1000,
+			HistoryCapacity:   models.DefaultHistoryCapacity,
+			HistoryIdleTTL:    models.DefaultHistoryIdleTTL,
+		},
+		Auth: Auth{ClientTokenTTL: 24 * time.Hour, KeyRotationOverlap: time.Hour},
+		TLS: TLS{
+			ReloadInterval: 30 * time.Second,
+			ClientAuth:     "require",
+			HTTPClientAuth: "none",
+		},
+		Cluster:  Cluster{NodeTTL: 30 * time.Second},
+		Logging:  Logging{Level: "info", Format: "text", HeartbeatSample: logging.DefaultHeartbeatSampleRate},
+		Tracing:  Tracing{Exporter: "none", MemorySpans: 1000, SampleRatio: 1},
+		Shutdown: Shutdown{Timeout: 30 * time.Second, ReconnectWindow: 10 * time.Second},
+	}
+}
+
+// Validate checks every setting and returns all the problems found
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.GRPCPort > 0 && c.Server.GRPCPort < 65536, "server.grpc_port must be a port number, got %d", c.Server.GRPCPort)
+	check(c.Server.HTTPPort > 0 && c.Server.HTTPPort < 65536, "server.http_port must be a port number, got %d", c.Server.HTTPPort)
+
+	check(c.Heartbeat.Interval > 0, "heartbeat.interval must be positive")
+	check(c.Heartbeat.MaxFailures > 0, "heartbeat.max_failures must be at least 1")
+	check(c.Heartbeat.StaleThreshold > c.Heartbeat.Interval, "heartbeat.stale_threshold must be longer than heartbeat.interval")
+	check(c.Heartbeat.MonitorInterval > 0, "heartbeat.monitor_interval must be positive")
+
+	check(c.Delivery.SendQueueSize > 0, "delivery.send_queue_size must be at least 1")
+	if _, err := models.ParseOverflowPolicy(c.Delivery.SendQueueOverflow); err != nil {
+		errs = append(errs, fmt.Errorf("delivery.send_queue_overflow: %v", err))
+	}
+	check(c.Delivery.BatchConcurrency > 0, "delivery.batch_concurrency must be at least 1")
+	check(c.Delivery.AckTimeout > 0, "delivery.ack_timeout must be positive")
+	check(c.Delivery.MaxAttempts > 0, "delivery.max_attempts must be at least 1")
+	check(c.Delivery.InboxCapacity > 0, "delivery.inbox_capacity must be at least 1")
+	check(c.Delivery.InboxMaxClients > 0, "delivery.inbox_max_clients must be at least 1")
+	check(c.Delivery.InboxTTL >= 0, "delivery.inbox_ttl must not be negative")
+	check(c.Delivery.MaxBatchSize > 0, "delivery.max_batch_size must be at least 1")
+	check(c.Delivery.HistoryCapacity > 0, "delivery.history_capacity must be at least 1")
+	check(c.Delivery.HistoryIdleTTL >= 0, "delivery.history_idle_ttl must not be negative")
+
+	check(c.Auth.ClientTokenTTL > 0, "auth.client_token_ttl must be positive")
+	check(c.Auth.KeyRotationOverlap >= 0, "auth.key_rotation_overlap must not be negative")
+
+	if c.TLS.CertFile != "" {
+		check(c.TLS.KeyFile != "", "tls.key_file is required with tls.cert_file")
+		check(c.TLS.ReloadInterval > 0, "tls.reload_interval must be positive")
+	}
+	check(isClientAuth(c.TLS.ClientAuth), "tls.client_auth must be none, request or require, got %q", c.TLS.ClientAuth)
+	check(isClientAuth(c.TLS.HTTPClientAuth), "tls.http_client_auth must be none, request or require, got %q", c.TLS.HTTPClientAuth)
+
+	check(c.Cluster.NodeTTL >= 3*time.Second, "cluster.node_ttl must be at least 3s, nodes refresh every third of it")
+
+	if _, err := logging.ParseLevel(c.Logging.Level); err != nil {
+		errs = append(errs, fmt.Errorf("logging.level: %v", err))
+	}
+	format := strings.ToLower(c.Logging.Format)
+	check(format == "text" || format == "json", "logging.format must be text or json, got %q", c.Logging.Format)
+	check(c.Logging.HeartbeatSample >= 0, "logging.heartbeat_sample must not be negative")
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout", "memory", "otlp":
+	default:
+		errs = append(errs, fmt.Errorf("tracing.exporter must be none, stdout, memory or otlp, got %q", c.Tracing.Exporter))
+	}
+	check(c.Tracing.MemorySpans > 0, "tracing.memory_spans must be at least 1")
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1, got %v", c.Tracing.SampleRatio)
+
+	check(c.Shutdown.Timeout > 0, "shutdown.timeout must be positive")
+	check(c.Shutdown.ReconnectWindow >= 0, "shutdown.reconnect_window must not be negative")
+
+	return errors.Join(errs...)
+}
+
+// GRPCAddr is the listen address of the gRPC server
+func (s Server) GRPCAddr() string {
+	return fmt.Sprintf(":%d", s.GRPCPort)
+}
+
+// HTTPAddr is the listen address of the HTTP gateway
+func (s Server) HTTPAddr() string {
+	return fmt.Sprintf(":%d", s.HTTPPort)
+}
+
+// MetricsServiceList splits MetricsServices into service names
+func (s Server) MetricsServiceList() []string {
+	var services []string
+	for _, service := range strings.Split(s.MetricsServices, ",") {
+		if service = strings.TrimSpace(service); service != "" {
+			services = append(services, service)
+		}
+	}
+	return services
+}
+
+// OverflowPolicy is the parsed SendQueueOverflow of a validated config
+func (d Delivery) OverflowPolicy() models.OverflowPolicy {
+	policy, _ := models.ParseOverflowPolicy(d.SendQueueOverflow)
+	return policy
+}
+
+// SlogLevel is the parsed Level of a validated config
+func (l Logging) SlogLevel() slog.Level {
+	level, _ := logging.ParseLevel(l.Level)
+	return level
+}
+
+// isClientAuth reports whether value is a client certificate policy: none, request or require
+func isClientAuth(value string) bool {
+	switch strings.ToLower(value) {
+	case "none", "request", "require":
+		return true
+	}
+	return false
+}
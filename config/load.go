@@ -0,0 +1,221 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Setting describes one field of Config
+type Setting struct {
+	Key        string // section.name in the config file, e.g. heartbeat.interval
+	Env        string // environment variable, e.g. HEARTBEAT_INTERVAL
+	Flag       string // command-line flag, e.g. -heartbeat-interval
+	Usage      string
+	Reloadable bool // can change while the server runs
+
+	index []int // field path from Config
+}
+
+// Settings lists every field of Config in declaration order
+func Settings() []Setting {
+	var settings []Setting
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		section := configType.Field(i)
+		for j := 0; j < section.Type.NumField(); j++ {
+			field := section.Type.Field(j)
+			key := section.Tag.Get("config") + "." + field.Tag.Get("config")
+			settings = append(settings, Setting{
+				Key:        key,
+				Env:        field.Tag.Get("env"),
+				Flag:       strings.NewReplacer(".", "-", "_", "-").Replace(key),
+				Usage:      field.Tag.Get("usage"),
+				Reloadable: field.Tag.Get("reload") == "true",
+				index:      []int{i, j},
+			})
+		}
+	}
+	return settings
+}
+
+// value returns the field of s in c
+func (s Setting) value(c *Config) reflect.Value {
+	return reflect.ValueOf(c).Elem().FieldByIndex(s.index)
+}
+
+// set parses raw into the field of s in c
+func (s Setting) set(c *Config, raw string) error {
+	field := s.value(c)
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("not a number: %s", raw)
+		}
+		field.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("not a number: %s", raw)
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("not a boolean: %s", raw)
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// Loader reads the configuration from its sources, again on every reload
+type Loader struct {
+	path  string            // config file, empty for none
+	flags map[string]string // values given on the command line, by key
+}
+
+// NewLoader parses the command-line arguments: -config names the config file (CONFIG_FILE by
+// default) and every setting has a flag named after its key, e.g. -heartbeat-interval=15s
+func NewLoader(args []string) (*Loader, error) {
+	l := &Loader{flags: make(map[string]string)}
+
+	fs := flag.NewFlagSet("grpcon", flag.ContinueOnError)
+	fs.StringVar(&l.path, "config", os.Getenv("CONFIG_FILE"), "YAML or TOML config file (env CONFIG_FILE)")
+	for _, s := range Settings() {
+		key := s.Key
+		usage := fmt.Sprintf("%s (env %s)", s.Usage, s.Env)
+		store := func(v string) error {
+			l.flags[key] = v
+			return nil
+		}
+		if s.value(Default()).Kind() == reflect.Bool {
+			fs.BoolFunc(s.Flag, usage, store)
+		} else {
+			fs.Func(s.Flag, usage, store)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	return l, nil
+}
+
+// Path returns the config file, empty if there is none
+func (l *Loader) Path() string {
+	return l.path
+}
+
+// Load reads the defaults, the config file, the environment and the flags, in that order, and
+// validates the result
+func (l *Loader) Load() (*Config, error) {
+	cfg := Default()
+	settings := Settings()
+
+	if l.path != "" {
+		values, err := ReadFile(l.path)
+		if err != nil {
+			return nil, err
+		}
+		known := make(map[string]bool, len(settings))
+		for _, s := range settings {
+			known[s.Key] = true
+			if v, ok := values[s.Key]; ok {
+				if err := s.set(cfg, v); err != nil {
+					return nil, fmt.Errorf("%s: invalid %s: %v", l.path, s.Key, err)
+				}
+			}
+		}
+		for key := range values {
+			if !known[key] {
+				return nil, fmt.Errorf("%s: unknown setting %s", l.path, key)
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if v := os.Getenv(s.Env); v != "" {
+			if err := s.set(cfg, v); err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", s.Env, err)
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := l.flags[s.Key]; ok {
+			if err := s.set(cfg, v); err != nil {
+				return nil, fmt.Errorf("invalid -%s: %v", s.Flag, err)
+			}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ReadFile reads a config file into its values by section.name key. Files ending in .toml are
+// TOML ([section] tables of key = value), anything else YAML (section: maps of key: value pairs).
+// Only one level of sections and scalar values are supported.
+func ReadFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var sections map[string]interface{}
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		_, err = toml.Decode(string(data), &sections)
+	} else {
+		err = yaml.Unmarshal(data, &sections)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	values := make(map[string]string)
+	for section, raw := range sections {
+		settings, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: %s must be a section of settings", path, section)
+		}
+		for name, value := range settings {
+			key := section + "." + name
+			switch value.(type) {
+			case nil:
+				values[key] = ""
+			case map[string]interface{}, []interface{}, []map[string]interface{}:
+				return nil, fmt.Errorf("%s: %s must be a single value", path, key)
+			default:
+				values[key] = fmt.Sprint(value)
+			}
+		}
+	}
+	return values, nil
+}
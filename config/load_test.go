@@ -0,0 +1,123 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadFileYAMLAndTOML(t *testing.T) {
+	yamlPath := writeConfig(t, "config.yaml", `
+heartbeat:
+  interval: 15s   # comment
+  max_failures: 4
+auth:
+  api_key: "se#cret"
+  disabled: true
+tracing:
+  sample_ratio: 0.25
+cluster:
+  node_id:
+`)
+	tomlPath := writeConfig(t, "config.toml", `
+[heartbeat]
+interval = "15s" # comment
+max_failures = 4
+
+[auth]
+api_key = "se#cret"
+disabled = true
+
+[tracing]
+sample_ratio = 0.25
+
+[cluster]
+node_id = ""
+`)
+
+	want := map[string]string{
+		"heartbeat.interval":     "15s",
+		"heartbeat.max_failures": "4",
+		"auth.api_key":           "se#cret",
+		"auth.disabled":          "true",
+		"tracing.sample_ratio":   "0.25",
+		"cluster.node_id":        "",
+	}
+	for _, path := range []string{yamlPath, tomlPath} {
+		values, err := ReadFile(path)
+		if err != nil {
+			t.Fatalf("%s: %v", filepath.Base(path), err)
+		}
+		if len(values) != len(want) {
+			t.Fatalf("%s: got %v, want %v", filepath.Base(path), values, want)
+		}
+		for key, v := range want {
+			if values[key] != v {
+				t.Fatalf("%s: %s = %q, want %q", filepath.Base(path), key, values[key], v)
+			}
+		}
+	}
+}
+
+func TestReadFileRejectsNonScalars(t *testing.T) {
+	for name, content := range map[string]string{
+		"top-level.yaml": "interval: 15s\n",
+		"nested.yaml":    "heartbeat:\n  timings:\n    interval: 15s\n",
+		"list.yaml":      "server:\n  metrics_services: [a, b]\n",
+		"top-level.toml": "interval = \"15s\"\n",
+		"nested.toml":    "[heartbeat.timings]\ninterval = \"15s\"\n",
+		"invalid.toml":   "[heartbeat\n",
+	} {
+		if _, err := ReadFile(writeConfig(t, name, content)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, "config.yaml", "heartbeat:\n  interval: 15s\n  max_failures: 4\ndelivery:\n  max_batch_size: 10\n")
+	t.Setenv("HEARTBEAT_MAX_FAILURES", "5")
+
+	loader, err := NewLoader([]string{"-config", path, "-delivery-max-batch-size=20"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loader.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Heartbeat.Interval != 15*time.Second || cfg.Heartbeat.MaxFailures != 5 || cfg.Delivery.MaxBatchSize != 20 {
+		t.Fatalf("got interval %s, max_failures %d, max_batch_size %d, want 15s, 5 and 20",
+			cfg.Heartbeat.Interval, cfg.Heartbeat.MaxFailures, cfg.Delivery.MaxBatchSize)
+	}
+	if cfg.Cluster.NodeTTL != 30*time.Second {
+		t.Fatalf("cluster.node_ttl = %s, want the 30s default", cfg.Cluster.NodeTTL)
+	}
+}
+
+func TestLoadRejectsUnknownAndInvalidSettings(t *testing.T) {
+	for content, want := range map[string]string{
+		"heartbeat:\n  intervall: 15s\n": "unknown setting heartbeat.intervall",
+		"cluster:\n  node_ttl: 1s\n":     "cluster.node_ttl",
+		"tls:\n  client_auth: always\n":  "tls.client_auth",
+	} {
+		loader, err := NewLoader([]string{"-config", writeConfig(t, "config.yaml", content)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loader.Load(); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Load(%q) = %v, want an error about %s", content, err, want)
+		}
+	}
+}
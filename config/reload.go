@@ -0,0 +1,71 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+)
+
+// Changed returns the keys of the settings that differ between old and next, split into those
+// that can be applied while running and those that need a restart
+func Changed(old, next *Config) (reloadable, restart []string) {
+	for _, s := range Settings() {
+		if reflect.DeepEqual(s.value(old).Interface(), s.value(next).Interface()) {
+			continue
+		}
+		if s.Reloadable {
+			reloadable = append(reloadable, s.Key)
+		} else {
+			restart = append(restart, s.Key)
+		}
+	}
+	return reloadable, restart
+}
+
+// withReloadable returns a copy of c with the reloadable settings of next
+func (c *Config) withReloadable(next *Config) *Config {
+	merged := *c
+	for _, s := range Settings() {
+		if s.Reloadable {
+			s.value(&merged).Set(s.value(next))
+		}
+	}
+	return &merged
+}
+
+// Watch reloads the configuration on every SIGHUP until stop is closed. If the new configuration
+// is valid, its reloadable settings are passed to apply along with the current value of the others,
+// which only change on restart.
+func (l *Loader) Watch(current *Config, apply func(*Config), stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			next, err := l.Load()
+			if err != nil {
+				slog.Error("Failed to reload configuration, keeping the current one", "error", err)
+				continue
+			}
+
+			reloadable, restart := Changed(current, next)
+			for _, key := range restart {
+				slog.Warn("Setting changed, restart to apply it", "setting", key)
+			}
+			if len(reloadable) == 0 {
+				slog.Info("Configuration reloaded, nothing to apply")
+				continue
+			}
+
+			current = current.withReloadable(next)
+			apply(current)
+			slog.Info("Configuration reloaded", "changed", reloadable)
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"log/slog"
+	"sync"
+
+	"grpcon/models"
+)
+
+const (
+	// DefaultMaxBatchSize is the most notifications one batch may hold by default
+	DefaultMaxBatchSize = 1000
+	// DefaultBatchConcurrency is how many clients of a batch are delivered to at once
+	DefaultBatchConcurrency = 16
+)
+
+// BatchItem is one notification of a batch and where it goes: a client (ClientID, with Strategy),
+// one device of a client (ClientID and DeviceID), every client (Broadcast) or topic subscribers (Topic)
+type BatchItem struct {
+	Notification *models.NotificationData
+	ClientID     string
+	DeviceID     string
+	Strategy     DeliveryStrategy
+	Broadcast    bool
+	Topic        string
+}
+
+// BatchResult is the outcome of one batch item
+type BatchResult struct {
+	Index          int              `json:"index"`
+	Status         DeliveryStatus   `json:"status"`
+	NotificationID string           `json:"notification_id,omitempty"`
+	Sequence       uint64           `json:"sequence,omitempty"`
+	Deliveries     []DeliveryResult `json:"deliveries,omitempty"`
+	ErrorCode      string           `json:"error_code,omitempty"`
+	Error          string           `json:"error,omitempty"`
+}
+
+// Publish delivers one notification to the target of item
+func (h *ConnectionHandler) Publish(item BatchItem) ([]DeliveryResult, error) {
+	if item.Notification == nil {
+		return nil, invalidRequest("notification is required")
+	}
+
+	switch {
+	case item.Broadcast:
+		item.Notification.ClientID = ""
+		return h.PublishBroadcast(item.Notification), nil
+
+	case item.Topic != "" && item.ClientID != "":
+		return nil, invalidRequest("topic can't be combined with client_id")
+
+	case item.Topic != "":
+		item.Notification.ClientID = ""
+		// Only an invalid topic fails the whole publish
+		return h.PublishToTopic(item.Notification, item.Topic)
+
+	case item.ClientID == "":
+		return nil, invalidRequest("client_id, broadcast or topic is required")
+
+	case item.DeviceID != "":
+		item.Notification.ClientID = item.ClientID
+		return h.PublishToDevice(item.Notification, item.ClientID, item.DeviceID)
+	}
+
+	if item.Strategy == nil {
+		return nil, invalidRequest("delivery strategy is required")
+	}
+	item.Notification.ClientID = item.ClientID
+	return h.PublishToClient(item.Notification, item.Strategy)
+}
+
+// PublishBatch delivers every item and reports each one, in item order. A failed item doesn't
+// stop the others. Items for different clients are delivered concurrently, items for the same
+// client one after the other so they keep their order in the client's stream. Once the server is
+// shutting down every item fails with ErrShuttingDown.
+func (h *ConnectionHandler) PublishBatch(items []BatchItem) []BatchResult {
+	results := make([]BatchResult, len(items))
+
+	// Group item indexes by client, broadcasts and topics reach many clients and go on their own
+	var groups [][]int
+	byClient := make(map[string]int)
+	for i, item := range items {
+		if item.ClientID == "" || item.Broadcast || item.Topic != "" {
+			groups = append(groups, []int{i})
+			continue
+		}
+		g, exists := byClient[item.ClientID]
+		if !exists {
+			g = len(groups)
+			byClient[item.ClientID] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+
+	h.optionsMu.RLock()
+	workers := h.batchConcurrency
+	h.optionsMu.RUnlock()
+	if workers > len(groups) {
+		workers = len(groups)
+	}
+
+	work := make(chan []int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range work {
+				for _, i := range group {
+					results[i] = h.publishBatchItem(i, items[i])
+				}
+			}
+		}()
+	}
+	for _, group := range groups {
+		work <- group
+	}
+	close(work)
+	wg.Wait()
+
+	slog.Info("Published batch", "notifications", len(items), "clients", len(byClient))
+	return results
+}
+
+// publishBatchItem delivers one item and turns the outcome into its result
+func (h *ConnectionHandler) publishBatchItem(index int, item BatchItem) BatchResult {
+	deliveries, err := h.Publish(item)
+
+	result := BatchResult{
+		Index:      index,
+		Status:     targetStatus(deliveries, err),
+		Deliveries: deliveries,
+	}
+	if item.Notification != nil && !item.Broadcast && item.Topic == "" {
+		// Broadcasts and topics give every client its own copy
+		result.NotificationID = item.Notification.ID
+		result.Sequence = item.Notification.Sequence
+	}
+
+	if result.ErrorCode = ErrorCode(err); result.ErrorCode != "" {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// InvalidBatchResult reports a batch item that was rejected before it reached PublishBatch
+func InvalidBatchResult(index int, err error) BatchResult {
+	return BatchResult{
+		Index:     index,
+		Status:    DeliveryFailed,
+		ErrorCode: ErrorCodeInvalidRequest,
+		Error:     err.Error(),
+	}
+}
+
+// SetMaxBatchSize sets the most notifications one batch may hold
+func (h *ConnectionHandler) SetMaxBatchSize(size int) {
+	if size < 1 {
+		size = DefaultMaxBatchSize
+	}
+	h.optionsMu.Lock()
+	defer h.optionsMu.Unlock()
+	h.maxBatchSize = size
+}
+
+// MaxBatchSize returns the most notifications one batch may hold
+func (h *ConnectionHandler) MaxBatchSize() int {
+	h.optionsMu.RLock()
+	defer h.optionsMu.RUnlock()
+	return h.maxBatchSize
+}
+
+// SetBatchConcurrency sets how many clients of a batch are delivered to at once
+func (h *ConnectionHandler) SetBatchConcurrency(concurrency int) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	h.optionsMu.Lock()
+	defer h.optionsMu.Unlock()
+	h.batchConcurrency = concurrency
+}
@@ -1,366 +1,896 @@
 package handlers
 
 import (
-	"fmt"
-	"log"
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync"
 	"time"
 
+	"grpcon/cluster"
+	"grpcon/logging"
 	"grpcon/models"
-	pb "grpcon/proto"
+	"grpcon/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// AckTimeout is how long, by default, a Connect device has to acknowledge a notification before it is redelivered
+	AckTimeout = 30 * time.Second
+	// MaxDeliveryAttempts is how many times, by default, an unacknowledged notification is sent before giving up
+	MaxDeliveryAttempts = 3
 )
 
+// HeartbeatOptions control how streams are kept alive and when silent devices are removed
+type HeartbeatOptions struct {
+	Interval        time.Duration // between two heartbeats on a stream
+	MaxFailures     int           // heartbeats in a row that may fail before the device is disconnected
+	StaleThreshold  time.Duration // time without a pong after which a streaming device is removed
+	MonitorInterval time.Duration // how often the health check monitor looks for stale devices
+}
+
+// DefaultHeartbeatOptions send a heartbeat every 30s, disconnect after 2 failed ones and remove
+// devices silent for 90s, checked every minute
+var DefaultHeartbeatOptions = HeartbeatOptions{
+	Interval:        30 * time.Second,
+	MaxFailures:     2,
+	StaleThreshold:  90 * time.Second,
+	MonitorInterval: 60 * time.Second,
+}
+
+// ErrNotificationQueued is returned when no device could take a notification and it was kept in the client's inbox
+var ErrNotificationQueued = errors.New("no active devices, notification queued for delivery")
+
 // ConnectionHandler manages device connections grouped by client
 type ConnectionHandler struct {
-	connManager *models.ConnectionManager
+	store    models.ConnectionStore
+	inbox    *models.NotificationInbox
+	history  *models.NotificationHistory
+	topics   *models.TopicIndex
+	registry cluster.Registry // nil when running as a single node
+
+	strategies *strategyRegistry // delivery strategies requests can pick by name
+
+	optionsMu      sync.RWMutex          // guards the options below, they can change while serving
+	queueCapacity  int                   // per-connection send queue size
+	overflowPolicy models.OverflowPolicy // what to do when a send queue is full
+
+	batchConcurrency int // clients of a batch delivered to at once
+	maxBatchSize     int // notifications one batch may hold
+
+	historyIdleTTL time.Duration // how long the history of a client without devices is kept
+
+	heartbeat           HeartbeatOptions
+	ackTimeout          time.Duration // how long Connect devices have to acknowledge a notification
+	maxDeliveryAttempts int           // sends of an unacknowledged notification before giving up
+
+	metrics *Metrics
+
+	registerMu sync.Mutex // makes check-then-add in RegisterDevice atomic
+
+	drainMu      sync.RWMutex  // held for reading by registrations and attaches, for writing to start a shutdown
+	shuttingDown bool          // no new registrations or streams, guarded by drainMu
+	monitorStop  chan struct{} // closed to stop the health check monitor
+	stopMonitor  sync.Once
 }
 
-// NewConnectionHandler creates a new connection handler
+// NewConnectionHandler creates a new connection handler backed by the in-memory connection manager
 func NewConnectionHandler() *ConnectionHandler {
+	return NewConnectionHandlerWithStore(models.NewConnectionManager())
+}
+
+// NewConnectionHandlerWithStore creates a new connection handler backed by the given connection store
+func NewConnectionHandlerWithStore(store models.ConnectionStore) *ConnectionHandler {
+	inbox := models.NewNotificationInbox(models.DefaultInboxCapacity, models.DefaultInboxTTL)
 	return &ConnectionHandler{
-		connManager: models.NewConnectionManager(),
+		store:          store,
+		inbox:          inbox,
+		history:        models.NewNotificationHistory(models.DefaultHistoryCapacity),
+		topics:         models.NewTopicIndex(),
+		strategies:     newStrategyRegistry(),
+		queueCapacity:  models.DefaultSendQueueCapacity,
+		overflowPolicy: models.OverflowDropOldest,
+
+		batchConcurrency: DefaultBatchConcurrency,
+		maxBatchSize:     DefaultMaxBatchSize,
+		historyIdleTTL:   models.DefaultHistoryIdleTTL,
+		metrics:          newMetrics(store, inbox),
+
+		heartbeat:           DefaultHeartbeatOptions,
+		ackTimeout:          AckTimeout,
+		maxDeliveryAttempts: MaxDeliveryAttempts,
+
+		monitorStop: make(chan struct{}),
 	}
 }
 
+// Metrics returns the handler's Prometheus instruments
+func (h *ConnectionHandler) Metrics() *Metrics {
+	return h.metrics
+}
+
+// SetSendQueueOptions configures the send queue of streams attached from now on
+func (h *ConnectionHandler) SetSendQueueOptions(capacity int, policy models.OverflowPolicy) {
+	h.optionsMu.Lock()
+	defer h.optionsMu.Unlock()
+	h.queueCapacity = capacity
+	h.overflowPolicy = policy
+}
+
+// SetHeartbeatOptions changes the heartbeat timings, running streams and the health check monitor
+// pick them up after their next tick
+func (h *ConnectionHandler) SetHeartbeatOptions(opts HeartbeatOptions) {
+	h.optionsMu.Lock()
+	defer h.optionsMu.Unlock()
+	h.heartbeat = opts
+}
+
+// HeartbeatOptions returns the current heartbeat timings
+func (h *ConnectionHandler) HeartbeatOptions() HeartbeatOptions {
+	h.optionsMu.RLock()
+	defer h.optionsMu.RUnlock()
+	return h.heartbeat
+}
+
+// SetAckOptions changes how long Connect devices have to acknowledge a notification and how many
+// times it is sent before giving up
+func (h *ConnectionHandler) SetAckOptions(timeout time.Duration, maxAttempts int) {
+	h.optionsMu.Lock()
+	defer h.optionsMu.Unlock()
+	h.ackTimeout = timeout
+	h.maxDeliveryAttempts = maxAttempts
+}
+
+// ackOptions returns the current ack timeout and max delivery attempts
+func (h *ConnectionHandler) ackOptions() (time.Duration, int) {
+	h.optionsMu.RLock()
+	defer h.optionsMu.RUnlock()
+	return h.ackTimeout, h.maxDeliveryAttempts
+}
+
+// SetHistoryOptions changes how many notifications are kept per client for replay and how long the
+// history of a client without devices is kept after its last notification
+func (h *ConnectionHandler) SetHistoryOptions(capacity int, idleTTL time.Duration) {
+	h.history.SetCapacity(capacity)
+	h.optionsMu.Lock()
+	defer h.optionsMu.Unlock()
+	h.historyIdleTTL = idleTTL
+}
+
+// historyIdleTTLOption returns how long the history of a client without devices is kept
+func (h *ConnectionHandler) historyIdleTTLOption() time.Duration {
+	h.optionsMu.RLock()
+	defer h.optionsMu.RUnlock()
+	return h.historyIdleTTL
+}
+
 // RegisterDevice registers a new device connection for a client
 func (h *ConnectionHandler) RegisterDevice(clientID, deviceID, serviceName string) (*models.Connection, error) {
+	return h.RegisterDeviceWithMetadata(clientID, deviceID, models.DeviceMetadata{ServiceName: serviceName})
+}
+
+// RegisterDeviceWithMetadata registers a new device connection for a client along with what the device reported
+// about itself. If the device is already registered, the existing connection is returned with the
+// platform and app version it reported now, the service name stays the one of the first registration.
+func (h *ConnectionHandler) RegisterDeviceWithMetadata(clientID, deviceID string, metadata models.DeviceMetadata) (*models.Connection, error) {
 	if clientID == "" {
-		return nil, fmt.Errorf("client_id is required")
+		return nil, invalidRequest("client_id is required")
 	}
 	if deviceID == "" {
-		return nil, fmt.Errorf("device_id is required")
+		return nil, invalidRequest("device_id is required")
 	}
 
-	uniqueID := models.CreateUniqueID(clientID, deviceID)
-
-	// Check if this device is already connected
-	if existingConn, exists := h.connManager.GetConnection(clientID, deviceID); exists {
-		log.Printf("Device already connected: %s", uniqueID)
-		return existingConn, nil
+	conn, created, err := h.addConnection(clientID, deviceID, metadata)
+	if err != nil || !created {
+		return conn, err
 	}
 
-	// Create new connection
-	conn := &models.Connection{
-		UniqueID:          uniqueID,
-		ClientID:          clientID,
-		DeviceID:          deviceID,
-		ServiceName:       serviceName,
-		ConnectedAt:       time.Now(),
-		NotificationCount: 0,
-		IsActive:          false, //will be set to true when stream is attached
+	// The registry may be remote, registrations and shutdown don't wait for it
+	h.syncOwnership(clientID, conn.UniqueID)
+
+	conn.Logger().Info("Device registered",
+		"service", metadata.ServiceName, "platform", metadata.Platform, "app_version", metadata.AppVersion)
+
+	return conn, nil
+}
+
+// addConnection adds a device connection to the store, or returns the existing one with created false
+func (h *ConnectionHandler) addConnection(clientID, deviceID string, metadata models.DeviceMetadata) (conn *models.Connection, created bool, err error) {
+	h.drainMu.RLock()
+	defer h.drainMu.RUnlock()
+	if h.shuttingDown {
+		return nil, false, newDeliveryError(ErrShuttingDown, clientID, deviceID, nil)
 	}
 
-	h.connManager.AddConnection(conn)
+	h.registerMu.Lock()
+	defer h.registerMu.Unlock()
 
-	log.Printf("Device registered: %s (Client: %s, Device: %s, Service: %s)",
-		uniqueID, clientID, deviceID, serviceName)
+	// Check if this device is already connected, a reconnecting app may have been updated
+	if existingConn, exists := h.store.GetConnection(clientID, deviceID); exists {
+		existingConn.SetAppInfo(metadata.Platform, metadata.AppVersion)
+		existingConn.Logger().Debug("Device already registered",
+			"platform", metadata.Platform, "app_version", metadata.AppVersion)
+		return existingConn, false, nil
+	}
 
-	return conn, nil
+	// Create new connection, it becomes active when a stream is attached
+	conn = models.NewConnection(models.CreateUniqueID(clientID, deviceID), clientID, deviceID, metadata.ServiceName)
+	conn.SetAppInfo(metadata.Platform, metadata.AppVersion)
+
+	h.store.AddConnection(conn)
+	return conn, true, nil
 }
 
 // UnregisterDevice removes a device connection
 func (h *ConnectionHandler) UnregisterDevice(clientID, deviceID string) error {
 	if clientID == "" || deviceID == "" {
-		return fmt.Errorf("client_id and device_id are required")
+		return invalidRequest("client_id and device_id are required")
 	}
 
-	uniqueID := models.CreateUniqueID(clientID, deviceID)
+	conn, err := h.removeConnection(clientID, deviceID)
+	if err != nil {
+		return err
+	}
+
+	h.syncOwnership(clientID, conn.UniqueID)
+
+	logging.Heartbeats.Forget(conn.UniqueID)
+	conn.Logger().Info("Device unregistered")
+	return nil
+}
+
+// removeConnection closes the stream of a device connection and removes it from the store
+func (h *ConnectionHandler) removeConnection(clientID, deviceID string) (*models.Connection, error) {
+	h.registerMu.Lock()
+	defer h.registerMu.Unlock()
+
 	// Get connection before removing to check stream status
-	conn, exists := h.connManager.GetConnection(clientID, deviceID)
+	conn, exists := h.store.GetConnection(clientID, deviceID)
 	if !exists {
-		return fmt.Errorf("device not found: %s", uniqueID)
+		return nil, newDeliveryError(ErrDeviceNotFound, clientID, deviceID, nil)
 	}
 
-	// If stream is attached and active, close it gracefully
-	if conn.Stream != nil && conn.IsActive {
-		log.Printf("Closing active stream for device: %s", uniqueID)
-		// Stop the heartbeat goroutine if it's running
-		if conn.HeartbeatStopChan != nil {
-			select {
-			case conn.HeartbeatStopChan <- true:
-				log.Printf("Heartbeat goroutine stopped for device: %s", uniqueID)
-			default:
-				// Channel might be closed or not ready, that's okay
-			}
-		}
-		// Mark as inactive first
-		conn.IsActive = false
-		conn.Stream = nil
+	// If a stream is attached, detach it first. This stops its heartbeat and closes the
+	// send queue, which ends the stream goroutine and disconnects the device.
+	if queue, detached := conn.DetachStream(nil); detached {
+		conn.Logger().Info("Closing active stream of unregistered device")
+		h.closeSendQueue(conn, queue)
 	}
-	removed := h.connManager.RemoveConnection(uniqueID, clientID, deviceID)
+	h.ReleaseUnacked(conn)
+	h.topics.RemoveDevice(conn.UniqueID)
 
-	if !removed {
-		return fmt.Errorf("device not found: %s", uniqueID)
+	if !h.store.RemoveConnection(conn.UniqueID, clientID, deviceID) {
+		return nil, newDeliveryError(ErrDeviceNotFound, clientID, deviceID, nil)
 	}
-
-	log.Printf("Device unregistered: %s", uniqueID)
-	return nil
+	// The client stays known after its devices left, evicted or not, so its notifications wait in the inbox
+	h.history.Touch(clientID)
+	return conn, nil
 }
 
-// AttachStream attaches a gRPC stream to an existing device connection
-func (h *ConnectionHandler) AttachStream(clientID, deviceID string, stream pb.NotificationService_StreamNotificationsServer) error {
-	conn, exists := h.connManager.GetConnection(clientID, deviceID)
+// ControlCursorReset is the type of the control message telling a device its resume cursor is from
+// another history epoch, after a restart or an eviction. Its data holds the new epoch and its
+// last_sequence, every retained notification of the new epoch is replayed after it.
+const ControlCursorReset = "cursor_reset"
+
+// AttachStream attaches a gRPC stream to an existing device connection.
+// If lastSequence is non-zero, every retained notification after that cursor of the given epoch
+// is replayed first. With acksEnabled the device must acknowledge every notification (Connect streams).
+func (h *ConnectionHandler) AttachStream(clientID, deviceID string, stream models.NotificationStream, epoch string, lastSequence uint64, acksEnabled bool) error {
+	h.drainMu.RLock()
+	defer h.drainMu.RUnlock()
+	if h.shuttingDown {
+		return newDeliveryError(ErrShuttingDown, clientID, deviceID, nil)
+	}
+
+	conn, exists := h.store.GetConnection(clientID, deviceID)
 	if !exists {
-		return fmt.Errorf("connection not found for client: %s, device: %s", clientID, deviceID)
+		return newDeliveryError(ErrDeviceNotFound, clientID, deviceID, nil)
+	}
+
+	h.optionsMu.RLock()
+	capacity, policy := h.queueCapacity, h.overflowPolicy
+	h.optionsMu.RUnlock()
+	queue := models.NewSendQueue(timedStream{stream, h.metrics.sendLatency}, capacity, policy)
+	if previous := conn.AttachStream(stream, queue, acksEnabled); previous != nil {
+		// A previous stream's queue may still hold messages, hand them back to the inbox first
+		h.closeSendQueue(conn, previous)
 	}
 
-	conn.Stream = stream
-	conn.IsActive = true
+	conn.Logger().Info("Stream attached")
 
-	log.Printf("Stream attached to device: %s", conn.UniqueID)
+	// Deliver anything that arrived while the device was away
+	h.flushPendingNotifications(conn, epoch, lastSequence)
 	return nil
 }
 
-// DetachStream marks a device's stream as inactive
-func (h *ConnectionHandler) DetachStream(clientID, deviceID string) {
-	conn, exists := h.connManager.GetConnection(clientID, deviceID)
-	if exists {
-		conn.Stream = nil
-		conn.IsActive = false
-		log.Printf("Stream detached from device: %s", conn.UniqueID)
+// flushPendingNotifications replays notifications after lastSequence (if set) and then sends
+// everything still waiting in the client's inbox to the given device
+func (h *ConnectionHandler) flushPendingNotifications(conn *models.Connection, epoch string, lastSequence uint64) {
+	replayedEpoch, replayedUpTo := "", uint64(0)
+	if lastSequence > 0 {
+		replay := h.history.Since(conn.ClientID, epoch, lastSequence)
+		if replay.Reset {
+			conn.Logger().Info("Resume cursor is from another epoch, replaying from the start",
+				"epoch", epoch, "last_sequence", lastSequence, "current_epoch", replay.Epoch)
+			h.sendCursorReset(conn, replay)
+		} else if !replay.Complete {
+			conn.Logger().Warn("Resume cursor is older than retained history, some notifications are lost",
+				"last_sequence", lastSequence)
+		}
+
+		missed := replay.Missed
+		replayedEpoch = replay.Epoch
+		for _, n := range missed {
+			if err := h.deliverToDevice(conn, n); err != nil {
+				conn.Logger().Warn("Failed to replay notification",
+					logging.KeyNotificationID, n.ID, "sequence", n.Sequence, "error", err)
+				return
+			}
+			replayedUpTo = n.Sequence
+		}
+
+		if len(missed) > 0 {
+			conn.Logger().Info("Replayed missed notifications", "count", len(missed), "last_sequence", lastSequence)
+		}
 	}
-}
 
-// GetClientDevices returns all devices for a specific client
-func (h *ConnectionHandler) GetClientDevices(clientID string) ([]*models.Connection, error) {
-	clientGroup, exists := h.connManager.GetClientGroup(clientID)
-	if !exists {
-		return nil, fmt.Errorf("no devices found for clientt: %s", clientID)
+	pending := h.inbox.Drain(conn.ClientID)
+	if len(pending) == 0 {
+		return
 	}
 
-	return clientGroup.GetAllDevices(), nil
-}
+	flushed := 0
+	for i, p := range pending {
+		// Already delivered by the replay above
+		if p.Notification.Epoch == replayedEpoch && p.Notification.Sequence <= replayedUpTo {
+			continue
+		}
 
-// GetDeviceInfo retrieves information about a specific device
-func (h *ConnectionHandler) GetDeviceInfo(clientID, deviceID string) (*models.Connection, error) {
-	conn, exists := h.connManager.GetConnection(clientID, deviceID)
-	if !exists {
-		return nil, fmt.Errorf("device not found")
-	}
-	return conn, nil
-}
+		if err := h.deliverToDevice(conn, p.Notification); err != nil {
+			conn.Logger().Warn("Failed to flush pending notification",
+				logging.KeyNotificationID, p.Notification.ID, "error", err)
+			// Keep the rest for the next device that attaches
+			h.requeue(conn, pending[i:])
+			return
+		}
 
-// GetDeviceByUniqueID retrieves a device by its unique ID
-func (h *ConnectionHandler) GetDeviceByUniqueID(uniqueID string) (*models.Connection, error) {
-	conn, exists := h.connManager.GetConnectionByUniqueID(uniqueID)
-	if !exists {
-		return nil, fmt.Errorf("device not found: %s", uniqueID)
+		flushed++
 	}
-	return conn, nil
+
+	conn.Logger().Info("Flushed pending notifications", "count", flushed)
 }
 
-// GetConnectionStats returns statistics about connections
-func (h *ConnectionHandler) GetConnectionStats() map[string]interface{} {
-	stats := h.connManager.GetStats()
-	stats["client_ids"] = h.connManager.GetAllClientIDs()
-	return stats
+// sendCursorReset tells a device to start its resume cursor over in the current epoch
+func (h *ConnectionHandler) sendCursorReset(conn *models.Connection, replay models.ReplayResult) {
+	queue := conn.GetQueue()
+	if queue == nil {
+		return
+	}
+	reset := newControlMessage(conn, ControlCursorReset)
+	reset.Data = map[string]string{"epoch": replay.Epoch, "last_sequence": strconv.FormatUint(replay.LastSequence, 10)}
+	if err := queue.Enqueue(&models.OutboundMessage{Message: reset}); err != nil {
+		conn.Logger().Warn("Failed to queue cursor reset", "error", err)
+	}
 }
 
-func (h *ConnectionHandler) SendToSingleDevice(notification *models.NotificationData, clientID string, deviceID string) error {
-	conn, exists := h.connManager.GetConnection(clientID, deviceID)
-	if !exists {
-		return fmt.Errorf("connection not found for client: %s, device: %s", clientID, deviceID)
+// closeSendQueue stops a detached queue's writer and puts notifications it never wrote back into the client's inbox
+func (h *ConnectionHandler) closeSendQueue(conn *models.Connection, queue *models.SendQueue) {
+	if queue == nil {
+		return
 	}
 
-	// Create unique ID for logging and notification
-	uniqueID := models.CreateUniqueID(clientID, deviceID)
+	if err := queue.Err(); err != nil {
+		conn.Logger().Warn("Send queue stopped", "error", err)
+	}
 
-	// Check if the device has an active stream
-	if conn.Stream == nil || !conn.IsActive {
-		return fmt.Errorf("device %s has no active stream", uniqueID)
+	unsent := queue.Close()
+	h.metrics.queueMaxDepth.Observe(float64(queue.Stats().MaxDepth))
+	pending := make([]*models.PendingNotification, 0, len(unsent))
+	for _, msg := range unsent {
+		// Heartbeats and other control messages are not worth keeping
+		if msg.Notification == nil {
+			continue
+		}
+		// It goes back through the inbox, so it no longer waits for an ack on this device
+		conn.DropUnacked(msg.Notification.ID)
+		pending = append(pending, &models.PendingNotification{
+			Notification: msg.Notification,
+			QueuedAt:     time.Now(),
+		})
 	}
 
-	// Send notification to the device
-	if err := conn.Stream.Send(notification.ToProto(uniqueID)); err != nil {
-		log.Printf("Failed to send notification to device %s: %v", uniqueID, err)
-		return fmt.Errorf("failed to send notification to device %s: %w", uniqueID, err)
+	if len(pending) > 0 {
+		h.requeue(conn, pending)
+		conn.Logger().Info("Returned unsent notifications to inbox", "count", len(pending))
 	}
+}
 
-	// Update device metadata
-	conn.LastNotificationAt = time.Now()
-	conn.NotificationCount++
+// deliverToDevice puts a notification on the device's send queue and updates its delivery metadata.
+// Fails with ErrNoActiveStream, ErrQueueFull or ErrSendFailed.
+func (h *ConnectionHandler) deliverToDevice(conn *models.Connection, notification *models.NotificationData) (err error) {
+	// Traced as a child of the publish, the device continues the trace from this span
+	ctx, span := tracing.StartFromTraceparent(notification.Traceparent, "deliver", trace.WithAttributes(
+		attribute.String("client_id", conn.ClientID),
+		attribute.String("device_id", conn.DeviceID),
+		attribute.String("notification_id", notification.ID),
+		attribute.Int64("sequence", int64(notification.Sequence)),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	queue := conn.GetQueue()
+	if queue == nil {
+		return newDeliveryError(ErrNoActiveStream, conn.ClientID, conn.DeviceID, nil)
+	}
 
-	log.Printf("Notification sent successfully to device %s (total notifications: %d)",
-		uniqueID, conn.NotificationCount)
+	msg := &models.OutboundMessage{
+		Notification: notification,
+		Message:      notification.ToProto(conn.UniqueID),
+	}
+	msg.Message.Traceparent = tracing.TraceparentFromContext(ctx)
+	// Connect devices must acknowledge, otherwise the notification is redelivered
+	tracked := conn.TrackUnacked(notification)
+	if err := queue.Enqueue(msg); err != nil {
+		// A failed redelivery stays tracked so it is released to the inbox with the rest
+		if tracked {
+			conn.DropUnacked(notification.ID)
+		}
+		return queueError(conn, err)
+	}
 
+	conn.RecordDelivery()
 	return nil
 }
 
-// SendToLeastLoadedDevice sends notification to the device with least notification count for load balancing
-func (h *ConnectionHandler) SendToDeviceWithLeastNotification(notification *models.NotificationData) error {
-	clientGroup, exists := h.connManager.GetClientGroup(notification.ClientID)
-	if !exists {
-		return fmt.Errorf("no devices found for client: %s", notification.ClientID)
+// queueError turns a send queue failure into ErrQueueFull or ErrSendFailed for the device
+func queueError(conn *models.Connection, err error) error {
+	if errors.Is(err, models.ErrQueueFull) {
+		return newDeliveryError(ErrQueueFull, conn.ClientID, conn.DeviceID, nil)
+	}
+	return newDeliveryError(ErrSendFailed, conn.ClientID, conn.DeviceID, err)
+}
+
+// AcknowledgeNotification marks a notification as processed by the device.
+// If notificationID is empty, everything up to and including sequence is acknowledged.
+func (h *ConnectionHandler) AcknowledgeNotification(conn *models.Connection, notificationID string, sequence uint64) int {
+	if notificationID != "" {
+		if conn.Acknowledge(notificationID) {
+			return 1
+		}
+		conn.Logger().Debug("Ack for unknown notification", logging.KeyNotificationID, notificationID)
+		return 0
 	}
+	return conn.AcknowledgeUpTo(sequence)
+}
+
+// RedeliverUnacked resends notifications the device has not acknowledged within the ack timeout
+func (h *ConnectionHandler) RedeliverUnacked(conn *models.Connection) {
+	timeout, maxAttempts := h.ackOptions()
+	for _, u := range conn.GetExpiredUnacked(timeout) {
+		if u.Attempts >= maxAttempts {
+			conn.Logger().Warn("Notification not acknowledged, giving up",
+				logging.KeyNotificationID, u.Notification.ID, "attempts", u.Attempts)
+			conn.DropUnacked(u.Notification.ID)
+			continue
+		}
 
-	// Get the device with the least notification count (already filters for active streams)
-	targetDevice, ok := clientGroup.GetDeviceWithLeastNotifications()
-	if !ok {
-		return fmt.Errorf("no active devices found for client: %s", notification.ClientID)
+		if !conn.CanReceive() {
+			return
+		}
+
+		if err := h.deliverToDevice(conn, u.Notification); err != nil {
+			conn.Logger().Warn("Failed to redeliver notification", logging.KeyNotificationID, u.Notification.ID, "error", err)
+			return
+		}
+		conn.Logger().Info("Redelivered unacknowledged notification",
+			logging.KeyNotificationID, u.Notification.ID, "attempt", u.Attempts+1)
 	}
+}
 
-	// Send notification to the target device
-	if err := targetDevice.Stream.Send(notification.ToProto(targetDevice.UniqueID)); err != nil {
-		log.Printf("Failed to send notification to device %s: %v", targetDevice.UniqueID, err)
-		return fmt.Errorf("failed to send notification to device %s: %w", targetDevice.UniqueID, err)
+// ReleaseUnacked moves a device's unacknowledged notifications back into the client's inbox
+// so they reach the next device that attaches a stream
+func (h *ConnectionHandler) ReleaseUnacked(conn *models.Connection) {
+	unacked := conn.TakeUnacked()
+	if len(unacked) == 0 {
+		return
 	}
 
-	// Update device metadata
-	targetDevice.LastNotificationAt = time.Now()
-	targetDevice.NotificationCount++
-	log.Printf("Notification sent successfully to device %s (total notifications: %d)",
-		targetDevice.UniqueID, targetDevice.NotificationCount)
+	pending := make([]*models.PendingNotification, 0, len(unacked))
+	for _, u := range unacked {
+		pending = append(pending, &models.PendingNotification{
+			Notification: u.Notification,
+			QueuedAt:     u.SentAt,
+		})
+	}
+	h.requeue(conn, pending)
 
-	return nil
+	conn.Logger().Info("Returned unacknowledged notifications to inbox", "count", len(pending))
 }
 
-// SendToFirstDevice sends notification to the first active device of a client
-func (h *ConnectionHandler) SendToFirstDevice(notification *models.NotificationData) error {
-	clientGroup, exists := h.connManager.GetClientGroup(notification.ClientID)
-	if !exists {
-		return fmt.Errorf("no devices found for client: %s", notification.ClientID)
+// recordNotification assigns the next per-client sequence (and an ID if missing) and keeps it for replay
+func (h *ConnectionHandler) recordNotification(notification *models.NotificationData) {
+	if notification.Sequence != 0 {
+		// Already recorded, e.g. a retry of the same notification
+		return
 	}
+	h.history.Append(notification)
+}
 
-	devices := clientGroup.GetAllDevices()
-	if len(devices) == 0 {
-		return fmt.Errorf("no devices found for client: %s", notification.ClientID)
+// queueForClient keeps an undelivered notification in the client's inbox until a device attaches a stream.
+// Returns ErrNotificationQueued, or ErrInboxFull if too many clients already have pending notifications.
+func (h *ConnectionHandler) queueForClient(notification *models.NotificationData) (DeliveryResult, error) {
+	result := DeliveryResult{ClientID: notification.ClientID, Status: DeliveryQueued}
+
+	dropped, err := h.inbox.Enqueue(notification)
+	if err != nil {
+		slog.Warn("Inbox full, notification not kept",
+			logging.KeyClientID, notification.ClientID, logging.KeyNotificationID, notification.ID,
+			"clients", h.inbox.GetClientCount())
+		result.fail(newDeliveryError(ErrInboxFull, notification.ClientID, "", nil))
+		return result, result.Err
+	}
+	if dropped {
+		slog.Warn("Inbox full, dropped oldest pending notification", logging.KeyClientID, notification.ClientID)
 	}
 
-	// Find the first device with an active stream
-	for _, device := range devices {
-		if device.Stream != nil && device.IsActive {
-			// Send notification to the first active device
-			if err := device.Stream.Send(notification.ToProto(device.UniqueID)); err != nil {
-				log.Printf("Failed to send notification to first device %s: %v", device.UniqueID, err)
-				return fmt.Errorf("failed to send notification to first device %s: %w", device.UniqueID, err)
-			}
+	slog.Debug("Notification queued in inbox",
+		logging.KeyClientID, notification.ClientID, logging.KeyNotificationID, notification.ID,
+		"pending", h.inbox.GetPendingCount(notification.ClientID))
 
-			// Update device metadata
-			device.LastNotificationAt = time.Now()
-			device.NotificationCount++
+	return result, ErrNotificationQueued
+}
 
-			log.Printf("Notification sent successfully to first device %s (total notifications: %d)",
-				device.UniqueID, device.NotificationCount)
+// requeue hands notifications back to the client's inbox, logging those its limits made it drop
+func (h *ConnectionHandler) requeue(conn *models.Connection, pending []*models.PendingNotification) {
+	if dropped := h.inbox.Requeue(conn.ClientID, pending); dropped > 0 {
+		conn.Logger().Warn("Inbox full, dropped pending notifications", "count", dropped)
+	}
+}
 
-			return nil
+// EnableCluster makes this handler one node of a cluster: device ownership is recorded in
+// the registry and notifications for devices attached to other nodes are relayed through it.
+// Sequences and history stay per node, a device resuming with last_sequence on another node
+// than the one it left gets a cursor reset.
+func (h *ConnectionHandler) EnableCluster(registry cluster.Registry) error {
+	h.optionsMu.Lock()
+	h.registry = registry
+	h.optionsMu.Unlock()
+
+	// Devices registered before the cluster was enabled
+	for _, conn := range h.store.GetAllConnections() {
+		if err := registry.RegisterDevice(conn.ClientID, conn.UniqueID); err != nil {
+			return err
 		}
 	}
 
-	return fmt.Errorf("no active devices found for client: %s", notification.ClientID)
+	return registry.Subscribe(h.handleEnvelope)
 }
 
-// SendNotificationToClient sends notification to all devices of a client
-func (h *ConnectionHandler) SendNotificationToClient(notification *models.NotificationData) error {
-	clientGroup, exists := h.connManager.GetClientGroup(notification.ClientID)
-	if !exists {
-		return fmt.Errorf("no devices found for client: %s", notification.ClientID)
-	}
-
-	devices := clientGroup.GetAllDevices()
-	// log.Printf("Sending notification to client %s with %d devices", notification.ClientID, len(devices))
-	// log.Printf(" devices: %v", devices)
-	successCount := 0
-	failCount := 0
-
-	for _, device := range devices {
-		// log.Printf(" single device data: %v", device)
-		if device.Stream != nil && device.IsActive {
-			// Send notification
-			if err := device.Stream.Send(notification.ToProto(device.UniqueID)); err != nil {
-				log.Printf("Failed to send notification to %s: %v", device.UniqueID, err)
-				failCount++
-			} else {
-				// Update last notification time and count
-				device.LastNotificationAt = time.Now()
-				device.NotificationCount++
-				successCount++
-			}
+// clusterRegistry returns the cluster registry, nil when running as a single node
+func (h *ConnectionHandler) clusterRegistry() cluster.Registry {
+	h.optionsMu.RLock()
+	defer h.optionsMu.RUnlock()
+	return h.registry
+}
+
+// syncOwnership records in the cluster registry whether this node owns a device, after a
+// registration or an unregistration. It runs without registerMu held, so the device is looked up
+// again afterwards: if it came or went during the call, the registry is brought in line.
+func (h *ConnectionHandler) syncOwnership(clientID, uniqueID string) {
+	registry := h.clusterRegistry()
+	if registry == nil {
+		return
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		_, owned := h.store.GetConnectionByUniqueID(uniqueID)
+		var err error
+		if owned {
+			err = registry.RegisterDevice(clientID, uniqueID)
 		} else {
-			log.Printf("Device %s has no active stream", device.UniqueID)
-			failCount++
+			err = registry.UnregisterDevice(clientID, uniqueID)
+		}
+		if err != nil {
+			slog.Error("Failed to update device ownership in cluster registry",
+				logging.KeyClientID, clientID, logging.KeyUniqueID, uniqueID, "owned", owned, "error", err)
+			return
+		}
+		if _, stillOwned := h.store.GetConnectionByUniqueID(uniqueID); stillOwned == owned {
+			return
 		}
 	}
+}
 
-	log.Printf("Notification sent to client %s: %d success, %d failed (total devices: %d)",
-		notification.ClientID, successCount, failCount, len(devices))
-
-	if successCount == 0 {
-		return fmt.Errorf("failed to send notification to any device")
+// handleEnvelope delivers a notification relayed by another node to the local devices
+func (h *ConnectionHandler) handleEnvelope(env *cluster.Envelope) {
+	notification := env.Notification
+	if notification == nil {
+		return
+	}
+	// Never bounce it back into the cluster
+	notification.Relayed = true
+
+	var err error
+	switch env.Kind {
+	case cluster.KindClient:
+		var strategy DeliveryStrategy
+		if strategy, err = h.GetStrategy(env.Strategy, env.DeviceID); err == nil {
+			_, err = h.PublishToClient(notification, strategy)
+		}
+	case cluster.KindClientAll:
+		err = h.SendNotificationToClient(notification)
+	case cluster.KindClientLeast:
+		err = h.SendToDeviceWithLeastNotification(notification)
+	case cluster.KindClientFirst:
+		err = h.SendToFirstDevice(notification)
+	case cluster.KindDevice:
+		err = h.SendToSingleDevice(notification, env.ClientID, env.DeviceID)
+	case cluster.KindBroadcast:
+		h.BroadcastToAll(notification)
+	case cluster.KindTopic:
+		_, err = h.PublishToTopic(notification, notification.Topic)
+	default:
+		slog.Warn("Unknown envelope kind from cluster", "kind", env.Kind, "node_id", env.Origin)
+		return
 	}
 
-	return nil
+	if err != nil && !errors.Is(err, ErrNotificationQueued) {
+		slog.Warn("Failed to deliver relayed notification",
+			logging.KeyNotificationID, notification.ID, "node_id", env.Origin, "error", err)
+	}
 }
 
-// BroadcastToAll sends notification to all connected clients and their devices
-func (h *ConnectionHandler) BroadcastToAll(notification *models.NotificationData) {
-	clientIDs := h.connManager.GetAllClientIDs()
-	totalDevices := 0
-	successCount := 0
+// relayToOwners hands a notification to the other nodes that own devices of its client.
+// Unless the strategy sends to all devices a single node is picked. Returns one result per node tried.
+func (h *ConnectionHandler) relayToOwners(notification *models.NotificationData, strategy DeliveryStrategy) []DeliveryResult {
+	registry := h.clusterRegistry()
+	if registry == nil || notification.Relayed {
+		return nil
+	}
+
+	owners, err := registry.GetClientOwners(notification.ClientID)
+	if err != nil {
+		slog.Error("Failed to look up client owners in cluster registry", logging.KeyClientID, notification.ClientID, "error", err)
+		return nil
+	}
+
+	nodes := make(map[string]bool)
+	for _, nodeID := range owners {
+		if nodeID != registry.NodeID() {
+			nodes[nodeID] = true
+		}
+	}
 
-	for _, clientID := range clientIDs {
-		clientGroup, exists := h.connManager.GetClientGroup(clientID)
-		if !exists {
+	var results []DeliveryResult
+	relayed := 0
+	for nodeID := range nodes {
+		result := DeliveryResult{ClientID: notification.ClientID, NodeID: nodeID, Status: DeliveryRelayed}
+		env := &cluster.Envelope{
+			Target:       nodeID,
+			Kind:         cluster.KindClient,
+			ClientID:     notification.ClientID,
+			Strategy:     strategy.Name(),
+			Notification: notification,
+		}
+		if err := registry.Publish(env); err != nil {
+			slog.Warn("Failed to relay notification",
+				logging.KeyClientID, notification.ClientID, logging.KeyNotificationID, notification.ID, "node_id", nodeID, "error", err)
+			result.fail(newDeliveryError(ErrSendFailed, notification.ClientID, "", err))
+			results = append(results, result)
 			continue
 		}
+		results = append(results, result)
+		relayed++
 
-		devices := clientGroup.GetAllDevices()
-		totalDevices += len(devices)
-
-		for _, device := range devices {
-			if device.Stream != nil && device.IsActive {
-				notif := &models.NotificationData{
-					ID:          notification.ID,
-					ClientID:    device.ClientID,
-					CreatedAt:   notification.CreatedAt,
-					UpdatedAt:   notification.UpdatedAt,
-					CallID:      notification.CallID,
-					ServiceName: notification.ServiceName,
-					Timestamp:   notification.Timestamp,
-				}
-
-				if err := device.Stream.Send(notif.ToProto(device.UniqueID)); err != nil {
-					log.Printf("Failed to broadcast to %s: %v", device.UniqueID, err)
-				} else {
-					device.LastNotificationAt = time.Now()
-					device.NotificationCount++
-					successCount++
-				}
-			}
+		if !strategy.AllDevices() {
+			break
 		}
 	}
 
-	log.Printf("Broadcast complete: %d/%d devices notified across %d clients",
-		successCount, totalDevices, len(clientIDs))
+	if relayed > 0 {
+		slog.Debug("Notification relayed",
+			logging.KeyClientID, notification.ClientID, logging.KeyNotificationID, notification.ID, "nodes", relayed)
+	}
+	return results
 }
 
-// GetConnectionManager returns the underlying connection manager
-func (h *ConnectionHandler) GetConnectionManager() *models.ConnectionManager {
-	return h.connManager
+// relayOrQueue relays a notification this node could not deliver, or keeps it in the inbox.
+// Returns ErrNotificationQueued if it was kept, ErrInboxFull if the inbox refused it.
+func (h *ConnectionHandler) relayOrQueue(notification *models.NotificationData, strategy DeliveryStrategy) ([]DeliveryResult, error) {
+	results := h.relayToOwners(notification, strategy)
+	if countStatus(results, DeliveryRelayed) > 0 {
+		return results, nil
+	}
+	queued, err := h.queueForClient(notification)
+	return append(results, queued), err
+}
+
+// DetachStream marks a device's stream as inactive. Nothing happens if the device has
+// attached a newer stream in the meantime.
+func (h *ConnectionHandler) DetachStream(clientID, deviceID string, stream models.NotificationStream) {
+	conn, exists := h.store.GetConnection(clientID, deviceID)
+	if !exists {
+		return
+	}
+
+	if queue, detached := conn.DetachStream(stream); detached {
+		h.closeSendQueue(conn, queue)
+		h.ReleaseUnacked(conn)
+		conn.Logger().Info("Stream detached")
+	}
+}
+
+// GetClientDevices returns all devices for a specific client
+func (h *ConnectionHandler) GetClientDevices(clientID string) ([]*models.Connection, error) {
+	clientGroup, exists := h.store.GetClientGroup(clientID)
+	if !exists {
+		return nil, newDeliveryError(ErrClientNotFound, clientID, "", nil)
+	}
+
+	return clientGroup.GetAllDevices(), nil
+}
+
+// GetDeviceInfo retrieves information about a specific device
+func (h *ConnectionHandler) GetDeviceInfo(clientID, deviceID string) (*models.Connection, error) {
+	conn, exists := h.store.GetConnection(clientID, deviceID)
+	if !exists {
+		return nil, newDeliveryError(ErrDeviceNotFound, clientID, deviceID, nil)
+	}
+	return conn, nil
+}
+
+// GetDeviceByUniqueID retrieves a device by its unique ID
+func (h *ConnectionHandler) GetDeviceByUniqueID(uniqueID string) (*models.Connection, error) {
+	conn, exists := h.store.GetConnectionByUniqueID(uniqueID)
+	if !exists {
+		return nil, newDeliveryError(ErrDeviceNotFound, "", uniqueID, nil)
+	}
+	return conn, nil
+}
+
+// GetConnectionStats returns statistics about connections
+func (h *ConnectionHandler) GetConnectionStats() map[string]interface{} {
+	stats := h.store.GetStats()
+	stats["client_ids"] = h.store.GetAllClientIDs()
+	stats["pending_notifications"] = h.inbox.GetTotalPending()
+	stats["inbox_clients"] = h.inbox.GetClientCount()
+	stats["inbox_dropped"] = h.inbox.GetDropped()
+	stats["topics"] = h.topics.GetTopicCount()
+
+	queued, dropped := 0, uint64(0)
+	for _, conn := range h.store.GetAllConnections() {
+		if queue := conn.GetQueue(); queue != nil {
+			queueStats := queue.Stats()
+			queued += queueStats.Depth
+			dropped += queueStats.Dropped
+		}
+	}
+	stats["queued_messages"] = queued
+	stats["dropped_messages"] = dropped
+	return stats
+}
+
+// SendToSingleDevice sends notification to one specific device of a client
+func (h *ConnectionHandler) SendToSingleDevice(notification *models.NotificationData, clientID string, deviceID string) error {
+	_, err := h.PublishToDevice(notification, clientID, deviceID)
+	return err
+}
+
+// SendToLeastLoadedDevice sends notification to the device with least notification count for load balancing
+func (h *ConnectionHandler) SendToDeviceWithLeastNotification(notification *models.NotificationData) error {
+	_, err := h.PublishToClient(notification, leastLoadedStrategy{})
+	return err
+}
+
+// SendToFirstDevice sends notification to the first active device of a client
+func (h *ConnectionHandler) SendToFirstDevice(notification *models.NotificationData) error {
+	_, err := h.PublishToClient(notification, firstStrategy{})
+	return err
+}
+
+// SendNotificationToClient sends notification to all devices of a client
+func (h *ConnectionHandler) SendNotificationToClient(notification *models.NotificationData) error {
+	_, err := h.PublishToClient(notification, allDevicesStrategy{})
+	return err
+}
+
+// BroadcastToAll sends notification to all connected clients and their devices
+func (h *ConnectionHandler) BroadcastToAll(notification *models.NotificationData) {
+	h.PublishBroadcast(notification)
+}
+
+// GetConnectionStore returns the underlying connection store
+func (h *ConnectionHandler) GetConnectionStore() models.ConnectionStore {
+	return h.store
+}
+
+// GetTopicIndex returns the topic subscription index
+func (h *ConnectionHandler) GetTopicIndex() *models.TopicIndex {
+	return h.topics
+}
+
+// GetInbox returns the pending notification inbox
+func (h *ConnectionHandler) GetInbox() *models.NotificationInbox {
+	return h.inbox
 }
 
 // StartHealthCheckMonitor runs a background goroutine that checks for stale connections
 func (h *ConnectionHandler) StartHealthCheckMonitor() {
 	go func() {
-		ticker := time.NewTicker(60 * time.Second) // Check every minute
+		interval := h.HeartbeatOptions().MonitorInterval
+		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 
-		log.Println("Health check monitor started")
-		for range ticker.C {
+		slog.Info("Health check monitor started", "interval", interval)
+		for {
+			select {
+			case <-ticker.C:
+			case <-h.monitorStop:
+				slog.Info("Health check monitor stopped")
+				return
+			}
+
 			h.cleanupStaleConnections()
+			if purged := h.inbox.PurgeExpired(); purged > 0 {
+				slog.Info("Purged expired pending notifications", "count", purged)
+			}
+			if purged := h.history.PurgeIdle(h.historyIdleTTLOption(), h.hasDevices); purged > 0 {
+				slog.Info("Purged history of idle clients", "count", purged)
+			}
+
+			if next := h.HeartbeatOptions().MonitorInterval; next != interval {
+				interval = next
+				ticker.Reset(interval)
+			}
 		}
 	}()
 }
 
-// cleanupStaleConnections removes connections that haven't received heartbeat in 90 seconds
+// hasDevices reports whether a client has at least one registered device on this node
+func (h *ConnectionHandler) hasDevices(clientID string) bool {
+	_, exists := h.store.GetClientGroup(clientID)
+	return exists
+}
+
+// isKnownClient reports whether a client has a device registered on this node or, in a cluster, on
+// another one, or was seen recently: it has pending notifications, or a history because it got
+// notifications or had devices within the history idle TTL. Clients whose owners can't be looked
+// up are assumed known.
+func (h *ConnectionHandler) isKnownClient(clientID string) bool {
+	if h.hasDevices(clientID) || h.inbox.GetPendingCount(clientID) > 0 || h.history.Has(clientID) {
+		return true
+	}
+	registry := h.clusterRegistry()
+	if registry == nil {
+		return false
+	}
+
+	owners, err := registry.GetClientOwners(clientID)
+	if err != nil {
+		slog.Error("Failed to look up client owners in cluster registry", logging.KeyClientID, clientID, "error", err)
+		return true
+	}
+	for _, nodeID := range owners {
+		if nodeID != registry.NodeID() {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanupStaleConnections removes streaming connections that haven't answered a heartbeat within the stale threshold
 func (h *ConnectionHandler) cleanupStaleConnections() {
-	allConns := h.connManager.GetAllConnections()
-	staleThreshold := 90 * time.Second
+	allConns := h.store.GetAllConnections()
+	staleThreshold := h.HeartbeatOptions().StaleThreshold
 
 	for _, conn := range allConns {
-		if conn.IsActive {
-			timeSinceHeartbeat := time.Since(conn.LastHeartbeatAt)
+		if conn.IsActive() {
+			// Connect devices answer heartbeats, so this is their last pong
+			timeSinceHeartbeat := time.Since(conn.GetLastSeen())
 			if timeSinceHeartbeat > staleThreshold {
-				log.Printf("Removing stale connection: %s (last heartbeat: %v ago)",
-					conn.UniqueID, timeSinceHeartbeat)
+				conn.Logger().Warn("Removing stale connection", "since_last_heartbeat", timeSinceHeartbeat)
+				h.metrics.staleEvictions.Inc()
 				h.UnregisterDevice(conn.ClientID, conn.DeviceID)
 			}
 		}
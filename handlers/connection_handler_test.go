@@ -0,0 +1,450 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"grpcon/cluster"
+	"grpcon/models"
+	pb "grpcon/proto"
+)
+
+func TestMain(m *testing.M) {
+	// Every register, attach and delivery logs a line, keep test output readable
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// testStream is a NotificationStream that records what it is sent
+type testStream struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	sent []*pb.Notification
+}
+
+func newTestStream() *testStream {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &testStream{ctx: ctx, cancel: cancel}
+}
+
+func (s *testStream) Send(n *pb.Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, n)
+	return nil
+}
+
+func (s *testStream) Context() context.Context {
+	return s.ctx
+}
+
+// notifications returns what was sent, without heartbeats and control messages
+func (s *testStream) notifications() []*pb.Notification {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []*pb.Notification
+	for _, n := range s.sent {
+		if n.Type == "" {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+// waitFor polls cond until it holds or three seconds have passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// attachDevice registers a device and attaches a test stream to it
+func attachDevice(t *testing.T, h *ConnectionHandler, clientID, deviceID string) *testStream {
+	t.Helper()
+	if _, err := h.RegisterDevice(clientID, deviceID, "test"); err != nil {
+		t.Fatalf("RegisterDevice %s/%s: %v", clientID, deviceID, err)
+	}
+	stream := newTestStream()
+	t.Cleanup(stream.cancel)
+	if err := h.AttachStream(clientID, deviceID, stream, "", 0, false); err != nil {
+		t.Fatalf("AttachStream %s/%s: %v", clientID, deviceID, err)
+	}
+	return stream
+}
+
+func newTestNotification(clientID string) *models.NotificationData {
+	return &models.NotificationData{ClientID: clientID, ServiceName: "test", Title: "title", Body: "body"}
+}
+
+func TestRegisterDeviceIsIdempotent(t *testing.T) {
+	h := NewConnectionHandler()
+
+	first, err := h.RegisterDevice("alice", "phone", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := h.RegisterDevice("alice", "phone", "test")
+	if err != nil || again != first {
+		t.Fatalf("second RegisterDevice = %p, %v, want the first connection", again, err)
+	}
+
+	if _, err := h.RegisterDevice("", "phone", "test"); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("RegisterDevice without client_id = %v, want ErrInvalidRequest", err)
+	}
+	if err := h.UnregisterDevice("alice", "tablet"); !errors.Is(err, ErrDeviceNotFound) {
+		t.Fatalf("UnregisterDevice of an unknown device = %v, want ErrDeviceNotFound", err)
+	}
+}
+
+func TestOfflineNotificationsFlushOnAttach(t *testing.T) {
+	h := NewConnectionHandler()
+	if _, err := h.RegisterDevice("alice", "phone", "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := h.SendNotificationToClient(newTestNotification("alice")); !errors.Is(err, ErrNotificationQueued) {
+			t.Fatalf("send to an offline client = %v, want ErrNotificationQueued", err)
+		}
+	}
+
+	stream := newTestStream()
+	t.Cleanup(stream.cancel)
+	if err := h.AttachStream("alice", "phone", stream, "", 0, false); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "flushed notifications", func() bool { return len(stream.notifications()) == 3 })
+	for i, n := range stream.notifications() {
+		if n.Sequence != uint64(i+1) {
+			t.Fatalf("notification %d has sequence %d", i, n.Sequence)
+		}
+	}
+}
+
+func TestAttachReplaysAfterCursor(t *testing.T) {
+	h := NewConnectionHandler()
+	first := attachDevice(t, h, "alice", "phone")
+	for i := 0; i < 4; i++ {
+		h.SendNotificationToClient(newTestNotification("alice"))
+	}
+	waitFor(t, "live notifications", func() bool { return len(first.notifications()) == 4 })
+	epoch := first.notifications()[1].Epoch
+	h.DetachStream("alice", "phone", first)
+
+	// Resume after sequence 2 of the same epoch
+	resumed := newTestStream()
+	t.Cleanup(resumed.cancel)
+	if err := h.AttachStream("alice", "phone", resumed, epoch, 2, false); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "replayed notifications", func() bool { return len(resumed.notifications()) == 2 })
+	if got := resumed.notifications()[0].Sequence; got != 3 {
+		t.Fatalf("replay starts at %d, want 3", got)
+	}
+
+	// A cursor of another epoch gets a reset and everything retained
+	reset := newTestStream()
+	t.Cleanup(reset.cancel)
+	if err := h.AttachStream("alice", "phone", reset, "gone", 2, false); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "reset replay", func() bool { return len(reset.notifications()) == 4 })
+	reset.mu.Lock()
+	defer reset.mu.Unlock()
+	if reset.sent[0].Type != ControlCursorReset || reset.sent[0].Data["epoch"] != epoch {
+		t.Fatalf("first message = %s %v, want a cursor reset to %s", reset.sent[0].Type, reset.sent[0].Data, epoch)
+	}
+}
+
+func TestSetHistoryOptionsLimitsReplay(t *testing.T) {
+	h := NewConnectionHandler()
+	h.SetHistoryOptions(2, time.Hour)
+	first := attachDevice(t, h, "alice", "phone")
+	for i := 0; i < 4; i++ {
+		h.SendNotificationToClient(newTestNotification("alice"))
+	}
+	waitFor(t, "live notifications", func() bool { return len(first.notifications()) == 4 })
+	epoch := first.notifications()[0].Epoch
+	h.DetachStream("alice", "phone", first)
+
+	// Resuming after sequence 1 only gets the last two, the only ones retained
+	resumed := newTestStream()
+	t.Cleanup(resumed.cancel)
+	if err := h.AttachStream("alice", "phone", resumed, epoch, 1, false); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "replayed notifications", func() bool { return len(resumed.notifications()) == 2 })
+	if got := resumed.notifications()[0].Sequence; got != 3 {
+		t.Fatalf("replay starts at %d, want 3", got)
+	}
+}
+
+// TestConcurrentRegisterAttachSendUnregister is meant for -race: devices come and go while
+// notifications and broadcasts are published
+func TestConcurrentRegisterAttachSendUnregister(t *testing.T) {
+	h := NewConnectionHandler()
+	const clients, devices, rounds = 4, 3, 20
+
+	var wg sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		clientID := fmt.Sprintf("client%d", c)
+		for d := 0; d < devices; d++ {
+			deviceID := fmt.Sprintf("device%d", d)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for r := 0; r < rounds; r++ {
+					if _, err := h.RegisterDevice(clientID, deviceID, "test"); err != nil {
+						t.Error(err)
+						return
+					}
+					stream := newTestStream()
+					if err := h.AttachStream(clientID, deviceID, stream, "", 0, r%2 == 0); err != nil {
+						t.Error(err)
+					}
+					if r%3 == 0 {
+						h.DetachStream(clientID, deviceID, stream)
+					}
+					if err := h.UnregisterDevice(clientID, deviceID); err != nil && !errors.Is(err, ErrDeviceNotFound) {
+						t.Error(err)
+					}
+					stream.cancel()
+				}
+			}()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			strategy, _ := h.GetStrategy(StrategyRoundRobin, "")
+			for r := 0; r < rounds; r++ {
+				h.PublishToClient(newTestNotification(clientID), strategy)
+				h.SendNotificationToClient(newTestNotification(clientID))
+				h.PublishToDevice(newTestNotification(clientID), clientID, "device0")
+			}
+		}()
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for r := 0; r < rounds; r++ {
+			h.PublishBroadcast(newTestNotification(""))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for r := 0; r < rounds; r++ {
+			h.GetConnectionStats()
+			h.cleanupStaleConnections()
+		}
+	}()
+	wg.Wait()
+
+	if got := h.store.GetTotalDeviceCount(); got != 0 {
+		t.Fatalf("%d devices left registered", got)
+	}
+}
+
+// newClusterNode creates a handler joined to hub as nodeID
+func newClusterNode(t *testing.T, hub *cluster.MemoryHub, nodeID string) *ConnectionHandler {
+	t.Helper()
+	h := NewConnectionHandler()
+	registry := hub.NewRegistry(nodeID)
+	if err := h.EnableCluster(registry); err != nil {
+		t.Fatalf("EnableCluster %s: %v", nodeID, err)
+	}
+	t.Cleanup(func() { registry.Close() })
+	return h
+}
+
+func TestPublishToUnknownClient(t *testing.T) {
+	h := NewConnectionHandler()
+	strategy, _ := h.GetStrategy(StrategyAllDevices, "")
+
+	results, err := h.PublishToClient(newTestNotification("nobody"), strategy)
+	if !errors.Is(err, ErrClientNotFound) || HTTPStatus(err) != http.StatusNotFound {
+		t.Fatalf("publish to an unknown client = %v, want ErrClientNotFound", err)
+	}
+	if len(results) != 1 || results[0].ErrorCode != ErrorCodeClientNotFound {
+		t.Fatalf("results = %+v, want one client_not_found failure", results)
+	}
+	if got := h.GetInbox().GetPendingCount("nobody"); got != 0 {
+		t.Fatalf("%d notifications queued for an unknown client", got)
+	}
+
+	if _, err := h.PublishToClient(newTestNotification(""), strategy); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("publish without client_id = %v, want ErrInvalidRequest", err)
+	}
+
+	// A registered client without a stream still gets it later
+	if _, err := h.RegisterDevice("alice", "phone", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.PublishToClient(newTestNotification("alice"), strategy); !errors.Is(err, ErrNotificationQueued) {
+		t.Fatalf("publish to an offline client = %v, want ErrNotificationQueued", err)
+	}
+}
+
+func TestPublishToEvictedClientQueues(t *testing.T) {
+	h := NewConnectionHandler()
+	strategy, _ := h.GetStrategy(StrategyAllDevices, "")
+	attachDevice(t, h, "alice", "phone")
+
+	// The stale sweep evicts the only device, which never got a notification
+	opts := h.HeartbeatOptions()
+	opts.StaleThreshold = time.Millisecond
+	h.SetHeartbeatOptions(opts)
+	time.Sleep(5 * time.Millisecond)
+	h.cleanupStaleConnections()
+	if h.hasDevices("alice") {
+		t.Fatal("stale device still registered")
+	}
+
+	if _, err := h.PublishToClient(newTestNotification("alice"), strategy); !errors.Is(err, ErrNotificationQueued) {
+		t.Fatalf("publish to an evicted client = %v, want ErrNotificationQueued", err)
+	}
+	if got := h.GetInbox().GetPendingCount("alice"); got != 1 {
+		t.Fatalf("pending notifications = %d, want 1", got)
+	}
+
+	// Once the client is forgotten it is unknown again
+	h.history.PurgeIdle(time.Nanosecond, func(string) bool { return false })
+	h.GetInbox().Drain("alice")
+	if _, err := h.PublishToClient(newTestNotification("alice"), strategy); !errors.Is(err, ErrClientNotFound) {
+		t.Fatalf("publish to a forgotten client = %v, want ErrClientNotFound", err)
+	}
+}
+
+func TestClusterKnowsClientsOfOtherNodes(t *testing.T) {
+	hub := cluster.NewMemoryHub()
+	nodeA := newClusterNode(t, hub, "a")
+	nodeB := newClusterNode(t, hub, "b")
+	strategy, _ := nodeA.GetStrategy(StrategyLeastLoaded, "")
+
+	if _, err := nodeA.PublishToClient(newTestNotification("alice"), strategy); !errors.Is(err, ErrClientNotFound) {
+		t.Fatalf("publish to a client no node knows = %v, want ErrClientNotFound", err)
+	}
+
+	if _, err := nodeB.RegisterDevice("alice", "phone", "test"); err != nil {
+		t.Fatal(err)
+	}
+	results, err := nodeA.PublishToClient(newTestNotification("alice"), strategy)
+	if err != nil || countStatus(results, DeliveryRelayed) != 1 {
+		t.Fatalf("publish to a client of another node = %+v, %v, want relayed", results, err)
+	}
+}
+
+func TestClusterRelaysToOwningNode(t *testing.T) {
+	hub := cluster.NewMemoryHub()
+	nodeA := newClusterNode(t, hub, "a")
+	nodeB := newClusterNode(t, hub, "b")
+
+	stream := attachDevice(t, nodeB, "alice", "phone")
+
+	strategy, err := nodeA.GetStrategy(StrategyAllDevices, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := nodeA.PublishToClient(newTestNotification("alice"), strategy)
+	if err != nil {
+		t.Fatalf("PublishToClient: %v", err)
+	}
+	if len(results) != 1 || results[0].Status != DeliveryRelayed || results[0].NodeID != "b" {
+		t.Fatalf("results = %+v, want one relayed to b", results)
+	}
+	waitFor(t, "relayed notification", func() bool { return len(stream.notifications()) == 1 })
+
+	// A specific device is relayed too
+	if _, err := nodeA.PublishToDevice(newTestNotification("alice"), "alice", "phone"); err != nil {
+		t.Fatalf("PublishToDevice: %v", err)
+	}
+	waitFor(t, "notification relayed to the device", func() bool { return len(stream.notifications()) == 2 })
+}
+
+func TestClusterOwnershipFollowsRegistration(t *testing.T) {
+	hub := cluster.NewMemoryHub()
+	nodeA := newClusterNode(t, hub, "a")
+	observer := hub.NewRegistry("observer")
+
+	uniqueID := models.CreateUniqueID("alice", "phone")
+	if _, err := nodeA.RegisterDevice("alice", "phone", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if owner, ok, _ := observer.GetDeviceOwner(uniqueID); !ok || owner != "a" {
+		t.Fatalf("owner after register = %q, %v, want a", owner, ok)
+	}
+
+	if err := nodeA.UnregisterDevice("alice", "phone"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := observer.GetDeviceOwner(uniqueID); ok {
+		t.Fatal("device still owned after unregister")
+	}
+}
+
+func TestClusterEnabledWhileServing(t *testing.T) {
+	hub := cluster.NewMemoryHub()
+	h := NewConnectionHandler()
+	stream := attachDevice(t, h, "alice", "phone")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := h.EnableCluster(hub.NewRegistry("a")); err != nil {
+			t.Error(err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			h.SendNotificationToClient(newTestNotification("alice"))
+		}
+	}()
+	wg.Wait()
+
+	waitFor(t, "notifications", func() bool { return len(stream.notifications()) == 20 })
+}
+
+func TestRegisterAgainUpdatesAppInfo(t *testing.T) {
+	h := NewConnectionHandler()
+	metadata := models.DeviceMetadata{ServiceName: "test", Platform: "ios", AppVersion: "1.0"}
+	conn, err := h.RegisterDeviceWithMetadata("alice", "phone", metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			h.RegisterDeviceWithMetadata("alice", "phone", models.DeviceMetadata{ServiceName: "test", AppVersion: "2.0"})
+		}()
+		go func() {
+			defer wg.Done()
+			conn.Snapshot()
+		}()
+	}
+	wg.Wait()
+
+	if platform, appVersion := conn.GetAppInfo(); platform != "ios" || appVersion != "2.0" {
+		t.Fatalf("app info = %s %s, want ios 2.0", platform, appVersion)
+	}
+}
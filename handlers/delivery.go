@@ -0,0 +1,330 @@
+package handlers
+
+import (
+	"log/slog"
+
+	"grpcon/cluster"
+	"grpcon/logging"
+	"grpcon/models"
+	pb "grpcon/proto"
+)
+
+// DeliveryStatus is what happened to a notification for one device
+type DeliveryStatus string
+
+const (
+	// DeliverySent means the notification was handed to the device's send queue
+	DeliverySent DeliveryStatus = "sent"
+	// DeliveryQueued means no device could take it and it was kept in the client's inbox
+	DeliveryQueued DeliveryStatus = "queued"
+	// DeliveryRelayed means it was handed to the node the device is attached to
+	DeliveryRelayed DeliveryStatus = "relayed"
+	// DeliveryFailed means the device could not take it
+	DeliveryFailed DeliveryStatus = "failed"
+)
+
+// DeliveryResult is the outcome of a notification for one device. Relayed results name the
+// node instead of a device, queued results only the client.
+type DeliveryResult struct {
+	ClientID     string         `json:"client_id,omitempty"`
+	DeviceID     string         `json:"device_id,omitempty"`
+	ConnectionID string         `json:"connection_id,omitempty"`
+	NodeID       string         `json:"node_id,omitempty"`
+	Status       DeliveryStatus `json:"status"`
+	ErrorCode    string         `json:"error_code,omitempty"`
+	Error        string         `json:"error,omitempty"`
+	Err          error          `json:"-"` // typed failure, see ErrorCode
+}
+
+// ToProto converts DeliveryResult to protobuf DeliveryResult
+func (r DeliveryResult) ToProto() *pb.DeliveryResult {
+	status := pb.DeliveryStatus_DELIVERY_STATUS_UNSPECIFIED
+	switch r.Status {
+	case DeliverySent:
+		status = pb.DeliveryStatus_DELIVERY_STATUS_SENT
+	case DeliveryQueued:
+		status = pb.DeliveryStatus_DELIVERY_STATUS_QUEUED
+	case DeliveryRelayed:
+		status = pb.DeliveryStatus_DELIVERY_STATUS_RELAYED
+	case DeliveryFailed:
+		status = pb.DeliveryStatus_DELIVERY_STATUS_FAILED
+	}
+
+	return &pb.DeliveryResult{
+		ClientId:     r.ClientID,
+		DeviceId:     r.DeviceID,
+		ConnectionId: r.ConnectionID,
+		NodeId:       r.NodeID,
+		Status:       status,
+		Error:        r.Error,
+		ErrorCode:    r.ErrorCode,
+	}
+}
+
+// DeliveryReport sums up a publish to one client: its outcome and which devices took the
+// notification and which failed
+type DeliveryReport struct {
+	NotificationID string           `json:"id"`
+	Sequence       uint64           `json:"sequence"`
+	Status         DeliveryStatus   `json:"status"`
+	Succeeded      []DeliveryResult `json:"succeeded,omitempty"`
+	Failed         []DeliveryResult `json:"failed,omitempty"`
+	ErrorCode      string           `json:"error_code,omitempty"`
+	Error          string           `json:"error,omitempty"`
+	Err            error            `json:"-"` // nil if delivered, ErrNotificationQueued if kept in the inbox
+}
+
+// NewDeliveryReport builds the report of a publish from the results and error it returned
+func NewDeliveryReport(notification *models.NotificationData, results []DeliveryResult, err error) DeliveryReport {
+	report := DeliveryReport{
+		NotificationID: notification.ID,
+		Sequence:       notification.Sequence,
+		Status:         targetStatus(results, err),
+		ErrorCode:      ErrorCode(err),
+		Err:            err,
+	}
+	if report.ErrorCode != "" {
+		report.Error = err.Error()
+	}
+	for _, r := range results {
+		if r.Status == DeliveryFailed {
+			report.Failed = append(report.Failed, r)
+		} else {
+			report.Succeeded = append(report.Succeeded, r)
+		}
+	}
+	return report
+}
+
+// countStatus returns how many results have the given status
+func countStatus(results []DeliveryResult, status DeliveryStatus) int {
+	count := 0
+	for _, r := range results {
+		if r.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// fail marks the result failed with err
+func (r *DeliveryResult) fail(err error) {
+	r.Status = DeliveryFailed
+	r.Err = err
+	r.ErrorCode = ErrorCode(err)
+	r.Error = err.Error()
+}
+
+// deliverWithResult sends a notification to one local device and reports the outcome
+func (h *ConnectionHandler) deliverWithResult(conn *models.Connection, notification *models.NotificationData) DeliveryResult {
+	result := DeliveryResult{
+		ClientID:     conn.ClientID,
+		DeviceID:     conn.DeviceID,
+		ConnectionID: conn.UniqueID,
+		Status:       DeliverySent,
+	}
+
+	if !conn.CanReceive() {
+		result.fail(newDeliveryError(ErrNoActiveStream, conn.ClientID, conn.DeviceID, nil))
+		return result
+	}
+
+	if err := h.deliverToDevice(conn, notification); err != nil {
+		conn.Logger().Warn("Failed to send notification", logging.KeyNotificationID, notification.ID, "error", err)
+		result.fail(err)
+	}
+	return result
+}
+
+// PublishToClient delivers a notification to the devices of notification.ClientID picked by strategy.
+// Returns ErrNotificationQueued if no device could take it and it was kept in the client's inbox,
+// ErrInboxFull if the inbox refused it, ErrClientNotFound if the client is unknown (see isKnownClient)
+// and ErrShuttingDown once the server is shutting down.
+func (h *ConnectionHandler) PublishToClient(notification *models.NotificationData, strategy DeliveryStrategy) (results []DeliveryResult, err error) {
+	if notification.ClientID == "" {
+		return nil, invalidRequest("client_id is required")
+	}
+	if h.refusesPublish(notification) {
+		return shuttingDownResults(notification.ClientID, "")
+	}
+	// The device may be attached to another node, or not at all
+	if specific, ok := strategy.(*SpecificDeviceStrategy); ok {
+		return h.PublishToDevice(notification, notification.ClientID, specific.DeviceID)
+	}
+	defer func() { h.metrics.recordDeliveries(strategy.Name(), notification.ServiceName, results) }()
+
+	// The node that relayed it saw a device of the client here, it waits in the inbox if that one left
+	if !notification.Relayed && !h.isKnownClient(notification.ClientID) {
+		result := DeliveryResult{ClientID: notification.ClientID}
+		result.fail(newDeliveryError(ErrClientNotFound, notification.ClientID, "", nil))
+		return []DeliveryResult{result}, result.Err
+	}
+
+	h.recordNotification(notification)
+
+	var candidates []*models.Connection
+	if clientGroup, exists := h.store.GetClientGroup(notification.ClientID); exists {
+		for _, device := range clientGroup.GetAllDevices() {
+			if device.CanReceive() {
+				candidates = append(candidates, device)
+			} else if strategy.AllDevices() {
+				results = append(results, h.deliverWithResult(device, notification))
+			}
+		}
+	}
+
+	successCount := 0
+	for _, device := range strategy.Select(notification.ClientID, candidates) {
+		result := h.deliverWithResult(device, notification)
+		results = append(results, result)
+		if result.Status != DeliverySent {
+			continue
+		}
+
+		successCount++
+		if !strategy.AllDevices() {
+			device.Logger().Debug("Notification sent", logging.KeyNotificationID, notification.ID,
+				"strategy", strategy.Name(), "total_notifications", device.GetNotificationCount())
+			return results, nil
+		}
+	}
+
+	if strategy.AllDevices() {
+		slog.Debug("Notification sent to all devices",
+			logging.KeyClientID, notification.ClientID, logging.KeyNotificationID, notification.ID,
+			"sent", successCount, "failed", len(results)-successCount, "devices", len(results))
+
+		// Devices of this client attached to other nodes
+		results = append(results, h.relayToOwners(notification, strategy)...)
+		if successCount > 0 || countStatus(results, DeliveryRelayed) > 0 {
+			return results, nil
+		}
+		queued, err := h.queueForClient(notification)
+		return append(results, queued), err
+	}
+
+	// No local device took it, another node or the inbox will
+	relayed, err := h.relayOrQueue(notification, strategy)
+	return append(results, relayed...), err
+}
+
+// PublishToDevice delivers a notification to one specific device of a client, relaying it if the
+// device is attached to another node. Returns ErrShuttingDown once the server is shutting down.
+func (h *ConnectionHandler) PublishToDevice(notification *models.NotificationData, clientID string, deviceID string) (results []DeliveryResult, err error) {
+	if h.refusesPublish(notification) {
+		return shuttingDownResults(clientID, deviceID)
+	}
+	defer func() { h.metrics.recordDeliveries(StrategySpecificDevice, notification.ServiceName, results) }()
+
+	h.recordNotification(notification)
+
+	// Create unique ID for logging and notification
+	uniqueID := models.CreateUniqueID(clientID, deviceID)
+	result := DeliveryResult{
+		ClientID:     clientID,
+		DeviceID:     deviceID,
+		ConnectionID: uniqueID,
+	}
+
+	conn, exists := h.store.GetConnection(clientID, deviceID)
+	if !exists {
+		// The device may be attached to another node
+		if registry := h.clusterRegistry(); registry != nil && !notification.Relayed {
+			if nodeID, ok, _ := registry.GetDeviceOwner(uniqueID); ok && nodeID != registry.NodeID() {
+				result.NodeID = nodeID
+				err := registry.Publish(&cluster.Envelope{
+					Target:       nodeID,
+					Kind:         cluster.KindDevice,
+					ClientID:     clientID,
+					DeviceID:     deviceID,
+					Notification: notification,
+				})
+				if err != nil {
+					result.fail(newDeliveryError(ErrSendFailed, clientID, deviceID, err))
+					return []DeliveryResult{result}, result.Err
+				}
+				result.Status = DeliveryRelayed
+				return []DeliveryResult{result}, nil
+			}
+		}
+
+		if _, exists := h.store.GetClientGroup(clientID); exists {
+			result.fail(newDeliveryError(ErrDeviceNotFound, clientID, deviceID, nil))
+		} else {
+			result.fail(newDeliveryError(ErrClientNotFound, clientID, "", nil))
+		}
+		return []DeliveryResult{result}, result.Err
+	}
+
+	result = h.deliverWithResult(conn, notification)
+	if result.Status != DeliverySent {
+		return []DeliveryResult{result}, result.Err
+	}
+
+	conn.Logger().Debug("Notification sent", logging.KeyNotificationID, notification.ID,
+		"strategy", StrategySpecificDevice, "total_notifications", conn.GetNotificationCount())
+
+	return []DeliveryResult{result}, nil
+}
+
+// PublishBroadcast delivers a notification to every active device of every client, and asks the
+// other nodes to do the same for theirs. Once the server is shutting down its only result fails
+// with ErrShuttingDown.
+func (h *ConnectionHandler) PublishBroadcast(notification *models.NotificationData) []DeliveryResult {
+	if h.refusesPublish(notification) {
+		results, _ := shuttingDownResults("", "")
+		return results
+	}
+
+	var results []DeliveryResult
+
+	// Let the other nodes broadcast to their own devices
+	if registry := h.clusterRegistry(); registry != nil && !notification.Relayed {
+		result := DeliveryResult{Status: DeliveryRelayed}
+		if err := registry.Publish(&cluster.Envelope{Kind: cluster.KindBroadcast, Notification: notification}); err != nil {
+			slog.Error("Failed to relay broadcast to cluster", logging.KeyNotificationID, notification.ID, "error", err)
+			result.fail(newDeliveryError(ErrSendFailed, "", "", err))
+		}
+		results = append(results, result)
+	}
+
+	clientIDs := h.store.GetAllClientIDs()
+	totalDevices := 0
+	successCount := 0
+
+	for _, clientID := range clientIDs {
+		clientGroup, exists := h.store.GetClientGroup(clientID)
+		if !exists {
+			continue
+		}
+
+		devices := clientGroup.GetAllDevices()
+		totalDevices += len(devices)
+
+		// Each client gets its own copy so it can be sequenced in that client's stream
+		notif := *notification
+		notif.ClientID = clientID
+		notif.Sequence = 0
+		h.recordNotification(&notif)
+
+		for _, device := range devices {
+			// Offline devices are skipped, broadcasts are not kept in the inbox
+			if !device.CanReceive() {
+				continue
+			}
+			result := h.deliverWithResult(device, &notif)
+			if result.Status == DeliverySent {
+				successCount++
+			} else {
+				device.Logger().Debug("Broadcast not delivered", "error", result.Error)
+			}
+			results = append(results, result)
+		}
+	}
+
+	slog.Info("Broadcast complete", logging.KeyNotificationID, notification.ID,
+		"sent", successCount, "devices", totalDevices, "clients", len(clientIDs))
+	h.metrics.recordDeliveries(metricsStrategyBroadcast, notification.ServiceName, results)
+
+	return results
+}
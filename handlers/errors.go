@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"grpcon/models"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Kinds of delivery failure. Check them with errors.Is, the errors returned wrap them in a
+// *DeliveryError naming the client or device.
+var (
+	// ErrInvalidRequest means the request can't be delivered as given, e.g. a missing target
+	ErrInvalidRequest = errors.New("invalid request")
+	// ErrClientNotFound means the client has no registered device and was not seen recently
+	ErrClientNotFound = errors.New("client not found")
+	// ErrDeviceNotFound means the client has no device with that ID
+	ErrDeviceNotFound = errors.New("device not found")
+	// ErrNoActiveStream means the device is registered but has no stream to send on
+	ErrNoActiveStream = errors.New("no active stream")
+	// ErrQueueFull means the device's send queue rejected the notification
+	ErrQueueFull = models.ErrQueueFull
+	// ErrInboxFull means no device could take the notification and the inbox refused to keep it
+	ErrInboxFull = models.ErrInboxFull
+	// ErrSendFailed means the notification could not be handed to the device or the node it is attached to
+	ErrSendFailed = errors.New("send failed")
+	// ErrShuttingDown means the server is shutting down and takes no new registrations, streams or notifications
+	ErrShuttingDown = errors.New("server is shutting down")
+)
+
+// Error codes reported in results, see ErrorCode
+const (
+	ErrorCodeInvalidRequest = "invalid_request"
+	ErrorCodeClientNotFound = "client_not_found"
+	ErrorCodeDeviceNotFound = "device_not_found"
+	ErrorCodeNoActiveStream = "no_active_stream"
+	ErrorCodeQueueFull      = "queue_full"
+	ErrorCodeInboxFull      = "inbox_full"
+	ErrorCodeSendFailed     = "send_failed"
+	ErrorCodeShuttingDown   = "shutting_down"
+	ErrorCodeDeliveryFailed = "delivery_failed" // any other failure
+)
+
+// DeliveryError is a failure to reach a client or one of its devices
+type DeliveryError struct {
+	Kind     error // one of the Err* kinds above
+	ClientID string
+	DeviceID string // empty if the error concerns the whole client
+	Err      error  // underlying cause, may be nil
+}
+
+func (e *DeliveryError) Error() string {
+	msg := e.Kind.Error()
+	switch {
+	case e.DeviceID != "" && e.ClientID == "":
+		msg = fmt.Sprintf("%s: device %s", msg, e.DeviceID)
+	case e.DeviceID != "":
+		msg = fmt.Sprintf("%s: device %s of client %s", msg, e.DeviceID, e.ClientID)
+	case e.ClientID != "":
+		msg = fmt.Sprintf("%s: client %s", msg, e.ClientID)
+	}
+	if e.Err != nil && e.Err != e.Kind {
+		msg = fmt.Sprintf("%s: %v", msg, e.Err)
+	}
+	return msg
+}
+
+// Unwrap lets errors.Is match both the kind and the cause, e.g. models.ErrQueueClosed
+func (e *DeliveryError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// GRPCStatus makes gRPC handlers returning a DeliveryError answer with the matching status code
+func (e *DeliveryError) GRPCStatus() *status.Status {
+	return status.New(GRPCCode(e), e.Error())
+}
+
+// newDeliveryError creates a DeliveryError for a device, or a client if deviceID is empty
+func newDeliveryError(kind error, clientID, deviceID string, cause error) *DeliveryError {
+	return &DeliveryError{Kind: kind, ClientID: clientID, DeviceID: deviceID, Err: cause}
+}
+
+// invalidRequest creates an ErrInvalidRequest error with a message saying what is wrong
+func invalidRequest(format string, args ...interface{}) error {
+	return newDeliveryError(ErrInvalidRequest, "", "", fmt.Errorf(format, args...))
+}
+
+// ErrorCode returns the code reported for an error, empty for nil and ErrNotificationQueued
+func ErrorCode(err error) string {
+	switch {
+	case err == nil, errors.Is(err, ErrNotificationQueued):
+		return ""
+	case errors.Is(err, ErrInvalidRequest):
+		return ErrorCodeInvalidRequest
+	case errors.Is(err, ErrClientNotFound):
+		return ErrorCodeClientNotFound
+	case errors.Is(err, ErrDeviceNotFound):
+		return ErrorCodeDeviceNotFound
+	case errors.Is(err, ErrNoActiveStream):
+		return ErrorCodeNoActiveStream
+	case errors.Is(err, ErrQueueFull):
+		return ErrorCodeQueueFull
+	case errors.Is(err, ErrInboxFull):
+		return ErrorCodeInboxFull
+	case errors.Is(err, ErrSendFailed):
+		return ErrorCodeSendFailed
+	case errors.Is(err, ErrShuttingDown):
+		return ErrorCodeShuttingDown
+	}
+	return ErrorCodeDeliveryFailed
+}
+
+// HTTPStatus returns the HTTP status code for the outcome of a delivery
+func HTTPStatus(err error) int {
+	switch ErrorCode(err) {
+	case "":
+		if errors.Is(err, ErrNotificationQueued) {
+			return http.StatusAccepted
+		}
+		return http.StatusOK
+	case ErrorCodeInvalidRequest:
+		return http.StatusBadRequest
+	case ErrorCodeClientNotFound, ErrorCodeDeviceNotFound:
+		return http.StatusNotFound
+	case ErrorCodeNoActiveStream:
+		return http.StatusConflict
+	case ErrorCodeQueueFull, ErrorCodeInboxFull, ErrorCodeShuttingDown:
+		return http.StatusServiceUnavailable
+	case ErrorCodeSendFailed:
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// GRPCCode returns the gRPC status code for the outcome of a delivery
+func GRPCCode(err error) codes.Code {
+	switch ErrorCode(err) {
+	case "":
+		return codes.OK
+	case ErrorCodeInvalidRequest:
+		return codes.InvalidArgument
+	case ErrorCodeClientNotFound, ErrorCodeDeviceNotFound:
+		return codes.NotFound
+	case ErrorCodeNoActiveStream:
+		return codes.FailedPrecondition
+	case ErrorCodeQueueFull, ErrorCodeInboxFull:
+		return codes.ResourceExhausted
+	case ErrorCodeSendFailed, ErrorCodeShuttingDown:
+		return codes.Unavailable
+	}
+	return codes.Internal
+}
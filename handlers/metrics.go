@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"grpcon/models"
+	pb "grpcon/proto"
+	"grpcon/tracing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Strategy labels of publishes that don't go through a DeliveryStrategy
+const (
+	metricsStrategyBroadcast = "broadcast"
+	metricsStrategyTopic     = "topic"
+)
+
+// metricsServiceOther is the service label of publishing services not in the allow-list
+const metricsServiceOther = "other"
+
+// DefaultMetricsServices are the publishing services given their own service label by default
+var DefaultMetricsServices = []string{"http_gateway", "grpc_publish"}
+
+// Metrics are the connection handler's Prometheus instruments
+type Metrics struct {
+	// Registry holds the instruments below and the Go runtime and process collectors, every
+	// handler has its own
+	Registry *prometheus.Registry
+
+	servicesMu sync.RWMutex
+	services   map[string]bool // service labels kept as they are, others are counted as other
+
+	notificationsSent   *prometheus.CounterVec // labels: strategy, service
+	notificationsFailed *prometheus.CounterVec // labels: strategy, service
+	heartbeatFailures   prometheus.Counter     // heartbeats a send queue rejected
+	staleEvictions      prometheus.Counter     // devices removed by the health check monitor
+	sendLatency         prometheus.Histogram   // Stream.Send duration in seconds
+	queueMaxDepth       prometheus.Histogram   // deepest a send queue got, observed when it closes
+}
+
+// sendLatencyBuckets are histogram bucket upper bounds in seconds, from 100µs to 5s
+var sendLatencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// queueDepthBuckets are histogram bucket upper bounds in queued messages, up to the default capacity
+var queueDepthBuckets = []float64{1, 4, 16, 64, 128, 256}
+
+// newMetrics registers the instruments, gauges are read from the store and the inbox on every scrape
+func newMetrics(store models.ConnectionStore, inbox *models.NotificationInbox) *Metrics {
+	registry := prometheus.NewRegistry()
+	factory := promauto.With(registry)
+	m := &Metrics{
+		Registry: registry,
+		services: serviceSet(DefaultMetricsServices),
+		notificationsSent: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpcon_notifications_sent_total",
+			Help: "Notifications handed to a device's send queue, per delivery strategy and publishing service.",
+		}, []string{"strategy", "service"}),
+		notificationsFailed: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpcon_notifications_failed_total",
+			Help: "Notifications a device or node could not take, per delivery strategy and publishing service.",
+		}, []string{"strategy", "service"}),
+		heartbeatFailures: factory.NewCounter(prometheus.CounterOpts{
+			Name: "grpcon_heartbeat_failures_total",
+			Help: "Heartbeats that found the send queue full or the previous heartbeat still unsent.",
+		}),
+		staleEvictions: factory.NewCounter(prometheus.CounterOpts{
+			Name: "grpcon_stale_connection_evictions_total",
+			Help: "Devices unregistered because they stopped answering heartbeats.",
+		}),
+		sendLatency: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "grpcon_stream_send_duration_seconds",
+			Help:    "Time taken by Stream.Send to write one message to a device.",
+			Buckets: sendLatencyBuckets,
+		}),
+		queueMaxDepth: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "grpcon_send_queue_max_depth",
+			Help:    "Most messages a device's send queue held at once, observed when its stream ends.",
+			Buckets: queueDepthBuckets,
+		}),
+	}
+
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	gauge := func(name, help string, fn func() float64) {
+		factory.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, fn)
+	}
+	gauge("grpcon_connected_clients", "Clients with at least one registered device.", func() float64 {
+		return float64(store.GetClientCount())
+	})
+	gauge("grpcon_connected_devices", "Registered devices.", func() float64 {
+		return float64(store.GetTotalDeviceCount())
+	})
+	gauge("grpcon_active_streams", "Devices with an attached stream.", func() float64 {
+		active := 0
+		for _, conn := range store.GetAllConnections() {
+			if conn.IsActive() {
+				active++
+			}
+		}
+		return float64(active)
+	})
+	gauge("grpcon_send_queue_depth", "Messages waiting in the send queues of all streams.", func() float64 {
+		depth := 0
+		for _, conn := range store.GetAllConnections() {
+			if queue := conn.GetQueue(); queue != nil {
+				depth += queue.Depth()
+			}
+		}
+		return float64(depth)
+	})
+	gauge("grpcon_inbox_pending", "Notifications waiting in the inbox for a device of their client.", func() float64 {
+		return float64(inbox.GetTotalPending())
+	})
+	factory.NewCounterFunc(prometheus.CounterOpts{
+		Name: "grpcon_inbox_dropped_total",
+		Help: "Notifications the inbox discarded or refused because a limit was reached.",
+	}, func() float64 {
+		return float64(inbox.GetDropped())
+	})
+	return m
+}
+
+// Handler serves the metrics of the registry to a Prometheus scrape
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{Registry: m.Registry})
+}
+
+// serviceSet builds the allow-list of service labels
+func serviceSet(services []string) map[string]bool {
+	set := make(map[string]bool, len(services))
+	for _, service := range services {
+		set[service] = true
+	}
+	return set
+}
+
+// serviceLabel returns service if it is in the allow-list, other if not, so clients can't
+// create a time series per service_name they make up
+func (m *Metrics) serviceLabel(service string) string {
+	m.servicesMu.RLock()
+	defer m.servicesMu.RUnlock()
+	if m.services[service] {
+		return service
+	}
+	return metricsServiceOther
+}
+
+// SetMetricsServices sets the publishing services counted under their own service label, the
+// others are counted as other
+func (h *ConnectionHandler) SetMetricsServices(services []string) {
+	set := serviceSet(services)
+	h.metrics.servicesMu.Lock()
+	defer h.metrics.servicesMu.Unlock()
+	h.metrics.services = set
+}
+
+// recordDeliveries counts the sent and failed device results of a publish
+func (m *Metrics) recordDeliveries(strategy, service string, results []DeliveryResult) {
+	service = m.serviceLabel(service)
+	for _, r := range results {
+		switch r.Status {
+		case DeliverySent:
+			m.notificationsSent.WithLabelValues(strategy, service).Inc()
+		case DeliveryFailed:
+			m.notificationsFailed.WithLabelValues(strategy, service).Inc()
+		}
+	}
+}
+
+// timedStream measures how long every Send on a device stream takes
+type timedStream struct {
+	models.NotificationStream
+	latency prometheus.Observer
+}
+
+// Send is traced as part of the notification's delivery, heartbeats are not traced
+func (s timedStream) Send(msg *pb.Notification) error {
+	start := time.Now()
+	if msg.Traceparent == "" {
+		err := s.NotificationStream.Send(msg)
+		s.latency.Observe(time.Since(start).Seconds())
+		return err
+	}
+
+	_, span := tracing.StartFromTraceparent(msg.Traceparent, "Stream.Send", trace.WithAttributes(
+		attribute.String("connection_id", msg.ConnectionId),
+		attribute.String("notification_id", msg.Id),
+	))
+	err := s.NotificationStream.Send(msg)
+	s.latency.Observe(time.Since(start).Seconds())
+	tracing.End(span, err)
+	return err
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsServiceLabelAllowList(t *testing.T) {
+	h := NewConnectionHandler()
+	attachDevice(t, h, "alice", "phone")
+	strategy, _ := h.GetStrategy(StrategyAllDevices, "")
+
+	publish := func(service string) {
+		n := newTestNotification("alice")
+		n.ServiceName = service
+		if _, err := h.PublishToClient(n, strategy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sent := func(service string) float64 {
+		return testutil.ToFloat64(h.metrics.notificationsSent.WithLabelValues(StrategyAllDevices, service))
+	}
+
+	publish("http_gateway")
+	publish("made_up_by_a_client")
+	if sent("http_gateway") != 1 || sent(metricsServiceOther) != 1 || sent("made_up_by_a_client") != 0 {
+		t.Fatalf("sent: http_gateway %v, other %v, made_up_by_a_client %v, want 1, 1, 0",
+			sent("http_gateway"), sent(metricsServiceOther), sent("made_up_by_a_client"))
+	}
+
+	h.SetMetricsServices([]string{"billing"})
+	publish("billing")
+	publish("http_gateway")
+	if sent("billing") != 1 || sent(metricsServiceOther) != 2 {
+		t.Fatalf("sent after SetMetricsServices: billing %v, other %v, want 1, 2", sent("billing"), sent(metricsServiceOther))
+	}
+}
+
+func TestMetricsHandlerServesInstrumentsAndRuntime(t *testing.T) {
+	h := NewConnectionHandler()
+	attachDevice(t, h, "alice", "phone")
+	strategy, _ := h.GetStrategy(StrategyAllDevices, "")
+	if _, err := h.PublishToClient(newTestNotification("alice"), strategy); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	h.metrics.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("scrape status = %d", recorder.Code)
+	}
+	body, _ := io.ReadAll(recorder.Body)
+
+	for _, want := range []string{
+		`grpcon_notifications_sent_total{service="other",strategy="all_devices"} 1`,
+		"grpcon_connected_devices 1",
+		"grpcon_active_streams 1",
+		"grpcon_inbox_dropped_total 0",
+		"# TYPE grpcon_stream_send_duration_seconds histogram",
+		"go_goroutines ",
+		"process_start_time_seconds ",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("scrape has no %q", want)
+		}
+	}
+
+	// Every handler has its own registry, a second one registers without conflicts
+	if other := NewConnectionHandler(); other.metrics.Registry == h.metrics.Registry {
+		t.Fatal("handlers share a registry")
+	}
+}
@@ -2,12 +2,18 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"time"
 
+	"grpcon/logging"
 	"grpcon/models"
 	pb "grpcon/proto"
+	"grpcon/tracing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // NotificationServer implements the NotificationService gRPC server
@@ -18,35 +24,54 @@ type NotificationServer struct {
 
 // NewNotificationServer creates a new notification server instance
 func NewNotificationServer() *NotificationServer {
+	return NewNotificationServerWithHandler(NewConnectionHandler())
+}
+
+// NewNotificationServerWithHandler creates a notification server around an existing connection handler,
+// e.g. one built with NewConnectionHandlerWithStore
+func NewNotificationServerWithHandler(connHandler *ConnectionHandler) *NotificationServer {
 	return &NotificationServer{
-		connHandler: NewConnectionHandler(),
+		connHandler: connHandler,
 	}
 }
 
+// DefaultDeviceID is used when a registration does not name the device
+const DefaultDeviceID = "default_device"
+
+// deviceFromRequest returns the client and device a ConnectionRequest refers to. Old clients put the
+// client ID in connection_id and the device ID in service_name, new ones set client_id and device_id.
+func deviceFromRequest(req *pb.ConnectionRequest) (clientID, deviceID, serviceName string, err error) {
+	if req.ClientId != "" {
+		clientID, deviceID, serviceName = req.ClientId, req.DeviceId, req.ServiceName
+	} else {
+		if req.ConnectionId == "" {
+			return "", "", "", invalidRequest("client_id is required (or connection_id for older clients)")
+		}
+		// Legacy format: service_name doubles as the device ID
+		clientID, deviceID, serviceName = req.ConnectionId, req.ServiceName, req.ServiceName
+	}
+
+	if deviceID == "" {
+		deviceID = DefaultDeviceID
+	}
+	return clientID, deviceID, serviceName, nil
+}
+
 // AddConnection handles adding a new device connection
 func (s *NotificationServer) AddConnection(ctx context.Context, req *pb.ConnectionRequest) (*pb.ConnectionResponse, error) {
-	// Extract client_id and device_id from connection_id (format: client_id_device_id)
-	// Or pass them separately - for now we'll parse the connection_id
-
-	if req.ConnectionId == "" {
+	clientID, deviceID, serviceName, err := deviceFromRequest(req)
+	if err != nil {
 		return &pb.ConnectionResponse{
 			Success: false,
-			Message: "connection_id is required (format: client_id_device_id)",
+			Message: err.Error(),
 		}, nil
 	}
 
-	// For simplicity, we'll use connection_id as client_id and service_name as device_id
-	// In a real implementation, you'd parse these properly
-	// Format expected: connection_id contains both client and device info
-
-	clientID := req.ConnectionId
-	deviceID := req.ServiceName // Using service_name field as device_id for now
-
-	if deviceID == "" {
-		deviceID = "default_device"
-	}
-
-	conn, err := s.connHandler.RegisterDevice(clientID, deviceID, req.ServiceName)
+	conn, err := s.connHandler.RegisterDeviceWithMetadata(clientID, deviceID, models.DeviceMetadata{
+		ServiceName: serviceName,
+		Platform:    req.Platform,
+		AppVersion:  req.AppVersion,
+	})
 	if err != nil {
 		return &pb.ConnectionResponse{
 			Success: false,
@@ -63,32 +88,32 @@ func (s *NotificationServer) AddConnection(ctx context.Context, req *pb.Connecti
 
 // RemoveConnection handles removing a device connection
 func (s *NotificationServer) RemoveConnection(ctx context.Context, req *pb.ConnectionRequest) (*pb.ConnectionResponse, error) {
-	if req.ConnectionId == "" {
+	clientID, deviceID, _, err := deviceFromRequest(req)
+	if err != nil {
 		return &pb.ConnectionResponse{
 			Success: false,
-			Message: "connection_id is required",
+			Message: err.Error(),
 		}, nil
 	}
 
-	clientID := req.ConnectionId
-	deviceID := req.ServiceName
-	if deviceID == "" {
-		deviceID = "default_device"
+	// Older clients get their connection_id echoed back as before
+	uniqueID := req.ConnectionId
+	if req.ClientId != "" {
+		uniqueID = models.CreateUniqueID(clientID, deviceID)
 	}
 
-	err := s.connHandler.UnregisterDevice(clientID, deviceID)
-	if err != nil {
+	if err := s.connHandler.UnregisterDevice(clientID, deviceID); err != nil {
 		return &pb.ConnectionResponse{
 			Success:      false,
 			Message:      err.Error(),
-			ConnectionId: req.ConnectionId,
+			ConnectionId: uniqueID,
 		}, nil
 	}
 
 	return &pb.ConnectionResponse{
 		Success:      true,
 		Message:      "device unregistered successfully",
-		ConnectionId: req.ConnectionId,
+		ConnectionId: uniqueID,
 	}, nil
 }
 
@@ -97,54 +122,337 @@ func (s *NotificationServer) StreamNotifications(req *pb.SubscribeRequest, strea
 	connectionID := req.ConnectionId
 
 	if connectionID == "" {
-		return fmt.Errorf("connection_id is required")
+		return invalidRequest("connection_id is required")
 	}
 
-	// Look up connection by unique ID (format: client_id_device_id)
+	// Look up connection by unique ID (format: client_id_device_id, see models.CreateUniqueID)
 	conn, err := s.connHandler.GetDeviceByUniqueID(connectionID)
 	if err != nil {
-		return fmt.Errorf("connection not found: %s", connectionID)
+		return err
 	}
 
-	// Attach stream to the connection
-	if err := s.connHandler.AttachStream(conn.ClientID, conn.DeviceID, stream); err != nil {
+	if err := s.connHandler.SubscribeTopics(conn, req.Topics); err != nil {
 		return err
 	}
 
-	// Initialize heartbeat timestamp
-	conn.LastHeartbeatAt = time.Now()
-	conn.HeartbeatFailCount = 0
+	// Attach stream to the connection, this also resets its heartbeat state
+	if err := s.connHandler.AttachStream(conn.ClientID, conn.DeviceID, stream, req.Epoch, req.LastSequence, false); err != nil {
+		return err
+	}
+	queue := conn.GetQueue()
+	if queue == nil {
+		return newDeliveryError(ErrNoActiveStream, conn.ClientID, conn.DeviceID, nil)
+	}
 
-	// Create heartbeat stop channel and store it in connection
-	conn.HeartbeatStopChan = make(chan bool, 1)
+	conn.Logger().Info("Started streaming notifications")
 
-	log.Printf("Client %s (Device: %s) started streaming notifications", conn.ClientID, conn.DeviceID)
+	// Start heartbeat goroutine, it stops when this stream is detached or replaced
+	go s.sendHeartbeats(conn, queue, conn.HeartbeatStop())
 
-	// Start heartbeat goroutine
-	go s.sendHeartbeats(conn, stream, conn.HeartbeatStopChan)
+	// Keep the stream alive until the client leaves or its send queue stops (send failure,
+	// overflow, unregistration or a newer stream for the same device)
+	select {
+	case <-stream.Context().Done():
+	case <-queue.Done():
+	}
+
+	// Detach stream when client disconnects
+	s.connHandler.DetachStream(conn.ClientID, conn.DeviceID, stream)
 
-	// Keep the stream alive
-	<-stream.Context().Done()
+	conn.Logger().Info("Disconnected from stream", "uptime", conn.GetUptime())
+
+	// Tell the device why we hung up if its send queue gave up
+	if err := queue.Err(); err != nil {
+		return queueError(conn, err)
+	}
+	return nil
+}
+
+// Connect handles the bidirectional stream where devices receive notifications and
+// send acks, heartbeat pongs and subscription changes back
+func (s *NotificationServer) Connect(stream pb.NotificationService_ConnectServer) error {
+	// The first message must tell us which connection this stream belongs to
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	sub := first.GetSubscribe()
+	if sub == nil || sub.ConnectionId == "" {
+		return invalidRequest("first message must be a subscribe with connection_id")
+	}
 
-	// Stop heartbeat goroutine
-	if conn.HeartbeatStopChan != nil {
+	conn, err := s.connHandler.GetDeviceByUniqueID(sub.ConnectionId)
+	if err != nil {
+		return err
+	}
+
+	if err := s.connHandler.SubscribeTopics(conn, sub.Topics); err != nil {
+		return err
+	}
+
+	// Acks are enabled while attaching so replayed and flushed notifications are tracked too
+	if err := s.connHandler.AttachStream(conn.ClientID, conn.DeviceID, stream, sub.Epoch, sub.LastSequence, true); err != nil {
+		return err
+	}
+	queue := conn.GetQueue()
+	if queue == nil {
+		return newDeliveryError(ErrNoActiveStream, conn.ClientID, conn.DeviceID, nil)
+	}
+
+	conn.Logger().Info("Connected with acknowledgements")
+
+	go s.sendHeartbeats(conn, queue, conn.HeartbeatStop())
+
+	redeliverDone := make(chan struct{})
+	go s.redeliverUnacked(conn, redeliverDone)
+
+	// Device messages are read on their own goroutine so a stopped send queue can end the stream too
+	messages := make(chan *pb.ClientMessage)
+	recvDone := make(chan struct{})
+	go func() {
+		defer close(recvDone)
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				if err != io.EOF && stream.Context().Err() == nil {
+					conn.Logger().Warn("Receive failed on stream", "error", err)
+				}
+				return
+			}
+			select {
+			case messages <- msg:
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
+
+	// Handle device messages until the stream ends
+loop:
+	for {
 		select {
-		case conn.HeartbeatStopChan <- true:
-			log.Printf("Signaled heartbeat stop for %s", conn.UniqueID)
-		default:
-			// Channel might already be stopped
+		case msg := <-messages:
+			s.handleClientMessage(conn, msg)
+		case <-recvDone:
+			break loop
+		case <-stream.Context().Done():
+			break loop
+		case <-queue.Done():
+			break loop
 		}
 	}
 
-	// Detach stream when client disconnects
-	s.connHandler.DetachStream(conn.ClientID, conn.DeviceID)
+	close(redeliverDone)
+
+	// Detach stream, unacked notifications go back to the client's inbox
+	s.connHandler.DetachStream(conn.ClientID, conn.DeviceID, stream)
 
-	log.Printf("Client %s (Device: %s) disconnected from stream (Uptime: %v)",
-		conn.ClientID, conn.DeviceID, conn.GetUptime())
+	conn.Logger().Info("Disconnected from stream", "uptime", conn.GetUptime(),
+		"delivered", conn.GetNotificationCount(), "acked", conn.GetAckedCount())
 
+	// Tell the device why we hung up if its send queue gave up
+	if err := queue.Err(); err != nil {
+		return queueError(conn, err)
+	}
 	return nil
 }
 
+// handleClientMessage applies an ack, pong or subscription change received on a Connect stream
+func (s *NotificationServer) handleClientMessage(conn *models.Connection, msg *pb.ClientMessage) {
+	switch payload := msg.Payload.(type) {
+	case *pb.ClientMessage_Ack:
+		s.connHandler.AcknowledgeNotification(conn, payload.Ack.NotificationId, payload.Ack.Sequence)
+
+	case *pb.ClientMessage_Pong:
+		conn.RecordPong()
+
+	case *pb.ClientMessage_Subscription:
+		paused := payload.Subscription.Paused
+		conn.SetPaused(paused)
+		conn.Logger().Info("Subscription changed", "paused", paused)
+		if !paused {
+			// Pick up anything that was queued while paused
+			s.connHandler.flushPendingNotifications(conn, "", 0)
+		}
+
+	case *pb.ClientMessage_Topics:
+		if err := s.connHandler.SubscribeTopics(conn, payload.Topics.Subscribe); err != nil {
+			conn.Logger().Warn("Rejected topic subscription", "error", err)
+		}
+		s.connHandler.UnsubscribeTopics(conn, payload.Topics.Unsubscribe)
+
+	case *pb.ClientMessage_Subscribe:
+		conn.Logger().Debug("Ignoring repeated subscribe")
+	}
+}
+
+// Publish delivers a notification from a backend service to its target. It is refused with
+// Unavailable once the server is shutting down, like PublishBatch.
+func (s *NotificationServer) Publish(ctx context.Context, req *pb.PublishRequest) (*pb.PublishResponse, error) {
+	if s.connHandler.IsShuttingDown() {
+		return nil, status.Error(codes.Unavailable, ErrShuttingDown.Error())
+	}
+	item, err := s.publishItem(ctx, req)
+	if err != nil {
+		return publishResponse(InvalidBatchResult(0, err)), nil
+	}
+	return publishResponse(s.connHandler.publishBatchItem(0, item)), nil
+}
+
+// PublishBatch publishes every notification of the batch, one response per request in the same order.
+// A failed request doesn't stop the others. The whole batch is refused with Unavailable once the
+// server is shutting down, so the caller can send it to another node.
+func (s *NotificationServer) PublishBatch(ctx context.Context, req *pb.PublishBatchRequest) (*pb.PublishBatchResponse, error) {
+	if s.connHandler.IsShuttingDown() {
+		return nil, status.Error(codes.Unavailable, ErrShuttingDown.Error())
+	}
+	if maxSize := s.connHandler.MaxBatchSize(); len(req.Requests) > maxSize {
+		return nil, status.Errorf(codes.InvalidArgument, "batch has %d requests, at most %d are allowed", len(req.Requests), maxSize)
+	}
+
+	// Invalid requests are answered right away, the others delivered together
+	results := make([]BatchResult, len(req.Requests))
+	var items []BatchItem
+	var indexes []int
+	for i, r := range req.Requests {
+		item, err := s.publishItem(ctx, r)
+		if err != nil {
+			results[i] = InvalidBatchResult(i, err)
+			continue
+		}
+		items = append(items, item)
+		indexes = append(indexes, i)
+	}
+	for j, result := range s.connHandler.PublishBatch(items) {
+		result.Index = indexes[j]
+		results[indexes[j]] = result
+	}
+
+	resp := &pb.PublishBatchResponse{Responses: make([]*pb.PublishResponse, 0, len(results))}
+	for _, result := range results {
+		r := publishResponse(result)
+		if r.Success {
+			resp.Succeeded++
+		} else {
+			resp.Failed++
+		}
+		resp.Responses = append(resp.Responses, r)
+	}
+	return resp, nil
+}
+
+// publishItem turns a publish request into the batch item the connection handler delivers
+// The deliveries are traced as part of the call's trace unless the notification carries its own traceparent.
+func (s *NotificationServer) publishItem(ctx context.Context, req *pb.PublishRequest) (BatchItem, error) {
+	if req.Notification == nil {
+		return BatchItem{}, invalidRequest("notification is required")
+	}
+
+	// ID and sequence are assigned by the connection handler
+	item := BatchItem{Notification: models.NotificationFromProto(req.Notification)}
+	if item.Notification.ServiceName == "" {
+		item.Notification.ServiceName = "grpc_publish"
+	}
+	if item.Notification.Timestamp == 0 {
+		item.Notification.Timestamp = time.Now().Unix()
+	}
+	if item.Notification.Traceparent == "" {
+		item.Notification.Traceparent = tracing.TraceparentFromContext(ctx)
+	}
+
+	switch target := req.GetTarget().GetTarget().(type) {
+	case *pb.Target_ClientId:
+		if target.ClientId == "" {
+			return BatchItem{}, invalidRequest("target client_id is required")
+		}
+		strategy, err := s.connHandler.GetStrategy(StrategyNameFromProto(req.Strategy), req.DeviceId)
+		if err != nil {
+			return BatchItem{}, err
+		}
+		item.ClientID = target.ClientId
+		item.Strategy = strategy
+
+	case *pb.Target_Device:
+		if target.Device.GetClientId() == "" || target.Device.GetDeviceId() == "" {
+			return BatchItem{}, invalidRequest("target client_id and device_id are required")
+		}
+		item.ClientID = target.Device.ClientId
+		item.DeviceID = target.Device.DeviceId
+
+	case *pb.Target_Broadcast:
+		if !target.Broadcast {
+			return BatchItem{}, invalidRequest("broadcast target must be true")
+		}
+		item.Broadcast = true
+
+	case *pb.Target_Topic:
+		if target.Topic == "" {
+			return BatchItem{}, invalidRequest("target topic is required")
+		}
+		item.Topic = target.Topic
+
+	default:
+		return BatchItem{}, invalidRequest("target is required")
+	}
+	return item, nil
+}
+
+// publishResponse converts the outcome of a publish to its protobuf response
+func publishResponse(result BatchResult) *pb.PublishResponse {
+	resp := &pb.PublishResponse{
+		Success:        result.ErrorCode == "",
+		Message:        "notification sent",
+		NotificationId: result.NotificationID,
+		Sequence:       result.Sequence,
+		Results:        make([]*pb.DeliveryResult, 0, len(result.Deliveries)),
+		ErrorCode:      result.ErrorCode,
+	}
+	for _, r := range result.Deliveries {
+		resp.Results = append(resp.Results, r.ToProto())
+	}
+
+	if result.Status == DeliveryQueued {
+		resp.Message = "no active devices, notification queued for delivery"
+	} else if !resp.Success {
+		resp.Message = result.Error
+	}
+	return resp
+}
+
+// UpdateTopics subscribes a registered device to topics or unsubscribes it
+func (s *NotificationServer) UpdateTopics(ctx context.Context, req *pb.TopicsRequest) (*pb.TopicsResponse, error) {
+	if req.ConnectionId == "" {
+		return &pb.TopicsResponse{
+			Success: false,
+			Message: "connection_id is required",
+		}, nil
+	}
+
+	conn, err := s.connHandler.GetDeviceByUniqueID(req.ConnectionId)
+	if err != nil {
+		return &pb.TopicsResponse{
+			Success: false,
+			Message: err.Error(),
+		}, nil
+	}
+
+	if err := s.connHandler.SubscribeTopics(conn, req.Subscribe); err != nil {
+		return &pb.TopicsResponse{
+			Success: false,
+			Message: err.Error(),
+			Topics:  s.connHandler.GetDeviceTopics(conn),
+		}, nil
+	}
+	s.connHandler.UnsubscribeTopics(conn, req.Unsubscribe)
+
+	return &pb.TopicsResponse{
+		Success: true,
+		Message: "topics updated",
+		Topics:  s.connHandler.GetDeviceTopics(conn),
+	}, nil
+}
+
 // SendNotificationToClient sends notification to all devices of a specific client
 func (s *NotificationServer) SendNotificationToClient(notification *models.NotificationData) error {
 	return s.connHandler.SendNotificationToClient(notification)
@@ -165,53 +473,124 @@ func (s *NotificationServer) GetConnectionStats() map[string]interface{} {
 	return s.connHandler.GetConnectionStats()
 }
 
-// sendHeartbeats sends periodic heartbeat messages to the client
-func (s *NotificationServer) sendHeartbeats(conn *models.Connection, stream pb.NotificationService_StreamNotificationsServer, done chan bool) {
-	ticker := time.NewTicker(30 * time.Second)
+// GetMetrics returns the Prometheus instruments of the server
+func (s *NotificationServer) GetMetrics() *Metrics {
+	return s.connHandler.Metrics()
+}
+
+// redeliverUnacked periodically resends notifications the device has not acknowledged
+func (s *NotificationServer) redeliverUnacked(conn *models.Connection, done chan struct{}) {
+	timeout, _ := s.connHandler.ackOptions()
+	ticker := time.NewTicker(timeout / 3)
 	defer ticker.Stop()
 
+	for {
+		select {
+		case <-ticker.C:
+			s.connHandler.RedeliverUnacked(conn)
+			if next, _ := s.connHandler.ackOptions(); next != timeout {
+				timeout = next
+				ticker.Reset(timeout / 3)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// newControlMessage creates a message of the given type for the device, e.g. a heartbeat
+func newControlMessage(conn *models.Connection, messageType string) *pb.Notification {
+	now := time.Now()
+	return &pb.Notification{
+		Id:           fmt.Sprintf("%s_%d", messageType, now.Unix()),
+		ConnectionId: conn.UniqueID,
+		CreatedAt:    now.Format(time.RFC3339),
+		UpdatedAt:    now.Format(time.RFC3339),
+		ClientId:     conn.ClientID,
+		CallId:       messageType,
+		ServiceName:  "system",
+		Timestamp:    now.Unix(),
+		Type:         messageType,
+	}
+}
+
+// sendHeartbeats sends periodic heartbeat messages to the client through the queue of the
+// stream it was started for, until stop is closed. A heartbeat only counts once the writer has
+// sent it: one still waiting in the queue at the next tick, or one the full queue has no room
+// for, is a failure.
+func (s *NotificationServer) sendHeartbeats(conn *models.Connection, queue *models.SendQueue, stop <-chan struct{}) {
+	opts := s.connHandler.HeartbeatOptions()
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+
+	var written chan struct{} // closed when the last heartbeat was sent, nil before the first one
+
 	for {
 		select {
 		case <-ticker.C:
 			// Check if connection is still active before sending
-			if !conn.IsActive || conn.Stream == nil {
-				log.Printf("Connection %s is no longer active, stopping heartbeat", conn.UniqueID)
+			if !conn.IsActive() {
+				conn.Logger().Debug("Connection no longer active, stopping heartbeat")
 				return
 			}
 
-			heartbeat := &pb.Notification{
-				Id:           fmt.Sprintf("heartbeat_%d", time.Now().Unix()),
-				ConnectionId: conn.UniqueID,
-				CreatedAt:    time.Now().Format(time.RFC3339),
-				UpdatedAt:    time.Now().Format(time.RFC3339),
-				ClientId:     conn.ClientID,
-				CallId:       "heartbeat",
-				ServiceName:  "system",
-				Timestamp:    time.Now().Unix(),
-				Type:         "heartbeat",
+			var err error
+			if written != nil && !isClosed(written) {
+				err = errHeartbeatNotSent
+			} else {
+				// Heartbeats go through the send queue like everything else, the writer owns the stream
+				sent := make(chan struct{})
+				heartbeat := &models.OutboundMessage{
+					Message: newControlMessage(conn, "heartbeat"),
+					OnSent: func() {
+						conn.RecordHeartbeat(nil)
+						close(sent)
+					},
+				}
+				if err = queue.Offer(heartbeat); err == nil {
+					written = sent
+				}
 			}
 
-			if err := stream.Send(heartbeat); err != nil {
-				conn.HeartbeatFailCount++
-				log.Printf("Failed to send heartbeat to %s (fail count: %d): %v",
-					conn.UniqueID, conn.HeartbeatFailCount, err)
+			if err != nil {
+				failCount := conn.RecordHeartbeat(err)
+				s.connHandler.metrics.heartbeatFailures.Inc()
+				conn.Logger().Warn("Failed to send heartbeat", "fail_count", failCount, "error", err)
 
-				// If failed twice, disconnect the device
-				if conn.HeartbeatFailCount >= 2 {
-					log.Printf("Heartbeat failed twice for %s, disconnecting device", conn.UniqueID)
+				// Too many failures in a row, disconnect the device
+				if failCount >= opts.MaxFailures {
+					conn.Logger().Warn("Heartbeats keep failing, disconnecting device", "fail_count", failCount)
 					s.connHandler.UnregisterDevice(conn.ClientID, conn.DeviceID)
 					return
 				}
-			} else {
-				// Reset fail count on successful heartbeat
-				conn.HeartbeatFailCount = 0
-				conn.LastHeartbeatAt = time.Now()
-				log.Printf("Heartbeat sent to %s", conn.UniqueID)
+			} else if logging.Heartbeats.Allow(conn.UniqueID) {
+				// One line per heartbeat per device floods the logs, only a sample is written
+				conn.Logger().Debug("Heartbeat queued", "queue_depth", queue.Depth())
 			}
 
-		case <-done:
-			log.Printf("Stopping heartbeat for %s", conn.UniqueID)
+			if next := s.connHandler.HeartbeatOptions(); next != opts {
+				if next.Interval != opts.Interval {
+					ticker.Reset(next.Interval)
+				}
+				opts = next
+			}
+
+		case <-stop:
+			conn.Logger().Debug("Stopping heartbeat")
 			return
 		}
 	}
 }
+
+// errHeartbeatNotSent is the failure of a heartbeat whose predecessor is still waiting to be written
+var errHeartbeatNotSent = errors.New("previous heartbeat not sent yet")
+
+// isClosed reports whether ch is closed without blocking
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"grpcon/models"
+	pb "grpcon/proto"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// stuckStream never finishes a Send until its context is cancelled, like a device that stopped reading
+type stuckStream struct {
+	ctx context.Context
+}
+
+func (s stuckStream) Send(*pb.Notification) error {
+	<-s.ctx.Done()
+	return s.ctx.Err()
+}
+
+func (s stuckStream) Context() context.Context {
+	return s.ctx
+}
+
+func startHeartbeats(t *testing.T, server *NotificationServer, clientID, deviceID string) {
+	t.Helper()
+	conn, exists := server.connHandler.store.GetConnection(clientID, deviceID)
+	if !exists {
+		t.Fatalf("%s/%s not registered", clientID, deviceID)
+	}
+	go server.sendHeartbeats(conn, conn.GetQueue(), conn.HeartbeatStop())
+}
+
+func TestHeartbeatsCountOnlyWrittenHeartbeats(t *testing.T) {
+	h := NewConnectionHandler()
+	h.SetHeartbeatOptions(HeartbeatOptions{Interval: 10 * time.Millisecond, MaxFailures: 3, StaleThreshold: time.Minute, MonitorInterval: time.Minute})
+	server := NewNotificationServerWithHandler(h)
+
+	stream := attachDevice(t, h, "alice", "phone")
+	conn, _ := h.store.GetConnection("alice", "phone")
+	attachedAt := conn.GetLastSeen()
+	startHeartbeats(t, server, "alice", "phone")
+
+	waitFor(t, "a written heartbeat", func() bool { return conn.GetLastSeen().After(attachedAt) })
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if len(stream.sent) == 0 {
+		t.Fatal("heartbeat recorded without being sent")
+	}
+}
+
+func TestHeartbeatsDisconnectStuckDevice(t *testing.T) {
+	h := NewConnectionHandler()
+	h.SetHeartbeatOptions(HeartbeatOptions{Interval: 10 * time.Millisecond, MaxFailures: 3, StaleThreshold: time.Minute, MonitorInterval: time.Minute})
+	server := NewNotificationServerWithHandler(h)
+
+	if _, err := h.RegisterDevice("alice", "phone", "test"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := h.AttachStream("alice", "phone", stuckStream{ctx}, "", 0, false); err != nil {
+		t.Fatal(err)
+	}
+	conn, _ := h.store.GetConnection("alice", "phone")
+	attachedAt := conn.GetLastSeen()
+	startHeartbeats(t, server, "alice", "phone")
+
+	// The first heartbeat sits in Send forever, the following ones fail until the device is dropped
+	waitFor(t, "the stuck device to be unregistered", func() bool {
+		_, exists := h.store.GetConnection("alice", "phone")
+		return !exists
+	})
+	if !conn.GetLastSeen().Equal(attachedAt) {
+		t.Fatal("a heartbeat that was never written counted as sent")
+	}
+	if got := testutil.ToFloat64(h.metrics.heartbeatFailures); got < 3 {
+		t.Fatalf("heartbeat failures = %v, want at least 3", got)
+	}
+}
+
+func TestPublishBatchRespectsMaxBatchSize(t *testing.T) {
+	h := NewConnectionHandler()
+	server := NewNotificationServerWithHandler(h)
+	attachDevice(t, h, "alice", "phone")
+
+	requests := make([]*pb.PublishRequest, 3)
+	for i := range requests {
+		requests[i] = &pb.PublishRequest{
+			Notification: &pb.Notification{Title: "title", Body: "body"},
+			Target:       &pb.Target{Target: &pb.Target_ClientId{ClientId: "alice"}},
+		}
+	}
+
+	h.SetMaxBatchSize(2)
+	if _, err := server.PublishBatch(context.Background(), &pb.PublishBatchRequest{Requests: requests}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("PublishBatch over the limit = %v, want InvalidArgument", err)
+	}
+
+	h.SetMaxBatchSize(0)
+	if got := h.MaxBatchSize(); got != DefaultMaxBatchSize {
+		t.Fatalf("MaxBatchSize after SetMaxBatchSize(0) = %d, want %d", got, DefaultMaxBatchSize)
+	}
+	resp, err := server.PublishBatch(context.Background(), &pb.PublishBatchRequest{Requests: requests})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Succeeded != 3 {
+		t.Fatalf("Succeeded = %d, want 3", resp.Succeeded)
+	}
+}
+
+// connectStream is the server side of a Connect stream, the test plays the device through recv
+type connectStream struct {
+	grpc.ServerStream
+	*testStream
+	recv chan *pb.ClientMessage
+}
+
+func newConnectStream(connectionID string) *connectStream {
+	s := &connectStream{testStream: newTestStream(), recv: make(chan *pb.ClientMessage, 8)}
+	s.recv <- &pb.ClientMessage{Payload: &pb.ClientMessage_Subscribe{Subscribe: &pb.SubscribeRequest{ConnectionId: connectionID}}}
+	return s
+}
+
+func (s *connectStream) Context() context.Context {
+	return s.testStream.Context()
+}
+
+func (s *connectStream) Send(n *pb.Notification) error {
+	return s.testStream.Send(n)
+}
+
+// Recv returns what the device sent, io.EOF once it closed its side
+func (s *connectStream) Recv() (*pb.ClientMessage, error) {
+	select {
+	case msg, ok := <-s.recv:
+		if !ok {
+			return nil, io.EOF
+		}
+		return msg, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+func (s *connectStream) ack(notificationID string) {
+	s.recv <- &pb.ClientMessage{Payload: &pb.ClientMessage_Ack{Ack: &pb.Ack{NotificationId: notificationID}}}
+}
+
+// connectDevice registers a device and serves its Connect stream until the test ends or the
+// device closes it. The returned channel gets Connect's result.
+func connectDevice(t *testing.T, server *NotificationServer, clientID, deviceID string) (*models.Connection, *connectStream, <-chan error) {
+	t.Helper()
+	conn, err := server.connHandler.RegisterDevice(clientID, deviceID, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := newConnectStream(conn.UniqueID)
+	t.Cleanup(stream.cancel)
+
+	done := make(chan error, 1)
+	go func() { done <- server.Connect(stream) }()
+	waitFor(t, "attached stream", func() bool { return conn.GetQueue() != nil })
+	return conn, stream, done
+}
+
+func TestConnectAckClearsPending(t *testing.T) {
+	h := NewConnectionHandler()
+	server := NewNotificationServerWithHandler(h)
+	conn, stream, _ := connectDevice(t, server, "alice", "phone")
+
+	notification := newTestNotification("alice")
+	if _, err := h.PublishToClient(notification, allDevicesStrategy{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "delivered notification", func() bool { return len(stream.notifications()) == 1 })
+	if got := conn.GetUnackedCount(); got != 1 {
+		t.Fatalf("GetUnackedCount before the ack = %d, want 1", got)
+	}
+
+	stream.ack(notification.ID)
+	waitFor(t, "acknowledged notification", func() bool { return conn.GetUnackedCount() == 0 && conn.GetAckedCount() == 1 })
+}
+
+func TestConnectRedeliversAfterAckTimeout(t *testing.T) {
+	h := NewConnectionHandler()
+	h.SetAckOptions(30*time.Millisecond, 3)
+	server := NewNotificationServerWithHandler(h)
+	conn, stream, _ := connectDevice(t, server, "alice", "phone")
+
+	notification := newTestNotification("alice")
+	if _, err := h.PublishToClient(notification, allDevicesStrategy{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "redelivered notification", func() bool { return len(stream.notifications()) >= 2 })
+	for _, n := range stream.notifications() {
+		if n.Id != notification.ID {
+			t.Fatalf("got notification %s, want only redeliveries of %s", n.Id, notification.ID)
+		}
+	}
+
+	// The ack of any delivery stops the redeliveries
+	stream.ack(notification.ID)
+	waitFor(t, "acknowledged notification", func() bool { return conn.GetUnackedCount() == 0 })
+}
+
+func TestRedeliverUnackedGivesUpAfterMaxAttempts(t *testing.T) {
+	h := NewConnectionHandler()
+	h.SetAckOptions(time.Millisecond, 2)
+	if _, err := h.RegisterDevice("alice", "phone", "test"); err != nil {
+		t.Fatal(err)
+	}
+	stream := newTestStream()
+	t.Cleanup(stream.cancel)
+	if err := h.AttachStream("alice", "phone", stream, "", 0, true); err != nil {
+		t.Fatal(err)
+	}
+	conn, _ := h.store.GetConnection("alice", "phone")
+
+	if _, err := h.PublishToClient(newTestNotification("alice"), allDevicesStrategy{}); err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 2; attempt <= 3; attempt++ {
+		time.Sleep(5 * time.Millisecond)
+		h.RedeliverUnacked(conn)
+	}
+
+	waitFor(t, "second delivery", func() bool { return len(stream.notifications()) == 2 })
+	if got := conn.GetUnackedCount(); got != 0 {
+		t.Fatalf("GetUnackedCount after the last attempt = %d, want 0", got)
+	}
+	if got := h.GetInbox().GetPendingCount("alice"); got != 0 {
+		t.Fatalf("GetPendingCount = %d, a notification given up on is not kept", got)
+	}
+}
+
+func TestConnectReleasesUnackedOnDetach(t *testing.T) {
+	h := NewConnectionHandler()
+	server := NewNotificationServerWithHandler(h)
+	conn, stream, done := connectDevice(t, server, "alice", "phone")
+
+	if _, err := h.PublishToClient(newTestNotification("alice"), allDevicesStrategy{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "delivered notification", func() bool { return len(stream.notifications()) == 1 })
+
+	// The device hangs up without acknowledging
+	close(stream.recv)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Connect = %v, want nil", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Connect did not return after the device closed the stream")
+	}
+
+	if got := conn.GetUnackedCount(); got != 0 {
+		t.Fatalf("GetUnackedCount after detach = %d, want 0", got)
+	}
+	if got := h.GetInbox().GetPendingCount("alice"); got != 1 {
+		t.Fatalf("GetPendingCount after detach = %d, want 1", got)
+	}
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"time"
+
+	"grpcon/models"
+)
+
+// ControlServerGoingAway is the type of the control message telling a device the server is shutting
+// down. Its data holds reconnect_after_ms, how long the device should wait before reconnecting.
+const ControlServerGoingAway = "server_going_away"
+
+// StopHealthCheckMonitor stops the goroutine started by StartHealthCheckMonitor
+func (h *ConnectionHandler) StopHealthCheckMonitor() {
+	h.stopMonitor.Do(func() { close(h.monitorStop) })
+}
+
+// IsShuttingDown reports whether Shutdown was called
+func (h *ConnectionHandler) IsShuttingDown() bool {
+	h.drainMu.RLock()
+	defer h.drainMu.RUnlock()
+	return h.shuttingDown
+}
+
+// refusesPublish reports whether a notification is refused because Shutdown was called.
+// Notifications relayed by other nodes are still delivered while the streams drain.
+func (h *ConnectionHandler) refusesPublish(notification *models.NotificationData) bool {
+	return !notification.Relayed && h.IsShuttingDown()
+}
+
+// shuttingDownResults fails a publish to clientID, or one of its devices if deviceID is set, with ErrShuttingDown
+func shuttingDownResults(clientID, deviceID string) ([]DeliveryResult, error) {
+	result := DeliveryResult{ClientID: clientID, DeviceID: deviceID}
+	result.fail(newDeliveryError(ErrShuttingDown, clientID, deviceID, nil))
+	return []DeliveryResult{result}, result.Err
+}
+
+// Shutdown drains the handler before the server stops. New registrations and streams are refused
+// with ErrShuttingDown and every streaming device is sent a server_going_away message asking it to
+// reconnect after a random delay within reconnectWindow, so devices don't all come back at once.
+// Send queues are flushed until ctx is done, then the streams are closed and whatever is still
+// queued goes back to the inbox. Returns ctx's error if some queues could not be flushed in time.
+func (h *ConnectionHandler) Shutdown(ctx context.Context, reconnectWindow time.Duration) error {
+	// Waits for registrations and attaches in progress, later ones see the flag
+	h.drainMu.Lock()
+	h.shuttingDown = true
+	h.drainMu.Unlock()
+
+	h.StopHealthCheckMonitor()
+
+	var streaming []*models.Connection
+	for _, conn := range h.store.GetAllConnections() {
+		queue := conn.GetQueue()
+		if queue == nil {
+			continue
+		}
+
+		goingAway := newControlMessage(conn, ControlServerGoingAway)
+		goingAway.Data = map[string]string{"reconnect_after_ms": strconv.FormatInt(reconnectDelay(reconnectWindow).Milliseconds(), 10)}
+		if err := queue.Enqueue(&models.OutboundMessage{Message: goingAway}); err != nil {
+			conn.Logger().Warn("Failed to queue going away message", "error", err)
+		}
+		streaming = append(streaming, conn)
+	}
+	slog.Info("Shutting down, flushing send queues", "streams", len(streaming))
+
+	// Every queue is flushed at once, a slow device only holds up its own stream
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	unflushed := 0
+	for _, conn := range streaming {
+		wg.Add(1)
+		go func(conn *models.Connection) {
+			defer wg.Done()
+			if queue := conn.GetQueue(); queue != nil && queue.Flush(ctx) != nil && ctx.Err() != nil {
+				mu.Lock()
+				unflushed++
+				mu.Unlock()
+			}
+		}(conn)
+	}
+	wg.Wait()
+
+	// Closing the send queues ends the stream handlers, unsent notifications go back to the inbox
+	for _, conn := range streaming {
+		h.DetachStream(conn.ClientID, conn.DeviceID, nil)
+	}
+
+	if unflushed > 0 {
+		slog.Warn("Some send queues were not flushed before the shutdown deadline", "streams", unflushed)
+		return ctx.Err()
+	}
+	return nil
+}
+
+// reconnectDelay picks a random delay within window
+func reconnectDelay(window time.Duration) time.Duration {
+	if window <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int64N(int64(window)))
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	pb "grpcon/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPublishRefusedWhileShuttingDown(t *testing.T) {
+	h := NewConnectionHandler()
+	server := NewNotificationServerWithHandler(h)
+	stream := attachDevice(t, h, "alice", "phone")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := h.Shutdown(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := h.PublishToClient(newTestNotification("alice"), allDevicesStrategy{})
+	if !errors.Is(err, ErrShuttingDown) || HTTPStatus(err) != http.StatusServiceUnavailable {
+		t.Fatalf("PublishToClient = %v, want ErrShuttingDown", err)
+	}
+	if len(results) != 1 || results[0].ErrorCode != ErrorCodeShuttingDown {
+		t.Fatalf("PublishToClient results = %+v, want one shutting_down result", results)
+	}
+	if _, err := h.PublishToDevice(newTestNotification("alice"), "alice", "phone"); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("PublishToDevice = %v, want ErrShuttingDown", err)
+	}
+	if _, err := h.PublishToTopic(newTestNotification(""), "news"); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("PublishToTopic = %v, want ErrShuttingDown", err)
+	}
+	if results := h.PublishBroadcast(newTestNotification("")); len(results) != 1 || results[0].ErrorCode != ErrorCodeShuttingDown {
+		t.Fatalf("PublishBroadcast = %+v, want one shutting_down result", results)
+	}
+
+	for _, result := range h.PublishToTargets(newTestNotification(""), []Target{{ClientID: "alice"}, {ClientID: "alice", DeviceID: "phone"}}, allDevicesStrategy{}) {
+		if result.Status != DeliveryFailed || result.ErrorCode != ErrorCodeShuttingDown {
+			t.Fatalf("PublishToTargets result = %+v, want shutting_down", result)
+		}
+	}
+
+	items := []BatchItem{
+		{Notification: newTestNotification(""), ClientID: "alice", Strategy: allDevicesStrategy{}},
+		{Notification: newTestNotification(""), Topic: "news"},
+	}
+	for _, result := range h.PublishBatch(items) {
+		if result.Status != DeliveryFailed || result.ErrorCode != ErrorCodeShuttingDown {
+			t.Fatalf("PublishBatch result = %+v, want shutting_down", result)
+		}
+	}
+
+	publish := &pb.PublishRequest{
+		Notification: &pb.Notification{Title: "title", Body: "body"},
+		Target:       &pb.Target{Target: &pb.Target_ClientId{ClientId: "alice"}},
+	}
+	if _, err := server.Publish(context.Background(), publish); status.Code(err) != codes.Unavailable {
+		t.Fatalf("gRPC Publish = %v, want Unavailable", err)
+	}
+	req := &pb.PublishBatchRequest{Requests: []*pb.PublishRequest{publish}}
+	if _, err := server.PublishBatch(context.Background(), req); status.Code(err) != codes.Unavailable {
+		t.Fatalf("gRPC PublishBatch = %v, want Unavailable", err)
+	}
+
+	if got := len(stream.notifications()); got != 0 {
+		t.Fatalf("device got %d notifications after shutdown, want none", got)
+	}
+}
+
+func TestRelayedPublishDeliveredWhileShuttingDown(t *testing.T) {
+	h := NewConnectionHandler()
+	h.drainMu.Lock()
+	h.shuttingDown = true
+	h.drainMu.Unlock()
+
+	// Another node saw a device of the client here, the notification waits in the inbox
+	notification := newTestNotification("alice")
+	notification.Relayed = true
+	if _, err := h.PublishToClient(notification, allDevicesStrategy{}); errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("relayed PublishToClient = %v, want it accepted", err)
+	}
+	if got := h.GetInbox().GetPendingCount("alice"); got != 1 {
+		t.Fatalf("pending notifications = %d, want 1", got)
+	}
+}
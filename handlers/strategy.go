@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"grpcon/models"
+	pb "grpcon/proto"
+)
+
+// Names of the built-in delivery strategies, as accepted by /send and Publish
+const (
+	StrategyAllDevices     = "all_devices"
+	StrategyFirst          = "first"
+	StrategyLeastLoaded    = "least_loaded"
+	StrategyMostRecent     = "most_recent"
+	StrategySpecificDevice = "specific_device"
+	StrategyRoundRobin     = "round_robin"
+
+	// DefaultStrategy is used when a request names no strategy
+	DefaultStrategy = StrategyLeastLoaded
+)
+
+// DeliveryStrategy picks which of a client's devices get a notification.
+// Custom strategies can be added with ConnectionHandler.RegisterStrategy.
+type DeliveryStrategy interface {
+	// Name is the value requests use to pick the strategy, e.g. "least_loaded"
+	Name() string
+	// Select orders the client's devices that can receive by preference, dropping the ones
+	// it does not want. It may be called from several goroutines at once.
+	Select(clientID string, devices []*models.Connection) []*models.Connection
+	// AllDevices reports whether every selected device gets the notification. Otherwise
+	// only the first one that takes it does.
+	AllDevices() bool
+}
+
+// allDevicesStrategy sends to every device of the client
+type allDevicesStrategy struct{}
+
+func (allDevicesStrategy) Name() string     { return StrategyAllDevices }
+func (allDevicesStrategy) AllDevices() bool { return true }
+func (allDevicesStrategy) Select(clientID string, devices []*models.Connection) []*models.Connection {
+	return devices
+}
+
+// firstStrategy sends to the device that registered first
+type firstStrategy struct{}
+
+func (firstStrategy) Name() string     { return StrategyFirst }
+func (firstStrategy) AllDevices() bool { return false }
+func (firstStrategy) Select(clientID string, devices []*models.Connection) []*models.Connection {
+	sort.SliceStable(devices, func(i, j int) bool {
+		return devices[i].ConnectedAt.Before(devices[j].ConnectedAt)
+	})
+	return devices
+}
+
+// leastLoadedStrategy sends to the device that received the fewest notifications
+type leastLoadedStrategy struct{}
+
+func (leastLoadedStrategy) Name() string     { return StrategyLeastLoaded }
+func (leastLoadedStrategy) AllDevices() bool { return false }
+func (leastLoadedStrategy) Select(clientID string, devices []*models.Connection) []*models.Connection {
+	// Counts change while sorting, read them once
+	counts := make(map[*models.Connection]int, len(devices))
+	for _, device := range devices {
+		counts[device] = device.GetNotificationCount()
+	}
+	sort.SliceStable(devices, func(i, j int) bool {
+		return counts[devices[i]] < counts[devices[j]]
+	})
+	return devices
+}
+
+// mostRecentStrategy sends to the device that attached its stream last
+type mostRecentStrategy struct{}
+
+func (mostRecentStrategy) Name() string     { return StrategyMostRecent }
+func (mostRecentStrategy) AllDevices() bool { return false }
+func (mostRecentStrategy) Select(clientID string, devices []*models.Connection) []*models.Connection {
+	attached := make(map[*models.Connection]int64, len(devices))
+	for _, device := range devices {
+		attached[device] = device.GetAttachedAt().UnixNano()
+	}
+	sort.SliceStable(devices, func(i, j int) bool {
+		return attached[devices[i]] > attached[devices[j]]
+	})
+	return devices
+}
+
+// roundRobinStrategy takes turns between the devices of each client
+type roundRobinStrategy struct {
+	mu   sync.Mutex
+	next map[string]int // key: client_id
+}
+
+func newRoundRobinStrategy() *roundRobinStrategy {
+	return &roundRobinStrategy{next: make(map[string]int)}
+}
+
+func (s *roundRobinStrategy) Name() string     { return StrategyRoundRobin }
+func (s *roundRobinStrategy) AllDevices() bool { return false }
+func (s *roundRobinStrategy) Select(clientID string, devices []*models.Connection) []*models.Connection {
+	if len(devices) == 0 {
+		return devices
+	}
+
+	// A stable order so the turns don't depend on map iteration
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].DeviceID < devices[j].DeviceID
+	})
+
+	s.mu.Lock()
+	start := s.next[clientID] % len(devices)
+	s.next[clientID] = start + 1
+	s.mu.Unlock()
+
+	rotated := make([]*models.Connection, 0, len(devices))
+	rotated = append(rotated, devices[start:]...)
+	return append(rotated, devices[:start]...)
+}
+
+// SpecificDeviceStrategy sends to one named device of the client
+type SpecificDeviceStrategy struct {
+	DeviceID string
+}
+
+func (s *SpecificDeviceStrategy) Name() string     { return StrategySpecificDevice }
+func (s *SpecificDeviceStrategy) AllDevices() bool { return false }
+func (s *SpecificDeviceStrategy) Select(clientID string, devices []*models.Connection) []*models.Connection {
+	for _, device := range devices {
+		if device.DeviceID == s.DeviceID {
+			return []*models.Connection{device}
+		}
+	}
+	return nil
+}
+
+// strategyRegistry holds the strategies requests can pick by name
+type strategyRegistry struct {
+	mu         sync.RWMutex
+	strategies map[string]DeliveryStrategy
+}
+
+// newStrategyRegistry creates a registry with the built-in strategies
+func newStrategyRegistry() *strategyRegistry {
+	r := &strategyRegistry{strategies: make(map[string]DeliveryStrategy)}
+	for _, strategy := range []DeliveryStrategy{
+		allDevicesStrategy{},
+		firstStrategy{},
+		leastLoadedStrategy{},
+		mostRecentStrategy{},
+		newRoundRobinStrategy(),
+	} {
+		r.register(strategy)
+	}
+	return r
+}
+
+func (r *strategyRegistry) register(strategy DeliveryStrategy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.strategies[strategy.Name()] = strategy
+}
+
+func (r *strategyRegistry) get(name string) (DeliveryStrategy, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	strategy, ok := r.strategies[name]
+	return strategy, ok
+}
+
+// RegisterStrategy adds a custom delivery strategy, or replaces a built-in one with the same name
+func (h *ConnectionHandler) RegisterStrategy(strategy DeliveryStrategy) {
+	h.strategies.register(strategy)
+}
+
+// GetStrategy resolves a strategy by name. deviceID is required by specific_device and ignored otherwise.
+func (h *ConnectionHandler) GetStrategy(name, deviceID string) (DeliveryStrategy, error) {
+	if name == StrategySpecificDevice {
+		if deviceID == "" {
+			return nil, invalidRequest("device_id is required for the %s strategy", StrategySpecificDevice)
+		}
+		return &SpecificDeviceStrategy{DeviceID: deviceID}, nil
+	}
+
+	strategy, ok := h.strategies.get(name)
+	if !ok {
+		return nil, invalidRequest("unknown delivery strategy: %s", name)
+	}
+	return strategy, nil
+}
+
+// StrategyNameFromProto returns the strategy name of a protobuf DeliveryStrategy,
+// e.g. DELIVERY_STRATEGY_LEAST_LOADED is "least_loaded". DELIVERY_STRATEGY_UNSPECIFIED is DefaultStrategy.
+func StrategyNameFromProto(strategy pb.DeliveryStrategy) string {
+	if strategy == pb.DeliveryStrategy_DELIVERY_STRATEGY_UNSPECIFIED {
+		return DefaultStrategy
+	}
+	return strings.ToLower(strings.TrimPrefix(strategy.String(), "DELIVERY_STRATEGY_"))
+}
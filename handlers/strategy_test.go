@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"grpcon/models"
+	pb "grpcon/proto"
+)
+
+// strategyDevices builds connections registered and attached in order, one millisecond apart
+func strategyDevices(deviceIDs ...string) []*models.Connection {
+	devices := make([]*models.Connection, len(deviceIDs))
+	base := time.Now()
+	for i, deviceID := range deviceIDs {
+		conn := models.NewConnection(models.CreateUniqueID("alice", deviceID), "alice", deviceID, "test")
+		conn.ConnectedAt = base.Add(time.Duration(i) * time.Millisecond)
+		devices[i] = conn
+	}
+	return devices
+}
+
+func deviceIDs(devices []*models.Connection) []string {
+	ids := make([]string, len(devices))
+	for i, device := range devices {
+		ids[i] = device.DeviceID
+	}
+	return ids
+}
+
+func TestBuiltinStrategiesOrderDevices(t *testing.T) {
+	h := NewConnectionHandler()
+
+	devices := strategyDevices("b", "a", "c")
+	// Every device but c received a notification, a got two
+	devices[0].RecordDelivery()
+	devices[1].RecordDelivery()
+	devices[1].RecordDelivery()
+
+	for _, tc := range []struct {
+		name  string
+		first string
+		all   bool
+	}{
+		{StrategyAllDevices, "b", true},
+		{StrategyFirst, "b", false},
+		{StrategyLeastLoaded, "c", false},
+	} {
+		strategy, err := h.GetStrategy(tc.name, "")
+		if err != nil {
+			t.Fatalf("GetStrategy(%s): %v", tc.name, err)
+		}
+		selected := strategy.Select("alice", append([]*models.Connection(nil), devices...))
+		if len(selected) != len(devices) || selected[0].DeviceID != tc.first {
+			t.Errorf("%s selected %v, want %s first", tc.name, deviceIDs(selected), tc.first)
+		}
+		if strategy.AllDevices() != tc.all {
+			t.Errorf("%s AllDevices = %v, want %v", tc.name, strategy.AllDevices(), tc.all)
+		}
+	}
+}
+
+func TestMostRecentStrategyPicksLastAttached(t *testing.T) {
+	h := NewConnectionHandler()
+	attachDevice(t, h, "alice", "phone")
+	time.Sleep(2 * time.Millisecond)
+	attachDevice(t, h, "alice", "tablet")
+
+	devices, _ := h.GetClientDevices("alice")
+	strategy, _ := h.GetStrategy(StrategyMostRecent, "")
+	if selected := strategy.Select("alice", devices); selected[0].DeviceID != "tablet" {
+		t.Fatalf("most_recent selected %v, want tablet first", deviceIDs(selected))
+	}
+}
+
+func TestRoundRobinStrategyTakesTurns(t *testing.T) {
+	h := NewConnectionHandler()
+	phone := attachDevice(t, h, "alice", "phone")
+	tablet := attachDevice(t, h, "alice", "tablet")
+
+	strategy, _ := h.GetStrategy(StrategyRoundRobin, "")
+	for i := 0; i < 4; i++ {
+		if _, err := h.PublishToClient(newTestNotification("alice"), strategy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "round robin deliveries", func() bool {
+		return len(phone.notifications()) == 2 && len(tablet.notifications()) == 2
+	})
+}
+
+func TestRoundRobinStrategyConcurrentSelect(t *testing.T) {
+	strategy := newRoundRobinStrategy()
+	devices := strategyDevices("a", "b", "c")
+
+	var wg sync.WaitGroup
+	counts := make([]int, len(devices))
+	var mu sync.Mutex
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			selected := strategy.Select("alice", append([]*models.Connection(nil), devices...))
+			mu.Lock()
+			defer mu.Unlock()
+			for j, device := range devices {
+				if selected[0] == device {
+					counts[j]++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for j, count := range counts {
+		if count != 10 {
+			t.Fatalf("device %s picked first %d times, want 10", devices[j].DeviceID, count)
+		}
+	}
+}
+
+func TestSpecificDeviceStrategy(t *testing.T) {
+	h := NewConnectionHandler()
+	if _, err := h.GetStrategy(StrategySpecificDevice, ""); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("specific_device without a device = %v, want ErrInvalidRequest", err)
+	}
+
+	strategy, err := h.GetStrategy(StrategySpecificDevice, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selected := strategy.Select("alice", strategyDevices("b", "a")); len(selected) != 1 || selected[0].DeviceID != "a" {
+		t.Fatalf("specific_device selected %v, want [a]", deviceIDs(selected))
+	}
+}
+
+// evenStrategy only wants devices whose ID ends in an even digit
+type evenStrategy struct{}
+
+func (evenStrategy) Name() string     { return "even" }
+func (evenStrategy) AllDevices() bool { return true }
+func (evenStrategy) Select(clientID string, devices []*models.Connection) []*models.Connection {
+	var selected []*models.Connection
+	for _, device := range devices {
+		if last := device.DeviceID[len(device.DeviceID)-1]; (last-'0')%2 == 0 {
+			selected = append(selected, device)
+		}
+	}
+	return selected
+}
+
+func TestCustomStrategy(t *testing.T) {
+	h := NewConnectionHandler()
+	if _, err := h.GetStrategy("even", ""); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("unknown strategy = %v, want ErrInvalidRequest", err)
+	}
+
+	h.RegisterStrategy(evenStrategy{})
+	odd := attachDevice(t, h, "alice", "device1")
+	even := attachDevice(t, h, "alice", "device2")
+
+	strategy, err := h.GetStrategy("even", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.PublishToClient(newTestNotification("alice"), strategy); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "delivery to the even device", func() bool { return len(even.notifications()) == 1 })
+	if len(odd.notifications()) != 0 {
+		t.Fatal("custom strategy delivered to a device it did not select")
+	}
+}
+
+func TestStrategyNameFromProto(t *testing.T) {
+	if got := StrategyNameFromProto(pb.DeliveryStrategy_DELIVERY_STRATEGY_LEAST_LOADED); got != StrategyLeastLoaded {
+		t.Fatalf("StrategyNameFromProto = %s, want %s", got, StrategyLeastLoaded)
+	}
+	if got := StrategyNameFromProto(pb.DeliveryStrategy_DELIVERY_STRATEGY_ALL_DEVICES); got != StrategyAllDevices {
+		t.Fatalf("StrategyNameFromProto = %s, want %s", got, StrategyAllDevices)
+	}
+	// An unset strategy means the same on gRPC as on /send
+	if got := StrategyNameFromProto(pb.DeliveryStrategy_DELIVERY_STRATEGY_UNSPECIFIED); got != DefaultStrategy {
+		t.Fatalf("StrategyNameFromProto of an unset strategy = %s, want %s", got, DefaultStrategy)
+	}
+}
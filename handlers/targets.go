@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"errors"
+
+	"grpcon/models"
+)
+
+// Target is one recipient of a multi-target send: a client, or one device of a client if DeviceID is set
+type Target struct {
+	ClientID string `json:"client_id"`
+	DeviceID string `json:"device_id,omitempty"`
+}
+
+// TargetResult is the outcome of a multi-target send for one target
+type TargetResult struct {
+	Target
+	Status         DeliveryStatus   `json:"status"`
+	NotificationID string           `json:"notification_id,omitempty"`
+	Sequence       uint64           `json:"sequence,omitempty"`
+	Deliveries     []DeliveryResult `json:"deliveries,omitempty"`
+	ErrorCode      string           `json:"error_code,omitempty"`
+	Error          string           `json:"error,omitempty"`
+	Err            error            `json:"-"`
+}
+
+// PublishToTargets delivers a copy of a notification to every target, each sequenced in its own
+// client's stream. Client targets use strategy, device targets go to that device only. Duplicate
+// targets are sent once. Returns one result per distinct target, in request order. Once the server
+// is shutting down every target fails with ErrShuttingDown.
+func (h *ConnectionHandler) PublishToTargets(notification *models.NotificationData, targets []Target, strategy DeliveryStrategy) []TargetResult {
+	results := make([]TargetResult, 0, len(targets))
+	seen := make(map[Target]bool, len(targets))
+
+	for _, target := range targets {
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+
+		result := TargetResult{Target: target}
+		if target.ClientID == "" {
+			result.Status = DeliveryFailed
+			result.Err = invalidRequest("client_id is required")
+			result.ErrorCode = ErrorCodeInvalidRequest
+			result.Error = result.Err.Error()
+			results = append(results, result)
+			continue
+		}
+
+		notif := *notification
+		notif.ClientID = target.ClientID
+		notif.Sequence = 0
+
+		var err error
+		if target.DeviceID != "" {
+			result.Deliveries, err = h.PublishToDevice(&notif, target.ClientID, target.DeviceID)
+		} else {
+			result.Deliveries, err = h.PublishToClient(&notif, strategy)
+		}
+		result.NotificationID = notif.ID
+		result.Sequence = notif.Sequence
+		result.Status = targetStatus(result.Deliveries, err)
+		if result.ErrorCode = ErrorCode(err); result.ErrorCode != "" {
+			result.Err = err
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// targetStatus sums up the outcome of one publish: queued or failed by its error, otherwise
+// relayed if no local device took it but another node did, or sent
+func targetStatus(deliveries []DeliveryResult, err error) DeliveryStatus {
+	switch {
+	case errors.Is(err, ErrNotificationQueued):
+		return DeliveryQueued
+	case err != nil:
+		return DeliveryFailed
+	case countStatus(deliveries, DeliverySent) == 0 && countStatus(deliveries, DeliveryRelayed) > 0:
+		return DeliveryRelayed
+	}
+	return DeliverySent
+}
+
+// SummarizeDeliveries counts results per status, e.g. {"sent": 3, "failed": 1}
+func SummarizeDeliveries(results []DeliveryResult) map[DeliveryStatus]int {
+	summary := make(map[DeliveryStatus]int)
+	for _, r := range results {
+		summary[r.Status]++
+	}
+	return summary
+}
+
+// SummarizeTargets counts target results per status, e.g. {"sent": 2, "queued": 1}
+func SummarizeTargets(results []TargetResult) map[DeliveryStatus]int {
+	summary := make(map[DeliveryStatus]int)
+	for _, r := range results {
+		summary[r.Status]++
+	}
+	return summary
+}
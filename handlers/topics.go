@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"log/slog"
+
+	"grpcon/cluster"
+	"grpcon/models"
+)
+
+// SubscribeTopics subscribes a registered device to topic patterns such as "call.123" or "team.sales.*".
+// Nothing is subscribed if any pattern is invalid.
+func (h *ConnectionHandler) SubscribeTopics(conn *models.Connection, patterns []string) error {
+	for _, pattern := range patterns {
+		if err := models.ValidateTopicPattern(pattern); err != nil {
+			return invalidRequest("%v", err)
+		}
+	}
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	h.topics.Subscribe(models.TopicSubscriber{
+		UniqueID: conn.UniqueID,
+		ClientID: conn.ClientID,
+		DeviceID: conn.DeviceID,
+	}, patterns)
+
+	conn.Logger().Info("Subscribed to topics", "topics", patterns)
+	return nil
+}
+
+// UnsubscribeTopics removes topic patterns of a device, unknown patterns are ignored
+func (h *ConnectionHandler) UnsubscribeTopics(conn *models.Connection, patterns []string) {
+	if len(patterns) == 0 {
+		return
+	}
+
+	h.topics.Unsubscribe(conn.UniqueID, patterns)
+	conn.Logger().Info("Unsubscribed from topics", "topics", patterns)
+}
+
+// GetDeviceTopics returns the topic patterns a device is subscribed to
+func (h *ConnectionHandler) GetDeviceTopics(conn *models.Connection) []string {
+	return h.topics.GetDeviceTopics(conn.UniqueID)
+}
+
+// TopicReport sums up a publish to a topic: how many devices took the notification and which
+// subscribers took it or failed. Relayed results stand for the subscribers of the other nodes.
+type TopicReport struct {
+	Topic     string                 `json:"topic"`
+	Status    DeliveryStatus         `json:"status"`
+	Summary   map[DeliveryStatus]int `json:"summary"`
+	Succeeded []DeliveryResult       `json:"succeeded,omitempty"`
+	Failed    []DeliveryResult       `json:"failed,omitempty"`
+}
+
+// NewTopicReport builds the report of a topic publish from its results. The status is failed
+// only if every subscriber failed.
+func NewTopicReport(topic string, results []DeliveryResult) TopicReport {
+	report := TopicReport{
+		Topic:   topic,
+		Status:  targetStatus(results, nil),
+		Summary: SummarizeDeliveries(results),
+	}
+	if len(results) > 0 && report.Summary[DeliveryFailed] == len(results) {
+		report.Status = DeliveryFailed
+	}
+	for _, r := range results {
+		if r.Status == DeliveryFailed {
+			report.Failed = append(report.Failed, r)
+		} else {
+			report.Succeeded = append(report.Succeeded, r)
+		}
+	}
+	return report
+}
+
+// PublishToTopic delivers a notification to every device subscribed to a matching pattern,
+// whatever client it belongs to, and asks the other nodes to do the same for theirs.
+// Devices without an active stream miss it but can replay it with last_sequence.
+// Returns ErrShuttingDown once the server is shutting down.
+func (h *ConnectionHandler) PublishToTopic(notification *models.NotificationData, topic string) ([]DeliveryResult, error) {
+	if err := models.ValidateTopic(topic); err != nil {
+		return nil, invalidRequest("%v", err)
+	}
+	if h.refusesPublish(notification) {
+		return shuttingDownResults("", "")
+	}
+	notification.Topic = topic
+
+	var results []DeliveryResult
+
+	// Subscribers attached to other nodes
+	if registry := h.clusterRegistry(); registry != nil && !notification.Relayed {
+		result := DeliveryResult{Status: DeliveryRelayed}
+		if err := registry.Publish(&cluster.Envelope{Kind: cluster.KindTopic, Notification: notification}); err != nil {
+			slog.Error("Failed to relay topic to cluster", "topic", topic, "error", err)
+			result.fail(newDeliveryError(ErrSendFailed, "", "", err))
+		}
+		results = append(results, result)
+	}
+
+	// Each client gets its own copy so it can be sequenced in that client's stream
+	copies := make(map[string]*models.NotificationData)
+	successCount := 0
+	subscribers := h.topics.Match(topic)
+
+	for _, subscriber := range subscribers {
+		notif, exists := copies[subscriber.ClientID]
+		if !exists {
+			copied := *notification
+			copied.ClientID = subscriber.ClientID
+			copied.Sequence = 0
+			h.recordNotification(&copied)
+			notif = &copied
+			copies[subscriber.ClientID] = notif
+		}
+
+		conn, exists := h.store.GetConnection(subscriber.ClientID, subscriber.DeviceID)
+		if !exists {
+			result := DeliveryResult{
+				ClientID:     subscriber.ClientID,
+				DeviceID:     subscriber.DeviceID,
+				ConnectionID: subscriber.UniqueID,
+			}
+			result.fail(newDeliveryError(ErrDeviceNotFound, subscriber.ClientID, subscriber.DeviceID, nil))
+			results = append(results, result)
+			continue
+		}
+
+		result := h.deliverWithResult(conn, notif)
+		if result.Status == DeliverySent {
+			successCount++
+		}
+		results = append(results, result)
+	}
+
+	slog.Info("Topic published", "topic", topic,
+		"sent", successCount, "subscribers", len(subscribers), "clients", len(copies))
+	h.metrics.recordDeliveries(metricsStrategyTopic, notification.ServiceName, results)
+
+	return results, nil
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"errors"
+	"testing"
+
+	"grpcon/models"
+)
+
+func TestPublishToTopic(t *testing.T) {
+	h := NewConnectionHandler()
+	alicePhone := attachDevice(t, h, "alice", "phone")
+	aliceTablet := attachDevice(t, h, "alice", "tablet")
+	bob := attachDevice(t, h, "bob", "phone")
+
+	subscribe := func(clientID, deviceID string, patterns ...string) {
+		conn, err := h.GetDeviceInfo(clientID, deviceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.SubscribeTopics(conn, patterns); err != nil {
+			t.Fatal(err)
+		}
+	}
+	subscribe("alice", "phone", "team.sales")
+	subscribe("alice", "tablet", "team.*")
+	subscribe("bob", "phone", "team.>")
+
+	results, err := h.PublishToTopic(newTestNotification(""), "team.sales")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := countStatus(results, DeliverySent); got != 3 {
+		t.Fatalf("%d devices sent, want 3: %+v", got, results)
+	}
+
+	waitFor(t, "topic deliveries", func() bool {
+		return len(alicePhone.notifications()) == 1 && len(aliceTablet.notifications()) == 1 && len(bob.notifications()) == 1
+	})
+
+	// Each client gets its own copy in its own sequence, devices of one client share it
+	a, b := alicePhone.notifications()[0], bob.notifications()[0]
+	if a.ClientId != "alice" || b.ClientId != "bob" || a.Topic != "team.sales" {
+		t.Fatalf("copies = %s/%s on %s", a.ClientId, b.ClientId, a.Topic)
+	}
+	if a.Id != aliceTablet.notifications()[0].Id || a.Id == b.Id {
+		t.Fatalf("IDs %s, %s, %s: want one per client", a.Id, aliceTablet.notifications()[0].Id, b.Id)
+	}
+
+	// team.sales.emea only matches bob's tail wildcard
+	if _, err := h.PublishToTopic(newTestNotification(""), "team.sales.emea"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "tail wildcard delivery", func() bool { return len(bob.notifications()) == 2 })
+	if len(alicePhone.notifications()) != 1 || len(aliceTablet.notifications()) != 1 {
+		t.Fatal("delivered to a device whose pattern does not match")
+	}
+}
+
+func TestTopicSubscriptionsFollowTheDevice(t *testing.T) {
+	h := NewConnectionHandler()
+	attachDevice(t, h, "alice", "phone")
+	conn, _ := h.GetDeviceInfo("alice", "phone")
+
+	if err := h.SubscribeTopics(conn, []string{"news.*", "team.>.x"}); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("SubscribeTopics with an invalid pattern = %v, want ErrInvalidRequest", err)
+	}
+	if topics := h.GetDeviceTopics(conn); len(topics) != 0 {
+		t.Fatalf("invalid request subscribed %v", topics)
+	}
+
+	h.SubscribeTopics(conn, []string{"news.*"})
+	if _, err := h.PublishToTopic(newTestNotification(""), "news.*"); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("publishing to a pattern = %v, want ErrInvalidRequest", err)
+	}
+
+	h.UnregisterDevice("alice", "phone")
+	if got := h.GetTopicIndex().Match("news.today"); len(got) != 0 {
+		t.Fatalf("unregistered device still subscribed: %v", got)
+	}
+	if _, err := h.PublishToTopic(&models.NotificationData{Title: "t"}, "news.today"); err != nil {
+		t.Fatalf("publishing without subscribers: %v", err)
+	}
+}
+
+func TestTopicReport(t *testing.T) {
+	h := NewConnectionHandler()
+	attachDevice(t, h, "alice", "phone")
+	conn, _ := h.GetDeviceInfo("alice", "phone")
+	h.SubscribeTopics(conn, []string{"news"})
+
+	results, err := h.PublishToTopic(newTestNotification(""), "news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := NewTopicReport("news", results)
+	if report.Status != DeliverySent || report.Summary[DeliverySent] != 1 || len(report.Succeeded) != 1 || report.Succeeded[0].DeviceID != "phone" {
+		t.Fatalf("report = %+v", report)
+	}
+
+	failed := DeliveryResult{ClientID: "alice", DeviceID: "phone"}
+	failed.fail(newDeliveryError(ErrNoActiveStream, "alice", "phone", nil))
+	report = NewTopicReport("news", []DeliveryResult{failed})
+	if report.Status != DeliveryFailed || len(report.Failed) != 1 {
+		t.Fatalf("report with every subscriber failed = %+v", report)
+	}
+
+	if _, err := h.Publish(BatchItem{Notification: newTestNotification(""), ClientID: "alice", Topic: "news"}); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("Publish with a topic and a client = %v, want ErrInvalidRequest", err)
+	}
+}
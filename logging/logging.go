@@ -0,0 +1,113 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Attribute keys shared by every log line about a device or notification
+const (
+	KeyClientID       = "client_id"
+	KeyDeviceID       = "device_id"
+	KeyUniqueID       = "unique_id"
+	KeyNotificationID = "notification_id"
+)
+
+// DefaultHeartbeatSampleRate logs one in this many successful heartbeats per device
+const DefaultHeartbeatSampleRate = 20
+
+// level is the minimum level of the default logger, it can change while the server runs
+var level = new(slog.LevelVar)
+
+// ParseLevel parses debug, info, warn or error (case-insensitive), empty means info
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level: %s", name)
+}
+
+// NewHandler creates a text or JSON handler writing records at level and above to w
+func NewHandler(w io.Writer, format string, level slog.Leveler) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(format) {
+	case "text", "":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("unknown log format: %s", format)
+}
+
+// Setup makes a handler for format the default logger, writing records at minLevel and above.
+// Lines written with the standard log package go through it too, at info level.
+func Setup(w io.Writer, format string, minLevel slog.Level) error {
+	handler, err := NewHandler(w, format, level)
+	if err != nil {
+		return err
+	}
+	level.Set(minLevel)
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// SetLevel changes the minimum level of the logger made by Setup
+func SetLevel(minLevel slog.Level) {
+	level.Set(minLevel)
+}
+
+// Fatal logs msg at error level and exits, like log.Fatal
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Sampler lets through one in every rate events per key, starting with the first, so
+// high-frequency events such as heartbeats don't flood the logs
+type Sampler struct {
+	rate   atomic.Int64
+	counts sync.Map // key -> *atomic.Uint64
+}
+
+// Heartbeats samples the log lines of successful heartbeats, keyed by device
+var Heartbeats = NewSampler(DefaultHeartbeatSampleRate)
+
+// NewSampler creates a sampler letting through one in rate events per key, rate 0 drops them all
+func NewSampler(rate int) *Sampler {
+	s := &Sampler{}
+	s.SetRate(rate)
+	return s
+}
+
+// SetRate changes how many events per key make one log line
+func (s *Sampler) SetRate(rate int) {
+	s.rate.Store(int64(rate))
+}
+
+// Allow reports whether this event for key should be logged
+func (s *Sampler) Allow(key string) bool {
+	rate := s.rate.Load()
+	if rate <= 0 {
+		return false
+	}
+	value, _ := s.counts.LoadOrStore(key, new(atomic.Uint64))
+	n := value.(*atomic.Uint64).Add(1)
+	return (n-1)%uint64(rate) == 0
+}
+
+// Forget drops the count of key, e.g. when the device unregisters
+func (s *Sampler) Forget(key string) {
+	s.counts.Delete(key)
+}
@@ -0,0 +1,59 @@
+package logging
+
+import "testing"
+
+// allowed runs n events for key through s and returns which ones were let through, 1-based
+func allowed(s *Sampler, key string, n int) []int {
+	var through []int
+	for i := 1; i <= n; i++ {
+		if s.Allow(key) {
+			through = append(through, i)
+		}
+	}
+	return through
+}
+
+func TestSamplerDropsRepeatsUntilNextWindow(t *testing.T) {
+	s := NewSampler(3)
+
+	// The first event of every window of 3 is logged, the repeats after it are dropped
+	got := allowed(s, "alice_phone", 7)
+	if len(got) != 3 || got[0] != 1 || got[1] != 4 || got[2] != 7 {
+		t.Fatalf("events let through = %v, want [1 4 7]", got)
+	}
+
+	// Keys are sampled independently
+	if !s.Allow("bob_phone") {
+		t.Fatal("first event of another key dropped")
+	}
+	if s.Allow("alice_phone") || s.Allow("alice_phone") {
+		t.Fatal("repeat within the window let through")
+	}
+	if !s.Allow("alice_phone") {
+		t.Fatal("first event of the next window dropped")
+	}
+
+	// A forgotten key starts a new window
+	s.Allow("alice_phone")
+	s.Forget("alice_phone")
+	if !s.Allow("alice_phone") {
+		t.Fatal("first event after Forget dropped")
+	}
+}
+
+func TestSamplerRate(t *testing.T) {
+	s := NewSampler(1)
+	if got := allowed(s, "alice_phone", 5); len(got) != 5 {
+		t.Fatalf("rate 1 let through %v, want every event", got)
+	}
+
+	s.SetRate(0)
+	if got := allowed(s, "alice_phone", 5); len(got) != 0 {
+		t.Fatalf("rate 0 let through %v, want none", got)
+	}
+
+	s.SetRate(2)
+	if got := allowed(s, "bob_phone", 4); len(got) != 2 || got[0] != 1 || got[1] != 3 {
+		t.Fatalf("rate 2 let through %v, want [1 3]", got)
+	}
+}
@@ -1,86 +1,217 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"grpcon/cluster"
+	"grpcon/config"
+	"grpcon/handlers"
+	"grpcon/logging"
 	"grpcon/middleware"
 	"grpcon/models"
 	"grpcon/services"
+	"grpcon/tracing"
 
 	"github.com/joho/godotenv"
 )
 
 func main() {
-	// Load .env file
-	if err := godotenv.Load(); err != nil {
-		log.Println("Warning: .env file not found, using environment variables")
+	// Load .env file, its variables are read like the rest of the environment
+	envErr := godotenv.Load()
+
+	// Defaults, then the config file, the environment and the command line
+	loader, err := config.NewLoader(os.Args[1:])
+	if err != nil {
+		logging.Fatal("Invalid command line", "error", err)
+	}
+	cfg, err := loader.Load()
+	if err != nil {
+		logging.Fatal("Invalid configuration", "error", err)
+	}
+
+	// Log level, text or JSON output and heartbeat sampling
+	if err := logging.Setup(os.Stderr, cfg.Logging.Format, cfg.Logging.SlogLevel()); err != nil {
+		logging.Fatal("Failed to configure logging", "error", err)
+	}
+	if envErr != nil {
+		slog.Warn(".env file not found, using environment variables")
+	}
+	if path := loader.Path(); path != "" {
+		slog.Info("Loaded config file", "path", path)
 	}
 
-	// Verify API key is loaded
-	if apiKey := os.Getenv("X_API_KEY"); apiKey != "" {
-		log.Printf("API key loaded successfully (length: %d)", len(apiKey))
-	} else {
-		log.Println("WARNING: X_API_KEY not found in environment!")
+	// API keys of services, on the HTTP gateway and the gRPC API
+	keys, err := middleware.LoadKeyStore(cfg.Auth.APIKeysFile, cfg.Auth.APIKey)
+	if err != nil {
+		logging.Fatal("Failed to load API keys", "error", err)
 	}
 
-	// Default ports
-	grpcPort := ":50051"
-	httpPort := ":8080"
+	// Which traces are sampled and where their spans go, nowhere unless an exporter is configured
+	tracerProvider, err := tracing.Setup(tracing.Options{
+		Exporter:     cfg.Tracing.Exporter,
+		MemorySpans:  cfg.Tracing.MemorySpans,
+		SampleRatio:  cfg.Tracing.SampleRatio,
+		OTLPEndpoint: cfg.Tracing.OTLPEndpoint,
+		OTLPInsecure: cfg.Tracing.OTLPInsecure,
+	})
+	if err != nil {
+		logging.Fatal("Failed to configure tracing", "error", err)
+	}
 
-	if p := os.Getenv("GRPC_PORT"); p != "" {
-		grpcPort = ":" + p
+	// TLS for both servers when a certificate is configured. Devices may have to present a client
+	// certificate to the gRPC server, the gateway only asks for one if tls.http_client_auth says so.
+	stopTLSReloader := make(chan struct{})
+	tlsReloader, err := middleware.StartTLSReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.ClientCAFile, cfg.TLS.ReloadInterval, stopTLSReloader)
+	if err != nil {
+		logging.Fatal("Failed to load TLS certificate", "error", err)
 	}
-	if p := os.Getenv("HTTP_PORT"); p != "" {
-		httpPort = ":" + p
+	var grpcTLS, httpTLS *tls.Config
+	if tlsReloader != nil {
+		// Both policies were checked when the configuration was loaded
+		grpcClientAuth, _ := middleware.ParseClientAuth(cfg.TLS.ClientAuth)
+		httpClientAuth, _ := middleware.ParseClientAuth(cfg.TLS.HTTPClientAuth)
+		grpcTLS = tlsReloader.Config(grpcClientAuth)
+		httpTLS = tlsReloader.Config(httpClientAuth)
+	}
+
+	auth, err := middleware.NewAuthenticator(services.AuthOptions(cfg, keys))
+	if err != nil {
+		logging.Fatal("Failed to configure gRPC authentication", "error", err)
 	}
 
 	// Create and start gRPC server
-	server, err := services.NewServer(grpcPort)
+	server, err := services.NewServerWithTLS(cfg.Server.GRPCAddr(), models.NewConnectionManager(), auth, grpcTLS)
 	if err != nil {
-		log.Fatalf("Failed to create server: %v", err)
+		logging.Fatal("Failed to create server", "error", err)
 	}
 
-	// Start health check monitor for stale connections
+	// Timings and limits of the connection handler, applied again when the configuration is reloaded
 	notifServer := server.GetNotificationServer()
 	connHandler := notifServer.GetConnectionHandler()
+	applyConfig := func(cfg *config.Config) {
+		connHandler.SetHeartbeatOptions(services.HeartbeatOptions(cfg.Heartbeat))
+		connHandler.SetSendQueueOptions(cfg.Delivery.SendQueueSize, cfg.Delivery.OverflowPolicy())
+		connHandler.SetBatchConcurrency(cfg.Delivery.BatchConcurrency)
+		connHandler.SetAckOptions(cfg.Delivery.AckTimeout, cfg.Delivery.MaxAttempts)
+		connHandler.GetInbox().SetLimits(cfg.Delivery.InboxCapacity, cfg.Delivery.InboxMaxClients, cfg.Delivery.InboxTTL)
+		connHandler.SetMaxBatchSize(cfg.Delivery.MaxBatchSize)
+		connHandler.SetHistoryOptions(cfg.Delivery.HistoryCapacity, cfg.Delivery.HistoryIdleTTL)
+		connHandler.SetMetricsServices(cfg.Server.MetricsServiceList())
+		logging.SetLevel(cfg.Logging.SlogLevel())
+		logging.Heartbeats.SetRate(cfg.Logging.HeartbeatSample)
+	}
+	applyConfig(cfg)
+	go loader.Watch(cfg, applyConfig, nil)
+
+	// Start health check monitor for stale connections
 	connHandler.StartHealthCheckMonitor()
-	log.Println("Health check monitor started successfully")
+
+	// Join the cluster when Redis is configured, otherwise run as a single node
+	var registry cluster.Registry
+	if cfg.Cluster.RedisAddr != "" {
+		nodeID := cfg.Cluster.NodeID
+		if nodeID == "" {
+			nodeID = cluster.DefaultNodeID()
+		}
+		redisRegistry, err := cluster.NewRedisRegistry(cfg.Cluster.RedisAddr, cfg.Cluster.RedisPassword, nodeID, cfg.Cluster.NodeTTL)
+		if err != nil {
+			logging.Fatal("Failed to connect to redis", "error", err)
+		}
+		if err := connHandler.EnableCluster(redisRegistry); err != nil {
+			logging.Fatal("Failed to join cluster", "error", err)
+		}
+		registry = redisRegistry
+		slog.Info("Cluster mode enabled", "node_id", registry.NodeID())
+	}
 
 	// Start HTTP gateway using the SAME notification server
+	httpServer := setupHTTPGateway(server, keys, cfg, httpTLS, tracerProvider.Memory())
 	go func() {
-		log.Printf("Starting HTTP gateway on %s", httpPort)
-		setupHTTPGateway(server, httpPort)
+		slog.Info("Starting HTTP gateway", "addr", httpServer.Addr)
+		var err error
+		if httpServer.TLSConfig != nil {
+			err = httpServer.ListenAndServeTLS("", "")
+		} else {
+			err = httpServer.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			logging.Fatal("HTTP gateway stopped", "error", err)
+		}
 	}()
 
-	// Handle graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	// Start serving gRPC
+	slog.Info("gRPC server listening", "addr", cfg.Server.GRPCAddr())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Start()
+	}()
 
+	// Serve until SIGINT or SIGTERM, a second one during the shutdown exits right away
+	sigChan := make(chan os.Signal, 2)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		logging.Fatal("Failed to serve", "error", err)
+	case sig := <-sigChan:
+		slog.Info("Received shutdown signal", "signal", sig.String(), "timeout", cfg.Shutdown.Timeout)
+	}
 	go func() {
 		<-sigChan
-		log.Println("Received shutdown signal")
-		server.Stop()
-		os.Exit(0)
+		logging.Fatal("Received second shutdown signal, exiting now")
 	}()
 
-	// Start serving gRPC
-	log.Printf("gRPC server listening on %s", grpcPort)
-	if err := server.Start(); err != nil {
-		log.Fatalf("Failed to serve: %v", err)
+	shutdown(cfg.Shutdown, connHandler, httpServer, registry, server, tracerProvider, stopTLSReloader)
+	slog.Info("Server stopped")
+}
+
+// shutdown stops the server within cfg.Timeout: devices are told to go away and their send queues
+// flushed during the first half, then the HTTP gateway and the gRPC server stop, cutting whatever
+// is still running when the time is up. The last spans are flushed and closing stopTLSReloader stops
+// watching the certificate files.
+func shutdown(cfg config.Shutdown, connHandler *handlers.ConnectionHandler, httpServer *http.Server, registry cluster.Registry, server *services.Server, tracerProvider *tracing.Provider, stopTLSReloader chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	// No new registrations or streams from here on
+	drainCtx, cancelDrain := context.WithTimeout(ctx, cfg.Timeout/2)
+	connHandler.Shutdown(drainCtx, cfg.ReconnectWindow)
+	cancelDrain()
+
+	// Requests in progress finish, the gateway takes no new ones
+	if err := httpServer.Shutdown(ctx); err != nil {
+		slog.Warn("HTTP gateway did not stop in time, closing it", "error", err)
+		httpServer.Close()
+	}
+
+	// Devices of this node can be claimed by the others as soon as they reconnect
+	if registry != nil {
+		if err := registry.Close(); err != nil {
+			slog.Error("Failed to leave cluster", "error", err)
+		}
 	}
+
+	server.Shutdown(ctx)
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		slog.Warn("Failed to flush trace spans", "error", err)
+	}
+	close(stopTLSReloader)
 }
 
-func setupHTTPGateway(server *services.Server, port string) {
+// setupHTTPGateway registers the gateway routes and returns the server for them, not yet listening
+func setupHTTPGateway(server *services.Server, keys *middleware.KeyStore, cfg *config.Config, tlsConfig *tls.Config, spans *tracing.MemoryExporter) *http.Server {
 	notifServer := server.GetNotificationServer()
 
-	http.HandleFunc("/send", middleware.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/send", middleware.AuthMiddleware(keys, middleware.ScopeSend, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			json.NewEncoder(w).Encode(map[string]string{"error": "Only POST method allowed"})
@@ -88,10 +219,13 @@ func setupHTTPGateway(server *services.Server, port string) {
 		}
 
 		var req struct {
-			ClientID  string `json:"client_id"`
-			CreatedAt string `json:"created_at"`
-			UpdatedAt string `json:"updated_at"`
-			CallID    string `json:"call_id"`
+			notificationRequest
+			ClientID  string            `json:"client_id"`
+			ClientIDs []string          `json:"client_ids"` // several clients, each gets its own copy
+			Devices   []handlers.Target `json:"devices"`    // specific devices, {"client_id", "device_id"}
+			Strategy  string            `json:"strategy"`   // delivery strategy, least_loaded by default
+			DeviceID  string            `json:"device_id"`  // for the specific_device strategy
+			Topic     string            `json:"topic"`      // publish to topic subscribers instead of client_id
 		}
 
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -100,52 +234,271 @@ func setupHTTPGateway(server *services.Server, port string) {
 			return
 		}
 
-		notification := &models.NotificationData{
-			ID:          fmt.Sprintf("notif_%d", time.Now().Unix()),
-			ClientID:    req.ClientID,
-			CreatedAt:   req.CreatedAt,
-			UpdatedAt:   req.UpdatedAt,
-			CallID:      req.CallID,
-			ServiceName: "http_gateway",
-			Timestamp:   time.Now().Unix(),
+		notification, err := req.toNotification(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
 		}
-		//change here to send to all devices of the client instead of only first device
-		// err := notifServer.SendNotificationToClient(notification)
-		// err := notifServer.GetConnectionHandler().SendToFirstDevice(notification)
-		err := notifServer.GetConnectionHandler().SendToDeviceWithLeastNotification(notification) // currently sending to device with least notification count.
+
+		if req.Strategy == "" {
+			req.Strategy = handlers.DefaultStrategy
+		}
+		strategy, err := notifServer.GetConnectionHandler().GetStrategy(req.Strategy, req.DeviceID)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(http.StatusBadRequest)
 			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 			return
 		}
 
-		json.NewEncoder(w).Encode(map[string]string{"status": "sent"})
+		// A topic reaches its subscribers whatever client they belong to, it can't be narrowed to clients
+		if req.Topic != "" && (req.ClientID != "" || len(req.ClientIDs) > 0 || len(req.Devices) > 0) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "topic can't be combined with client_id, client_ids or devices"})
+			return
+		}
+
+		// Several clients and/or devices: report the outcome of each one
+		if len(req.ClientIDs) > 0 || len(req.Devices) > 0 {
+			var targets []handlers.Target
+			if req.ClientID != "" {
+				targets = append(targets, handlers.Target{ClientID: req.ClientID})
+			}
+			for _, clientID := range req.ClientIDs {
+				targets = append(targets, handlers.Target{ClientID: clientID})
+			}
+			targets = append(targets, req.Devices...)
+
+			results := notifServer.GetConnectionHandler().PublishToTargets(notification, targets, strategy)
+			summary := handlers.SummarizeTargets(results)
+
+			switch {
+			case summary[handlers.DeliveryFailed] == len(results):
+				w.WriteHeader(targetsFailedStatus(results))
+			case summary[handlers.DeliveryQueued] == len(results):
+				w.WriteHeader(http.StatusAccepted)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status":  multiTargetStatus(summary, len(results)),
+				"summary": summary,
+				"results": results,
+			})
+			return
+		}
+
+		if req.Topic != "" {
+			results, err := notifServer.GetConnectionHandler().PublishToTopic(notification, req.Topic)
+			if err != nil {
+				w.WriteHeader(handlers.HTTPStatus(err))
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+				return
+			}
+			json.NewEncoder(w).Encode(handlers.NewTopicReport(req.Topic, results))
+			return
+		}
+
+		if req.ClientID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "client_id, client_ids, devices or topic is required"})
+			return
+		}
+		notification.ClientID = req.ClientID
+
+		// 202 if no device is online right now, it will be delivered when one attaches a stream
+		results, err := notifServer.GetConnectionHandler().PublishToClient(notification, strategy)
+		report := handlers.NewDeliveryReport(notification, results, err)
+		w.WriteHeader(handlers.HTTPStatus(err))
+		json.NewEncoder(w).Encode(report)
+	}))
+
+	// Send many notifications in one call, each one reported on its own
+	http.HandleFunc("/send/batch", middleware.AuthMiddleware(keys, middleware.ScopeSend, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Only POST method allowed"})
+			return
+		}
+
+		var req struct {
+			Notifications []struct {
+				notificationRequest
+				ClientID string `json:"client_id"`
+				Strategy string `json:"strategy"`  // delivery strategy, least_loaded by default
+				DeviceID string `json:"device_id"` // for the specific_device strategy
+				Topic    string `json:"topic"`
+			} `json:"notifications"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+			return
+		}
+		connHandler := notifServer.GetConnectionHandler()
+		if connHandler.IsShuttingDown() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{"error": handlers.ErrShuttingDown.Error()})
+			return
+		}
+		if maxSize := connHandler.MaxBatchSize(); len(req.Notifications) == 0 || len(req.Notifications) > maxSize {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": fmt.Sprintf("notifications must hold 1 to %d items", maxSize),
+			})
+			return
+		}
+
+		// Invalid items are reported right away, the others delivered together
+		results := make([]handlers.BatchResult, len(req.Notifications))
+		var items []handlers.BatchItem
+		var indexes []int
+		for i, n := range req.Notifications {
+			notification, err := n.toNotification(r.Context())
+			if err != nil {
+				results[i] = handlers.InvalidBatchResult(i, err)
+				continue
+			}
+			item := handlers.BatchItem{Notification: notification, ClientID: n.ClientID, Topic: n.Topic}
+			if n.Topic == "" {
+				if n.Strategy == "" {
+					n.Strategy = handlers.DefaultStrategy
+				}
+				item.Strategy, err = connHandler.GetStrategy(n.Strategy, n.DeviceID)
+				if err != nil {
+					results[i] = handlers.InvalidBatchResult(i, err)
+					continue
+				}
+			}
+			items = append(items, item)
+			indexes = append(indexes, i)
+		}
+		for j, result := range connHandler.PublishBatch(items) {
+			result.Index = indexes[j]
+			results[indexes[j]] = result
+		}
+
+		summary := map[string]int{"total": len(results)}
+		for _, result := range results {
+			summary[string(result.Status)]++
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"summary": summary,
+			"results": results,
+		})
+	}))
+
+	// Broadcast a notification to every device of every client
+	http.HandleFunc("/broadcast", middleware.AuthMiddleware(keys, middleware.ScopeBroadcast, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Only POST method allowed"})
+			return
+		}
+
+		var req notificationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+			return
+		}
+
+		notification, err := req.toNotification(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+
+		connHandler := notifServer.GetConnectionHandler()
+		if connHandler.IsShuttingDown() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{"error": handlers.ErrShuttingDown.Error()})
+			return
+		}
+
+		results := connHandler.PublishBroadcast(notification)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "broadcast",
+			"summary": handlers.SummarizeDeliveries(results),
+			"results": results,
+		})
+	}))
+
+	// Issue a device token for the gRPC API, devices send it as "authorization: Bearer <token>"
+	http.HandleFunc("/token", middleware.AuthMiddleware(keys, middleware.ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Only POST method allowed"})
+			return
+		}
+
+		secret := cfg.Auth.ClientTokenSecret
+		if secret == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "auth.client_token_secret (CLIENT_TOKEN_SECRET) is not configured"})
+			return
+		}
+
+		var req struct {
+			ClientID string `json:"client_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ClientID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "client_id is required"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"client_id":  req.ClientID,
+			"token":      middleware.SignClientToken([]byte(secret), req.ClientID, cfg.Auth.ClientTokenTTL),
+			"expires_at": time.Now().Add(cfg.Auth.ClientTokenTTL).Unix(),
+		})
 	}))
 
 	// Get connection stats endpoint
-	http.HandleFunc("/stats", middleware.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/stats", middleware.AuthMiddleware(keys, middleware.ScopeReadStats, func(w http.ResponseWriter, r *http.Request) {
 		stats := notifServer.GetConnectionStats()
 		json.NewEncoder(w).Encode(stats)
 	}))
 
+	// Prometheus metrics, open to unauthenticated scrapers with server.metrics_public
+	metricsHandler := notifServer.GetMetrics().Handler().ServeHTTP
+	if !cfg.Server.MetricsPublic {
+		metricsHandler = middleware.AuthMiddleware(keys, middleware.ScopeReadStats, metricsHandler)
+	}
+	http.HandleFunc("/metrics", metricsHandler)
+
 	// List all clients endpoint
-	http.HandleFunc("/clients", middleware.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/clients", middleware.AuthMiddleware(keys, middleware.ScopeReadStats, func(w http.ResponseWriter, r *http.Request) {
 		connHandler := notifServer.GetConnectionHandler()
-		clientIDs := connHandler.GetConnectionManager().GetAllClientIDs()
+		clientIDs := connHandler.GetConnectionStore().GetAllClientIDs()
 
 		clientsInfo := make(map[string]interface{})
 		for _, clientID := range clientIDs {
 			devices, _ := connHandler.GetClientDevices(clientID)
 			deviceList := make([]map[string]interface{}, 0)
 			for _, device := range devices {
-				deviceList = append(deviceList, map[string]interface{}{
-					"device_id":    device.DeviceID,
-					"unique_id":    device.UniqueID,
-					"service_name": device.ServiceName,
-					"is_active":    device.IsActive,
-					"connected_at": device.ConnectedAt,
-					"notif_count":  device.NotificationCount,
-				})
+				// Read everything under one lock so the fields agree with each other
+				snapshot := device.Snapshot()
+				info := map[string]interface{}{
+					"device_id":    snapshot.DeviceID,
+					"unique_id":    snapshot.UniqueID,
+					"service_name": snapshot.ServiceName,
+					"platform":     snapshot.Platform,
+					"app_version":  snapshot.AppVersion,
+					"is_active":    snapshot.IsActive,
+					"connected_at": snapshot.ConnectedAt,
+					"notif_count":  snapshot.NotificationCount,
+					"acked_count":  snapshot.AckedCount,
+					"unacked":      snapshot.UnackedCount,
+					"paused":       snapshot.Paused,
+					"topics":       connHandler.GetDeviceTopics(device),
+				}
+				if snapshot.Queue != nil {
+					info["queue_depth"] = snapshot.Queue.Depth
+					info["queue_max_depth"] = snapshot.Queue.MaxDepth
+					info["queue_dropped"] = snapshot.Queue.Dropped
+				}
+				deviceList = append(deviceList, info)
 			}
 			clientsInfo[clientID] = deviceList
 		}
@@ -153,5 +506,128 @@ func setupHTTPGateway(server *services.Server, port string) {
 		json.NewEncoder(w).Encode(clientsInfo)
 	}))
 
-	log.Fatal(http.ListenAndServe(port, nil))
+	// List API keys, without their secrets
+	http.HandleFunc("/keys", middleware.AuthMiddleware(keys, middleware.ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys.Describe()})
+	}))
+
+	// Issue a new secret for a key, the current ones stay valid for overlap_seconds (default auth.key_rotation_overlap)
+	http.HandleFunc("/keys/rotate", middleware.AuthMiddleware(keys, middleware.ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Only POST method allowed"})
+			return
+		}
+
+		var req struct {
+			Name           string `json:"name"`
+			OverlapSeconds *int   `json:"overlap_seconds"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "name is required"})
+			return
+		}
+		overlap := cfg.Auth.KeyRotationOverlap
+		if req.OverlapSeconds != nil {
+			if *req.OverlapSeconds < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "overlap_seconds can't be negative"})
+				return
+			}
+			overlap = time.Duration(*req.OverlapSeconds) * time.Second
+		}
+
+		secret, err := keys.Rotate(req.Name, overlap)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"name":                req.Name,
+			"key":                 secret,
+			"previous_expires_at": time.Now().Add(overlap),
+		})
+	}))
+
+	// Recent requests made with API keys
+	http.HandleFunc("/audit", middleware.AuthMiddleware(keys, middleware.ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"entries": keys.AuditLog()})
+	}))
+
+	// Recent trace spans kept by the memory exporter, ?trace_id= selects one trace
+	if spans != nil {
+		http.HandleFunc("/traces", middleware.AuthMiddleware(keys, middleware.ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(map[string]interface{}{"spans": spans.Spans(r.URL.Query().Get("trace_id"))})
+		}))
+	}
+
+	// Every request is traced, continuing the caller's traceparent header
+	return &http.Server{
+		Addr:      cfg.Server.HTTPAddr(),
+		Handler:   tracing.HTTPHandler(http.DefaultServeMux),
+		TLSConfig: tlsConfig,
+	}
+}
+
+// notificationRequest holds the notification fields accepted by /send and /broadcast
+type notificationRequest struct {
+	CreatedAt string            `json:"created_at"`
+	UpdatedAt string            `json:"updated_at"`
+	CallID    string            `json:"call_id"`
+	Title     string            `json:"title"`
+	Body      string            `json:"body"`
+	Data      map[string]string `json:"data"`
+	Payload   []byte            `json:"payload"` // base64 encoded
+	Category  string            `json:"category"`
+	Priority  string            `json:"priority"`
+}
+
+// toNotification builds the notification, ID and sequence are assigned by the connection handler.
+// Its deliveries are traced as part of the request's trace.
+func (req notificationRequest) toNotification(ctx context.Context) (*models.NotificationData, error) {
+	priority, err := models.ParsePriority(req.Priority)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.NotificationData{
+		CreatedAt:   req.CreatedAt,
+		UpdatedAt:   req.UpdatedAt,
+		CallID:      req.CallID,
+		ServiceName: "http_gateway",
+		Timestamp:   time.Now().Unix(),
+		Title:       req.Title,
+		Body:        req.Body,
+		Data:        req.Data,
+		Payload:     req.Payload,
+		Category:    req.Category,
+		Priority:    priority,
+		Traceparent: tracing.TraceparentFromContext(ctx),
+	}, nil
+}
+
+// targetsFailedStatus returns the HTTP status for a multi-target send where every target failed:
+// the status of their error if they all failed the same way, 500 otherwise
+func targetsFailedStatus(results []handlers.TargetResult) int {
+	for _, result := range results[1:] {
+		if result.ErrorCode != results[0].ErrorCode {
+			return http.StatusInternalServerError
+		}
+	}
+	return handlers.HTTPStatus(results[0].Err)
+}
+
+// multiTargetStatus sums up a multi-target send: "completed" if every target got the notification
+// (sent, relayed or queued), "failed" if none did, "partial" otherwise
+func multiTargetStatus(summary map[handlers.DeliveryStatus]int, targets int) string {
+	switch summary[handlers.DeliveryFailed] {
+	case 0:
+		return "completed"
+	case targets:
+		return "failed"
+	}
+	return "partial"
 }
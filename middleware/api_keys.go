@@ -0,0 +1,387 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Scope is what an API key may do on the HTTP gateway
+type Scope string
+
+const (
+	ScopeSend      Scope = "send"       // /send
+	ScopeBroadcast Scope = "broadcast"  // /broadcast
+	ScopeReadStats Scope = "read_stats" // /stats, /clients, /metrics
+	ScopeAdmin     Scope = "admin"      // everything, including /token, /keys and /audit
+)
+
+// ParseScope validates a scope name
+func ParseScope(value string) (Scope, error) {
+	switch scope := Scope(value); scope {
+	case ScopeSend, ScopeBroadcast, ScopeReadStats, ScopeAdmin:
+		return scope, nil
+	}
+	return "", fmt.Errorf("unknown scope: %s", value)
+}
+
+// auditLogSize is how many audit entries the key store keeps for /audit
+const auditLogSize = 1000
+
+// APIKey is one secret of a named key. A name can have several secrets at once while a key is
+// being rotated, they share the name's scopes and rate limit.
+type APIKey struct {
+	Name               string
+	Scopes             []Scope
+	RateLimitPerMinute int       // 0 means unlimited
+	NotBefore          time.Time // zero means valid now
+	ExpiresAt          time.Time // zero means never expires
+
+	hash [sha256.Size]byte
+}
+
+// HasScope reports whether the key grants scope. ScopeAdmin grants every scope.
+func (k *APIKey) HasScope(scope Scope) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// validAt reports whether the secret can be used at the given time
+func (k *APIKey) validAt(now time.Time) bool {
+	if !k.NotBefore.IsZero() && now.Before(k.NotBefore) {
+		return false
+	}
+	return k.ExpiresAt.IsZero() || now.Before(k.ExpiresAt)
+}
+
+// AuditEntry records one request made with an API key
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	KeyName    string    `json:"key_name"`
+	Action     Scope     `json:"action"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status,omitempty"`    // HTTP requests
+	GRPCCode   string    `json:"grpc_code,omitempty"` // gRPC calls
+	RemoteAddr string    `json:"remote_addr"`
+}
+
+// rateLimiter is a token bucket refilled with limit tokens per minute
+type rateLimiter struct {
+	limit  float64
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token, or returns how long until one is available
+func (l *rateLimiter) allow(now time.Time) (bool, time.Duration) {
+	l.tokens += now.Sub(l.last).Minutes() * l.limit
+	if l.tokens > l.limit {
+		l.tokens = l.limit
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - l.tokens) / l.limit * float64(time.Minute))
+}
+
+// KeyStore holds the API keys of the HTTP gateway
+type KeyStore struct {
+	mu        sync.Mutex
+	keys      []*APIKey
+	limiters  map[string]*rateLimiter // key: key name
+	audit     []AuditEntry            // ring buffer, oldest at auditNext once full
+	auditNext int
+}
+
+// NewKeyStore creates an empty key store
+func NewKeyStore() *KeyStore {
+	return &KeyStore{limiters: make(map[string]*rateLimiter)}
+}
+
+// hashKey returns the digest secrets are stored and compared as
+func hashKey(secret string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(secret))
+}
+
+// Add adds a secret for a named key. Keys with the same name share scopes and rate limit, the
+// ones of the last secret added win.
+func (s *KeyStore) Add(key APIKey, secret string) error {
+	if key.Name == "" {
+		return fmt.Errorf("key name is required")
+	}
+	if secret == "" {
+		return fmt.Errorf("key %s has no secret", key.Name)
+	}
+	if len(key.Scopes) == 0 {
+		return fmt.Errorf("key %s has no scopes", key.Name)
+	}
+	key.hash = hashKey(secret)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.keys {
+		if existing.Name == key.Name {
+			existing.Scopes = key.Scopes
+			existing.RateLimitPerMinute = key.RateLimitPerMinute
+		}
+	}
+	s.keys = append(s.keys, &key)
+	s.setLimiterLocked(key.Name, key.RateLimitPerMinute)
+	return nil
+}
+
+// setLimiterLocked (re)creates the rate limiter of a key name. Caller must hold s.mu.
+func (s *KeyStore) setLimiterLocked(name string, perMinute int) {
+	if perMinute <= 0 {
+		delete(s.limiters, name)
+		return
+	}
+	if limiter, exists := s.limiters[name]; exists && limiter.limit == float64(perMinute) {
+		return
+	}
+	s.limiters[name] = &rateLimiter{limit: float64(perMinute), tokens: float64(perMinute), last: time.Now()}
+}
+
+// Lookup returns the key a secret belongs to. Every stored secret is compared in constant time,
+// so the time taken doesn't tell which key, if any, was close.
+func (s *KeyStore) Lookup(secret string) (*APIKey, bool) {
+	hash := hashKey(secret)
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var found *APIKey
+	for _, key := range s.keys {
+		if subtle.ConstantTimeCompare(hash[:], key.hash[:]) == 1 && found == nil {
+			found = key
+		}
+	}
+	if found == nil || !found.validAt(now) {
+		return nil, false
+	}
+	// A copy, rotation changes the stored key
+	key := *found
+	return &key, true
+}
+
+// Allow applies the rate limit of a key name. Returns how long to wait when it is exceeded.
+func (s *KeyStore) Allow(name string) (bool, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	limiter, exists := s.limiters[name]
+	if !exists {
+		return true, 0
+	}
+	return limiter.allow(time.Now())
+}
+
+// Rotate issues a new secret for a named key. The current secrets stay valid for overlap so
+// callers can switch over, then expire. Rotation only changes the store in memory: after a restart
+// the keys of the key file are valid again and the new secret is not, unless it was added there.
+func (s *KeyStore) Rotate(name string, overlap time.Duration) (string, error) {
+	secret, err := generateSecret()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var current *APIKey
+	for _, key := range s.keys {
+		if key.Name != name || !key.validAt(now) {
+			continue
+		}
+		current = key
+		if key.ExpiresAt.IsZero() || key.ExpiresAt.After(now.Add(overlap)) {
+			key.ExpiresAt = now.Add(overlap)
+		}
+	}
+	if current == nil {
+		return "", fmt.Errorf("no active key named %s", name)
+	}
+
+	s.keys = append(s.keys, &APIKey{
+		Name:               name,
+		Scopes:             current.Scopes,
+		RateLimitPerMinute: current.RateLimitPerMinute,
+		hash:               hashKey(secret),
+	})
+	s.removeExpiredLocked(now)
+
+	slog.Info("API key rotated", "key", name, "previous_expires_at", now.Add(overlap).Format(time.RFC3339))
+	return secret, nil
+}
+
+// removeExpiredLocked drops secrets that can't be used anymore. Caller must hold s.mu.
+func (s *KeyStore) removeExpiredLocked(now time.Time) {
+	kept := s.keys[:0]
+	for _, key := range s.keys {
+		if key.ExpiresAt.IsZero() || now.Before(key.ExpiresAt) {
+			kept = append(kept, key)
+		}
+	}
+	s.keys = kept
+}
+
+// generateSecret returns a random 32 byte secret, hex encoded
+func generateSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Len returns the number of stored secrets
+func (s *KeyStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.keys)
+}
+
+// Describe lists the stored keys without their secrets, for /keys
+func (s *KeyStore) Describe() []map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	result := make([]map[string]interface{}, 0, len(s.keys))
+	for _, key := range s.keys {
+		info := map[string]interface{}{
+			"name":                  key.Name,
+			"scopes":                key.Scopes,
+			"rate_limit_per_minute": key.RateLimitPerMinute,
+			"active":                key.validAt(now),
+			// A short fingerprint tells secrets of the same name apart
+			"fingerprint": hex.EncodeToString(key.hash[:4]),
+		}
+		if !key.NotBefore.IsZero() {
+			info["not_before"] = key.NotBefore
+		}
+		if !key.ExpiresAt.IsZero() {
+			info["expires_at"] = key.ExpiresAt
+		}
+		result = append(result, info)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i]["name"].(string) < result[j]["name"].(string)
+	})
+	return result
+}
+
+// Record adds an entry to the audit log and writes it to the server log
+func (s *KeyStore) Record(entry AuditEntry) {
+	slog.Info("AUDIT", "key", entry.KeyName, "action", entry.Action, "method", entry.Method,
+		"path", entry.Path, "status", entry.Status, "grpc_code", entry.GRPCCode, "remote", entry.RemoteAddr)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.audit) < auditLogSize {
+		s.audit = append(s.audit, entry)
+		return
+	}
+	s.audit[s.auditNext] = entry
+	s.auditNext = (s.auditNext + 1) % auditLogSize
+}
+
+// AuditLog returns the most recent audit entries, oldest first
+func (s *KeyStore) AuditLog() []AuditEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]AuditEntry, 0, len(s.audit))
+	entries = append(entries, s.audit[s.auditNext:]...)
+	return append(entries, s.audit[:s.auditNext]...)
+}
+
+// keyFileEntry is one key of the API_KEYS_FILE
+type keyFileEntry struct {
+	Name               string     `json:"name"`
+	Key                string     `json:"key"`
+	Scopes             []string   `json:"scopes"`
+	RateLimitPerMinute int        `json:"rate_limit_per_minute"`
+	NotBefore          *time.Time `json:"not_before"`
+	ExpiresAt          *time.Time `json:"expires_at"`
+}
+
+// LoadKeyFile adds the keys of a JSON file: {"keys": [{"name", "key", "scopes", ...}]}
+func (s *KeyStore) LoadKeyFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var file struct {
+		Keys []keyFileEntry `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("invalid API key file %s: %v", path, err)
+	}
+
+	for _, entry := range file.Keys {
+		key := APIKey{Name: entry.Name, RateLimitPerMinute: entry.RateLimitPerMinute}
+		for _, value := range entry.Scopes {
+			scope, err := ParseScope(value)
+			if err != nil {
+				return fmt.Errorf("key %s: %v", entry.Name, err)
+			}
+			key.Scopes = append(key.Scopes, scope)
+		}
+		if entry.NotBefore != nil {
+			key.NotBefore = *entry.NotBefore
+		}
+		if entry.ExpiresAt != nil {
+			key.ExpiresAt = *entry.ExpiresAt
+		}
+		if err := s.Add(key, entry.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadKeyStore loads the keys of the key file at path, if any. defaultSecret, if set, is added as
+// the "default" key with the admin scope.
+func LoadKeyStore(path, defaultSecret string) (*KeyStore, error) {
+	store := NewKeyStore()
+
+	if path != "" {
+		if err := store.LoadKeyFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if secret := defaultSecret; secret != "" {
+		if err := store.Add(APIKey{Name: "default", Scopes: []Scope{ScopeAdmin}}, secret); err != nil {
+			return nil, err
+		}
+	}
+
+	if store.Len() == 0 {
+		slog.Warn("No API keys configured (auth.api_keys_file, auth.api_key), every HTTP request will be rejected")
+	} else {
+		slog.Info("Loaded API keys", "count", store.Len())
+	}
+	return store, nil
+}
@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestKeyStore holds the given keys, each added with its name as the secret
+func newTestKeyStore(t *testing.T, keys ...APIKey) *KeyStore {
+	t.Helper()
+	store := NewKeyStore()
+	for _, key := range keys {
+		if err := store.Add(key, key.Name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestKeyStoreScopes(t *testing.T) {
+	store := newTestKeyStore(t,
+		APIKey{Name: "billing", Scopes: []Scope{ScopeSend}},
+		APIKey{Name: "ops", Scopes: []Scope{ScopeAdmin}},
+		APIKey{Name: "later", Scopes: []Scope{ScopeSend}, NotBefore: time.Now().Add(time.Hour)},
+		APIKey{Name: "expired", Scopes: []Scope{ScopeSend}, ExpiresAt: time.Now().Add(-time.Minute)},
+	)
+
+	billing, ok := store.Lookup("billing")
+	if !ok || billing.Name != "billing" {
+		t.Fatalf("Lookup(billing) = %+v, %v", billing, ok)
+	}
+	if !billing.HasScope(ScopeSend) || billing.HasScope(ScopeBroadcast) || billing.HasScope(ScopeAdmin) {
+		t.Fatalf("billing scopes = %v, want only send", billing.Scopes)
+	}
+
+	ops, _ := store.Lookup("ops")
+	for _, scope := range []Scope{ScopeSend, ScopeBroadcast, ScopeReadStats, ScopeAdmin} {
+		if !ops.HasScope(scope) {
+			t.Errorf("admin key lacks the %s scope", scope)
+		}
+	}
+
+	for _, secret := range []string{"nope", "later", "expired"} {
+		if key, ok := store.Lookup(secret); ok {
+			t.Errorf("Lookup(%s) = %+v, want it rejected", secret, key)
+		}
+	}
+
+	if _, err := ParseScope("write"); err == nil {
+		t.Error("ParseScope accepted an unknown scope")
+	}
+	if err := store.Add(APIKey{Name: "none"}, "none"); err == nil {
+		t.Error("key without scopes added")
+	}
+}
+
+func TestKeyStoreRateLimit(t *testing.T) {
+	store := newTestKeyStore(t,
+		APIKey{Name: "limited", Scopes: []Scope{ScopeSend}, RateLimitPerMinute: 2},
+		APIKey{Name: "unlimited", Scopes: []Scope{ScopeSend}},
+	)
+
+	for i := 0; i < 2; i++ {
+		if allowed, _ := store.Allow("limited"); !allowed {
+			t.Fatalf("request %d refused within the limit", i+1)
+		}
+	}
+	allowed, retryAfter := store.Allow("limited")
+	if allowed {
+		t.Fatal("third request in a minute allowed with a limit of 2")
+	}
+	if retryAfter <= 0 || retryAfter > 30*time.Second {
+		t.Fatalf("retry after %v, want up to 30s", retryAfter)
+	}
+
+	for i := 0; i < 10; i++ {
+		if allowed, _ := store.Allow("unlimited"); !allowed {
+			t.Fatal("key without a rate limit refused")
+		}
+	}
+
+	// Half a minute later one more token is available
+	store.mu.Lock()
+	store.limiters["limited"].last = store.limiters["limited"].last.Add(-30 * time.Second)
+	store.mu.Unlock()
+	if allowed, _ := store.Allow("limited"); !allowed {
+		t.Fatal("request refused after the bucket refilled")
+	}
+	if allowed, _ := store.Allow("limited"); allowed {
+		t.Fatal("refill gave more than one token")
+	}
+}
+
+func TestKeyStoreRotationOverlap(t *testing.T) {
+	store := newTestKeyStore(t, APIKey{Name: "billing", Scopes: []Scope{ScopeSend, ScopeBroadcast}, RateLimitPerMinute: 60})
+
+	secret, err := store.Rotate("billing", 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret == "" || secret == "billing" {
+		t.Fatalf("Rotate returned %q, want a new secret", secret)
+	}
+
+	// Both secrets work during the overlap, with the same scopes
+	for _, s := range []string{"billing", secret} {
+		key, ok := store.Lookup(s)
+		if !ok || key.Name != "billing" || !key.HasScope(ScopeBroadcast) || key.RateLimitPerMinute != 60 {
+			t.Fatalf("Lookup during the overlap = %+v, %v", key, ok)
+		}
+	}
+	if got := store.Len(); got != 2 {
+		t.Fatalf("store holds %d secrets, want 2", got)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if _, ok := store.Lookup("billing"); ok {
+		t.Fatal("old secret still valid after the overlap")
+	}
+	if _, ok := store.Lookup(secret); !ok {
+		t.Fatal("new secret rejected after the overlap")
+	}
+
+	if _, err := store.Rotate("unknown", time.Minute); err == nil {
+		t.Fatal("rotated a key that doesn't exist")
+	}
+}
+
+func TestKeyStoreAuditLog(t *testing.T) {
+	store := NewKeyStore()
+	if entries := store.AuditLog(); len(entries) != 0 {
+		t.Fatalf("new store has %d audit entries", len(entries))
+	}
+
+	store.Record(AuditEntry{KeyName: "billing", Action: ScopeSend, Method: "POST", Path: "/send", Status: 200})
+	store.Record(AuditEntry{KeyName: "ops", Action: ScopeAdmin, Method: "GET", Path: "/keys", Status: 403})
+	entries := store.AuditLog()
+	if len(entries) != 2 || entries[0].KeyName != "billing" || entries[1].Path != "/keys" || entries[1].Status != 403 {
+		t.Fatalf("AuditLog = %+v", entries)
+	}
+
+	// Once full, the oldest entries make room and the log stays in order
+	for i := 0; i < auditLogSize; i++ {
+		store.Record(AuditEntry{KeyName: "billing", Status: i})
+	}
+	entries = store.AuditLog()
+	if len(entries) != auditLogSize {
+		t.Fatalf("AuditLog has %d entries, want %d", len(entries), auditLogSize)
+	}
+	if entries[0].Status != 0 || entries[auditLogSize-1].Status != auditLogSize-1 {
+		t.Fatalf("AuditLog spans %d..%d, want 0..%d", entries[0].Status, entries[auditLogSize-1].Status, auditLogSize-1)
+	}
+}
@@ -1,36 +1,82 @@
 package middleware
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"math"
 	"net/http"
-	"os"
+	"time"
 )
 
-// AuthMiddleware validates the X-API-KEY header
-func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		apiKey := r.Header.Get("X-API-KEY")
-		expectedKey := os.Getenv("X_API_KEY")
+type apiKeyContextKey struct{}
 
-		if expectedKey == "" {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Server configuration error"})
-			return
-		}
+// APIKeyFromContext returns the key that authenticated an HTTP request
+func APIKeyFromContext(ctx context.Context) (*APIKey, bool) {
+	key, ok := ctx.Value(apiKeyContextKey{}).(*APIKey)
+	return key, ok
+}
 
+// statusRecorder remembers the status code written by a handler for the audit log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// AuthMiddleware validates the X-API-KEY header against the key store, checks the key has the
+// scope, applies its rate limit and records the request in the audit log
+func AuthMiddleware(keys *KeyStore, scope Scope, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiKey := r.Header.Get("X-API-KEY")
 		if apiKey == "" {
 			w.WriteHeader(http.StatusUnauthorized)
 			json.NewEncoder(w).Encode(map[string]string{"error": "Missing X-API-KEY header"})
 			return
 		}
 
-		if apiKey != expectedKey {
+		key, ok := keys.Lookup(apiKey)
+		if !ok {
 			w.WriteHeader(http.StatusUnauthorized)
 			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid API key"})
 			return
 		}
 
+		entry := AuditEntry{
+			Time:       time.Now(),
+			KeyName:    key.Name,
+			Action:     scope,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			RemoteAddr: r.RemoteAddr,
+		}
+
+		if !key.HasScope(scope) {
+			entry.Status = http.StatusForbidden
+			keys.Record(entry)
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("API key %s lacks the %s scope", key.Name, scope)})
+			return
+		}
+
+		if allowed, retryAfter := keys.Allow(key.Name); !allowed {
+			entry.Status = http.StatusTooManyRequests
+			keys.Record(entry)
+			w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(retryAfter.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Rate limit exceeded"})
+			return
+		}
+
 		// API key is valid, proceed to the next handler
-		next(w, r)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+
+		entry.Status = recorder.status
+		keys.Record(entry)
 	}
 }
@@ -0,0 +1,380 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"grpcon/models"
+	pb "grpcon/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Metadata keys gRPC callers put their credentials in
+const (
+	APIKeyMetadataKey        = "x-api-key"     // backend services
+	AuthorizationMetadataKey = "authorization" // devices, "Bearer <token>"
+)
+
+// ErrNoCredentials is returned by an Authenticator when the request carries none of the credentials it understands
+var ErrNoCredentials = errors.New("no credentials")
+
+// Identity is the authenticated caller of a gRPC request
+type Identity struct {
+	Subject  string // client ID for devices, key name for services
+	ClientID string // the only client a device may act as, empty for services
+	Service  bool   // services may act for any client and publish notifications
+	Method   string // how the caller authenticated, e.g. "api_key", "client_token", "jwt" or "client_certificate"
+
+	// ExpiresAt is when the credentials expire, zero if they don't. Streams are closed then.
+	ExpiresAt time.Time
+
+	// APIKey is the key a service authenticated with, its scopes limit what the service may call
+	APIKey *APIKey
+	keys   *KeyStore // records the calls made with APIKey
+}
+
+// Authenticator validates the credentials in the incoming gRPC metadata
+type Authenticator interface {
+	// Authenticate returns the caller's identity, ErrNoCredentials if the metadata has nothing
+	// for this authenticator, or another error if the credentials are invalid
+	Authenticate(ctx context.Context, md metadata.MD) (*Identity, error)
+}
+
+// ChainAuthenticator tries each authenticator in turn until one recognises the credentials
+type ChainAuthenticator []Authenticator
+
+// Authenticate implements Authenticator
+func (c ChainAuthenticator) Authenticate(ctx context.Context, md metadata.MD) (*Identity, error) {
+	for _, auth := range c {
+		identity, err := auth.Authenticate(ctx, md)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return identity, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// APIKeyAuthenticator accepts service API keys of the key store in the x-api-key metadata. The keys
+// are the gateway's: their scopes, rate limits and audit log apply to gRPC calls too.
+type APIKeyAuthenticator struct {
+	Keys *KeyStore
+}
+
+// Authenticate implements Authenticator. A key over its rate limit fails with ResourceExhausted.
+func (a *APIKeyAuthenticator) Authenticate(ctx context.Context, md metadata.MD) (*Identity, error) {
+	values := md.Get(APIKeyMetadataKey)
+	if len(values) == 0 || values[0] == "" {
+		return nil, ErrNoCredentials
+	}
+	key, ok := a.Keys.Lookup(values[0])
+	if !ok {
+		return nil, errors.New("invalid API key")
+	}
+
+	if allowed, retryAfter := a.Keys.Allow(key.Name); !allowed {
+		fullMethod, _ := grpc.Method(ctx)
+		err := status.Errorf(codes.ResourceExhausted, "rate limit of API key %s exceeded, retry in %v", key.Name, retryAfter.Round(time.Second))
+		recordCall(ctx, a.Keys, key.Name, ScopeSend, fullMethod, err)
+		return nil, err
+	}
+	return &Identity{Subject: key.Name, Service: true, Method: "api_key", APIKey: key, keys: a.Keys}, nil
+}
+
+// recordCall adds a gRPC call made with an API key to the audit log
+func recordCall(ctx context.Context, keys *KeyStore, keyName string, scope Scope, fullMethod string, err error) {
+	entry := AuditEntry{
+		Time:     time.Now(),
+		KeyName:  keyName,
+		Action:   scope,
+		Method:   "gRPC",
+		Path:     fullMethod,
+		GRPCCode: status.Code(err).String(),
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		entry.RemoteAddr = p.Addr.String()
+	}
+	keys.Record(entry)
+}
+
+// bearerToken returns the token of an "authorization: Bearer <token>" metadata entry
+func bearerToken(md metadata.MD) (string, bool) {
+	values := md.Get(AuthorizationMetadataKey)
+	if len(values) == 0 {
+		return "", false
+	}
+	scheme, token, found := strings.Cut(values[0], " ")
+	if !found || !strings.EqualFold(scheme, "bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// AuthOptions are the credentials the gRPC authenticator accepts, empty ones are not accepted
+type AuthOptions struct {
+	Disabled          bool      // no authentication at all
+	APIKeys           *KeyStore // services, with the scopes and rate limits they have on the gateway
+	ClientTokenSecret string    // devices, see SignClientToken
+	JWTSecret         string    // HS256 JWTs
+	JWKSFile          string    // RS256/ES256 JWTs
+	JWTIssuer         string    // required iss of JWTs, if set
+	JWTAudience       string    // required aud of JWTs, if set
+	ClientCerts       bool      // client certificates verified by the TLS handshake
+	ClientCertMap     string    // file mapping certificates to client IDs
+}
+
+// NewAuthenticator builds the gRPC authenticator: services use the API key, devices tokens signed
+// with the client token secret, JWTs or client certificates. Returns nil (no authentication) only
+// if opts.Disabled is set.
+func NewAuthenticator(opts AuthOptions) (Authenticator, error) {
+	if opts.Disabled {
+		slog.Warn("gRPC authentication is disabled (auth.disabled)")
+		return nil, nil
+	}
+
+	var chain ChainAuthenticator
+	if keys := opts.APIKeys; keys != nil && keys.Len() > 0 {
+		chain = append(chain, &APIKeyAuthenticator{Keys: keys})
+	}
+	if secret := opts.ClientTokenSecret; secret != "" {
+		chain = append(chain, &ClientTokenAuthenticator{Secret: []byte(secret)})
+	}
+
+	jwtAuth := &JWTAuthenticator{
+		HMACSecret: []byte(opts.JWTSecret),
+		Issuer:     opts.JWTIssuer,
+		Audience:   opts.JWTAudience,
+	}
+	if path := opts.JWKSFile; path != "" {
+		jwks, err := LoadJWKS(path)
+		if err != nil {
+			return nil, err
+		}
+		jwtAuth.JWKS = jwks
+		slog.Info("Loaded JWT verification keys", "path", path)
+	}
+	if len(jwtAuth.HMACSecret) > 0 || jwtAuth.JWKS != nil {
+		chain = append(chain, jwtAuth)
+	}
+
+	// Client certificates verified by the TLS handshake, see StartTLSReloader
+	if opts.ClientCerts {
+		certAuth := &CertificateAuthenticator{}
+		if path := opts.ClientCertMap; path != "" {
+			mapping, err := LoadClientCertMap(path)
+			if err != nil {
+				return nil, err
+			}
+			certAuth.ClientIDs = mapping
+		}
+		chain = append(chain, certAuth)
+	}
+
+	if len(chain) == 0 {
+		slog.Warn("No gRPC credentials are configured (auth.api_key, auth.client_token_secret, auth.jwt_hs256_secret, auth.jwt_jwks_file, tls.client_ca_file), every gRPC call will be rejected")
+	}
+	return chain, nil
+}
+
+type identityKey struct{}
+
+// IdentityFromContext returns the identity the auth interceptors attached to a request context
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(*Identity)
+	return identity, ok
+}
+
+// authenticate runs the authenticator on the request metadata and attaches the identity to the context
+func authenticate(ctx context.Context, auth Authenticator) (context.Context, *Identity, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	identity, err := auth.Authenticate(ctx, md)
+	if errors.Is(err, ErrNoCredentials) {
+		return nil, nil, status.Error(codes.Unauthenticated, "missing credentials: set x-api-key or authorization metadata")
+	}
+	if status.Code(err) == codes.ResourceExhausted {
+		return nil, nil, err
+	}
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Unauthenticated, "invalid credentials: %v", err)
+	}
+	return context.WithValue(ctx, identityKey{}, identity), identity, nil
+}
+
+// serviceOnlyMethods can only be called with service credentials
+var serviceOnlyMethods = map[string]bool{
+	pb.NotificationService_Publish_FullMethodName:      true,
+	pb.NotificationService_PublishBatch_FullMethodName: true,
+}
+
+// requiredScope is the API key scope a service needs for a request: broadcast to publish to every
+// device, send for everything else
+func requiredScope(req interface{}) Scope {
+	var targets []*pb.Target
+	switch r := req.(type) {
+	case *pb.PublishRequest:
+		targets = append(targets, r.Target)
+	case *pb.PublishBatchRequest:
+		for _, item := range r.Requests {
+			targets = append(targets, item.GetTarget())
+		}
+	}
+	for _, target := range targets {
+		if target.GetBroadcast() {
+			return ScopeBroadcast
+		}
+	}
+	return ScopeSend
+}
+
+// requestClientID returns the client a request acts for, if it names one
+func requestClientID(req interface{}) (string, bool) {
+	switch r := req.(type) {
+	case *pb.ConnectionRequest:
+		// Same rules as NotificationServer.AddConnection: connection_id is the client ID for older clients
+		if r.ClientId != "" {
+			return r.ClientId, true
+		}
+		return r.ConnectionId, true
+	case *pb.SubscribeRequest:
+		return clientIDFromConnectionID(r.ConnectionId), true
+	case *pb.TopicsRequest:
+		return clientIDFromConnectionID(r.ConnectionId), true
+	case *pb.ClientMessage:
+		if sub := r.GetSubscribe(); sub != nil {
+			return clientIDFromConnectionID(sub.ConnectionId), true
+		}
+	}
+	return "", false
+}
+
+// clientIDFromConnectionID returns the client part of a unique connection ID
+func clientIDFromConnectionID(connectionID string) string {
+	clientID, _, ok := models.ParseUniqueID(connectionID)
+	if !ok {
+		return connectionID
+	}
+	return clientID
+}
+
+// authorize checks that the identity may make this request
+func authorize(identity *Identity, fullMethod string, req interface{}) error {
+	if identity.Service {
+		if key := identity.APIKey; key != nil {
+			if scope := requiredScope(req); !key.HasScope(scope) {
+				return status.Errorf(codes.PermissionDenied, "API key %s lacks the %s scope", key.Name, scope)
+			}
+		}
+		return nil
+	}
+	if serviceOnlyMethods[fullMethod] {
+		return status.Errorf(codes.PermissionDenied, "%s requires service credentials", fullMethod)
+	}
+
+	clientID, ok := requestClientID(req)
+	if !ok {
+		return nil
+	}
+	if clientID != identity.ClientID {
+		return status.Errorf(codes.PermissionDenied, "credentials for client %q can't act as client %q", identity.ClientID, clientID)
+	}
+	return nil
+}
+
+// UnaryAuthInterceptor authenticates unary calls and checks the client_id they act for
+func UnaryAuthInterceptor(auth Authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, identity, err := authenticate(ctx, auth)
+		if err != nil {
+			slog.Warn("Rejected gRPC call", "method", info.FullMethod, "error", err)
+			return nil, err
+		}
+		if err := authorize(identity, info.FullMethod, req); err != nil {
+			slog.Warn("Rejected gRPC call", "method", info.FullMethod, "subject", identity.Subject, "error", err)
+			if identity.keys != nil {
+				recordCall(ctx, identity.keys, identity.Subject, requiredScope(req), info.FullMethod, err)
+			}
+			return nil, err
+		}
+
+		resp, err := handler(ctx, req)
+		if identity.keys != nil {
+			recordCall(ctx, identity.keys, identity.Subject, requiredScope(req), info.FullMethod, err)
+		}
+		return resp, err
+	}
+}
+
+// StreamAuthInterceptor authenticates streams and checks the client_id of every message that
+// names one, e.g. the SubscribeRequest of StreamNotifications or the first message of Connect.
+// Streams opened with expiring credentials are closed with Unauthenticated when they expire.
+func StreamAuthInterceptor(auth Authenticator) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, identity, err := authenticate(ss.Context(), auth)
+		if err != nil {
+			slog.Warn("Rejected gRPC call", "method", info.FullMethod, "error", err)
+			return err
+		}
+		// Services need the send scope to open any stream
+		if err := authorize(identity, info.FullMethod, nil); err != nil {
+			slog.Warn("Rejected gRPC call", "method", info.FullMethod, "subject", identity.Subject, "error", err)
+			if identity.keys != nil {
+				recordCall(ctx, identity.keys, identity.Subject, ScopeSend, info.FullMethod, err)
+			}
+			return err
+		}
+
+		if !identity.ExpiresAt.IsZero() {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, identity.ExpiresAt)
+			defer cancel()
+		}
+
+		err = handler(srv, &authenticatedStream{
+			ServerStream: ss,
+			ctx:          ctx,
+			identity:     identity,
+			fullMethod:   info.FullMethod,
+		})
+		if identity.keys != nil {
+			recordCall(ctx, identity.keys, identity.Subject, ScopeSend, info.FullMethod, err)
+		}
+
+		// The handlers end streams when their context is done, tell the device why
+		if ctx.Err() == context.DeadlineExceeded && ss.Context().Err() == nil {
+			slog.Info("Closing stream, credentials expired", "method", info.FullMethod, "subject", identity.Subject)
+			return status.Error(codes.Unauthenticated, "credentials expired")
+		}
+		return err
+	}
+}
+
+// authenticatedStream carries the identity in its context and authorizes received messages
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx        context.Context
+	identity   *Identity
+	fullMethod string
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *authenticatedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if err := authorize(s.identity, s.fullMethod, m); err != nil {
+		slog.Warn("Rejected stream message", "method", s.fullMethod, "subject", s.identity.Subject, "error", err)
+		return err
+	}
+	return nil
+}
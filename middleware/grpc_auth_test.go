@@ -0,0 +1,285 @@
+package middleware
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	pb "grpcon/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func incoming(pairs ...string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(pairs...))
+}
+
+func TestClientTokenRoundTrip(t *testing.T) {
+	secret := []byte("secret")
+	token := SignClientToken(secret, "alice", time.Hour)
+
+	clientID, expiresAt, err := VerifyClientToken(secret, token)
+	if err != nil || clientID != "alice" {
+		t.Fatalf("VerifyClientToken = %q, %v, want alice", clientID, err)
+	}
+	if until := time.Until(expiresAt); until <= 59*time.Minute || until > time.Hour {
+		t.Fatalf("token expires in %v, want an hour", until)
+	}
+	if _, _, err := VerifyClientToken([]byte("other"), token); err == nil {
+		t.Fatal("token verified with another secret")
+	}
+	bobPayload, _, _ := strings.Cut(SignClientToken(secret, "bob", time.Hour), ".")
+	_, aliceSignature, _ := strings.Cut(token, ".")
+	forged := bobPayload + "." + aliceSignature
+	if _, _, err := VerifyClientToken(secret, forged); err == nil {
+		t.Fatal("token with a swapped client ID verified")
+	}
+}
+
+func TestClientTokenExpires(t *testing.T) {
+	secret := []byte("secret")
+	expired := SignClientToken(secret, "alice", -time.Minute)
+	if _, _, err := VerifyClientToken(secret, expired); err != nil {
+		t.Fatalf("a non-positive TTL should fall back to the default, got %v", err)
+	}
+
+	// Re-sign a payload that expired a second ago
+	payload := base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10) + ":alice"))
+	expired = payload + "." + base64.RawURLEncoding.EncodeToString(clientTokenSignature(secret, payload))
+	if _, _, err := VerifyClientToken(secret, expired); err == nil {
+		t.Fatal("expired token verified")
+	}
+	if _, err := (&ClientTokenAuthenticator{Secret: secret}).Authenticate(context.Background(), metadata.Pairs(AuthorizationMetadataKey, "Bearer "+expired)); err == nil {
+		t.Fatal("expired token authenticated")
+	}
+
+	identity, err := (&ClientTokenAuthenticator{Secret: secret}).Authenticate(context.Background(), metadata.Pairs(AuthorizationMetadataKey, "Bearer "+SignClientToken(secret, "alice", time.Minute)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.ExpiresAt.IsZero() || time.Until(identity.ExpiresAt) > time.Minute {
+		t.Fatalf("identity expires at %v, want within a minute", identity.ExpiresAt)
+	}
+}
+
+func TestChainAuthenticator(t *testing.T) {
+	secret := []byte("secret")
+	keys := newTestKeyStore(t, APIKey{Name: "key", Scopes: []Scope{ScopeAdmin}})
+	auth, err := NewAuthenticator(AuthOptions{APIKeys: keys, ClientTokenSecret: string(secret)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		md       metadata.MD
+		wantErr  bool
+		noCreds  bool
+		service  bool
+		clientID string
+	}{
+		{name: "api key", md: metadata.Pairs(APIKeyMetadataKey, "key"), service: true},
+		{name: "wrong api key", md: metadata.Pairs(APIKeyMetadataKey, "nope"), wantErr: true},
+		{name: "client token", md: metadata.Pairs(AuthorizationMetadataKey, "Bearer "+SignClientToken(secret, "alice", time.Hour)), clientID: "alice"},
+		{name: "forged client token", md: metadata.Pairs(AuthorizationMetadataKey, "Bearer "+SignClientToken([]byte("x"), "alice", time.Hour)), wantErr: true},
+		{name: "not bearer", md: metadata.Pairs(AuthorizationMetadataKey, "Basic abc"), noCreds: true},
+		{name: "nothing", md: metadata.MD{}, noCreds: true},
+	} {
+		identity, err := auth.Authenticate(context.Background(), tc.md)
+		switch {
+		case tc.noCreds:
+			if !errors.Is(err, ErrNoCredentials) {
+				t.Errorf("%s: err = %v, want ErrNoCredentials", tc.name, err)
+			}
+		case tc.wantErr:
+			if err == nil || errors.Is(err, ErrNoCredentials) {
+				t.Errorf("%s: err = %v, want invalid credentials", tc.name, err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", tc.name, err)
+		case identity.Service != tc.service || identity.ClientID != tc.clientID:
+			t.Errorf("%s: identity = %+v", tc.name, identity)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	device := &Identity{Subject: "alice", ClientID: "alice"}
+	service := &Identity{Subject: "api_key", Service: true}
+
+	for _, tc := range []struct {
+		name     string
+		identity *Identity
+		method   string
+		req      interface{}
+		code     codes.Code
+	}{
+		{"device adds itself", device, pb.NotificationService_AddConnection_FullMethodName, &pb.ConnectionRequest{ClientId: "alice", DeviceId: "phone"}, codes.OK},
+		{"device adds another client", device, pb.NotificationService_AddConnection_FullMethodName, &pb.ConnectionRequest{ClientId: "bob"}, codes.PermissionDenied},
+		{"older device request", device, pb.NotificationService_AddConnection_FullMethodName, &pb.ConnectionRequest{ConnectionId: "bob"}, codes.PermissionDenied},
+		{"device subscribes to its stream", device, pb.NotificationService_StreamNotifications_FullMethodName, &pb.SubscribeRequest{ConnectionId: "alice_phone"}, codes.OK},
+		{"device subscribes to another stream", device, pb.NotificationService_StreamNotifications_FullMethodName, &pb.SubscribeRequest{ConnectionId: "bob_phone"}, codes.PermissionDenied},
+		{"device publishes", device, pb.NotificationService_Publish_FullMethodName, &pb.PublishRequest{}, codes.PermissionDenied},
+		{"service publishes", service, pb.NotificationService_Publish_FullMethodName, &pb.PublishRequest{}, codes.OK},
+		{"service acts for a client", service, pb.NotificationService_AddConnection_FullMethodName, &pb.ConnectionRequest{ClientId: "bob"}, codes.OK},
+	} {
+		if got := status.Code(authorize(tc.identity, tc.method, tc.req)); got != tc.code {
+			t.Errorf("%s: code = %v, want %v", tc.name, got, tc.code)
+		}
+	}
+}
+
+func TestUnaryAuthInterceptor(t *testing.T) {
+	interceptor := UnaryAuthInterceptor(&APIKeyAuthenticator{Keys: newTestKeyStore(t, APIKey{Name: "key", Scopes: []Scope{ScopeSend}})})
+	info := &grpc.UnaryServerInfo{FullMethod: pb.NotificationService_Publish_FullMethodName}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		identity, ok := IdentityFromContext(ctx)
+		if !ok || !identity.Service {
+			t.Error("handler called without the service identity")
+		}
+		return "ok", nil
+	}
+
+	if _, err := interceptor(context.Background(), &pb.PublishRequest{}, info, handler); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("call without credentials = %v, want Unauthenticated", err)
+	}
+	if _, err := interceptor(incoming(APIKeyMetadataKey, "bad"), &pb.PublishRequest{}, info, handler); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("call with a bad key = %v, want Unauthenticated", err)
+	}
+	if resp, err := interceptor(incoming(APIKeyMetadataKey, "key"), &pb.PublishRequest{}, info, handler); err != nil || resp != "ok" {
+		t.Fatalf("call with the key = %v, %v", resp, err)
+	}
+}
+
+func TestAPIKeyScopesAndRateLimitOnGRPC(t *testing.T) {
+	keys := newTestKeyStore(t,
+		APIKey{Name: "billing", Scopes: []Scope{ScopeSend}, RateLimitPerMinute: 2},
+		APIKey{Name: "dashboard", Scopes: []Scope{ScopeReadStats}},
+	)
+	auth := &APIKeyAuthenticator{Keys: keys}
+	unary := UnaryAuthInterceptor(auth)
+	publish := &grpc.UnaryServerInfo{FullMethod: pb.NotificationService_Publish_FullMethodName}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil }
+	toClient := &pb.PublishRequest{Target: &pb.Target{Target: &pb.Target_ClientId{ClientId: "alice"}}}
+	broadcast := &pb.PublishRequest{Target: &pb.Target{Target: &pb.Target_Broadcast{Broadcast: true}}}
+
+	if _, err := unary(incoming(APIKeyMetadataKey, "billing"), toClient, publish, handler); err != nil {
+		t.Fatalf("publish with the send scope = %v", err)
+	}
+	if _, err := unary(incoming(APIKeyMetadataKey, "billing"), broadcast, publish, handler); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("broadcast without the broadcast scope = %v, want PermissionDenied", err)
+	}
+	// The two calls used up the limit
+	if _, err := unary(incoming(APIKeyMetadataKey, "billing"), toClient, publish, handler); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("call over the rate limit = %v, want ResourceExhausted", err)
+	}
+	if _, err := unary(incoming(APIKeyMetadataKey, "dashboard"), toClient, publish, handler); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("publish without the send scope = %v, want PermissionDenied", err)
+	}
+
+	stream := StreamAuthInterceptor(auth)
+	connect := &grpc.StreamServerInfo{FullMethod: pb.NotificationService_Connect_FullMethodName}
+	err := stream(nil, &testServerStream{ctx: incoming(APIKeyMetadataKey, "dashboard")}, connect, func(srv interface{}, ss grpc.ServerStream) error {
+		t.Error("stream opened without the send scope")
+		return nil
+	})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("stream without the send scope = %v, want PermissionDenied", err)
+	}
+
+	// Every call is in the audit log with its key, scope and outcome
+	want := []struct {
+		key    string
+		action Scope
+		code   codes.Code
+	}{
+		{"billing", ScopeSend, codes.OK},
+		{"billing", ScopeBroadcast, codes.PermissionDenied},
+		{"billing", ScopeSend, codes.ResourceExhausted},
+		{"dashboard", ScopeSend, codes.PermissionDenied},
+		{"dashboard", ScopeSend, codes.PermissionDenied},
+	}
+	entries := keys.AuditLog()
+	if len(entries) != len(want) {
+		t.Fatalf("audit log has %d entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.KeyName != w.key || e.Action != w.action || e.GRPCCode != w.code.String() || e.Method != "gRPC" {
+			t.Errorf("audit entry %d = %+v, want %s %s %s", i, e, w.key, w.action, w.code)
+		}
+	}
+	if entries[0].Path != pb.NotificationService_Publish_FullMethodName || entries[4].Path != pb.NotificationService_Connect_FullMethodName {
+		t.Errorf("audit paths = %s, %s", entries[0].Path, entries[4].Path)
+	}
+}
+
+// testServerStream is a grpc.ServerStream that receives the given messages
+type testServerStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	recv []interface{}
+}
+
+func (s *testServerStream) Context() context.Context { return s.ctx }
+
+func (s *testServerStream) RecvMsg(m interface{}) error {
+	if len(s.recv) == 0 {
+		return errors.New("no more messages")
+	}
+	next := s.recv[0].(*pb.ClientMessage)
+	s.recv = s.recv[1:]
+	*m.(*pb.ClientMessage) = pb.ClientMessage{Payload: next.Payload}
+	return nil
+}
+
+// expiringAuthenticator authenticates every call as alice until expiresAt
+type expiringAuthenticator struct {
+	expiresAt time.Time
+}
+
+func (a expiringAuthenticator) Authenticate(ctx context.Context, md metadata.MD) (*Identity, error) {
+	return &Identity{Subject: "alice", ClientID: "alice", ExpiresAt: a.expiresAt}, nil
+}
+
+func TestStreamAuthInterceptorChecksMessages(t *testing.T) {
+	interceptor := StreamAuthInterceptor(expiringAuthenticator{})
+	info := &grpc.StreamServerInfo{FullMethod: pb.NotificationService_Connect_FullMethodName}
+
+	subscribe := func(connectionID string) *pb.ClientMessage {
+		return &pb.ClientMessage{Payload: &pb.ClientMessage_Subscribe{Subscribe: &pb.SubscribeRequest{ConnectionId: connectionID}}}
+	}
+	stream := &testServerStream{ctx: context.Background(), recv: []interface{}{subscribe("alice_phone"), subscribe("bob_phone")}}
+
+	err := interceptor(nil, stream, info, func(srv interface{}, ss grpc.ServerStream) error {
+		var msg pb.ClientMessage
+		if err := ss.RecvMsg(&msg); err != nil {
+			t.Errorf("own subscribe rejected: %v", err)
+		}
+		return ss.RecvMsg(&msg)
+	})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("subscribe for another client = %v, want PermissionDenied", err)
+	}
+}
+
+func TestStreamAuthInterceptorClosesExpiredStreams(t *testing.T) {
+	interceptor := StreamAuthInterceptor(expiringAuthenticator{expiresAt: time.Now().Add(20 * time.Millisecond)})
+	info := &grpc.StreamServerInfo{FullMethod: pb.NotificationService_StreamNotifications_FullMethodName}
+	stream := &testServerStream{ctx: context.Background()}
+
+	err := interceptor(nil, stream, info, func(srv interface{}, ss grpc.ServerStream) error {
+		<-ss.Context().Done()
+		return nil
+	})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("stream outliving its credentials = %v, want Unauthenticated", err)
+	}
+}
@@ -0,0 +1,190 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/MicahParks/jwkset"
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// jwtLeeway is the clock skew tolerated when checking exp and nbf
+	jwtLeeway = 30 * time.Second
+	// minRSAKeyBits is the smallest RSA modulus accepted for RS256
+	minRSAKeyBits = 2048
+)
+
+// jwtMethods are the accepted signing algorithms, any other alg header is rejected before a key is chosen
+var jwtMethods = []string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg()}
+
+// JWTAuthenticator accepts device JWTs in "authorization: Bearer <token>". The sub claim is the
+// client_id the device may act as. Tokens are signed with HS256 using HMACSecret, or with
+// RS256/ES256 using the JWKS key named by their kid header.
+type JWTAuthenticator struct {
+	HMACSecret []byte
+	JWKS       keyfunc.Keyfunc // RS256/ES256 keys, see LoadJWKS
+	Issuer     string          // required iss claim, if set
+	Audience   string          // required aud claim, if set
+}
+
+// Authenticate implements Authenticator
+func (a *JWTAuthenticator) Authenticate(ctx context.Context, md metadata.MD) (*Identity, error) {
+	token, ok := bearerToken(md)
+	if !ok || strings.Count(token, ".") != 2 {
+		return nil, ErrNoCredentials
+	}
+
+	claims, err := a.verify(token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	// The token is accepted until exp plus the leeway, streams opened with it stay open as long
+	return &Identity{
+		Subject:   claims.Subject,
+		ClientID:  claims.Subject,
+		Method:    "jwt",
+		ExpiresAt: claims.ExpiresAt.Add(jwtLeeway),
+	}, nil
+}
+
+// verify checks the signature and claims of a token
+func (a *JWTAuthenticator) verify(token string, now time.Time) (*jwt.RegisteredClaims, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(jwtMethods),
+		jwt.WithLeeway(jwtLeeway),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(func() time.Time { return now }),
+	}
+	if a.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(a.Issuer))
+	}
+	if a.Audience != "" {
+		opts = append(opts, jwt.WithAudience(a.Audience))
+	}
+
+	var claims jwt.RegisteredClaims
+	if _, err := jwt.NewParser(opts...).ParseWithClaims(token, &claims, a.key); err != nil {
+		return nil, fmt.Errorf("invalid JWT: %w", err)
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("JWT has no sub claim")
+	}
+	return &claims, nil
+}
+
+// key returns the key verifying a token with an accepted alg. The key must be meant for that alg,
+// so an RSA public key can't be used as an HMAC secret.
+func (a *JWTAuthenticator) key(token *jwt.Token) (interface{}, error) {
+	alg := token.Method.Alg()
+	if alg == jwt.SigningMethodHS256.Alg() {
+		if len(a.HMACSecret) == 0 {
+			return nil, errors.New("HS256 tokens are not accepted")
+		}
+		return a.HMACSecret, nil
+	}
+
+	if a.JWKS == nil {
+		return nil, fmt.Errorf("%s tokens are not accepted", alg)
+	}
+	// Without a kid the keyfunc would try every key, each key is checked against the alg instead
+	if kid, _ := token.Header["kid"].(string); kid == "" {
+		return nil, errors.New("JWT has no kid header")
+	}
+	// Rejects keys whose alg differs from the token's or whose use is not sig
+	key, err := a.JWKS.Keyfunc(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVerificationKey(alg, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// checkVerificationKey reports whether key may verify alg: an RSA key of at least minRSAKeyBits
+// for RS256, a P-256 key for ES256
+func checkVerificationKey(alg string, key interface{}) error {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg != jwt.SigningMethodRS256.Alg() {
+			return fmt.Errorf("RSA key can't verify %s", alg)
+		}
+		if k.N.BitLen() < minRSAKeyBits {
+			return fmt.Errorf("RSA key has %d bits, at least %d are required", k.N.BitLen(), minRSAKeyBits)
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if alg != jwt.SigningMethodES256.Alg() {
+			return fmt.Errorf("EC key can't verify %s", alg)
+		}
+		if k.Curve != elliptic.P256() {
+			return fmt.Errorf("EC key on %s can't verify ES256", k.Curve.Params().Name)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T for %s", key, alg)
+}
+
+// LoadJWKS reads the public keys of a JWKS file. Every key must be usable for RS256 or ES256, and
+// signing if its use is set.
+func LoadJWKS(path string) (keyfunc.Keyfunc, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	jwks, err := parseJWKS(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWKS %s: %w", path, err)
+	}
+	return jwks, nil
+}
+
+// parseJWKS builds a keyfunc from the JSON of a JWKS, see LoadJWKS
+func parseJWKS(data []byte) (keyfunc.Keyfunc, error) {
+	set, err := keyfunc.NewJWKSetJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	keys, err := set.Storage().KeyReadAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		marshal := k.Marshal()
+		alg := marshal.ALG.String()
+		if alg == "" {
+			switch marshal.KTY {
+			case jwkset.KtyRSA:
+				alg = jwt.SigningMethodRS256.Alg()
+			case jwkset.KtyEC:
+				alg = jwt.SigningMethodES256.Alg()
+			}
+		}
+		if err := checkVerificationKey(alg, k.Key()); err != nil {
+			return nil, fmt.Errorf("key %q: %w", marshal.KID, err)
+		}
+		if marshal.USE != "" && marshal.USE != jwkset.UseSig {
+			return nil, fmt.Errorf("key %q: use %q is not sig", marshal.KID, marshal.USE)
+		}
+	}
+
+	// Only keys for signing, or without a use, verify tokens
+	return keyfunc.New(keyfunc.Options{
+		Ctx:          ctx,
+		Storage:      set.Storage(),
+		UseWhitelist: []jwkset.USE{jwkset.UseSig, ""},
+	})
+}
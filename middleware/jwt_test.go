@@ -0,0 +1,290 @@
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MicahParks/keyfunc/v3"
+	"google.golang.org/grpc/metadata"
+)
+
+// signJWT builds a token with the given header and claims, signed by key: a []byte HMAC secret,
+// an *rsa.PrivateKey or an *ecdsa.PrivateKey
+func signJWT(t *testing.T, header map[string]string, claims map[string]interface{}, key interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signingInput := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// rsaJWK and ecJWK are the JWKS entries of public keys
+func rsaJWK(kid string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{"kty": "RSA", "kid": kid, "n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()), "e": "AQAB"}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) map[string]string {
+	x, y := make([]byte, 32), make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": base64.RawURLEncoding.EncodeToString(x), "y": base64.RawURLEncoding.EncodeToString(y)}
+}
+
+// jwksJSON is the JSON of a JWKS holding keys
+func jwksJSON(keys ...map[string]string) []byte {
+	data, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	return data
+}
+
+// testJWKS builds the keyfunc of a JWKS holding keys
+func testJWKS(t *testing.T, keys ...map[string]string) keyfunc.Keyfunc {
+	t.Helper()
+	jwks, err := parseJWKS(jwksJSON(keys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jwks
+}
+
+func claimsFor(subject string, exp time.Time) map[string]interface{} {
+	return map[string]interface{}{"sub": subject, "exp": exp.Unix()}
+}
+
+func TestJWTAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("secret")
+	auth := &JWTAuthenticator{
+		HMACSecret: secret,
+		JWKS:       testJWKS(t, rsaJWK("rsa", &rsaKey.PublicKey), ecJWK("ec", &ecKey.PublicKey)),
+	}
+	exp := time.Now().Add(time.Hour)
+
+	for _, tc := range []struct {
+		name    string
+		header  map[string]string
+		key     interface{}
+		wantErr bool
+	}{
+		{"HS256", map[string]string{"alg": "HS256"}, secret, false},
+		{"RS256", map[string]string{"alg": "RS256", "kid": "rsa"}, rsaKey, false},
+		{"ES256", map[string]string{"alg": "ES256", "kid": "ec"}, ecKey, false},
+		{"HS256 with another secret", map[string]string{"alg": "HS256"}, []byte("other"), true},
+		{"unknown kid", map[string]string{"alg": "RS256", "kid": "missing"}, rsaKey, true},
+		{"RS256 with the EC kid", map[string]string{"alg": "RS256", "kid": "ec"}, rsaKey, true},
+		{"ES256 with the RSA kid", map[string]string{"alg": "ES256", "kid": "rsa"}, ecKey, true},
+		{"alg none", map[string]string{"alg": "none"}, []byte{}, true},
+		{"RS256 without kid", map[string]string{"alg": "RS256"}, rsaKey, true},
+		{"RS384 with the RSA kid", map[string]string{"alg": "RS384", "kid": "rsa"}, rsaKey, true},
+	} {
+		token := signJWT(t, tc.header, claimsFor("alice", exp), tc.key)
+		claims, err := auth.verify(token, time.Now())
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: token accepted", tc.name)
+			}
+			continue
+		}
+		if err != nil || claims.Subject != "alice" {
+			t.Errorf("%s: verify = %+v, %v", tc.name, claims, err)
+		}
+	}
+}
+
+func TestJWTRejectsRSAKeyAsHMACSecret(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without an HMAC secret, an HS256 token signed with the public key must not verify against the RSA key
+	publicKey, _ := json.Marshal(rsaKey.PublicKey)
+	auth := &JWTAuthenticator{JWKS: testJWKS(t, rsaJWK("rsa", &rsaKey.PublicKey))}
+	token := signJWT(t, map[string]string{"alg": "HS256", "kid": "rsa"}, claimsFor("alice", time.Now().Add(time.Hour)), publicKey)
+	if _, err := auth.verify(token, time.Now()); err == nil {
+		t.Fatal("HS256 token accepted with only an RSA key configured")
+	}
+}
+
+func TestJWTClaims(t *testing.T) {
+	secret := []byte("secret")
+	auth := &JWTAuthenticator{HMACSecret: secret, Issuer: "issuer", Audience: "grpcon"}
+	now := time.Now()
+	header := map[string]string{"alg": "HS256"}
+	valid := func(changes map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{"sub": "alice", "exp": now.Add(time.Hour).Unix(), "iss": "issuer", "aud": "grpcon"}
+		for k, v := range changes {
+			if v == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = v
+			}
+		}
+		return claims
+	}
+
+	for _, tc := range []struct {
+		name    string
+		claims  map[string]interface{}
+		wantErr bool
+	}{
+		{"valid", valid(nil), false},
+		{"audience in a list", valid(map[string]interface{}{"aud": []string{"other", "grpcon"}}), false},
+		{"expired within the leeway", valid(map[string]interface{}{"exp": now.Add(-jwtLeeway / 2).Unix()}), false},
+		{"expired past the leeway", valid(map[string]interface{}{"exp": now.Add(-2 * jwtLeeway).Unix()}), true},
+		{"not before within the leeway", valid(map[string]interface{}{"nbf": now.Add(jwtLeeway / 2).Unix()}), false},
+		{"not before past the leeway", valid(map[string]interface{}{"nbf": now.Add(2 * jwtLeeway).Unix()}), true},
+		{"no exp", valid(map[string]interface{}{"exp": nil}), true},
+		{"no sub", valid(map[string]interface{}{"sub": nil}), true},
+		{"wrong issuer", valid(map[string]interface{}{"iss": "someone"}), true},
+		{"wrong audience", valid(map[string]interface{}{"aud": "other"}), true},
+		{"audience list without ours", valid(map[string]interface{}{"aud": []string{"a", "b"}}), true},
+	} {
+		_, err := auth.verify(signJWT(t, header, tc.claims, secret), now)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: verify error = %v, want error %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestJWTIdentityExpiresAfterLeeway(t *testing.T) {
+	secret := []byte("secret")
+	auth := &JWTAuthenticator{HMACSecret: secret}
+	exp := time.Now().Add(time.Minute).Truncate(time.Second)
+	token := signJWT(t, map[string]string{"alg": "HS256"}, claimsFor("alice", exp), secret)
+
+	identity, err := auth.Authenticate(context.Background(), metadata.Pairs(AuthorizationMetadataKey, "Bearer "+token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.ClientID != "alice" || !identity.ExpiresAt.Equal(exp.Add(jwtLeeway)) {
+		t.Fatalf("identity = %+v, want alice expiring at %v", identity, exp.Add(jwtLeeway))
+	}
+
+	// Client tokens are not JWTs
+	if _, err := auth.Authenticate(context.Background(), metadata.Pairs(AuthorizationMetadataKey, "Bearer "+SignClientToken(secret, "alice", time.Hour))); !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("client token = %v, want ErrNoCredentials", err)
+	}
+}
+
+func TestLoadJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwksJSON(rsaJWK("rsa", &rsaKey.PublicKey), ecJWK("ec", &ecKey.PublicKey)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	jwks, err := LoadJWKS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &JWTAuthenticator{JWKS: jwks}
+	exp := time.Now().Add(time.Hour)
+	for kid, key := range map[string]interface{}{"rsa": rsaKey, "ec": ecKey} {
+		alg := map[string]string{"rsa": "RS256", "ec": "ES256"}[kid]
+		token := signJWT(t, map[string]string{"alg": alg, "kid": kid}, claimsFor("alice", exp), key)
+		if _, err := auth.verify(token, time.Now()); err != nil {
+			t.Errorf("%s token signed with the JWKS key: %v", alg, err)
+		}
+	}
+}
+
+func TestJWKSRejectsUnfitKeys(t *testing.T) {
+	weakKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	with := func(jwk map[string]string, field, value string) map[string]string {
+		jwk[field] = value
+		return jwk
+	}
+
+	for name, jwk := range map[string]map[string]string{
+		"1024-bit RSA key":  rsaJWK("weak", &weakKey.PublicKey),
+		"RSA key for RS384": with(rsaJWK("rsa", &rsaKey.PublicKey), "alg", "RS384"),
+		"encryption key":    with(rsaJWK("rsa", &rsaKey.PublicKey), "use", "enc"),
+		"P-384 key": with(map[string]string{
+			"kty": "EC", "kid": "ec", "crv": "P-384",
+			"x": base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 48))),
+			"y": base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 48))),
+		}, "alg", "ES384"),
+	} {
+		if _, err := parseJWKS(jwksJSON(jwk)); err == nil {
+			t.Errorf("%s: JWKS accepted", name)
+		}
+	}
+
+	// A keyfunc built without LoadJWKS still has its keys checked when verifying
+	unchecked, err := keyfunc.NewJWKSetJSON(jwksJSON(rsaJWK("weak", &weakKey.PublicKey), with(rsaJWK("rs512", &rsaKey.PublicKey), "alg", "RS512")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &JWTAuthenticator{JWKS: unchecked}
+	exp := time.Now().Add(time.Hour)
+	if _, err := auth.verify(signJWT(t, map[string]string{"alg": "RS256", "kid": "weak"}, claimsFor("alice", exp), weakKey), time.Now()); err == nil {
+		t.Error("token signed with a 1024-bit RSA key accepted")
+	}
+	if _, err := auth.verify(signJWT(t, map[string]string{"alg": "RS256", "kid": "rs512"}, claimsFor("alice", exp), rsaKey), time.Now()); err == nil {
+		t.Error("RS256 token accepted with a key whose alg is RS512")
+	}
+}
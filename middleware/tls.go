@@ -0,0 +1,261 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// DefaultTLSReloadInterval is how often certificate files are checked for changes
+const DefaultTLSReloadInterval = 30 * time.Second
+
+// TLSReloader serves a certificate and client CA pool that are reloaded when their files change,
+// so certificates can be renewed without restarting the server
+type TLSReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string // empty if client certificates are not verified
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time // key: file path
+}
+
+// NewTLSReloader loads the certificate, key and optional client CA bundle
+func NewTLSReloader(certFile, keyFile, clientCAFile string) (*TLSReloader, error) {
+	r := &TLSReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// files returns the files the reloader watches
+func (r *TLSReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+	return files
+}
+
+// reload reads every file again. The previous certificate stays in use if any of them is invalid.
+func (r *TLSReloader) reload() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	// Remember these versions even if they turn out invalid, so a broken file is reported once
+	// and not on every check
+	r.mu.Lock()
+	r.modTimes = modTimes
+	r.mu.Unlock()
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate %s: %v", r.certFile, err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.clientCAFile != "" {
+		pem, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA file %s", r.clientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	return nil
+}
+
+// changed reports whether any watched file was modified since the last reload
+func (r *TLSReloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			// Probably being replaced, look again next time
+			continue
+		}
+		if !info.ModTime().Equal(r.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the files when they change until stop is closed
+func (r *TLSReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			if err := r.reload(); err != nil {
+				slog.Error("Failed to reload TLS certificate, keeping the current one", "error", err)
+				continue
+			}
+			slog.Info("Reloaded TLS certificate", "cert_file", r.certFile)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Config returns a server TLS config that uses the current certificate and client CAs on every
+// handshake. clientAuth is ignored (no client certificates) if no client CA file is configured.
+func (r *TLSReloader) Config(clientAuth tls.ClientAuthType) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+			}
+			if r.clientCAs != nil {
+				config.ClientCAs = r.clientCAs
+				config.ClientAuth = clientAuth
+			}
+			return config, nil
+		},
+	}
+}
+
+// ParseClientAuth parses a client certificate policy: "none", "request" (verified if sent) or "require"
+func ParseClientAuth(value string) (tls.ClientAuthType, error) {
+	switch strings.ToLower(value) {
+	case "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("unknown client auth policy: %s", value)
+}
+
+// StartTLSReloader loads certFile, keyFile and the optional clientCAFile and watches them for
+// changes every interval until stop is closed. Returns nil if certFile is empty.
+func StartTLSReloader(certFile, keyFile, clientCAFile string, interval time.Duration, stop <-chan struct{}) (*TLSReloader, error) {
+	if certFile == "" {
+		return nil, nil
+	}
+	if keyFile == "" {
+		return nil, fmt.Errorf("a key file is required with the certificate")
+	}
+	if interval <= 0 {
+		interval = DefaultTLSReloadInterval
+	}
+
+	reloader, err := NewTLSReloader(certFile, keyFile, clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	go reloader.Watch(interval, stop)
+
+	slog.Info("TLS enabled", "cert_file", certFile, "reload_interval", interval)
+	return reloader, nil
+}
+
+// CertificateFingerprint returns the hex SHA-256 of a certificate
+func CertificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// CertificateAuthenticator binds devices presenting a verified client certificate to a client_id.
+// The certificate is looked up in ClientIDs by SHA-256 fingerprint, then by subject common name.
+// Certificates in neither use their common name as client_id.
+type CertificateAuthenticator struct {
+	ClientIDs map[string]string
+}
+
+// ClientID returns the client_id a certificate is bound to
+func (a *CertificateAuthenticator) ClientID(cert *x509.Certificate) string {
+	if clientID, ok := a.ClientIDs[CertificateFingerprint(cert)]; ok {
+		return clientID
+	}
+	if clientID, ok := a.ClientIDs[cert.Subject.CommonName]; ok {
+		return clientID
+	}
+	return cert.Subject.CommonName
+}
+
+// Authenticate implements Authenticator
+func (a *CertificateAuthenticator) Authenticate(ctx context.Context, md metadata.MD) (*Identity, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	cert := info.State.VerifiedChains[0][0]
+	clientID := a.ClientID(cert)
+	if clientID == "" {
+		return nil, fmt.Errorf("client certificate %s is not mapped to a client", CertificateFingerprint(cert))
+	}
+	return &Identity{Subject: clientID, ClientID: clientID, Method: "client_certificate", ExpiresAt: cert.NotAfter}, nil
+}
+
+// LoadClientCertMap reads a JSON object mapping certificate fingerprints or common names to client IDs
+func LoadClientCertMap(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	mapping := make(map[string]string)
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("invalid client certificate map %s: %v", path, err)
+	}
+	// Fingerprints are matched in lower case
+	normalized := make(map[string]string, len(mapping))
+	for key, clientID := range mapping {
+		if _, err := hex.DecodeString(key); err == nil && len(key) == sha256.Size*2 {
+			key = strings.ToLower(key)
+		}
+		normalized[key] = clientID
+	}
+	return normalized, nil
+}
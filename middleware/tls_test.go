@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate for commonName and its key, dated modTime
+func writeCertificate(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// servedCommonName returns the common name of the certificate the reloader currently serves
+func servedCommonName(t *testing.T, r *TLSReloader) string {
+	t.Helper()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	leaf, err := x509.ParseCertificate(r.cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestTLSReloaderReloadsUntilStopped(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour)
+	writeCertificate(t, certFile, keyFile, "one", start)
+
+	stop := make(chan struct{})
+	reloader, err := StartTLSReloader(certFile, keyFile, "", 5*time.Millisecond, stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := servedCommonName(t, reloader); got != "one" {
+		t.Fatalf("served certificate = %s, want one", got)
+	}
+
+	writeCertificate(t, certFile, keyFile, "two", start.Add(time.Minute))
+	deadline := time.Now().Add(3 * time.Second)
+	for servedCommonName(t, reloader) != "two" {
+		if time.Now().After(deadline) {
+			t.Fatal("renewed certificate was not loaded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	close(stop)
+	time.Sleep(20 * time.Millisecond)
+	writeCertificate(t, certFile, keyFile, "three", start.Add(2*time.Minute))
+	time.Sleep(50 * time.Millisecond)
+	if got := servedCommonName(t, reloader); got != "two" {
+		t.Fatalf("served certificate after stop = %s, want two", got)
+	}
+}
@@ -0,0 +1,440 @@
+package models
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"grpcon/logging"
+	pb "grpcon/proto"
+)
+
+// NotificationStream is the server side of a stream that notifications can be pushed on.
+// Both StreamNotifications and Connect streams satisfy it.
+type NotificationStream interface {
+	Send(*pb.Notification) error
+	Context() context.Context
+}
+
+// UnackedNotification is a notification delivered to a device that has not been acknowledged yet
+type UnackedNotification struct {
+	Notification *NotificationData
+	SentAt       time.Time
+	Attempts     int
+}
+
+// Connection represents a device connection.
+//
+// The identity fields never change after registration. Everything else is shared between the
+// stream goroutines, the HTTP gateway and the health check monitor, so it is guarded by mu and
+// only reachable through methods.
+type Connection struct {
+	UniqueID    string // client_id_device_id
+	ClientID    string
+	DeviceID    string
+	ServiceName string
+	ConnectedAt time.Time
+
+	mu                 sync.RWMutex
+	platform           string // e.g. "ios", "android", "web", updated when the device registers again
+	appVersion         string
+	stream             NotificationStream
+	queue              *SendQueue // Outbound queue, the only writer to stream
+	active             bool
+	paused             bool      // Device asked to stop receiving notifications for now
+	acksEnabled        bool      // Device acknowledges notifications (Connect streams only)
+	attachedAt         time.Time // When the current (or last) stream was attached
+	lastNotificationAt time.Time
+	lastHeartbeatAt    time.Time                       // Last heartbeat sent
+	lastPongAt         time.Time                       // Last heartbeat pong received (Connect streams only)
+	notificationCount  int                             // Notifications delivered on the stream
+	ackedCount         int                             // Notifications acknowledged by the device
+	heartbeatFailCount int                             // Track consecutive heartbeat failures
+	heartbeatStop      chan struct{}                   // Closed to stop the heartbeat goroutine of the current stream
+	unacked            map[string]*UnackedNotification // key: notification id
+}
+
+// DeviceMetadata describes the app behind a device connection, as reported at registration
+type DeviceMetadata struct {
+	ServiceName string
+	Platform    string
+	AppVersion  string
+}
+
+// NewConnection creates a registered device connection without a stream
+func NewConnection(uniqueID, clientID, deviceID, serviceName string) *Connection {
+	return &Connection{
+		UniqueID:    uniqueID,
+		ClientID:    clientID,
+		DeviceID:    deviceID,
+		ServiceName: serviceName,
+		ConnectedAt: time.Now(),
+	}
+}
+
+// SetAppInfo records the platform and app version the device reported, empty values keep the current ones
+func (c *Connection) SetAppInfo(platform, appVersion string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if platform != "" {
+		c.platform = platform
+	}
+	if appVersion != "" {
+		c.appVersion = appVersion
+	}
+}
+
+// GetAppInfo returns the platform and app version the device reported
+func (c *Connection) GetAppInfo() (platform, appVersion string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.platform, c.appVersion
+}
+
+// ConnectionSnapshot is a consistent copy of a connection's state, safe to read without locks
+type ConnectionSnapshot struct {
+	UniqueID           string
+	ClientID           string
+	DeviceID           string
+	ServiceName        string
+	Platform           string
+	AppVersion         string
+	ConnectedAt        time.Time
+	IsActive           bool
+	Paused             bool
+	AcksEnabled        bool
+	AttachedAt         time.Time
+	LastNotificationAt time.Time
+	LastHeartbeatAt    time.Time
+	NotificationCount  int
+	AckedCount         int
+	UnackedCount       int
+	Queue              *SendQueueStats // nil without an attached stream
+}
+
+// GetUptime returns how long the connection has been active
+func (c *Connection) GetUptime() time.Duration {
+	return time.Since(c.ConnectedAt)
+}
+
+// Logger returns the default logger with the connection's client_id, device_id and unique_id
+func (c *Connection) Logger() *slog.Logger {
+	return slog.With(logging.KeyClientID, c.ClientID, logging.KeyDeviceID, c.DeviceID, logging.KeyUniqueID, c.UniqueID)
+}
+
+// AttachStream makes stream the device's active stream, drained by queue.
+// Returns the queue of the stream it replaced (nil if none) so the caller can hand its messages back.
+func (c *Connection) AttachStream(stream NotificationStream, queue *SendQueue, acksEnabled bool) *SendQueue {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	previous := c.queue
+	c.stopHeartbeatLocked()
+
+	now := time.Now()
+	c.stream = stream
+	c.queue = queue
+	c.active = true
+	c.paused = false
+	c.acksEnabled = acksEnabled
+	c.attachedAt = now
+	c.lastHeartbeatAt = now
+	c.lastPongAt = now
+	c.heartbeatFailCount = 0
+	c.heartbeatStop = make(chan struct{})
+
+	return previous
+}
+
+// DetachStream clears the active stream if it is still stream (nil detaches whatever is attached),
+// so a stale stream goroutine can't tear down a newer one. Returns the detached queue and whether
+// anything was detached.
+func (c *Connection) DetachStream(stream NotificationStream) (*SendQueue, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stream == nil || (stream != nil && c.stream != stream) {
+		return nil, false
+	}
+
+	queue := c.queue
+	c.stream = nil
+	c.queue = nil
+	c.active = false
+	c.paused = false
+	c.acksEnabled = false
+	c.stopHeartbeatLocked()
+
+	return queue, true
+}
+
+// stopHeartbeatLocked signals the heartbeat goroutine of the current stream. Caller must hold c.mu.
+func (c *Connection) stopHeartbeatLocked() {
+	if c.heartbeatStop != nil {
+		close(c.heartbeatStop)
+		c.heartbeatStop = nil
+	}
+}
+
+// HeartbeatStop returns a channel closed when the heartbeat goroutine of the current stream must stop
+func (c *Connection) HeartbeatStop() <-chan struct{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.heartbeatStop == nil {
+		// Nothing attached, stop right away
+		stopped := make(chan struct{})
+		close(stopped)
+		return stopped
+	}
+	return c.heartbeatStop
+}
+
+// GetStream returns the attached stream, nil if the device is offline
+func (c *Connection) GetStream() NotificationStream {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.stream
+}
+
+// GetQueue returns the send queue of the attached stream, nil if the device is offline
+func (c *Connection) GetQueue() *SendQueue {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.queue
+}
+
+// GetAttachedAt returns when the device last attached a stream, zero if it never did
+func (c *Connection) GetAttachedAt() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.attachedAt
+}
+
+// IsActive reports whether a stream is attached
+func (c *Connection) IsActive() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.active
+}
+
+// CanReceive reports whether notifications can currently be pushed to this device
+func (c *Connection) CanReceive() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.stream != nil && c.queue != nil && c.active && !c.paused
+}
+
+// IsPaused reports whether the device asked to stop receiving notifications
+func (c *Connection) IsPaused() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.paused
+}
+
+// SetPaused pauses or resumes delivery to this device
+func (c *Connection) SetPaused(paused bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = paused
+}
+
+// AcksEnabled reports whether the device acknowledges notifications
+func (c *Connection) AcksEnabled() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.acksEnabled
+}
+
+// GetNotificationCount returns the number of notifications delivered to this device
+func (c *Connection) GetNotificationCount() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.notificationCount
+}
+
+// GetAckedCount returns the number of notifications the device acknowledged
+func (c *Connection) GetAckedCount() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ackedCount
+}
+
+// RecordDelivery updates delivery metadata after a notification was handed to the send queue
+func (c *Connection) RecordDelivery() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastNotificationAt = time.Now()
+	c.notificationCount++
+}
+
+// TrackUnacked starts waiting for the notification's ack if the device acknowledges notifications.
+// It must be called before the notification is queued, the device may ack before Enqueue returns.
+// Returns true if the notification was not tracked before.
+func (c *Connection) TrackUnacked(notification *NotificationData) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.acksEnabled {
+		return false
+	}
+
+	if c.unacked == nil {
+		c.unacked = make(map[string]*UnackedNotification)
+	}
+	if existing, ok := c.unacked[notification.ID]; ok {
+		existing.SentAt = time.Now()
+		existing.Attempts++
+		return false
+	}
+	c.unacked[notification.ID] = &UnackedNotification{
+		Notification: notification,
+		SentAt:       time.Now(),
+		Attempts:     1,
+	}
+	return true
+}
+
+// RecordHeartbeat records the outcome of a heartbeat and returns the consecutive failure count
+func (c *Connection) RecordHeartbeat(err error) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil {
+		c.heartbeatFailCount++
+		return c.heartbeatFailCount
+	}
+	c.heartbeatFailCount = 0
+	c.lastHeartbeatAt = time.Now()
+	return 0
+}
+
+// RecordPong records a heartbeat answer from the device
+func (c *Connection) RecordPong() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastPongAt = time.Now()
+}
+
+// GetLastSeen returns the last time the connection was known to be alive: the last pong for
+// devices that answer heartbeats, otherwise the last heartbeat sent
+func (c *Connection) GetLastSeen() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.acksEnabled && !c.lastPongAt.IsZero() {
+		return c.lastPongAt
+	}
+	return c.lastHeartbeatAt
+}
+
+// Acknowledge marks a notification as processed by the device. Returns false if it was not pending.
+func (c *Connection) Acknowledge(notificationID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.unacked[notificationID]; !ok {
+		return false
+	}
+	delete(c.unacked, notificationID)
+	c.ackedCount++
+	return true
+}
+
+// AcknowledgeUpTo marks every pending notification with a sequence up to and including seq as processed
+func (c *Connection) AcknowledgeUpTo(seq uint64) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	acked := 0
+	for id, u := range c.unacked {
+		if u.Notification.Sequence != 0 && u.Notification.Sequence <= seq {
+			delete(c.unacked, id)
+			acked++
+		}
+	}
+	c.ackedCount += acked
+	return acked
+}
+
+// GetUnackedCount returns the number of notifications waiting for an acknowledgement
+func (c *Connection) GetUnackedCount() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.unacked)
+}
+
+// GetExpiredUnacked returns copies of pending notifications sent more than timeout ago, oldest sequence first
+func (c *Connection) GetExpiredUnacked(timeout time.Duration) []UnackedNotification {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var expired []UnackedNotification
+	for _, u := range c.unacked {
+		if time.Since(u.SentAt) > timeout {
+			expired = append(expired, *u)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].Notification.Sequence < expired[j].Notification.Sequence
+	})
+	return expired
+}
+
+// DropUnacked stops tracking a notification without counting it as acknowledged
+func (c *Connection) DropUnacked(notificationID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.unacked, notificationID)
+}
+
+// TakeUnacked removes and returns every pending notification, oldest sequence first
+func (c *Connection) TakeUnacked() []UnackedNotification {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	taken := make([]UnackedNotification, 0, len(c.unacked))
+	for _, u := range c.unacked {
+		taken = append(taken, *u)
+	}
+	c.unacked = nil
+
+	sort.Slice(taken, func(i, j int) bool {
+		return taken[i].Notification.Sequence < taken[j].Notification.Sequence
+	})
+	return taken
+}
+
+// Snapshot returns a consistent copy of the connection state
+func (c *Connection) Snapshot() ConnectionSnapshot {
+	c.mu.RLock()
+	snapshot := ConnectionSnapshot{
+		UniqueID:           c.UniqueID,
+		ClientID:           c.ClientID,
+		DeviceID:           c.DeviceID,
+		ServiceName:        c.ServiceName,
+		Platform:           c.platform,
+		AppVersion:         c.appVersion,
+		ConnectedAt:        c.ConnectedAt,
+		IsActive:           c.active,
+		Paused:             c.paused,
+		AcksEnabled:        c.acksEnabled,
+		AttachedAt:         c.attachedAt,
+		LastNotificationAt: c.lastNotificationAt,
+		LastHeartbeatAt:    c.lastHeartbeatAt,
+		NotificationCount:  c.notificationCount,
+		AckedCount:         c.ackedCount,
+		UnackedCount:       len(c.unacked),
+	}
+	queue := c.queue
+	c.mu.RUnlock()
+
+	// The queue has its own lock, don't hold ours while taking it
+	if queue != nil {
+		stats := queue.Stats()
+		snapshot.Queue = &stats
+	}
+	return snapshot
+}
@@ -0,0 +1,152 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	pb "grpcon/proto"
+)
+
+// nopStream accepts every Send. It is not empty so two of them are different streams.
+type nopStream struct{ id int }
+
+func (nopStream) Send(*pb.Notification) error { return nil }
+func (nopStream) Context() context.Context    { return context.Background() }
+
+func TestConnectionAttachDetach(t *testing.T) {
+	conn := NewConnection(CreateUniqueID("alice", "phone"), "alice", "phone", "test")
+	if conn.IsActive() || conn.CanReceive() {
+		t.Fatal("new connection is active")
+	}
+
+	first, second := &nopStream{1}, &nopStream{2}
+	firstQueue := NewSendQueue(first, 4, OverflowDropOldest)
+	defer firstQueue.Close()
+	if previous := conn.AttachStream(first, firstQueue, false); previous != nil {
+		t.Fatal("first attach returned a previous queue")
+	}
+	stop := conn.HeartbeatStop()
+
+	secondQueue := NewSendQueue(second, 4, OverflowDropOldest)
+	defer secondQueue.Close()
+	if previous := conn.AttachStream(second, secondQueue, true); previous != firstQueue {
+		t.Fatal("attach did not hand back the replaced queue")
+	}
+	select {
+	case <-stop:
+	default:
+		t.Fatal("heartbeat of the replaced stream not stopped")
+	}
+
+	// The stale stream can't detach the newer one
+	if _, detached := conn.DetachStream(first); detached {
+		t.Fatal("stale stream detached the current one")
+	}
+	if !conn.CanReceive() || !conn.AcksEnabled() {
+		t.Fatal("current stream lost")
+	}
+
+	conn.SetPaused(true)
+	if conn.CanReceive() {
+		t.Fatal("paused connection can receive")
+	}
+
+	if queue, detached := conn.DetachStream(second); !detached || queue != secondQueue {
+		t.Fatal("current stream not detached")
+	}
+	if conn.IsActive() || conn.IsPaused() || conn.GetQueue() != nil {
+		t.Fatal("detached connection keeps its stream state")
+	}
+}
+
+func TestConnectionAcks(t *testing.T) {
+	conn := NewConnection(CreateUniqueID("alice", "phone"), "alice", "phone", "test")
+	queue := NewSendQueue(nopStream{}, 4, OverflowDropOldest)
+	defer queue.Close()
+	conn.AttachStream(nopStream{}, queue, true)
+
+	for seq := uint64(1); seq <= 4; seq++ {
+		n := &NotificationData{ID: fmt.Sprintf("n%d", seq), ClientID: "alice", Sequence: seq}
+		if !conn.TrackUnacked(n) {
+			t.Fatalf("n%d already tracked", seq)
+		}
+	}
+	if conn.TrackUnacked(&NotificationData{ID: "n1", Sequence: 1}) {
+		t.Fatal("tracking n1 twice")
+	}
+
+	if !conn.Acknowledge("n2") || conn.Acknowledge("n2") {
+		t.Fatal("Acknowledge n2 must succeed exactly once")
+	}
+	if acked := conn.AcknowledgeUpTo(3); acked != 2 {
+		t.Fatalf("AcknowledgeUpTo(3) = %d, want 2", acked)
+	}
+	if got := conn.GetAckedCount(); got != 3 {
+		t.Fatalf("GetAckedCount = %d, want 3", got)
+	}
+
+	if expired := conn.GetExpiredUnacked(time.Hour); len(expired) != 0 {
+		t.Fatalf("GetExpiredUnacked = %d notifications, want none", len(expired))
+	}
+	if expired := conn.GetExpiredUnacked(-time.Second); len(expired) != 1 || expired[0].Notification.ID != "n4" {
+		t.Fatalf("GetExpiredUnacked = %v, want n4", expired)
+	}
+
+	if taken := conn.TakeUnacked(); len(taken) != 1 || conn.GetUnackedCount() != 0 {
+		t.Fatalf("TakeUnacked = %d, left %d", len(taken), conn.GetUnackedCount())
+	}
+}
+
+func TestConnectionConcurrentUse(t *testing.T) {
+	conn := NewConnection(CreateUniqueID("alice", "phone"), "alice", "phone", "test")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				stream := &nopStream{j}
+				queue := NewSendQueue(stream, 4, OverflowDropOldest)
+				if previous := conn.AttachStream(stream, queue, j%2 == 0); previous != nil {
+					previous.Close()
+				}
+				if queue, detached := conn.DetachStream(stream); detached {
+					queue.Close()
+				}
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				n := &NotificationData{ID: fmt.Sprintf("n%d_%d", i, j), Sequence: uint64(j + 1)}
+				conn.TrackUnacked(n)
+				conn.RecordDelivery()
+				conn.Acknowledge(n.ID)
+				conn.AcknowledgeUpTo(uint64(j))
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				conn.RecordHeartbeat(nil)
+				conn.RecordPong()
+				conn.SetPaused(j%2 == 0)
+				conn.CanReceive()
+				conn.Snapshot()
+				conn.GetLastSeen()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := conn.GetNotificationCount(); got != 8*50 {
+		t.Fatalf("GetNotificationCount = %d, want %d", got, 8*50)
+	}
+	if queue, detached := conn.DetachStream(nil); detached {
+		queue.Close()
+	}
+}
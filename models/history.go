@@ -0,0 +1,192 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultHistoryCapacity is the number of recent notifications kept per client for replay
+	DefaultHistoryCapacity = 500
+	// DefaultHistoryIdleTTL is how long the history of a client without devices is kept after its last
+	// notification or its last device leaving
+	DefaultHistoryIdleTTL = 24 * time.Hour
+)
+
+// clientHistory is the sequence and the retained notifications of one client
+type clientHistory struct {
+	epoch    string // changes whenever the sequence starts over
+	sequence uint64 // last assigned sequence
+	entries  []*NotificationData
+	lastUsed time.Time // last notification or Touch
+}
+
+// NotificationHistory assigns monotonic per-client sequence numbers and keeps
+// the most recent notifications of each client so reconnecting devices can resume.
+// Sequences are only meaningful within an epoch: a new one starts when the server boots
+// or when an idle client's history is evicted.
+type NotificationHistory struct {
+	mu        sync.Mutex
+	clients   map[string]*clientHistory // key: client_id
+	capacity  int
+	lastEpoch int64 // last epoch handed out, epochs only go up
+}
+
+// ReplayResult is what Since found for a resume cursor
+type ReplayResult struct {
+	Missed       []*NotificationData // retained notifications after the cursor, oldest first
+	Complete     bool                // false if the cursor is older than the retained window and some were lost
+	Reset        bool                // the cursor belongs to another epoch, Missed starts from the beginning of this one
+	Epoch        string              // current epoch of the client
+	LastSequence uint64              // last sequence assigned in the current epoch
+}
+
+// NewNotificationHistory creates a new history keeping up to capacity notifications per client
+func NewNotificationHistory(capacity int) *NotificationHistory {
+	if capacity <= 0 {
+		capacity = DefaultHistoryCapacity
+	}
+	return &NotificationHistory{
+		clients:  make(map[string]*clientHistory),
+		capacity: capacity,
+	}
+}
+
+// SetCapacity changes the number of notifications kept per client, longer histories shrink on their next Append
+func (nh *NotificationHistory) SetCapacity(capacity int) {
+	if capacity <= 0 {
+		capacity = DefaultHistoryCapacity
+	}
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+	nh.capacity = capacity
+}
+
+// client returns the history of a client, starting a new epoch if it has none
+func (nh *NotificationHistory) client(clientID string) *clientHistory {
+	ch, exists := nh.clients[clientID]
+	if !exists {
+		epoch := time.Now().UnixNano()
+		if epoch <= nh.lastEpoch {
+			epoch = nh.lastEpoch + 1
+		}
+		nh.lastEpoch = epoch
+		ch = &clientHistory{epoch: strconv.FormatInt(epoch, 36)}
+		nh.clients[clientID] = ch
+	}
+	return ch
+}
+
+// Append assigns the next sequence number for the notification's client, fills in the
+// notification ID if it is empty and records it for replay
+func (nh *NotificationHistory) Append(notification *NotificationData) uint64 {
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+
+	ch := nh.client(notification.ClientID)
+	ch.sequence++
+	ch.lastUsed = time.Now()
+
+	notification.Sequence = ch.sequence
+	notification.Epoch = ch.epoch
+	if notification.ID == "" {
+		notification.ID = CreateNotificationID(notification.ClientID, ch.epoch, ch.sequence)
+	}
+
+	if over := len(ch.entries) - nh.capacity + 1; over > 0 {
+		ch.entries = ch.entries[over:]
+	}
+	ch.entries = append(ch.entries, notification)
+
+	return ch.sequence
+}
+
+// Since returns the retained notifications of a client with a sequence greater than cursor.
+// If epoch is set and is not the client's current one, or the cursor is ahead of what was
+// assigned, the cursor is from before a restart or an eviction: the result is marked Reset
+// and holds every retained notification of the current epoch.
+func (nh *NotificationHistory) Since(clientID, epoch string, cursor uint64) ReplayResult {
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+
+	ch, exists := nh.clients[clientID]
+	if !exists {
+		// Nothing was sent since the cursor's epoch ended
+		return ReplayResult{Reset: true, Complete: true}
+	}
+
+	result := ReplayResult{Epoch: ch.epoch, LastSequence: ch.sequence}
+	if (epoch != "" && epoch != ch.epoch) || cursor > ch.sequence {
+		result.Reset = true
+		cursor = 0
+	}
+
+	result.Complete = len(ch.entries) == 0 || ch.entries[0].Sequence <= cursor+1
+	for _, n := range ch.entries {
+		if n.Sequence > cursor {
+			result.Missed = append(result.Missed, n)
+		}
+	}
+	return result
+}
+
+// Touch keeps the history of a client, starting one if it has none, for another idle TTL. The client
+// is known until PurgeIdle drops it, even without notifications.
+func (nh *NotificationHistory) Touch(clientID string) {
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+	nh.client(clientID).lastUsed = time.Now()
+}
+
+// Has reports whether a client has a history, i.e. got a notification or was touched within the idle TTL
+func (nh *NotificationHistory) Has(clientID string) bool {
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+	_, exists := nh.clients[clientID]
+	return exists
+}
+
+// GetLastSequence returns the last sequence number assigned for a client
+func (nh *NotificationHistory) GetLastSequence(clientID string) uint64 {
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+	if ch, exists := nh.clients[clientID]; exists {
+		return ch.sequence
+	}
+	return 0
+}
+
+// GetClientCount returns the number of clients with a history
+func (nh *NotificationHistory) GetClientCount() int {
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+	return len(nh.clients)
+}
+
+// PurgeIdle drops the history of clients that got no notification and no Touch within ttl, unless keep
+// reports them as still in use. Their next notification starts a new epoch. Returns how many
+// clients were dropped.
+func (nh *NotificationHistory) PurgeIdle(ttl time.Duration, keep func(clientID string) bool) int {
+	if ttl <= 0 {
+		return 0
+	}
+
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+
+	removed := 0
+	for clientID, ch := range nh.clients {
+		if time.Since(ch.lastUsed) > ttl && !keep(clientID) {
+			delete(nh.clients, clientID)
+			removed++
+		}
+	}
+	return removed
+}
+
+// CreateNotificationID generates a notification ID from client_id, the history epoch and its sequence number
+func CreateNotificationID(clientID, epoch string, sequence uint64) string {
+	return fmt.Sprintf("notif_%s_%s_%d", clientID, epoch, sequence)
+}
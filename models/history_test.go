@@ -0,0 +1,131 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func appendHistory(nh *NotificationHistory, clientID string, count int) []*NotificationData {
+	appended := make([]*NotificationData, count)
+	for i := range appended {
+		appended[i] = &NotificationData{ClientID: clientID, Title: "title"}
+		nh.Append(appended[i])
+	}
+	return appended
+}
+
+func TestHistoryAssignsSequencesPerClient(t *testing.T) {
+	nh := NewNotificationHistory(10)
+	alice := appendHistory(nh, "alice", 3)
+	bob := appendHistory(nh, "bob", 1)
+
+	if alice[2].Sequence != 3 || bob[0].Sequence != 1 {
+		t.Fatalf("sequences = %d, %d, want 3, 1", alice[2].Sequence, bob[0].Sequence)
+	}
+	if alice[0].Epoch == "" || alice[0].Epoch != alice[2].Epoch {
+		t.Fatalf("epochs of one client differ: %q, %q", alice[0].Epoch, alice[2].Epoch)
+	}
+	if want := "notif_alice_" + alice[2].Epoch + "_3"; alice[2].ID != want {
+		t.Fatalf("ID = %s, want %s", alice[2].ID, want)
+	}
+
+	// IDs given by the publisher are kept
+	given := &NotificationData{ID: "mine", ClientID: "alice"}
+	nh.Append(given)
+	if given.ID != "mine" || given.Sequence != 4 {
+		t.Fatalf("Append overwrote the ID or skipped a sequence: %s, %d", given.ID, given.Sequence)
+	}
+}
+
+func TestHistorySinceResumesAfterCursor(t *testing.T) {
+	nh := NewNotificationHistory(3)
+	appended := appendHistory(nh, "alice", 5)
+	epoch := appended[0].Epoch
+
+	replay := nh.Since("alice", epoch, 3)
+	if replay.Reset || !replay.Complete || len(replay.Missed) != 2 || replay.Missed[0].Sequence != 4 {
+		t.Fatalf("Since(3) = %+v, want sequences 4 and 5", replay)
+	}
+
+	// Only 3 to 5 are retained
+	replay = nh.Since("alice", epoch, 1)
+	if replay.Reset || replay.Complete || len(replay.Missed) != 3 {
+		t.Fatalf("Since(1) = %+v, want 3 notifications and Complete false", replay)
+	}
+
+	if replay = nh.Since("alice", epoch, 5); len(replay.Missed) != 0 || !replay.Complete {
+		t.Fatalf("Since(5) = %+v, want nothing missed", replay)
+	}
+}
+
+func TestHistorySinceResetsCursorOfAnotherEpoch(t *testing.T) {
+	nh := NewNotificationHistory(10)
+	appendHistory(nh, "alice", 2)
+
+	for name, replay := range map[string]ReplayResult{
+		"other epoch":    nh.Since("alice", "old", 1),
+		"cursor ahead":   nh.Since("alice", "", 9),
+		"unknown client": nh.Since("bob", "old", 4),
+	} {
+		if !replay.Reset {
+			t.Errorf("%s: Reset = false, want true", name)
+		}
+	}
+
+	replay := nh.Since("alice", "old", 1)
+	if len(replay.Missed) != 2 || replay.LastSequence != 2 || replay.Epoch == "old" {
+		t.Fatalf("Since from another epoch = %+v, want both notifications of the current one", replay)
+	}
+}
+
+func TestHistoryPurgeIdleStartsNewEpoch(t *testing.T) {
+	nh := NewNotificationHistory(10)
+	first := appendHistory(nh, "alice", 2)
+	appendHistory(nh, "bob", 1)
+
+	if removed := nh.PurgeIdle(time.Hour, func(string) bool { return false }); removed != 0 {
+		t.Fatalf("PurgeIdle removed %d recent clients", removed)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	keep := func(clientID string) bool { return clientID == "bob" }
+	if removed := nh.PurgeIdle(time.Millisecond, keep); removed != 1 {
+		t.Fatalf("PurgeIdle removed %d, want 1", removed)
+	}
+	if got := nh.GetClientCount(); got != 1 {
+		t.Fatalf("GetClientCount = %d, want 1", got)
+	}
+
+	next := appendHistory(nh, "alice", 1)[0]
+	if next.Sequence != 1 || next.Epoch == first[0].Epoch {
+		t.Fatalf("after eviction: sequence %d epoch %s, want 1 in a new epoch", next.Sequence, next.Epoch)
+	}
+	if !strings.HasSuffix(next.ID, "_1") || next.ID == first[0].ID {
+		t.Fatalf("ID %s reused after eviction", next.ID)
+	}
+	if replay := nh.Since("alice", first[0].Epoch, 2); !replay.Reset || len(replay.Missed) != 1 {
+		t.Fatalf("Since with the evicted epoch = %+v, want a reset", replay)
+	}
+}
+
+func TestHistoryTouchKeepsClientKnown(t *testing.T) {
+	nh := NewNotificationHistory(10)
+	if nh.Has("alice") {
+		t.Fatal("client without notifications has a history")
+	}
+
+	nh.Touch("alice")
+	if !nh.Has("alice") || nh.GetLastSequence("alice") != 0 {
+		t.Fatal("Touch didn't start an empty history")
+	}
+	if removed := nh.PurgeIdle(time.Hour, func(string) bool { return false }); removed != 0 {
+		t.Fatalf("PurgeIdle removed %d recently touched clients", removed)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	nh.PurgeIdle(time.Millisecond, func(string) bool { return false })
+	if nh.Has("alice") {
+		t.Fatal("idle touched client still has a history")
+	}
+}
@@ -0,0 +1,203 @@
+package models
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultInboxCapacity is the max number of pending notifications kept per client
+	DefaultInboxCapacity = 100
+	// DefaultInboxMaxClients is the max number of clients with pending notifications at once
+	DefaultInboxMaxClients = 10000
+	// DefaultInboxTTL is how long an undelivered notification is kept before it is discarded
+	DefaultInboxTTL = 24 * time.Hour
+)
+
+// ErrInboxFull is returned when a notification is refused because too many clients already have pending ones
+var ErrInboxFull = errors.New("inbox full")
+
+// PendingNotification is a notification waiting for one of the client's devices to attach a stream
+type PendingNotification struct {
+	Notification *NotificationData
+	QueuedAt     time.Time
+}
+
+// IsExpired reports whether the pending notification is older than the given ttl
+func (p *PendingNotification) IsExpired(ttl time.Duration) bool {
+	return ttl > 0 && time.Since(p.QueuedAt) > ttl
+}
+
+// NotificationInbox keeps undelivered notifications per client until a device comes online.
+// Both the notifications kept per client and the number of clients are bounded.
+type NotificationInbox struct {
+	mu         sync.Mutex
+	pending    map[string][]*PendingNotification // key: client_id
+	capacity   int                               // per client
+	maxClients int
+	ttl        time.Duration
+	dropped    uint64 // notifications discarded or refused because a limit was reached
+}
+
+// NewNotificationInbox creates a new inbox with the given per-client capacity and ttl, holding
+// notifications of up to DefaultInboxMaxClients clients
+func NewNotificationInbox(capacity int, ttl time.Duration) *NotificationInbox {
+	if capacity <= 0 {
+		capacity = DefaultInboxCapacity
+	}
+	return &NotificationInbox{
+		pending:    make(map[string][]*PendingNotification),
+		capacity:   capacity,
+		maxClients: DefaultInboxMaxClients,
+		ttl:        ttl,
+	}
+}
+
+// SetLimits changes the per-client capacity, the number of clients and the ttl. Inboxes over the
+// new capacity shrink on their next Enqueue, expired notifications are discarded on the next Drain
+// or PurgeExpired. Clients over the new maxClients keep their inbox until it is drained.
+func (ib *NotificationInbox) SetLimits(capacity, maxClients int, ttl time.Duration) {
+	if capacity <= 0 {
+		capacity = DefaultInboxCapacity
+	}
+	if maxClients <= 0 {
+		maxClients = DefaultInboxMaxClients
+	}
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	ib.capacity = capacity
+	ib.maxClients = maxClients
+	ib.ttl = ttl
+}
+
+// Enqueue stores a notification for its client, dropping the oldest one if the client's inbox is full.
+// Returns true if an older notification had to be dropped, or ErrInboxFull if the client has no
+// inbox yet and the max number of clients is reached.
+func (ib *NotificationInbox) Enqueue(notification *NotificationData) (bool, error) {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
+	queue, exists := ib.pending[notification.ClientID]
+	if !exists && len(ib.pending) >= ib.maxClients {
+		ib.dropped++
+		return false, ErrInboxFull
+	}
+
+	dropped := false
+	if len(queue) >= ib.capacity {
+		ib.dropped += uint64(len(queue) - ib.capacity + 1)
+		queue = queue[len(queue)-ib.capacity+1:]
+		dropped = true
+	}
+
+	ib.pending[notification.ClientID] = append(queue, &PendingNotification{
+		Notification: notification,
+		QueuedAt:     time.Now(),
+	})
+	return dropped, nil
+}
+
+// Drain removes and returns all non-expired pending notifications for a client, oldest first
+func (ib *NotificationInbox) Drain(clientID string) []*PendingNotification {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
+	queue, exists := ib.pending[clientID]
+	if !exists {
+		return nil
+	}
+	delete(ib.pending, clientID)
+
+	result := make([]*PendingNotification, 0, len(queue))
+	for _, p := range queue {
+		if !p.IsExpired(ib.ttl) {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// Requeue puts notifications back at the front of a client's inbox (used when a flush fails midway).
+// Returns how many had to be dropped to stay within the limits.
+func (ib *NotificationInbox) Requeue(clientID string, items []*PendingNotification) int {
+	if len(items) == 0 {
+		return 0
+	}
+
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
+	existing, exists := ib.pending[clientID]
+	if !exists && len(ib.pending) >= ib.maxClients {
+		ib.dropped += uint64(len(items))
+		return len(items)
+	}
+
+	queue := append(append([]*PendingNotification{}, items...), existing...)
+	dropped := 0
+	if len(queue) > ib.capacity {
+		dropped = len(queue) - ib.capacity
+		queue = queue[dropped:]
+		ib.dropped += uint64(dropped)
+	}
+	ib.pending[clientID] = queue
+	return dropped
+}
+
+// GetPendingCount returns number of pending notifications for a client
+func (ib *NotificationInbox) GetPendingCount(clientID string) int {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	return len(ib.pending[clientID])
+}
+
+// GetTotalPending returns number of pending notifications across all clients
+func (ib *NotificationInbox) GetTotalPending() int {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
+	total := 0
+	for _, queue := range ib.pending {
+		total += len(queue)
+	}
+	return total
+}
+
+// GetClientCount returns the number of clients with pending notifications
+func (ib *NotificationInbox) GetClientCount() int {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	return len(ib.pending)
+}
+
+// GetDropped returns how many notifications were discarded or refused because a limit was reached
+func (ib *NotificationInbox) GetDropped() uint64 {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	return ib.dropped
+}
+
+// PurgeExpired discards notifications older than the inbox ttl and returns how many were removed
+func (ib *NotificationInbox) PurgeExpired() int {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
+	removed := 0
+	for clientID, queue := range ib.pending {
+		kept := queue[:0]
+		for _, p := range queue {
+			if p.IsExpired(ib.ttl) {
+				removed++
+				continue
+			}
+			kept = append(kept, p)
+		}
+		if len(kept) == 0 {
+			delete(ib.pending, clientID)
+		} else {
+			ib.pending[clientID] = kept
+		}
+	}
+	return removed
+}
@@ -0,0 +1,117 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func inboxNotification(clientID, id string) *NotificationData {
+	return &NotificationData{ID: id, ClientID: clientID, Title: "title", Body: "body"}
+}
+
+func pendingIDs(pending []*PendingNotification) []string {
+	ids := make([]string, len(pending))
+	for i, p := range pending {
+		ids[i] = p.Notification.ID
+	}
+	return ids
+}
+
+func TestInboxDropsOldestOverCapacity(t *testing.T) {
+	ib := NewNotificationInbox(2, time.Hour)
+
+	for i := 1; i <= 3; i++ {
+		dropped, err := ib.Enqueue(inboxNotification("c1", fmt.Sprintf("n%d", i)))
+		if err != nil {
+			t.Fatalf("Enqueue n%d: %v", i, err)
+		}
+		if want := i == 3; dropped != want {
+			t.Fatalf("Enqueue n%d dropped = %v, want %v", i, dropped, want)
+		}
+	}
+
+	if got := fmt.Sprint(pendingIDs(ib.Drain("c1"))); got != "[n2 n3]" {
+		t.Fatalf("Drain = %s, want [n2 n3]", got)
+	}
+	if got := ib.GetDropped(); got != 1 {
+		t.Fatalf("GetDropped = %d, want 1", got)
+	}
+	if got := ib.GetPendingCount("c1"); got != 0 {
+		t.Fatalf("GetPendingCount after Drain = %d, want 0", got)
+	}
+}
+
+func TestInboxRefusesClientsOverLimit(t *testing.T) {
+	ib := NewNotificationInbox(10, time.Hour)
+	ib.SetLimits(10, 2, time.Hour)
+
+	for _, clientID := range []string{"c1", "c2"} {
+		if _, err := ib.Enqueue(inboxNotification(clientID, "n")); err != nil {
+			t.Fatalf("Enqueue %s: %v", clientID, err)
+		}
+	}
+
+	if _, err := ib.Enqueue(inboxNotification("c3", "n")); !errors.Is(err, ErrInboxFull) {
+		t.Fatalf("Enqueue over the client limit = %v, want ErrInboxFull", err)
+	}
+	// Clients that already have an inbox still get notifications
+	if _, err := ib.Enqueue(inboxNotification("c1", "n2")); err != nil {
+		t.Fatalf("Enqueue for an existing client: %v", err)
+	}
+	if dropped := ib.Requeue("c4", []*PendingNotification{{Notification: inboxNotification("c4", "n")}}); dropped != 1 {
+		t.Fatalf("Requeue over the client limit dropped %d, want 1", dropped)
+	}
+
+	if got := ib.GetClientCount(); got != 2 {
+		t.Fatalf("GetClientCount = %d, want 2", got)
+	}
+	if got := ib.GetDropped(); got != 2 {
+		t.Fatalf("GetDropped = %d, want 2", got)
+	}
+
+	// Draining frees a slot
+	ib.Drain("c2")
+	if _, err := ib.Enqueue(inboxNotification("c3", "n")); err != nil {
+		t.Fatalf("Enqueue after Drain: %v", err)
+	}
+}
+
+func TestInboxRequeueKeepsOrder(t *testing.T) {
+	ib := NewNotificationInbox(3, time.Hour)
+	ib.Enqueue(inboxNotification("c1", "n3"))
+	ib.Enqueue(inboxNotification("c1", "n4"))
+
+	items := []*PendingNotification{
+		{Notification: inboxNotification("c1", "n1"), QueuedAt: time.Now()},
+		{Notification: inboxNotification("c1", "n2"), QueuedAt: time.Now()},
+	}
+	if dropped := ib.Requeue("c1", items); dropped != 1 {
+		t.Fatalf("Requeue dropped %d, want 1", dropped)
+	}
+	if got := fmt.Sprint(pendingIDs(ib.Drain("c1"))); got != "[n2 n3 n4]" {
+		t.Fatalf("Drain = %s, want [n2 n3 n4]", got)
+	}
+}
+
+func TestInboxExpiry(t *testing.T) {
+	ib := NewNotificationInbox(10, time.Minute)
+	ib.Requeue("c1", []*PendingNotification{
+		{Notification: inboxNotification("c1", "old"), QueuedAt: time.Now().Add(-time.Hour)},
+		{Notification: inboxNotification("c1", "new"), QueuedAt: time.Now()},
+	})
+	ib.Requeue("c2", []*PendingNotification{
+		{Notification: inboxNotification("c2", "old"), QueuedAt: time.Now().Add(-time.Hour)},
+	})
+
+	if removed := ib.PurgeExpired(); removed != 2 {
+		t.Fatalf("PurgeExpired = %d, want 2", removed)
+	}
+	if got := ib.GetClientCount(); got != 1 {
+		t.Fatalf("GetClientCount after PurgeExpired = %d, want 1", got)
+	}
+	if got := fmt.Sprint(pendingIDs(ib.Drain("c1"))); got != "[new]" {
+		t.Fatalf("Drain = %s, want [new]", got)
+	}
+}
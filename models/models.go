@@ -2,33 +2,12 @@ package models
 
 import (
 	"fmt"
+	"strings"
 	"sync"
-	"time"
 
 	pb "grpcon/proto"
 )
 
-// Connection represents an active device connection
-type Connection struct {
-	UniqueID           string // client_id_device_id
-	ClientID           string
-	DeviceID           string
-	ServiceName        string
-	Stream             pb.NotificationService_StreamNotificationsServer
-	ConnectedAt        time.Time
-	LastNotificationAt time.Time
-	LastHeartbeatAt    time.Time // Last heartbeat sent
-	NotificationCount  int
-	IsActive           bool
-	HeartbeatFailCount int       // Track consecutive heartbeat failures
-	HeartbeatStopChan  chan bool // Channel to stop heartbeat goroutine
-}
-
-// GetUptime returns how long the connection has been active
-func (c *Connection) GetUptime() time.Duration {
-	return time.Since(c.ConnectedAt)
-}
-
 // ClientGroup represents all devices connected for a single client
 type ClientGroup struct {
 	ClientID string
@@ -75,11 +54,14 @@ func (cg *ClientGroup) GetDeviceWithLeastNotifications() (*Connection, bool) {
 	cg.mu.RLock()
 	defer cg.mu.RUnlock()
 	var selectedConn *Connection
+	selectedCount := 0
 	for _, conn := range cg.Devices {
 		// Only consider devices with active streams
-		if conn.Stream != nil && conn.IsActive {
-			if selectedConn == nil || conn.NotificationCount < selectedConn.NotificationCount {
+		if conn.CanReceive() {
+			count := conn.GetNotificationCount()
+			if selectedConn == nil || count < selectedCount {
 				selectedConn = conn
+				selectedCount = count
 			}
 		}
 	}
@@ -107,16 +89,37 @@ func (cg *ClientGroup) GetDeviceCount() int {
 	return len(cg.Devices)
 }
 
+// ConnectionStore keeps track of device connections grouped by client.
+// ConnectionManager is the default in-memory implementation; sharded, persistent
+// or distributed stores (and test mocks) can be plugged into the handlers instead.
+type ConnectionStore interface {
+	AddConnection(conn *Connection)
+	RemoveConnection(uniqueID string, clientID string, deviceID string) bool
+	GetConnection(clientID string, deviceID string) (*Connection, bool)
+	GetConnectionByUniqueID(uniqueID string) (*Connection, bool)
+	GetClientGroup(clientID string) (*ClientGroup, bool)
+	GetAllClientIDs() []string
+	GetAllConnections() []*Connection
+	GetTotalDeviceCount() int
+	GetClientCount() int
+	GetStats() map[string]interface{}
+}
+
+// Ensure the in-memory manager satisfies ConnectionStore
+var _ ConnectionStore = (*ConnectionManager)(nil)
+
 // ConnectionManager manages all client groups and their device connections
 type ConnectionManager struct {
-	mu      sync.RWMutex
-	clients map[string]*ClientGroup // key: client_id
+	mu          sync.RWMutex
+	clients     map[string]*ClientGroup // key: client_id
+	connections map[string]*Connection  // key: unique_id, secondary index over clients
 }
 
 // NewConnectionManager creates a new connection manager instance
 func NewConnectionManager() *ConnectionManager {
 	return &ConnectionManager{
-		clients: make(map[string]*ClientGroup),
+		clients:     make(map[string]*ClientGroup),
+		connections: make(map[string]*Connection),
 	}
 }
 
@@ -134,6 +137,7 @@ func (cm *ConnectionManager) AddConnection(conn *Connection) {
 
 	// Add device to client group
 	clientGroup.AddDevice(conn)
+	cm.connections[conn.UniqueID] = conn
 }
 
 // RemoveConnection removes a device connection using unique_id (client_id_device_id)
@@ -146,7 +150,11 @@ func (cm *ConnectionManager) RemoveConnection(uniqueID string, clientID string,
 		return false
 	}
 
+	conn, _ := clientGroup.GetDevice(deviceID)
 	removed := clientGroup.RemoveDevice(deviceID)
+	if removed {
+		delete(cm.connections, conn.UniqueID)
+	}
 
 	// If client has no more devices, remove the client group
 	if clientGroup.GetDeviceCount() == 0 {
@@ -169,20 +177,13 @@ func (cm *ConnectionManager) GetConnection(clientID string, deviceID string) (*C
 	return clientGroup.GetDevice(deviceID)
 }
 
-// GetConnectionByUniqueID retrieves a connection using its unique ID (client_id_device_id)
+// GetConnectionByUniqueID retrieves a connection using its unique ID (see CreateUniqueID)
 func (cm *ConnectionManager) GetConnectionByUniqueID(uniqueID string) (*Connection, bool) {
 	cm.mu.RLock()
 	defer cm.mu.RUnlock()
 
-	// Iterate through all clients and their devices to find matching unique ID
-	for _, clientGroup := range cm.clients {
-		for _, device := range clientGroup.Devices {
-			if device.UniqueID == uniqueID {
-				return device, true
-			}
-		}
-	}
-	return nil, false
+	conn, exists := cm.connections[uniqueID]
+	return conn, exists
 }
 
 // GetClientGroup retrieves all devices for a specific client
@@ -261,6 +262,17 @@ type NotificationData struct {
 	CallID      string
 	ServiceName string
 	Timestamp   int64
+	Title       string
+	Body        string
+	Data        map[string]string // Arbitrary key/value pairs for the app, treat as read-only once sent
+	Payload     []byte            // Opaque app payload, passed through untouched
+	Category    string
+	Priority    pb.Priority
+	Topic       string // Topic it was published to, empty when sent to a client
+	Sequence    uint64 // Per-client sequence, assigned by the connection handler
+	Epoch       string // History epoch the sequence belongs to
+	Relayed     bool   // Received from another node, never relayed again
+	Traceparent string // W3C trace context of the publish, deliveries are traced as its children
 }
 
 // ToProto converts NotificationData to protobuf Notification
@@ -274,10 +286,73 @@ func (n *NotificationData) ToProto(connectionID string) *pb.Notification {
 		CallId:       n.CallID,
 		ServiceName:  n.ServiceName,
 		Timestamp:    n.Timestamp,
+		Sequence:     n.Sequence,
+		Epoch:        n.Epoch,
+		Title:        n.Title,
+		Body:         n.Body,
+		Data:         n.Data,
+		Payload:      n.Payload,
+		Category:     n.Category,
+		Priority:     n.Priority,
+		Topic:        n.Topic,
+		Traceparent:  n.Traceparent,
+	}
+}
+
+// NotificationFromProto converts a protobuf Notification published by a backend service.
+// Sequence and connection ID are assigned on delivery, so they are not copied.
+func NotificationFromProto(n *pb.Notification) *NotificationData {
+	return &NotificationData{
+		ID:          n.Id,
+		ClientID:    n.ClientId,
+		CreatedAt:   n.CreatedAt,
+		UpdatedAt:   n.UpdatedAt,
+		CallID:      n.CallId,
+		ServiceName: n.ServiceName,
+		Timestamp:   n.Timestamp,
+		Title:       n.Title,
+		Body:        n.Body,
+		Data:        n.Data,
+		Payload:     n.Payload,
+		Category:    n.Category,
+		Priority:    n.Priority,
+		Traceparent: n.Traceparent,
+	}
+}
+
+// ParsePriority parses low, normal, high or critical (case-insensitive), empty means normal
+func ParsePriority(name string) (pb.Priority, error) {
+	switch strings.ToLower(name) {
+	case "normal", "":
+		return pb.Priority_PRIORITY_NORMAL, nil
+	case "low":
+		return pb.Priority_PRIORITY_LOW, nil
+	case "high":
+		return pb.Priority_PRIORITY_HIGH, nil
+	case "critical":
+		return pb.Priority_PRIORITY_CRITICAL, nil
 	}
+	return pb.Priority_PRIORITY_NORMAL, fmt.Errorf("unknown priority: %s", name)
 }
 
-// CreateUniqueID generates unique connection ID from client_id and device_id
+// uniqueIDEscaper escapes the separator in client IDs so the first "_" of a unique ID always ends the client ID
+var uniqueIDEscaper = strings.NewReplacer("%", "%25", "_", "%5F")
+
+// uniqueIDUnescaper reverses uniqueIDEscaper
+var uniqueIDUnescaper = strings.NewReplacer("%25", "%", "%5F", "_")
+
+// CreateUniqueID generates unique connection ID from client_id and device_id.
+// It is client_id_device_id, with "%" and "_" in the client ID escaped as "%25" and "%5F",
+// so "a_b"+"c" and "a"+"b_c" get different IDs. IDs without those characters are unchanged.
 func CreateUniqueID(clientID, deviceID string) string {
-	return fmt.Sprintf("%s_%s", clientID, deviceID)
+	return fmt.Sprintf("%s_%s", uniqueIDEscaper.Replace(clientID), deviceID)
+}
+
+// ParseUniqueID splits a unique connection ID created by CreateUniqueID into client_id and device_id
+func ParseUniqueID(uniqueID string) (clientID, deviceID string, ok bool) {
+	escapedClientID, deviceID, found := strings.Cut(uniqueID, "_")
+	if !found {
+		return "", "", false
+	}
+	return uniqueIDUnescaper.Replace(escapedClientID), deviceID, true
 }
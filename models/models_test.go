@@ -0,0 +1,58 @@
+package models
+
+import "testing"
+
+func TestCreateUniqueIDIsUnambiguous(t *testing.T) {
+	if a, b := CreateUniqueID("a_b", "c"), CreateUniqueID("a", "b_c"); a == b {
+		t.Fatalf("a_b/c and a/b_c both get %s", a)
+	}
+	if got := CreateUniqueID("alice", "phone"); got != "alice_phone" {
+		t.Fatalf("CreateUniqueID(alice, phone) = %s, want alice_phone", got)
+	}
+
+	for _, ids := range [][2]string{
+		{"alice", "phone"},
+		{"a_b", "c"},
+		{"a", "b_c"},
+		{"100%_sure", "x_%5F"},
+		{"%5F", "_"},
+		{"", "phone"},
+	} {
+		uniqueID := CreateUniqueID(ids[0], ids[1])
+		clientID, deviceID, ok := ParseUniqueID(uniqueID)
+		if !ok || clientID != ids[0] || deviceID != ids[1] {
+			t.Errorf("ParseUniqueID(%q) = %q, %q, %v, want %q, %q", uniqueID, clientID, deviceID, ok, ids[0], ids[1])
+		}
+	}
+
+	if _, _, ok := ParseUniqueID("nounderscore"); ok {
+		t.Error("ParseUniqueID accepted an ID without a separator")
+	}
+}
+
+func TestConnectionManagerIndexesUniqueIDs(t *testing.T) {
+	cm := NewConnectionManager()
+	phone := NewConnection(CreateUniqueID("a_b", "c"), "a_b", "c", "test")
+	tablet := NewConnection(CreateUniqueID("a", "b_c"), "a", "b_c", "test")
+	cm.AddConnection(phone)
+	cm.AddConnection(tablet)
+
+	for _, conn := range []*Connection{phone, tablet} {
+		if got, ok := cm.GetConnectionByUniqueID(conn.UniqueID); !ok || got != conn {
+			t.Fatalf("GetConnectionByUniqueID(%s) = %v, %v, want its connection", conn.UniqueID, got, ok)
+		}
+	}
+
+	if !cm.RemoveConnection(phone.UniqueID, "a_b", "c") {
+		t.Fatal("RemoveConnection = false, want true")
+	}
+	if _, ok := cm.GetConnectionByUniqueID(phone.UniqueID); ok {
+		t.Fatal("removed connection still found by unique ID")
+	}
+	if got, ok := cm.GetConnectionByUniqueID(tablet.UniqueID); !ok || got != tablet {
+		t.Fatal("removing one connection dropped another from the index")
+	}
+	if cm.RemoveConnection(phone.UniqueID, "a_b", "c") {
+		t.Fatal("RemoveConnection of a removed connection = true, want false")
+	}
+}
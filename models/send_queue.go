@@ -0,0 +1,317 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	pb "grpcon/proto"
+)
+
+const (
+	// DefaultSendQueueCapacity is the default number of messages buffered per connection
+	DefaultSendQueueCapacity = 256
+	// writerStopTimeout is how long Close waits for a Send in progress to return
+	writerStopTimeout = time.Second
+)
+
+var (
+	// ErrQueueFull is returned when a message is rejected because the send queue is full
+	ErrQueueFull = errors.New("send queue full")
+	// ErrQueueClosed is returned when enqueueing on a queue whose writer has stopped
+	ErrQueueClosed = errors.New("send queue closed")
+)
+
+// OverflowPolicy decides what happens when a message arrives at a full send queue
+type OverflowPolicy int
+
+const (
+	// OverflowDropOldest discards the oldest queued message to make room
+	OverflowDropOldest OverflowPolicy = iota
+	// OverflowDropNewest rejects the incoming message
+	OverflowDropNewest
+	// OverflowDisconnect rejects the message and closes the queue so the device gets disconnected
+	OverflowDisconnect
+)
+
+// String returns the config name of the policy
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowDropOldest:
+		return "drop_oldest"
+	case OverflowDropNewest:
+		return "drop_newest"
+	case OverflowDisconnect:
+		return "disconnect"
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+// ParseOverflowPolicy parses drop_oldest, drop_newest or disconnect
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch name {
+	case "drop_oldest", "":
+		return OverflowDropOldest, nil
+	case "drop_newest":
+		return OverflowDropNewest, nil
+	case "disconnect":
+		return OverflowDisconnect, nil
+	}
+	return OverflowDropOldest, fmt.Errorf("unknown overflow policy: %s", name)
+}
+
+// OutboundMessage is a message waiting to be written to a device stream.
+// Notification is nil for control messages such as heartbeats.
+type OutboundMessage struct {
+	Notification *NotificationData
+	Message      *pb.Notification
+	OnSent       func() // called by the writer once Send returned without error, must not block
+}
+
+// SendQueueStats is a snapshot of a send queue's counters
+type SendQueueStats struct {
+	Depth    int
+	MaxDepth int
+	Capacity int
+	Enqueued uint64
+	Sent     uint64
+	Dropped  uint64
+}
+
+// SendQueue is a bounded per-connection outbound queue drained by a single writer goroutine,
+// so only one goroutine ever calls Send on the stream
+type SendQueue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond // wakes the writer
+	idle     *sync.Cond // wakes Flush when the writer has nothing left to send
+	sending  bool       // the writer is in Send
+	stream   NotificationStream
+	items    []*OutboundMessage
+	capacity int
+	policy   OverflowPolicy
+	closed   bool
+	err      error            // why the writer stopped, nil if closed normally
+	done     chan struct{}    // closed when the queue stops
+	inFlight *OutboundMessage // message in Send, nil otherwise
+	drained  bool             // Close handed the unsent messages out
+	stopped  chan struct{}    // closed when the writer goroutine returns
+
+	maxDepth int
+	enqueued uint64
+	sent     uint64
+	dropped  uint64
+}
+
+// NewSendQueue creates a send queue for the stream and starts its writer goroutine
+func NewSendQueue(stream NotificationStream, capacity int, policy OverflowPolicy) *SendQueue {
+	if capacity <= 0 {
+		capacity = DefaultSendQueueCapacity
+	}
+
+	q := &SendQueue{
+		stream:   stream,
+		items:    make([]*OutboundMessage, 0, capacity),
+		capacity: capacity,
+		policy:   policy,
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	q.idle = sync.NewCond(&q.mu)
+
+	go q.writeLoop()
+	return q
+}
+
+// Enqueue adds a message for the writer, applying the overflow policy if the queue is full
+func (q *SendQueue) Enqueue(msg *OutboundMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	if len(q.items) >= q.capacity {
+		q.dropped++
+		switch q.policy {
+		case OverflowDropNewest:
+			return ErrQueueFull
+		case OverflowDisconnect:
+			q.stopLocked(ErrQueueFull)
+			return ErrQueueFull
+		default:
+			q.items = q.items[1:]
+		}
+	}
+
+	q.items = append(q.items, msg)
+	q.enqueued++
+	if len(q.items) > q.maxDepth {
+		q.maxDepth = len(q.items)
+	}
+
+	q.cond.Signal()
+	return nil
+}
+
+// Offer adds a message only if the queue has room, without applying the overflow policy.
+// Heartbeats use it so they never push a notification out of a full queue.
+func (q *SendQueue) Offer(msg *OutboundMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+	if len(q.items) >= q.capacity {
+		return ErrQueueFull
+	}
+
+	q.items = append(q.items, msg)
+	q.enqueued++
+	if len(q.items) > q.maxDepth {
+		q.maxDepth = len(q.items)
+	}
+
+	q.cond.Signal()
+	return nil
+}
+
+// writeLoop sends queued messages one at a time until the queue is closed or a send fails
+func (q *SendQueue) writeLoop() {
+	defer close(q.stopped)
+	for {
+		q.mu.Lock()
+		for len(q.items) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return
+		}
+		msg := q.items[0]
+		q.items = q.items[1:]
+		q.sending = true
+		q.inFlight = msg
+		q.mu.Unlock()
+
+		if err := q.stream.Send(msg.Message); err != nil {
+			q.mu.Lock()
+			// Keep the failed message so it can be handed back to the inbox, unless Close gave
+			// up waiting and already handed it out
+			if !q.drained {
+				q.items = append([]*OutboundMessage{msg}, q.items...)
+			}
+			q.sending = false
+			q.inFlight = nil
+			q.stopLocked(err)
+			q.mu.Unlock()
+			return
+		}
+		if msg.OnSent != nil {
+			msg.OnSent()
+		}
+
+		q.mu.Lock()
+		q.sent++
+		q.sending = false
+		q.inFlight = nil
+		if len(q.items) == 0 {
+			q.idle.Broadcast()
+		}
+		q.mu.Unlock()
+	}
+}
+
+// stopLocked marks the queue closed and wakes up the writer. Caller must hold q.mu.
+func (q *SendQueue) stopLocked(err error) {
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.err = err
+	close(q.done)
+	q.cond.Broadcast()
+	q.idle.Broadcast()
+}
+
+// Flush waits until the writer has sent every queued message. It returns early with the queue's
+// error if the writer stops, or with ctx's error if ctx is done first.
+func (q *SendQueue) Flush(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.idle.Broadcast()
+	})
+	defer stop()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for (len(q.items) > 0 || q.sending) && !q.closed {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		q.idle.Wait()
+	}
+	return q.err
+}
+
+// Close stops the writer and returns the messages that were never sent. It waits for a Send in
+// progress to return so a message that fails is not lost; if the Send is still blocked after
+// writerStopTimeout, its message is returned as well and may end up delivered twice.
+func (q *SendQueue) Close() []*OutboundMessage {
+	q.mu.Lock()
+	q.stopLocked(nil)
+	q.mu.Unlock()
+
+	select {
+	case <-q.stopped:
+	case <-time.After(writerStopTimeout):
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	unsent := q.items
+	if q.inFlight != nil && !q.drained {
+		unsent = append([]*OutboundMessage{q.inFlight}, unsent...)
+	}
+	q.items = nil
+	q.drained = true
+	return unsent
+}
+
+// Done is closed when the writer stops: the queue was closed, a send failed or it overflowed with OverflowDisconnect
+func (q *SendQueue) Done() <-chan struct{} {
+	return q.done
+}
+
+// Err returns why the writer stopped, nil while running or after a normal Close
+func (q *SendQueue) Err() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.err
+}
+
+// Depth returns the number of messages waiting to be written
+func (q *SendQueue) Depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// Stats returns a snapshot of the queue counters
+func (q *SendQueue) Stats() SendQueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return SendQueueStats{
+		Depth:    len(q.items),
+		MaxDepth: q.maxDepth,
+		Capacity: q.capacity,
+		Enqueued: q.enqueued,
+		Sent:     q.sent,
+		Dropped:  q.dropped,
+	}
+}
@@ -0,0 +1,224 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	pb "grpcon/proto"
+)
+
+// blockingStream lets a test decide when and how each Send returns
+type blockingStream struct {
+	mu      sync.Mutex
+	sent    []string
+	release chan error // each Send waits for one value, nil to succeed
+	entered chan struct{}
+}
+
+func newBlockingStream() *blockingStream {
+	return &blockingStream{release: make(chan error), entered: make(chan struct{}, 16)}
+}
+
+func (s *blockingStream) Send(n *pb.Notification) error {
+	s.entered <- struct{}{}
+	if err := <-s.release; err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, n.Id)
+	return nil
+}
+
+func (s *blockingStream) Context() context.Context {
+	return context.Background()
+}
+
+func (s *blockingStream) sentIDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.sent...)
+}
+
+func outbound(id string) *OutboundMessage {
+	return &OutboundMessage{
+		Notification: &NotificationData{ID: id},
+		Message:      &pb.Notification{Id: id},
+	}
+}
+
+func TestSendQueueOverflowPolicies(t *testing.T) {
+	for _, tc := range []struct {
+		policy    OverflowPolicy
+		wantErr   error
+		wantQueue []string
+		closed    bool
+	}{
+		{OverflowDropOldest, nil, []string{"b", "c"}, false},
+		{OverflowDropNewest, ErrQueueFull, []string{"a", "b"}, false},
+		{OverflowDisconnect, ErrQueueFull, []string{"a", "b"}, true},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			stream := newBlockingStream()
+			q := NewSendQueue(stream, 2, tc.policy)
+
+			// The writer holds "first" in Send, the queue itself is empty
+			q.Enqueue(outbound("first"))
+			<-stream.entered
+
+			q.Enqueue(outbound("a"))
+			q.Enqueue(outbound("b"))
+			if err := q.Enqueue(outbound("c")); !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Enqueue on a full queue = %v, want %v", err, tc.wantErr)
+			}
+			if got := q.Stats().Dropped; got != 1 {
+				t.Fatalf("Dropped = %d, want 1", got)
+			}
+			select {
+			case <-q.Done():
+				if !tc.closed {
+					t.Fatal("queue stopped")
+				}
+			default:
+				if tc.closed {
+					t.Fatal("queue still running")
+				}
+			}
+
+			stream.release <- errors.New("gone")
+			unsent := q.Close()
+			var ids []string
+			for _, msg := range unsent {
+				ids = append(ids, msg.Message.Id)
+			}
+			want := append([]string{"first"}, tc.wantQueue...)
+			if len(ids) != len(want) {
+				t.Fatalf("unsent = %v, want %v", ids, want)
+			}
+			for i := range want {
+				if ids[i] != want[i] {
+					t.Fatalf("unsent = %v, want %v", ids, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSendQueueOfferNeverDrops(t *testing.T) {
+	stream := newBlockingStream()
+	q := NewSendQueue(stream, 1, OverflowDropOldest)
+	defer func() {
+		close(stream.release)
+		q.Close()
+	}()
+
+	q.Enqueue(outbound("first"))
+	<-stream.entered
+	q.Enqueue(outbound("queued"))
+
+	if err := q.Offer(outbound("heartbeat")); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Offer on a full queue = %v, want ErrQueueFull", err)
+	}
+	if got := q.Stats(); got.Depth != 1 || got.Dropped != 0 {
+		t.Fatalf("Offer changed the queue: %+v", got)
+	}
+}
+
+func TestSendQueueOnSentAfterSend(t *testing.T) {
+	stream := newBlockingStream()
+	q := NewSendQueue(stream, 4, OverflowDropOldest)
+	defer q.Close()
+
+	sent := make(chan struct{})
+	msg := outbound("heartbeat")
+	msg.OnSent = func() { close(sent) }
+	q.Offer(msg)
+
+	<-stream.entered
+	select {
+	case <-sent:
+		t.Fatal("OnSent called before Send returned")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	stream.release <- nil
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("OnSent not called after Send")
+	}
+}
+
+func TestSendQueueCloseKeepsFailedInFlightMessage(t *testing.T) {
+	stream := newBlockingStream()
+	q := NewSendQueue(stream, 4, OverflowDropOldest)
+
+	q.Enqueue(outbound("in-flight"))
+	<-stream.entered
+	q.Enqueue(outbound("queued"))
+
+	// The Send fails while Close is waiting for the writer
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		stream.release <- errors.New("stream closed")
+	}()
+
+	unsent := q.Close()
+	if len(unsent) != 2 || unsent[0].Message.Id != "in-flight" || unsent[1].Message.Id != "queued" {
+		t.Fatalf("unsent = %v, want in-flight then queued", unsent)
+	}
+	if again := q.Close(); len(again) != 0 {
+		t.Fatalf("second Close returned %d messages", len(again))
+	}
+}
+
+func TestSendQueueCloseReturnsStuckMessage(t *testing.T) {
+	stream := newBlockingStream()
+	q := NewSendQueue(stream, 4, OverflowDropOldest)
+
+	q.Enqueue(outbound("stuck"))
+	<-stream.entered
+
+	unsent := q.Close()
+	if len(unsent) != 1 || unsent[0].Message.Id != "stuck" {
+		t.Fatalf("unsent = %v, want the stuck message", unsent)
+	}
+
+	// The late failure must not resurrect it
+	stream.release <- errors.New("stream closed")
+	<-q.stopped
+	if again := q.Close(); len(again) != 0 {
+		t.Fatalf("second Close returned %d messages", len(again))
+	}
+}
+
+func TestSendQueueFlush(t *testing.T) {
+	stream := newBlockingStream()
+	q := NewSendQueue(stream, 8, OverflowDropOldest)
+	defer q.Close()
+
+	go func() {
+		for range 3 {
+			<-stream.entered
+			stream.release <- nil
+		}
+	}()
+	for _, id := range []string{"a", "b", "c"} {
+		q.Enqueue(outbound(id))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := q.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if got := stream.sentIDs(); len(got) != 3 {
+		t.Fatalf("sent = %v, want 3 messages", got)
+	}
+	if got := q.Stats(); got.Sent != 3 || got.Depth != 0 || got.MaxDepth == 0 {
+		t.Fatalf("Stats = %+v", got)
+	}
+}
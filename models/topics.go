@@ -0,0 +1,216 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Topic wildcards. Topics are dot-separated, e.g. "team.sales.emea".
+const (
+	TopicWildcardOne  = "*" // matches exactly one segment: "team.*" matches "team.sales"
+	TopicWildcardTail = ">" // as last segment matches one or more: "team.>" matches "team.sales.emea"
+)
+
+// TopicSubscriber is a device subscribed to a topic pattern
+type TopicSubscriber struct {
+	UniqueID string
+	ClientID string
+	DeviceID string
+}
+
+// TopicIndex keeps track of the topic patterns each device is subscribed to
+type TopicIndex struct {
+	mu       sync.RWMutex
+	exact    map[string]map[string]TopicSubscriber // key: topic, then unique_id
+	patterns map[string]map[string]TopicSubscriber // key: pattern with wildcards, then unique_id
+	devices  map[string]map[string]bool            // key: unique_id, then pattern
+}
+
+// NewTopicIndex creates an empty topic index
+func NewTopicIndex() *TopicIndex {
+	return &TopicIndex{
+		exact:    make(map[string]map[string]TopicSubscriber),
+		patterns: make(map[string]map[string]TopicSubscriber),
+		devices:  make(map[string]map[string]bool),
+	}
+}
+
+// ValidateTopic checks a topic notifications are published to, wildcards are not allowed
+func ValidateTopic(topic string) error {
+	if err := validateSegments(topic); err != nil {
+		return err
+	}
+	if isPattern(topic) {
+		return fmt.Errorf("invalid topic %q: wildcards are only allowed in subscriptions", topic)
+	}
+	return nil
+}
+
+// ValidateTopicPattern checks a topic pattern devices subscribe to
+func ValidateTopicPattern(pattern string) error {
+	if err := validateSegments(pattern); err != nil {
+		return err
+	}
+	segments := strings.Split(pattern, ".")
+	for i, segment := range segments {
+		if segment == TopicWildcardTail && i != len(segments)-1 {
+			return fmt.Errorf("invalid topic %q: %s must be the last segment", pattern, TopicWildcardTail)
+		}
+		if len(segment) > 1 && strings.ContainsAny(segment, TopicWildcardOne+TopicWildcardTail) {
+			return fmt.Errorf("invalid topic %q: wildcards must be a whole segment", pattern)
+		}
+	}
+	return nil
+}
+
+// validateSegments rejects empty topics and empty segments such as "a..b"
+func validateSegments(topic string) error {
+	if topic == "" {
+		return fmt.Errorf("topic is required")
+	}
+	for _, segment := range strings.Split(topic, ".") {
+		if segment == "" {
+			return fmt.Errorf("invalid topic %q: empty segment", topic)
+		}
+	}
+	return nil
+}
+
+// isPattern reports whether a topic contains wildcards
+func isPattern(topic string) bool {
+	for _, segment := range strings.Split(topic, ".") {
+		if segment == TopicWildcardOne || segment == TopicWildcardTail {
+			return true
+		}
+	}
+	return false
+}
+
+// TopicMatches reports whether a topic matches a subscription pattern
+func TopicMatches(pattern, topic string) bool {
+	patternSegments := strings.Split(pattern, ".")
+	topicSegments := strings.Split(topic, ".")
+
+	for i, segment := range patternSegments {
+		if segment == TopicWildcardTail {
+			return len(topicSegments) > i
+		}
+		if i >= len(topicSegments) {
+			return false
+		}
+		if segment != TopicWildcardOne && segment != topicSegments[i] {
+			return false
+		}
+	}
+	return len(patternSegments) == len(topicSegments)
+}
+
+// Subscribe adds topic patterns for a device. Patterns must be valid, see ValidateTopicPattern.
+func (ti *TopicIndex) Subscribe(subscriber TopicSubscriber, patterns []string) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	subscribed, exists := ti.devices[subscriber.UniqueID]
+	if !exists {
+		subscribed = make(map[string]bool)
+		ti.devices[subscriber.UniqueID] = subscribed
+	}
+
+	for _, pattern := range patterns {
+		subscribed[pattern] = true
+
+		index := ti.exact
+		if isPattern(pattern) {
+			index = ti.patterns
+		}
+		if index[pattern] == nil {
+			index[pattern] = make(map[string]TopicSubscriber)
+		}
+		index[pattern][subscriber.UniqueID] = subscriber
+	}
+}
+
+// Unsubscribe removes topic patterns of a device
+func (ti *TopicIndex) Unsubscribe(uniqueID string, patterns []string) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	for _, pattern := range patterns {
+		ti.removeLocked(uniqueID, pattern)
+	}
+	if len(ti.devices[uniqueID]) == 0 {
+		delete(ti.devices, uniqueID)
+	}
+}
+
+// RemoveDevice removes every subscription of a device
+func (ti *TopicIndex) RemoveDevice(uniqueID string) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	for pattern := range ti.devices[uniqueID] {
+		ti.removeLocked(uniqueID, pattern)
+	}
+	delete(ti.devices, uniqueID)
+}
+
+// removeLocked removes one subscription. Caller must hold ti.mu.
+func (ti *TopicIndex) removeLocked(uniqueID, pattern string) {
+	delete(ti.devices[uniqueID], pattern)
+
+	index := ti.exact
+	if isPattern(pattern) {
+		index = ti.patterns
+	}
+	delete(index[pattern], uniqueID)
+	if len(index[pattern]) == 0 {
+		delete(index, pattern)
+	}
+}
+
+// Match returns every device subscribed to a pattern matching the topic, each device once
+func (ti *TopicIndex) Match(topic string) []TopicSubscriber {
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+
+	matched := make(map[string]TopicSubscriber)
+	for uniqueID, subscriber := range ti.exact[topic] {
+		matched[uniqueID] = subscriber
+	}
+	for pattern, subscribers := range ti.patterns {
+		if !TopicMatches(pattern, topic) {
+			continue
+		}
+		for uniqueID, subscriber := range subscribers {
+			matched[uniqueID] = subscriber
+		}
+	}
+
+	result := make([]TopicSubscriber, 0, len(matched))
+	for _, subscriber := range matched {
+		result = append(result, subscriber)
+	}
+	return result
+}
+
+// GetDeviceTopics returns the topic patterns a device is subscribed to, sorted
+func (ti *TopicIndex) GetDeviceTopics(uniqueID string) []string {
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+
+	topics := make([]string, 0, len(ti.devices[uniqueID]))
+	for pattern := range ti.devices[uniqueID] {
+		topics = append(topics, pattern)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// GetTopicCount returns the number of distinct topic patterns with at least one subscriber
+func (ti *TopicIndex) GetTopicCount() int {
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+	return len(ti.exact) + len(ti.patterns)
+}
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestTopicMatches(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, topic string
+		want           bool
+	}{
+		{"call.123", "call.123", true},
+		{"call.123", "call.124", false},
+		{"team.*", "team.sales", true},
+		{"team.*", "team.sales.emea", false},
+		{"team.*.emea", "team.sales.emea", true},
+		{"team.>", "team.sales", true},
+		{"team.>", "team.sales.emea", true},
+		{"team.>", "team", false},
+		{"*", "team", true},
+		{">", "team.sales", true},
+	} {
+		if got := TopicMatches(tc.pattern, tc.topic); got != tc.want {
+			t.Errorf("TopicMatches(%q, %q) = %v, want %v", tc.pattern, tc.topic, got, tc.want)
+		}
+	}
+}
+
+func TestValidateTopics(t *testing.T) {
+	for _, topic := range []string{"", "a..b", ".a", "team.*", "team.>"} {
+		if ValidateTopic(topic) == nil {
+			t.Errorf("ValidateTopic(%q) accepted", topic)
+		}
+	}
+	if err := ValidateTopic("team.sales"); err != nil {
+		t.Errorf("ValidateTopic(team.sales): %v", err)
+	}
+
+	for _, pattern := range []string{"", "team.>.x", "team.sa*", "a..b"} {
+		if ValidateTopicPattern(pattern) == nil {
+			t.Errorf("ValidateTopicPattern(%q) accepted", pattern)
+		}
+	}
+	for _, pattern := range []string{"team.*", "team.>", "*.sales", "call.123"} {
+		if err := ValidateTopicPattern(pattern); err != nil {
+			t.Errorf("ValidateTopicPattern(%q): %v", pattern, err)
+		}
+	}
+}
+
+func subscriberIDs(subscribers []TopicSubscriber) []string {
+	ids := make([]string, len(subscribers))
+	for i, s := range subscribers {
+		ids[i] = s.UniqueID
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestTopicIndex(t *testing.T) {
+	ti := NewTopicIndex()
+	phone := TopicSubscriber{UniqueID: "alice_phone", ClientID: "alice", DeviceID: "phone"}
+	tablet := TopicSubscriber{UniqueID: "bob_tablet", ClientID: "bob", DeviceID: "tablet"}
+
+	ti.Subscribe(phone, []string{"team.sales", "team.*"})
+	ti.Subscribe(tablet, []string{"team.>"})
+
+	// A device matching through two patterns is only returned once
+	if got := fmt.Sprint(subscriberIDs(ti.Match("team.sales"))); got != "[alice_phone bob_tablet]" {
+		t.Fatalf("Match(team.sales) = %s", got)
+	}
+	if got := fmt.Sprint(subscriberIDs(ti.Match("team.sales.emea"))); got != "[bob_tablet]" {
+		t.Fatalf("Match(team.sales.emea) = %s", got)
+	}
+
+	ti.Unsubscribe("alice_phone", []string{"team.*", "unknown"})
+	if got := ti.GetDeviceTopics("alice_phone"); len(got) != 1 || got[0] != "team.sales" {
+		t.Fatalf("GetDeviceTopics after Unsubscribe = %v", got)
+	}
+
+	ti.RemoveDevice("bob_tablet")
+	if got := ti.Match("team.sales.emea"); len(got) != 0 {
+		t.Fatalf("removed device still matches: %v", got)
+	}
+	if got := ti.GetDeviceTopics("bob_tablet"); len(got) != 0 {
+		t.Fatalf("removed device keeps topics %v", got)
+	}
+}
+
+func TestTopicIndexConcurrentUse(t *testing.T) {
+	ti := NewTopicIndex()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		subscriber := TopicSubscriber{UniqueID: fmt.Sprintf("c%d_d", i), ClientID: fmt.Sprintf("c%d", i), DeviceID: "d"}
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				ti.Subscribe(subscriber, []string{"news.*", fmt.Sprintf("call.%d", j)})
+				ti.Unsubscribe(subscriber.UniqueID, []string{fmt.Sprintf("call.%d", j)})
+			}
+			ti.RemoveDevice(subscriber.UniqueID)
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				ti.Match("news.today")
+				ti.GetTopicCount()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := ti.Match("news.today"); len(got) != 0 {
+		t.Fatalf("%d subscribers left", len(got))
+	}
+}
@@ -21,11 +21,188 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+// Priority tells devices how urgently a notification should be surfaced
+type Priority int32
+
+const (
+	Priority_PRIORITY_NORMAL   Priority = 0
+	Priority_PRIORITY_LOW      Priority = 1
+	Priority_PRIORITY_HIGH     Priority = 2
+	Priority_PRIORITY_CRITICAL Priority = 3
+)
+
+// Enum value maps for Priority.
+var (
+	Priority_name = map[int32]string{
+		0: "PRIORITY_NORMAL",
+		1: "PRIORITY_LOW",
+		2: "PRIORITY_HIGH",
+		3: "PRIORITY_CRITICAL",
+	}
+	Priority_value = map[string]int32{
+		"PRIORITY_NORMAL":   0,
+		"PRIORITY_LOW":      1,
+		"PRIORITY_HIGH":     2,
+		"PRIORITY_CRITICAL": 3,
+	}
+)
+
+func (x Priority) Enum() *Priority {
+	p := new(Priority)
+	*p = x
+	return p
+}
+
+func (x Priority) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Priority) Descriptor() protoreflect.EnumDescriptor {
+	return file_proto_notification_proto_enumTypes[0].Descriptor()
+}
+
+func (Priority) Type() protoreflect.EnumType {
+	return &file_proto_notification_proto_enumTypes[0]
+}
+
+func (x Priority) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Priority.Descriptor instead.
+func (Priority) EnumDescriptor() ([]byte, []int) {
+	return file_proto_notification_proto_rawDescGZIP(), []int{0}
+}
+
+// DeliveryStrategy picks the devices of a client a notification goes to
+type DeliveryStrategy int32
+
+const (
+	DeliveryStrategy_DELIVERY_STRATEGY_UNSPECIFIED     DeliveryStrategy = 0 // the default of /send, least_loaded
+	DeliveryStrategy_DELIVERY_STRATEGY_ALL_DEVICES     DeliveryStrategy = 1 // every active device of the client
+	DeliveryStrategy_DELIVERY_STRATEGY_LEAST_LOADED    DeliveryStrategy = 2 // device that received the fewest notifications
+	DeliveryStrategy_DELIVERY_STRATEGY_FIRST           DeliveryStrategy = 3 // device that registered first
+	DeliveryStrategy_DELIVERY_STRATEGY_MOST_RECENT     DeliveryStrategy = 4 // device that attached its stream last
+	DeliveryStrategy_DELIVERY_STRATEGY_SPECIFIC_DEVICE DeliveryStrategy = 5 // device named by device_id
+	DeliveryStrategy_DELIVERY_STRATEGY_ROUND_ROBIN     DeliveryStrategy = 6 // takes turns between the client's devices
+)
+
+// Enum value maps for DeliveryStrategy.
+var (
+	DeliveryStrategy_name = map[int32]string{
+		0: "DELIVERY_STRATEGY_UNSPECIFIED",
+		1: "DELIVERY_STRATEGY_ALL_DEVICES",
+		2: "DELIVERY_STRATEGY_LEAST_LOADED",
+		3: "DELIVERY_STRATEGY_FIRST",
+		4: "DELIVERY_STRATEGY_MOST_RECENT",
+		5: "DELIVERY_STRATEGY_SPECIFIC_DEVICE",
+		6: "DELIVERY_STRATEGY_ROUND_ROBIN",
+	}
+	DeliveryStrategy_value = map[string]int32{
+		"DELIVERY_STRATEGY_UNSPECIFIED":     0,
+		"DELIVERY_STRATEGY_ALL_DEVICES":     1,
+		"DELIVERY_STRATEGY_LEAST_LOADED":    2,
+		"DELIVERY_STRATEGY_FIRST":           3,
+		"DELIVERY_STRATEGY_MOST_RECENT":     4,
+		"DELIVERY_STRATEGY_SPECIFIC_DEVICE": 5,
+		"DELIVERY_STRATEGY_ROUND_ROBIN":     6,
+	}
+)
+
+func (x DeliveryStrategy) Enum() *DeliveryStrategy {
+	p := new(DeliveryStrategy)
+	*p = x
+	return p
+}
+
+func (x DeliveryStrategy) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (DeliveryStrategy) Descriptor() protoreflect.EnumDescriptor {
+	return file_proto_notification_proto_enumTypes[1].Descriptor()
+}
+
+func (DeliveryStrategy) Type() protoreflect.EnumType {
+	return &file_proto_notification_proto_enumTypes[1]
+}
+
+func (x DeliveryStrategy) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use DeliveryStrategy.Descriptor instead.
+func (DeliveryStrategy) EnumDescriptor() ([]byte, []int) {
+	return file_proto_notification_proto_rawDescGZIP(), []int{1}
+}
+
+// DeliveryStatus is what happened to a notification for one device
+type DeliveryStatus int32
+
+const (
+	DeliveryStatus_DELIVERY_STATUS_UNSPECIFIED DeliveryStatus = 0
+	DeliveryStatus_DELIVERY_STATUS_SENT        DeliveryStatus = 1 // handed to the device's stream
+	DeliveryStatus_DELIVERY_STATUS_QUEUED      DeliveryStatus = 2 // no device online, kept in the client's inbox
+	DeliveryStatus_DELIVERY_STATUS_RELAYED     DeliveryStatus = 3 // handed to the node the device is attached to
+	DeliveryStatus_DELIVERY_STATUS_FAILED      DeliveryStatus = 4
+)
+
+// Enum value maps for DeliveryStatus.
+var (
+	DeliveryStatus_name = map[int32]string{
+		0: "DELIVERY_STATUS_UNSPECIFIED",
+		1: "DELIVERY_STATUS_SENT",
+		2: "DELIVERY_STATUS_QUEUED",
+		3: "DELIVERY_STATUS_RELAYED",
+		4: "DELIVERY_STATUS_FAILED",
+	}
+	DeliveryStatus_value = map[string]int32{
+		"DELIVERY_STATUS_UNSPECIFIED": 0,
+		"DELIVERY_STATUS_SENT":        1,
+		"DELIVERY_STATUS_QUEUED":      2,
+		"DELIVERY_STATUS_RELAYED":     3,
+		"DELIVERY_STATUS_FAILED":      4,
+	}
+)
+
+func (x DeliveryStatus) Enum() *DeliveryStatus {
+	p := new(DeliveryStatus)
+	*p = x
+	return p
+}
+
+func (x DeliveryStatus) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (DeliveryStatus) Descriptor() protoreflect.EnumDescriptor {
+	return file_proto_notification_proto_enumTypes[2].Descriptor()
+}
+
+func (DeliveryStatus) Type() protoreflect.EnumType {
+	return &file_proto_notification_proto_enumTypes[2]
+}
+
+func (x DeliveryStatus) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use DeliveryStatus.Descriptor instead.
+func (DeliveryStatus) EnumDescriptor() ([]byte, []int) {
+	return file_proto_notification_proto_rawDescGZIP(), []int{2}
+}
+
 // ConnectionRequest contains connection details
+// Old clients only set connection_id (the client ID) and service_name (used as the device ID).
+// When client_id is set, connection_id is ignored and service_name is only the service name.
 type ConnectionRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	ConnectionId  string                 `protobuf:"bytes,1,opt,name=connection_id,json=connectionId,proto3" json:"connection_id,omitempty"`
 	ServiceName   string                 `protobuf:"bytes,2,opt,name=service_name,json=serviceName,proto3" json:"service_name,omitempty"`
+	ClientId      string                 `protobuf:"bytes,3,opt,name=client_id,json=clientId,proto3" json:"client_id,omitempty"`
+	DeviceId      string                 `protobuf:"bytes,4,opt,name=device_id,json=deviceId,proto3" json:"device_id,omitempty"` // defaults to "default_device"
+	Platform      string                 `protobuf:"bytes,5,opt,name=platform,proto3" json:"platform,omitempty"`                 // e.g. "ios", "android", "web"
+	AppVersion    string                 `protobuf:"bytes,6,opt,name=app_version,json=appVersion,proto3" json:"app_version,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -74,6 +251,34 @@ func (x *ConnectionRequest) GetServiceName() string {
 	return ""
 }
 
+func (x *ConnectionRequest) GetClientId() string {
+	if x != nil {
+		return x.ClientId
+	}
+	return ""
+}
+
+func (x *ConnectionRequest) GetDeviceId() string {
+	if x != nil {
+		return x.DeviceId
+	}
+	return ""
+}
+
+func (x *ConnectionRequest) GetPlatform() string {
+	if x != nil {
+		return x.Platform
+	}
+	return ""
+}
+
+func (x *ConnectionRequest) GetAppVersion() string {
+	if x != nil {
+		return x.AppVersion
+	}
+	return ""
+}
+
 // ConnectionResponse confirms the connection operation
 type ConnectionResponse struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
@@ -139,6 +344,9 @@ func (x *ConnectionResponse) GetConnectionId() string {
 type SubscribeRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	ConnectionId  string                 `protobuf:"bytes,1,opt,name=connection_id,json=connectionId,proto3" json:"connection_id,omitempty"`
+	LastSequence  uint64                 `protobuf:"varint,2,opt,name=last_sequence,json=lastSequence,proto3" json:"last_sequence,omitempty"` // resume cursor: replay every notification with a greater sequence
+	Topics        []string               `protobuf:"bytes,3,rep,name=topics,proto3" json:"topics,omitempty"`                                  // topic patterns to subscribe to, e.g. "call.123" or "team.sales.*"
+	Epoch         string                 `protobuf:"bytes,4,opt,name=epoch,proto3" json:"epoch,omitempty"`                                    // epoch of the notification last_sequence came from
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -180,6 +388,27 @@ func (x *SubscribeRequest) GetConnectionId() string {
 	return ""
 }
 
+func (x *SubscribeRequest) GetLastSequence() uint64 {
+	if x != nil {
+		return x.LastSequence
+	}
+	return 0
+}
+
+func (x *SubscribeRequest) GetTopics() []string {
+	if x != nil {
+		return x.Topics
+	}
+	return nil
+}
+
+func (x *SubscribeRequest) GetEpoch() string {
+	if x != nil {
+		return x.Epoch
+	}
+	return ""
+}
+
 // Notification message structure
 type Notification struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
@@ -191,7 +420,17 @@ type Notification struct {
 	CallId        string                 `protobuf:"bytes,6,opt,name=call_id,json=callId,proto3" json:"call_id,omitempty"`
 	ServiceName   string                 `protobuf:"bytes,7,opt,name=service_name,json=serviceName,proto3" json:"service_name,omitempty"`
 	Timestamp     int64                  `protobuf:"varint,8,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
-	Type          string                 `protobuf:"bytes,9,opt,name=type,proto3" json:"type,omitempty"` // "notification" or "heartbeat"
+	Type          string                 `protobuf:"bytes,9,opt,name=type,proto3" json:"type,omitempty"`           // "notification", "heartbeat", "server_going_away" (data: reconnect_after_ms) or "cursor_reset" (data: epoch, last_sequence)
+	Sequence      uint64                 `protobuf:"varint,10,opt,name=sequence,proto3" json:"sequence,omitempty"` // monotonic per-client sequence, 0 for heartbeats
+	Title         string                 `protobuf:"bytes,11,opt,name=title,proto3" json:"title,omitempty"`
+	Body          string                 `protobuf:"bytes,12,opt,name=body,proto3" json:"body,omitempty"`
+	Data          map[string]string      `protobuf:"bytes,13,rep,name=data,proto3" json:"data,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"` // arbitrary key/value pairs for the app
+	Payload       []byte                 `protobuf:"bytes,14,opt,name=payload,proto3" json:"payload,omitempty"`                                                                     // opaque app payload, passed through untouched
+	Category      string                 `protobuf:"bytes,15,opt,name=category,proto3" json:"category,omitempty"`                                                                   // app-defined, e.g. "call", "chat", "billing"
+	Priority      Priority               `protobuf:"varint,16,opt,name=priority,proto3,enum=notification.Priority" json:"priority,omitempty"`
+	Topic         string                 `protobuf:"bytes,17,opt,name=topic,proto3" json:"topic,omitempty"`             // topic it was published to, empty for notifications sent to a client
+	Traceparent   string                 `protobuf:"bytes,18,opt,name=traceparent,proto3" json:"traceparent,omitempty"` // W3C trace context of the delivery, so the device can continue the trace
+	Epoch         string                 `protobuf:"bytes,19,opt,name=epoch,proto3" json:"epoch,omitempty"`             // sequences start over when it changes, send it back with last_sequence
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -289,87 +528,1302 @@ func (x *Notification) GetType() string {
 	return ""
 }
 
-var File_proto_notification_proto protoreflect.FileDescriptor
+func (x *Notification) GetSequence() uint64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
 
-const file_proto_notification_proto_rawDesc = "" +
-	"\n" +
-	"\x18proto/notification.proto\x12\fnotification\"[\n" +
-	"\x11ConnectionRequest\x12#\n" +
-	"\rconnection_id\x18\x01 \x01(\tR\fconnectionId\x12!\n" +
-	"\fservice_name\x18\x02 \x01(\tR\vserviceName\"m\n" +
-	"\x12ConnectionResponse\x12\x18\n" +
-	"\asuccess\x18\x01 \x01(\bR\asuccess\x12\x18\n" +
-	"\amessage\x18\x02 \x01(\tR\amessage\x12#\n" +
-	"\rconnection_id\x18\x03 \x01(\tR\fconnectionId\"7\n" +
-	"\x10SubscribeRequest\x12#\n" +
-	"\rconnection_id\x18\x01 \x01(\tR\fconnectionId\"\x8c\x02\n" +
-	"\fNotification\x12\x0e\n" +
-	"\x02id\x18\x01 \x01(\tR\x02id\x12#\n" +
-	"\rconnection_id\x18\x02 \x01(\tR\fconnectionId\x12\x1d\n" +
-	"\n" +
-	"created_at\x18\x03 \x01(\tR\tcreatedAt\x12\x1d\n" +
-	"\n" +
-	"updated_at\x18\x04 \x01(\tR\tupdatedAt\x12\x1b\n" +
-	"\tclient_id\x18\x05 \x01(\tR\bclientId\x12\x17\n" +
-	"\acall_id\x18\x06 \x01(\tR\x06callId\x12!\n" +
-	"\fservice_name\x18\a \x01(\tR\vserviceName\x12\x1c\n" +
-	"\ttimestamp\x18\b \x01(\x03R\ttimestamp\x12\x12\n" +
-	"\x04type\x18\t \x01(\tR\x04type2\x95\x02\n" +
-	"\x13NotificationService\x12R\n" +
-	"\rAddConnection\x12\x1f.notification.ConnectionRequest\x1a .notification.ConnectionResponse\x12U\n" +
-	"\x10RemoveConnection\x12\x1f.notification.ConnectionRequest\x1a .notification.ConnectionResponse\x12S\n" +
-	"\x13StreamNotifications\x12\x1e.notification.SubscribeRequest\x1a\x1a.notification.Notification0\x01B\x0eZ\fgrpcon/protob\x06proto3"
+func (x *Notification) GetTitle() string {
+	if x != nil {
+		return x.Title
+	}
+	return ""
+}
 
-var (
-	file_proto_notification_proto_rawDescOnce sync.Once
-	file_proto_notification_proto_rawDescData []byte
-)
+func (x *Notification) GetBody() string {
+	if x != nil {
+		return x.Body
+	}
+	return ""
+}
 
-func file_proto_notification_proto_rawDescGZIP() []byte {
-	file_proto_notification_proto_rawDescOnce.Do(func() {
-		file_proto_notification_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_proto_notification_proto_rawDesc), len(file_proto_notification_proto_rawDesc)))
-	})
-	return file_proto_notification_proto_rawDescData
+func (x *Notification) GetData() map[string]string {
+	if x != nil {
+		return x.Data
+	}
+	return nil
 }
 
-var file_proto_notification_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
-var file_proto_notification_proto_goTypes = []any{
-	(*ConnectionRequest)(nil),  // 0: notification.ConnectionRequest
-	(*ConnectionResponse)(nil), // 1: notification.ConnectionResponse
-	(*SubscribeRequest)(nil),   // 2: notification.SubscribeRequest
-	(*Notification)(nil),       // 3: notification.Notification
+func (x *Notification) GetPayload() []byte {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
 }
-var file_proto_notification_proto_depIdxs = []int32{
-	0, // 0: notification.NotificationService.AddConnection:input_type -> notification.ConnectionRequest
-	0, // 1: notification.NotificationService.RemoveConnection:input_type -> notification.ConnectionRequest
-	2, // 2: notification.NotificationService.StreamNotifications:input_type -> notification.SubscribeRequest
-	1, // 3: notification.NotificationService.AddConnection:output_type -> notification.ConnectionResponse
-	1, // 4: notification.NotificationService.RemoveConnection:output_type -> notification.ConnectionResponse
-	3, // 5: notification.NotificationService.StreamNotifications:output_type -> notification.Notification
-	3, // [3:6] is the sub-list for method output_type
-	0, // [0:3] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+
+func (x *Notification) GetCategory() string {
+	if x != nil {
+		return x.Category
+	}
+	return ""
 }
 
-func init() { file_proto_notification_proto_init() }
-func file_proto_notification_proto_init() {
-	if File_proto_notification_proto != nil {
-		return
+func (x *Notification) GetPriority() Priority {
+	if x != nil {
+		return x.Priority
+	}
+	return Priority_PRIORITY_NORMAL
+}
+
+func (x *Notification) GetTopic() string {
+	if x != nil {
+		return x.Topic
+	}
+	return ""
+}
+
+func (x *Notification) GetTraceparent() string {
+	if x != nil {
+		return x.Traceparent
+	}
+	return ""
+}
+
+func (x *Notification) GetEpoch() string {
+	if x != nil {
+		return x.Epoch
+	}
+	return ""
+}
+
+// ClientMessage is sent by devices on the Connect stream
+type ClientMessage struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Payload:
+	//
+	//	*ClientMessage_Subscribe
+	//	*ClientMessage_Ack
+	//	*ClientMessage_Pong
+	//	*ClientMessage_Subscription
+	//	*ClientMessage_Topics
+	Payload       isClientMessage_Payload `protobuf_oneof:"payload"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ClientMessage) Reset() {
+	*x = ClientMessage{}
+	mi := &file_proto_notification_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ClientMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ClientMessage) ProtoMessage() {}
+
+func (x *ClientMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_notification_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ClientMessage.ProtoReflect.Descriptor instead.
+func (*ClientMessage) Descriptor() ([]byte, []int) {
+	return file_proto_notification_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ClientMessage) GetPayload() isClientMessage_Payload {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *ClientMessage) GetSubscribe() *SubscribeRequest {
+	if x != nil {
+		if x, ok := x.Payload.(*ClientMessage_Subscribe); ok {
+			return x.Subscribe
+		}
+	}
+	return nil
+}
+
+func (x *ClientMessage) GetAck() *Ack {
+	if x != nil {
+		if x, ok := x.Payload.(*ClientMessage_Ack); ok {
+			return x.Ack
+		}
+	}
+	return nil
+}
+
+func (x *ClientMessage) GetPong() *Pong {
+	if x != nil {
+		if x, ok := x.Payload.(*ClientMessage_Pong); ok {
+			return x.Pong
+		}
+	}
+	return nil
+}
+
+func (x *ClientMessage) GetSubscription() *SubscriptionChange {
+	if x != nil {
+		if x, ok := x.Payload.(*ClientMessage_Subscription); ok {
+			return x.Subscription
+		}
+	}
+	return nil
+}
+
+func (x *ClientMessage) GetTopics() *TopicChange {
+	if x != nil {
+		if x, ok := x.Payload.(*ClientMessage_Topics); ok {
+			return x.Topics
+		}
+	}
+	return nil
+}
+
+type isClientMessage_Payload interface {
+	isClientMessage_Payload()
+}
+
+type ClientMessage_Subscribe struct {
+	Subscribe *SubscribeRequest `protobuf:"bytes,1,opt,name=subscribe,proto3,oneof"`
+}
+
+type ClientMessage_Ack struct {
+	Ack *Ack `protobuf:"bytes,2,opt,name=ack,proto3,oneof"`
+}
+
+type ClientMessage_Pong struct {
+	Pong *Pong `protobuf:"bytes,3,opt,name=pong,proto3,oneof"`
+}
+
+type ClientMessage_Subscription struct {
+	Subscription *SubscriptionChange `protobuf:"bytes,4,opt,name=subscription,proto3,oneof"`
+}
+
+type ClientMessage_Topics struct {
+	Topics *TopicChange `protobuf:"bytes,5,opt,name=topics,proto3,oneof"`
+}
+
+func (*ClientMessage_Subscribe) isClientMessage_Payload() {}
+
+func (*ClientMessage_Ack) isClientMessage_Payload() {}
+
+func (*ClientMessage_Pong) isClientMessage_Payload() {}
+
+func (*ClientMessage_Subscription) isClientMessage_Payload() {}
+
+func (*ClientMessage_Topics) isClientMessage_Payload() {}
+
+// Ack confirms a notification was processed by the device
+type Ack struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	NotificationId string                 `protobuf:"bytes,1,opt,name=notification_id,json=notificationId,proto3" json:"notification_id,omitempty"`
+	Sequence       uint64                 `protobuf:"varint,2,opt,name=sequence,proto3" json:"sequence,omitempty"` // if notification_id is empty, acks everything up to and including this sequence
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *Ack) Reset() {
+	*x = Ack{}
+	mi := &file_proto_notification_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Ack) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Ack) ProtoMessage() {}
+
+func (x *Ack) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_notification_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Ack.ProtoReflect.Descriptor instead.
+func (*Ack) Descriptor() ([]byte, []int) {
+	return file_proto_notification_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Ack) GetNotificationId() string {
+	if x != nil {
+		return x.NotificationId
+	}
+	return ""
+}
+
+func (x *Ack) GetSequence() uint64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
+// Pong answers a heartbeat notification
+type Pong struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	HeartbeatId   string                 `protobuf:"bytes,1,opt,name=heartbeat_id,json=heartbeatId,proto3" json:"heartbeat_id,omitempty"`
+	Timestamp     int64                  `protobuf:"varint,2,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Pong) Reset() {
+	*x = Pong{}
+	mi := &file_proto_notification_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Pong) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Pong) ProtoMessage() {}
+
+func (x *Pong) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_notification_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Pong.ProtoReflect.Descriptor instead.
+func (*Pong) Descriptor() ([]byte, []int) {
+	return file_proto_notification_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *Pong) GetHeartbeatId() string {
+	if x != nil {
+		return x.HeartbeatId
+	}
+	return ""
+}
+
+func (x *Pong) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+// SubscriptionChange updates what the device wants to receive
+type SubscriptionChange struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Paused        bool                   `protobuf:"varint,1,opt,name=paused,proto3" json:"paused,omitempty"` // stop receiving notifications until unpaused, they go to other devices or the inbox
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SubscriptionChange) Reset() {
+	*x = SubscriptionChange{}
+	mi := &file_proto_notification_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SubscriptionChange) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SubscriptionChange) ProtoMessage() {}
+
+func (x *SubscriptionChange) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_notification_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SubscriptionChange.ProtoReflect.Descriptor instead.
+func (*SubscriptionChange) Descriptor() ([]byte, []int) {
+	return file_proto_notification_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *SubscriptionChange) GetPaused() bool {
+	if x != nil {
+		return x.Paused
+	}
+	return false
+}
+
+// TopicChange subscribes the device to topic patterns or unsubscribes it
+type TopicChange struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Subscribe     []string               `protobuf:"bytes,1,rep,name=subscribe,proto3" json:"subscribe,omitempty"`
+	Unsubscribe   []string               `protobuf:"bytes,2,rep,name=unsubscribe,proto3" json:"unsubscribe,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TopicChange) Reset() {
+	*x = TopicChange{}
+	mi := &file_proto_notification_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TopicChange) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TopicChange) ProtoMessage() {}
+
+func (x *TopicChange) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_notification_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TopicChange.ProtoReflect.Descriptor instead.
+func (*TopicChange) Descriptor() ([]byte, []int) {
+	return file_proto_notification_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *TopicChange) GetSubscribe() []string {
+	if x != nil {
+		return x.Subscribe
+	}
+	return nil
+}
+
+func (x *TopicChange) GetUnsubscribe() []string {
+	if x != nil {
+		return x.Unsubscribe
+	}
+	return nil
+}
+
+// TopicsRequest changes the topic subscriptions of a registered device
+type TopicsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ConnectionId  string                 `protobuf:"bytes,1,opt,name=connection_id,json=connectionId,proto3" json:"connection_id,omitempty"`
+	Subscribe     []string               `protobuf:"bytes,2,rep,name=subscribe,proto3" json:"subscribe,omitempty"`
+	Unsubscribe   []string               `protobuf:"bytes,3,rep,name=unsubscribe,proto3" json:"unsubscribe,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TopicsRequest) Reset() {
+	*x = TopicsRequest{}
+	mi := &file_proto_notification_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TopicsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TopicsRequest) ProtoMessage() {}
+
+func (x *TopicsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_notification_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TopicsRequest.ProtoReflect.Descriptor instead.
+func (*TopicsRequest) Descriptor() ([]byte, []int) {
+	return file_proto_notification_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *TopicsRequest) GetConnectionId() string {
+	if x != nil {
+		return x.ConnectionId
+	}
+	return ""
+}
+
+func (x *TopicsRequest) GetSubscribe() []string {
+	if x != nil {
+		return x.Subscribe
+	}
+	return nil
+}
+
+func (x *TopicsRequest) GetUnsubscribe() []string {
+	if x != nil {
+		return x.Unsubscribe
+	}
+	return nil
+}
+
+// TopicsResponse lists the device's topic subscriptions after the change
+type TopicsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Success       bool                   `protobuf:"varint,1,opt,name=success,proto3" json:"success,omitempty"`
+	Message       string                 `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	Topics        []string               `protobuf:"bytes,3,rep,name=topics,proto3" json:"topics,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TopicsResponse) Reset() {
+	*x = TopicsResponse{}
+	mi := &file_proto_notification_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TopicsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TopicsResponse) ProtoMessage() {}
+
+func (x *TopicsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_notification_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TopicsResponse.ProtoReflect.Descriptor instead.
+func (*TopicsResponse) Descriptor() ([]byte, []int) {
+	return file_proto_notification_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *TopicsResponse) GetSuccess() bool {
+	if x != nil {
+		return x.Success
+	}
+	return false
+}
+
+func (x *TopicsResponse) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+func (x *TopicsResponse) GetTopics() []string {
+	if x != nil {
+		return x.Topics
+	}
+	return nil
+}
+
+// PublishRequest is a notification to deliver and who should get it
+type PublishRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Notification  *Notification          `protobuf:"bytes,1,opt,name=notification,proto3" json:"notification,omitempty"` // id, connection_id, type and sequence are assigned by the server
+	Target        *Target                `protobuf:"bytes,2,opt,name=target,proto3" json:"target,omitempty"`
+	Strategy      DeliveryStrategy       `protobuf:"varint,3,opt,name=strategy,proto3,enum=notification.DeliveryStrategy" json:"strategy,omitempty"` // which devices of a client get it, ignored for device targets
+	DeviceId      string                 `protobuf:"bytes,4,opt,name=device_id,json=deviceId,proto3" json:"device_id,omitempty"`                     // device for DELIVERY_STRATEGY_SPECIFIC_DEVICE
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PublishRequest) Reset() {
+	*x = PublishRequest{}
+	mi := &file_proto_notification_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PublishRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PublishRequest) ProtoMessage() {}
+
+func (x *PublishRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_notification_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PublishRequest.ProtoReflect.Descriptor instead.
+func (*PublishRequest) Descriptor() ([]byte, []int) {
+	return file_proto_notification_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *PublishRequest) GetNotification() *Notification {
+	if x != nil {
+		return x.Notification
+	}
+	return nil
+}
+
+func (x *PublishRequest) GetTarget() *Target {
+	if x != nil {
+		return x.Target
+	}
+	return nil
+}
+
+func (x *PublishRequest) GetStrategy() DeliveryStrategy {
+	if x != nil {
+		return x.Strategy
+	}
+	return DeliveryStrategy_DELIVERY_STRATEGY_UNSPECIFIED
+}
+
+func (x *PublishRequest) GetDeviceId() string {
+	if x != nil {
+		return x.DeviceId
+	}
+	return ""
+}
+
+// Target selects who receives a published notification
+type Target struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Target:
+	//
+	//	*Target_ClientId
+	//	*Target_Device
+	//	*Target_Broadcast
+	//	*Target_Topic
+	Target        isTarget_Target `protobuf_oneof:"target"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Target) Reset() {
+	*x = Target{}
+	mi := &file_proto_notification_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Target) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Target) ProtoMessage() {}
+
+func (x *Target) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_notification_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Target.ProtoReflect.Descriptor instead.
+func (*Target) Descriptor() ([]byte, []int) {
+	return file_proto_notification_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *Target) GetTarget() isTarget_Target {
+	if x != nil {
+		return x.Target
+	}
+	return nil
+}
+
+func (x *Target) GetClientId() string {
+	if x != nil {
+		if x, ok := x.Target.(*Target_ClientId); ok {
+			return x.ClientId
+		}
+	}
+	return ""
+}
+
+func (x *Target) GetDevice() *DeviceTarget {
+	if x != nil {
+		if x, ok := x.Target.(*Target_Device); ok {
+			return x.Device
+		}
+	}
+	return nil
+}
+
+func (x *Target) GetBroadcast() bool {
+	if x != nil {
+		if x, ok := x.Target.(*Target_Broadcast); ok {
+			return x.Broadcast
+		}
+	}
+	return false
+}
+
+func (x *Target) GetTopic() string {
+	if x != nil {
+		if x, ok := x.Target.(*Target_Topic); ok {
+			return x.Topic
+		}
+	}
+	return ""
+}
+
+type isTarget_Target interface {
+	isTarget_Target()
+}
+
+type Target_ClientId struct {
+	ClientId string `protobuf:"bytes,1,opt,name=client_id,json=clientId,proto3,oneof"`
+}
+
+type Target_Device struct {
+	Device *DeviceTarget `protobuf:"bytes,2,opt,name=device,proto3,oneof"`
+}
+
+type Target_Broadcast struct {
+	Broadcast bool `protobuf:"varint,3,opt,name=broadcast,proto3,oneof"`
+}
+
+type Target_Topic struct {
+	Topic string `protobuf:"bytes,4,opt,name=topic,proto3,oneof"`
+}
+
+func (*Target_ClientId) isTarget_Target() {}
+
+func (*Target_Device) isTarget_Target() {}
+
+func (*Target_Broadcast) isTarget_Target() {}
+
+func (*Target_Topic) isTarget_Target() {}
+
+// DeviceTarget is a single device of a client
+type DeviceTarget struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ClientId      string                 `protobuf:"bytes,1,opt,name=client_id,json=clientId,proto3" json:"client_id,omitempty"`
+	DeviceId      string                 `protobuf:"bytes,2,opt,name=device_id,json=deviceId,proto3" json:"device_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeviceTarget) Reset() {
+	*x = DeviceTarget{}
+	mi := &file_proto_notification_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeviceTarget) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeviceTarget) ProtoMessage() {}
+
+func (x *DeviceTarget) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_notification_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeviceTarget.ProtoReflect.Descriptor instead.
+func (*DeviceTarget) Descriptor() ([]byte, []int) {
+	return file_proto_notification_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *DeviceTarget) GetClientId() string {
+	if x != nil {
+		return x.ClientId
+	}
+	return ""
+}
+
+func (x *DeviceTarget) GetDeviceId() string {
+	if x != nil {
+		return x.DeviceId
+	}
+	return ""
+}
+
+// DeliveryResult is the outcome for one device. Relayed results name the node instead of a device.
+type DeliveryResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ClientId      string                 `protobuf:"bytes,1,opt,name=client_id,json=clientId,proto3" json:"client_id,omitempty"`
+	DeviceId      string                 `protobuf:"bytes,2,opt,name=device_id,json=deviceId,proto3" json:"device_id,omitempty"`
+	ConnectionId  string                 `protobuf:"bytes,3,opt,name=connection_id,json=connectionId,proto3" json:"connection_id,omitempty"`
+	NodeId        string                 `protobuf:"bytes,4,opt,name=node_id,json=nodeId,proto3" json:"node_id,omitempty"`
+	Status        DeliveryStatus         `protobuf:"varint,5,opt,name=status,proto3,enum=notification.DeliveryStatus" json:"status,omitempty"`
+	Error         string                 `protobuf:"bytes,6,opt,name=error,proto3" json:"error,omitempty"`
+	ErrorCode     string                 `protobuf:"bytes,7,opt,name=error_code,json=errorCode,proto3" json:"error_code,omitempty"` // why it failed, see PublishResponse.error_code
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeliveryResult) Reset() {
+	*x = DeliveryResult{}
+	mi := &file_proto_notification_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeliveryResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeliveryResult) ProtoMessage() {}
+
+func (x *DeliveryResult) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_notification_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeliveryResult.ProtoReflect.Descriptor instead.
+func (*DeliveryResult) Descriptor() ([]byte, []int) {
+	return file_proto_notification_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *DeliveryResult) GetClientId() string {
+	if x != nil {
+		return x.ClientId
+	}
+	return ""
+}
+
+func (x *DeliveryResult) GetDeviceId() string {
+	if x != nil {
+		return x.DeviceId
+	}
+	return ""
+}
+
+func (x *DeliveryResult) GetConnectionId() string {
+	if x != nil {
+		return x.ConnectionId
+	}
+	return ""
+}
+
+func (x *DeliveryResult) GetNodeId() string {
+	if x != nil {
+		return x.NodeId
+	}
+	return ""
+}
+
+func (x *DeliveryResult) GetStatus() DeliveryStatus {
+	if x != nil {
+		return x.Status
+	}
+	return DeliveryStatus_DELIVERY_STATUS_UNSPECIFIED
+}
+
+func (x *DeliveryResult) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *DeliveryResult) GetErrorCode() string {
+	if x != nil {
+		return x.ErrorCode
+	}
+	return ""
+}
+
+// PublishResponse reports how a published notification was delivered
+type PublishResponse struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	Success        bool                   `protobuf:"varint,1,opt,name=success,proto3" json:"success,omitempty"`
+	Message        string                 `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	NotificationId string                 `protobuf:"bytes,3,opt,name=notification_id,json=notificationId,proto3" json:"notification_id,omitempty"` // empty for broadcasts and topics, every client gets its own copy
+	Sequence       uint64                 `protobuf:"varint,4,opt,name=sequence,proto3" json:"sequence,omitempty"`
+	Results        []*DeliveryResult      `protobuf:"bytes,5,rep,name=results,proto3" json:"results,omitempty"`
+	// Set when success is false: "invalid_request", "client_not_found", "device_not_found",
+	// "no_active_stream", "queue_full", "inbox_full", "send_failed", "shutting_down" or "delivery_failed"
+	ErrorCode     string `protobuf:"bytes,6,opt,name=error_code,json=errorCode,proto3" json:"error_code,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PublishResponse) Reset() {
+	*x = PublishResponse{}
+	mi := &file_proto_notification_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PublishResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PublishResponse) ProtoMessage() {}
+
+func (x *PublishResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_notification_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PublishResponse.ProtoReflect.Descriptor instead.
+func (*PublishResponse) Descriptor() ([]byte, []int) {
+	return file_proto_notification_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *PublishResponse) GetSuccess() bool {
+	if x != nil {
+		return x.Success
+	}
+	return false
+}
+
+func (x *PublishResponse) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+func (x *PublishResponse) GetNotificationId() string {
+	if x != nil {
+		return x.NotificationId
+	}
+	return ""
+}
+
+func (x *PublishResponse) GetSequence() uint64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
+func (x *PublishResponse) GetResults() []*DeliveryResult {
+	if x != nil {
+		return x.Results
+	}
+	return nil
+}
+
+func (x *PublishResponse) GetErrorCode() string {
+	if x != nil {
+		return x.ErrorCode
+	}
+	return ""
+}
+
+// PublishBatchRequest contains several publish requests, at most delivery.max_batch_size
+// (1000 by default). They are delivered concurrently, requests for the same client in order.
+type PublishBatchRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Requests      []*PublishRequest      `protobuf:"bytes,1,rep,name=requests,proto3" json:"requests,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PublishBatchRequest) Reset() {
+	*x = PublishBatchRequest{}
+	mi := &file_proto_notification_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PublishBatchRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PublishBatchRequest) ProtoMessage() {}
+
+func (x *PublishBatchRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_notification_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PublishBatchRequest.ProtoReflect.Descriptor instead.
+func (*PublishBatchRequest) Descriptor() ([]byte, []int) {
+	return file_proto_notification_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *PublishBatchRequest) GetRequests() []*PublishRequest {
+	if x != nil {
+		return x.Requests
+	}
+	return nil
+}
+
+// PublishBatchResponse has one response per request, in request order
+type PublishBatchResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Responses     []*PublishResponse     `protobuf:"bytes,1,rep,name=responses,proto3" json:"responses,omitempty"`
+	Succeeded     int32                  `protobuf:"varint,2,opt,name=succeeded,proto3" json:"succeeded,omitempty"` // responses with success, including queued ones
+	Failed        int32                  `protobuf:"varint,3,opt,name=failed,proto3" json:"failed,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PublishBatchResponse) Reset() {
+	*x = PublishBatchResponse{}
+	mi := &file_proto_notification_proto_msgTypes[17]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PublishBatchResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PublishBatchResponse) ProtoMessage() {}
+
+func (x *PublishBatchResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_notification_proto_msgTypes[17]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PublishBatchResponse.ProtoReflect.Descriptor instead.
+func (*PublishBatchResponse) Descriptor() ([]byte, []int) {
+	return file_proto_notification_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *PublishBatchResponse) GetResponses() []*PublishResponse {
+	if x != nil {
+		return x.Responses
+	}
+	return nil
+}
+
+func (x *PublishBatchResponse) GetSucceeded() int32 {
+	if x != nil {
+		return x.Succeeded
+	}
+	return 0
+}
+
+func (x *PublishBatchResponse) GetFailed() int32 {
+	if x != nil {
+		return x.Failed
+	}
+	return 0
+}
+
+var File_proto_notification_proto protoreflect.FileDescriptor
+
+const file_proto_notification_proto_rawDesc = "" +
+	"\n" +
+	"\x18proto/notification.proto\x12\fnotification\"\xd2\x01\n" +
+	"\x11ConnectionRequest\x12#\n" +
+	"\rconnection_id\x18\x01 \x01(\tR\fconnectionId\x12!\n" +
+	"\fservice_name\x18\x02 \x01(\tR\vserviceName\x12\x1b\n" +
+	"\tclient_id\x18\x03 \x01(\tR\bclientId\x12\x1b\n" +
+	"\tdevice_id\x18\x04 \x01(\tR\bdeviceId\x12\x1a\n" +
+	"\bplatform\x18\x05 \x01(\tR\bplatform\x12\x1f\n" +
+	"\vapp_version\x18\x06 \x01(\tR\n" +
+	"appVersion\"m\n" +
+	"\x12ConnectionResponse\x12\x18\n" +
+	"\asuccess\x18\x01 \x01(\bR\asuccess\x12\x18\n" +
+	"\amessage\x18\x02 \x01(\tR\amessage\x12#\n" +
+	"\rconnection_id\x18\x03 \x01(\tR\fconnectionId\"\x8a\x01\n" +
+	"\x10SubscribeRequest\x12#\n" +
+	"\rconnection_id\x18\x01 \x01(\tR\fconnectionId\x12#\n" +
+	"\rlast_sequence\x18\x02 \x01(\x04R\flastSequence\x12\x16\n" +
+	"\x06topics\x18\x03 \x03(\tR\x06topics\x12\x14\n" +
+	"\x05epoch\x18\x04 \x01(\tR\x05epoch\"\xfd\x04\n" +
+	"\fNotification\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12#\n" +
+	"\rconnection_id\x18\x02 \x01(\tR\fconnectionId\x12\x1d\n" +
+	"\n" +
+	"created_at\x18\x03 \x01(\tR\tcreatedAt\x12\x1d\n" +
+	"\n" +
+	"updated_at\x18\x04 \x01(\tR\tupdatedAt\x12\x1b\n" +
+	"\tclient_id\x18\x05 \x01(\tR\bclientId\x12\x17\n" +
+	"\acall_id\x18\x06 \x01(\tR\x06callId\x12!\n" +
+	"\fservice_name\x18\a \x01(\tR\vserviceName\x12\x1c\n" +
+	"\ttimestamp\x18\b \x01(\x03R\ttimestamp\x12\x12\n" +
+	"\x04type\x18\t \x01(\tR\x04type\x12\x1a\n" +
+	"\bsequence\x18\n" +
+	" \x01(\x04R\bsequence\x12\x14\n" +
+	"\x05title\x18\v \x01(\tR\x05title\x12\x12\n" +
+	"\x04body\x18\f \x01(\tR\x04body\x128\n" +
+	"\x04data\x18\r \x03(\v2$.notification.Notification.DataEntryR\x04data\x12\x18\n" +
+	"\apayload\x18\x0e \x01(\fR\apayload\x12\x1a\n" +
+	"\bcategory\x18\x0f \x01(\tR\bcategory\x122\n" +
+	"\bpriority\x18\x10 \x01(\x0e2\x16.notification.PriorityR\bpriority\x12\x14\n" +
+	"\x05topic\x18\x11 \x01(\tR\x05topic\x12 \n" +
+	"\vtraceparent\x18\x12 \x01(\tR\vtraceparent\x12\x14\n" +
+	"\x05epoch\x18\x13 \x01(\tR\x05epoch\x1a7\n" +
+	"\tDataEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\xa8\x02\n" +
+	"\rClientMessage\x12>\n" +
+	"\tsubscribe\x18\x01 \x01(\v2\x1e.notification.SubscribeRequestH\x00R\tsubscribe\x12%\n" +
+	"\x03ack\x18\x02 \x01(\v2\x11.notification.AckH\x00R\x03ack\x12(\n" +
+	"\x04pong\x18\x03 \x01(\v2\x12.notification.PongH\x00R\x04pong\x12F\n" +
+	"\fsubscription\x18\x04 \x01(\v2 .notification.SubscriptionChangeH\x00R\fsubscription\x123\n" +
+	"\x06topics\x18\x05 \x01(\v2\x19.notification.TopicChangeH\x00R\x06topicsB\t\n" +
+	"\apayload\"J\n" +
+	"\x03Ack\x12'\n" +
+	"\x0fnotification_id\x18\x01 \x01(\tR\x0enotificationId\x12\x1a\n" +
+	"\bsequence\x18\x02 \x01(\x04R\bsequence\"G\n" +
+	"\x04Pong\x12!\n" +
+	"\fheartbeat_id\x18\x01 \x01(\tR\vheartbeatId\x12\x1c\n" +
+	"\ttimestamp\x18\x02 \x01(\x03R\ttimestamp\",\n" +
+	"\x12SubscriptionChange\x12\x16\n" +
+	"\x06paused\x18\x01 \x01(\bR\x06paused\"M\n" +
+	"\vTopicChange\x12\x1c\n" +
+	"\tsubscribe\x18\x01 \x03(\tR\tsubscribe\x12 \n" +
+	"\vunsubscribe\x18\x02 \x03(\tR\vunsubscribe\"t\n" +
+	"\rTopicsRequest\x12#\n" +
+	"\rconnection_id\x18\x01 \x01(\tR\fconnectionId\x12\x1c\n" +
+	"\tsubscribe\x18\x02 \x03(\tR\tsubscribe\x12 \n" +
+	"\vunsubscribe\x18\x03 \x03(\tR\vunsubscribe\"\\\n" +
+	"\x0eTopicsResponse\x12\x18\n" +
+	"\asuccess\x18\x01 \x01(\bR\asuccess\x12\x18\n" +
+	"\amessage\x18\x02 \x01(\tR\amessage\x12\x16\n" +
+	"\x06topics\x18\x03 \x03(\tR\x06topics\"\xd7\x01\n" +
+	"\x0ePublishRequest\x12>\n" +
+	"\fnotification\x18\x01 \x01(\v2\x1a.notification.NotificationR\fnotification\x12,\n" +
+	"\x06target\x18\x02 \x01(\v2\x14.notification.TargetR\x06target\x12:\n" +
+	"\bstrategy\x18\x03 \x01(\x0e2\x1e.notification.DeliveryStrategyR\bstrategy\x12\x1b\n" +
+	"\tdevice_id\x18\x04 \x01(\tR\bdeviceId\"\x9f\x01\n" +
+	"\x06Target\x12\x1d\n" +
+	"\tclient_id\x18\x01 \x01(\tH\x00R\bclientId\x124\n" +
+	"\x06device\x18\x02 \x01(\v2\x1a.notification.DeviceTargetH\x00R\x06device\x12\x1e\n" +
+	"\tbroadcast\x18\x03 \x01(\bH\x00R\tbroadcast\x12\x16\n" +
+	"\x05topic\x18\x04 \x01(\tH\x00R\x05topicB\b\n" +
+	"\x06target\"H\n" +
+	"\fDeviceTarget\x12\x1b\n" +
+	"\tclient_id\x18\x01 \x01(\tR\bclientId\x12\x1b\n" +
+	"\tdevice_id\x18\x02 \x01(\tR\bdeviceId\"\xf3\x01\n" +
+	"\x0eDeliveryResult\x12\x1b\n" +
+	"\tclient_id\x18\x01 \x01(\tR\bclientId\x12\x1b\n" +
+	"\tdevice_id\x18\x02 \x01(\tR\bdeviceId\x12#\n" +
+	"\rconnection_id\x18\x03 \x01(\tR\fconnectionId\x12\x17\n" +
+	"\anode_id\x18\x04 \x01(\tR\x06nodeId\x124\n" +
+	"\x06status\x18\x05 \x01(\x0e2\x1c.notification.DeliveryStatusR\x06status\x12\x14\n" +
+	"\x05error\x18\x06 \x01(\tR\x05error\x12\x1d\n" +
+	"\n" +
+	"error_code\x18\a \x01(\tR\terrorCode\"\xe1\x01\n" +
+	"\x0fPublishResponse\x12\x18\n" +
+	"\asuccess\x18\x01 \x01(\bR\asuccess\x12\x18\n" +
+	"\amessage\x18\x02 \x01(\tR\amessage\x12'\n" +
+	"\x0fnotification_id\x18\x03 \x01(\tR\x0enotificationId\x12\x1a\n" +
+	"\bsequence\x18\x04 \x01(\x04R\bsequence\x126\n" +
+	"\aresults\x18\x05 \x03(\v2\x1c.notification.DeliveryResultR\aresults\x12\x1d\n" +
+	"\n" +
+	"error_code\x18\x06 \x01(\tR\terrorCode\"O\n" +
+	"\x13PublishBatchRequest\x128\n" +
+	"\brequests\x18\x01 \x03(\v2\x1c.notification.PublishRequestR\brequests\"\x89\x01\n" +
+	"\x14PublishBatchResponse\x12;\n" +
+	"\tresponses\x18\x01 \x03(\v2\x1d.notification.PublishResponseR\tresponses\x12\x1c\n" +
+	"\tsucceeded\x18\x02 \x01(\x05R\tsucceeded\x12\x16\n" +
+	"\x06failed\x18\x03 \x01(\x05R\x06failed*[\n" +
+	"\bPriority\x12\x13\n" +
+	"\x0fPRIORITY_NORMAL\x10\x00\x12\x10\n" +
+	"\fPRIORITY_LOW\x10\x01\x12\x11\n" +
+	"\rPRIORITY_HIGH\x10\x02\x12\x15\n" +
+	"\x11PRIORITY_CRITICAL\x10\x03*\x86\x02\n" +
+	"\x10DeliveryStrategy\x12!\n" +
+	"\x1dDELIVERY_STRATEGY_UNSPECIFIED\x10\x00\x12!\n" +
+	"\x1dDELIVERY_STRATEGY_ALL_DEVICES\x10\x01\x12\"\n" +
+	"\x1eDELIVERY_STRATEGY_LEAST_LOADED\x10\x02\x12\x1b\n" +
+	"\x17DELIVERY_STRATEGY_FIRST\x10\x03\x12!\n" +
+	"\x1dDELIVERY_STRATEGY_MOST_RECENT\x10\x04\x12%\n" +
+	"!DELIVERY_STRATEGY_SPECIFIC_DEVICE\x10\x05\x12!\n" +
+	"\x1dDELIVERY_STRATEGY_ROUND_ROBIN\x10\x06*\xa0\x01\n" +
+	"\x0eDeliveryStatus\x12\x1f\n" +
+	"\x1bDELIVERY_STATUS_UNSPECIFIED\x10\x00\x12\x18\n" +
+	"\x14DELIVERY_STATUS_SENT\x10\x01\x12\x1a\n" +
+	"\x16DELIVERY_STATUS_QUEUED\x10\x02\x12\x1b\n" +
+	"\x17DELIVERY_STATUS_RELAYED\x10\x03\x12\x1a\n" +
+	"\x16DELIVERY_STATUS_FAILED\x10\x042\xc7\x04\n" +
+	"\x13NotificationService\x12R\n" +
+	"\rAddConnection\x12\x1f.notification.ConnectionRequest\x1a .notification.ConnectionResponse\x12U\n" +
+	"\x10RemoveConnection\x12\x1f.notification.ConnectionRequest\x1a .notification.ConnectionResponse\x12S\n" +
+	"\x13StreamNotifications\x12\x1e.notification.SubscribeRequest\x1a\x1a.notification.Notification0\x01\x12F\n" +
+	"\aConnect\x12\x1b.notification.ClientMessage\x1a\x1a.notification.Notification(\x010\x01\x12F\n" +
+	"\aPublish\x12\x1c.notification.PublishRequest\x1a\x1d.notification.PublishResponse\x12U\n" +
+	"\fPublishBatch\x12!.notification.PublishBatchRequest\x1a\".notification.PublishBatchResponse\x12I\n" +
+	"\fUpdateTopics\x12\x1b.notification.TopicsRequest\x1a\x1c.notification.TopicsResponseB\x0eZ\fgrpcon/protob\x06proto3"
+
+var (
+	file_proto_notification_proto_rawDescOnce sync.Once
+	file_proto_notification_proto_rawDescData []byte
+)
+
+func file_proto_notification_proto_rawDescGZIP() []byte {
+	file_proto_notification_proto_rawDescOnce.Do(func() {
+		file_proto_notification_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_proto_notification_proto_rawDesc), len(file_proto_notification_proto_rawDesc)))
+	})
+	return file_proto_notification_proto_rawDescData
+}
+
+var file_proto_notification_proto_enumTypes = make([]protoimpl.EnumInfo, 3)
+var file_proto_notification_proto_msgTypes = make([]protoimpl.MessageInfo, 19)
+var file_proto_notification_proto_goTypes = []any{
+	(Priority)(0),                // 0: notification.Priority
+	(DeliveryStrategy)(0),        // 1: notification.DeliveryStrategy
+	(DeliveryStatus)(0),          // 2: notification.DeliveryStatus
+	(*ConnectionRequest)(nil),    // 3: notification.ConnectionRequest
+	(*ConnectionResponse)(nil),   // 4: notification.ConnectionResponse
+	(*SubscribeRequest)(nil),     // 5: notification.SubscribeRequest
+	(*Notification)(nil),         // 6: notification.Notification
+	(*ClientMessage)(nil),        // 7: notification.ClientMessage
+	(*Ack)(nil),                  // 8: notification.Ack
+	(*Pong)(nil),                 // 9: notification.Pong
+	(*SubscriptionChange)(nil),   // 10: notification.SubscriptionChange
+	(*TopicChange)(nil),          // 11: notification.TopicChange
+	(*TopicsRequest)(nil),        // 12: notification.TopicsRequest
+	(*TopicsResponse)(nil),       // 13: notification.TopicsResponse
+	(*PublishRequest)(nil),       // 14: notification.PublishRequest
+	(*Target)(nil),               // 15: notification.Target
+	(*DeviceTarget)(nil),         // 16: notification.DeviceTarget
+	(*DeliveryResult)(nil),       // 17: notification.DeliveryResult
+	(*PublishResponse)(nil),      // 18: notification.PublishResponse
+	(*PublishBatchRequest)(nil),  // 19: notification.PublishBatchRequest
+	(*PublishBatchResponse)(nil), // 20: notification.PublishBatchResponse
+	nil,                          // 21: notification.Notification.DataEntry
+}
+var file_proto_notification_proto_depIdxs = []int32{
+	21, // 0: notification.Notification.data:type_name -> notification.Notification.DataEntry
+	0,  // 1: notification.Notification.priority:type_name -> notification.Priority
+	5,  // 2: notification.ClientMessage.subscribe:type_name -> notification.SubscribeRequest
+	8,  // 3: notification.ClientMessage.ack:type_name -> notification.Ack
+	9,  // 4: notification.ClientMessage.pong:type_name -> notification.Pong
+	10, // 5: notification.ClientMessage.subscription:type_name -> notification.SubscriptionChange
+	11, // 6: notification.ClientMessage.topics:type_name -> notification.TopicChange
+	6,  // 7: notification.PublishRequest.notification:type_name -> notification.Notification
+	15, // 8: notification.PublishRequest.target:type_name -> notification.Target
+	1,  // 9: notification.PublishRequest.strategy:type_name -> notification.DeliveryStrategy
+	16, // 10: notification.Target.device:type_name -> notification.DeviceTarget
+	2,  // 11: notification.DeliveryResult.status:type_name -> notification.DeliveryStatus
+	17, // 12: notification.PublishResponse.results:type_name -> notification.DeliveryResult
+	14, // 13: notification.PublishBatchRequest.requests:type_name -> notification.PublishRequest
+	18, // 14: notification.PublishBatchResponse.responses:type_name -> notification.PublishResponse
+	3,  // 15: notification.NotificationService.AddConnection:input_type -> notification.ConnectionRequest
+	3,  // 16: notification.NotificationService.RemoveConnection:input_type -> notification.ConnectionRequest
+	5,  // 17: notification.NotificationService.StreamNotifications:input_type -> notification.SubscribeRequest
+	7,  // 18: notification.NotificationService.Connect:input_type -> notification.ClientMessage
+	14, // 19: notification.NotificationService.Publish:input_type -> notification.PublishRequest
+	19, // 20: notification.NotificationService.PublishBatch:input_type -> notification.PublishBatchRequest
+	12, // 21: notification.NotificationService.UpdateTopics:input_type -> notification.TopicsRequest
+	4,  // 22: notification.NotificationService.AddConnection:output_type -> notification.ConnectionResponse
+	4,  // 23: notification.NotificationService.RemoveConnection:output_type -> notification.ConnectionResponse
+	6,  // 24: notification.NotificationService.StreamNotifications:output_type -> notification.Notification
+	6,  // 25: notification.NotificationService.Connect:output_type -> notification.Notification
+	18, // 26: notification.NotificationService.Publish:output_type -> notification.PublishResponse
+	20, // 27: notification.NotificationService.PublishBatch:output_type -> notification.PublishBatchResponse
+	13, // 28: notification.NotificationService.UpdateTopics:output_type -> notification.TopicsResponse
+	22, // [22:29] is the sub-list for method output_type
+	15, // [15:22] is the sub-list for method input_type
+	15, // [15:15] is the sub-list for extension type_name
+	15, // [15:15] is the sub-list for extension extendee
+	0,  // [0:15] is the sub-list for field type_name
+}
+
+func init() { file_proto_notification_proto_init() }
+func file_proto_notification_proto_init() {
+	if File_proto_notification_proto != nil {
+		return
+	}
+	file_proto_notification_proto_msgTypes[4].OneofWrappers = []any{
+		(*ClientMessage_Subscribe)(nil),
+		(*ClientMessage_Ack)(nil),
+		(*ClientMessage_Pong)(nil),
+		(*ClientMessage_Subscription)(nil),
+		(*ClientMessage_Topics)(nil),
+	}
+	file_proto_notification_proto_msgTypes[12].OneofWrappers = []any{
+		(*Target_ClientId)(nil),
+		(*Target_Device)(nil),
+		(*Target_Broadcast)(nil),
+		(*Target_Topic)(nil),
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_proto_notification_proto_rawDesc), len(file_proto_notification_proto_rawDesc)),
-			NumEnums:      0,
-			NumMessages:   4,
+			NumEnums:      3,
+			NumMessages:   19,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
 		GoTypes:           file_proto_notification_proto_goTypes,
 		DependencyIndexes: file_proto_notification_proto_depIdxs,
+		EnumInfos:         file_proto_notification_proto_enumTypes,
 		MessageInfos:      file_proto_notification_proto_msgTypes,
 	}.Build()
 	File_proto_notification_proto = out.File
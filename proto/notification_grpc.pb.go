@@ -22,6 +22,10 @@ const (
 	NotificationService_AddConnection_FullMethodName       = "/notification.NotificationService/AddConnection"
 	NotificationService_RemoveConnection_FullMethodName    = "/notification.NotificationService/RemoveConnection"
 	NotificationService_StreamNotifications_FullMethodName = "/notification.NotificationService/StreamNotifications"
+	NotificationService_Connect_FullMethodName             = "/notification.NotificationService/Connect"
+	NotificationService_Publish_FullMethodName             = "/notification.NotificationService/Publish"
+	NotificationService_PublishBatch_FullMethodName        = "/notification.NotificationService/PublishBatch"
+	NotificationService_UpdateTopics_FullMethodName        = "/notification.NotificationService/UpdateTopics"
 )
 
 // NotificationServiceClient is the client API for NotificationService service.
@@ -36,6 +40,15 @@ type NotificationServiceClient interface {
 	RemoveConnection(ctx context.Context, in *ConnectionRequest, opts ...grpc.CallOption) (*ConnectionResponse, error)
 	// StreamNotifications is a server-side streaming RPC to push notifications to clients
 	StreamNotifications(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Notification], error)
+	// Connect is a bidirectional streaming RPC. The first client message must be a subscribe,
+	// after that the device sends acks, heartbeat pongs and subscription changes on the same stream.
+	Connect(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[ClientMessage, Notification], error)
+	// Publish delivers a notification from a backend service to a client, a device, every client or a topic
+	Publish(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*PublishResponse, error)
+	// PublishBatch publishes several notifications at once, each one gets its own response
+	PublishBatch(ctx context.Context, in *PublishBatchRequest, opts ...grpc.CallOption) (*PublishBatchResponse, error)
+	// UpdateTopics subscribes a registered device to topics or unsubscribes it
+	UpdateTopics(ctx context.Context, in *TopicsRequest, opts ...grpc.CallOption) (*TopicsResponse, error)
 }
 
 type notificationServiceClient struct {
@@ -85,6 +98,49 @@ func (c *notificationServiceClient) StreamNotifications(ctx context.Context, in
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
 type NotificationService_StreamNotificationsClient = grpc.ServerStreamingClient[Notification]
 
+func (c *notificationServiceClient) Connect(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[ClientMessage, Notification], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &NotificationService_ServiceDesc.Streams[1], NotificationService_Connect_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ClientMessage, Notification]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type NotificationService_ConnectClient = grpc.BidiStreamingClient[ClientMessage, Notification]
+
+func (c *notificationServiceClient) Publish(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*PublishResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PublishResponse)
+	err := c.cc.Invoke(ctx, NotificationService_Publish_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *notificationServiceClient) PublishBatch(ctx context.Context, in *PublishBatchRequest, opts ...grpc.CallOption) (*PublishBatchResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PublishBatchResponse)
+	err := c.cc.Invoke(ctx, NotificationService_PublishBatch_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *notificationServiceClient) UpdateTopics(ctx context.Context, in *TopicsRequest, opts ...grpc.CallOption) (*TopicsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(TopicsResponse)
+	err := c.cc.Invoke(ctx, NotificationService_UpdateTopics_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // NotificationServiceServer is the server API for NotificationService service.
 // All implementations must embed UnimplementedNotificationServiceServer
 // for forward compatibility.
@@ -97,6 +153,15 @@ type NotificationServiceServer interface {
 	RemoveConnection(context.Context, *ConnectionRequest) (*ConnectionResponse, error)
 	// StreamNotifications is a server-side streaming RPC to push notifications to clients
 	StreamNotifications(*SubscribeRequest, grpc.ServerStreamingServer[Notification]) error
+	// Connect is a bidirectional streaming RPC. The first client message must be a subscribe,
+	// after that the device sends acks, heartbeat pongs and subscription changes on the same stream.
+	Connect(grpc.BidiStreamingServer[ClientMessage, Notification]) error
+	// Publish delivers a notification from a backend service to a client, a device, every client or a topic
+	Publish(context.Context, *PublishRequest) (*PublishResponse, error)
+	// PublishBatch publishes several notifications at once, each one gets its own response
+	PublishBatch(context.Context, *PublishBatchRequest) (*PublishBatchResponse, error)
+	// UpdateTopics subscribes a registered device to topics or unsubscribes it
+	UpdateTopics(context.Context, *TopicsRequest) (*TopicsResponse, error)
 	mustEmbedUnimplementedNotificationServiceServer()
 }
 
@@ -116,6 +181,18 @@ func (UnimplementedNotificationServiceServer) RemoveConnection(context.Context,
 func (UnimplementedNotificationServiceServer) StreamNotifications(*SubscribeRequest, grpc.ServerStreamingServer[Notification]) error {
 	return status.Error(codes.Unimplemented, "method StreamNotifications not implemented")
 }
+func (UnimplementedNotificationServiceServer) Connect(grpc.BidiStreamingServer[ClientMessage, Notification]) error {
+	return status.Error(codes.Unimplemented, "method Connect not implemented")
+}
+func (UnimplementedNotificationServiceServer) Publish(context.Context, *PublishRequest) (*PublishResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method Publish not implemented")
+}
+func (UnimplementedNotificationServiceServer) PublishBatch(context.Context, *PublishBatchRequest) (*PublishBatchResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method PublishBatch not implemented")
+}
+func (UnimplementedNotificationServiceServer) UpdateTopics(context.Context, *TopicsRequest) (*TopicsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method UpdateTopics not implemented")
+}
 func (UnimplementedNotificationServiceServer) mustEmbedUnimplementedNotificationServiceServer() {}
 func (UnimplementedNotificationServiceServer) testEmbeddedByValue()                             {}
 
@@ -184,6 +261,67 @@ func _NotificationService_StreamNotifications_Handler(srv interface{}, stream gr
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
 type NotificationService_StreamNotificationsServer = grpc.ServerStreamingServer[Notification]
 
+func _NotificationService_Connect_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(NotificationServiceServer).Connect(&grpc.GenericServerStream[ClientMessage, Notification]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type NotificationService_ConnectServer = grpc.BidiStreamingServer[ClientMessage, Notification]
+
+func _NotificationService_Publish_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PublishRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NotificationServiceServer).Publish(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NotificationService_Publish_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NotificationServiceServer).Publish(ctx, req.(*PublishRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NotificationService_PublishBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PublishBatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NotificationServiceServer).PublishBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NotificationService_PublishBatch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NotificationServiceServer).PublishBatch(ctx, req.(*PublishBatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NotificationService_UpdateTopics_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TopicsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NotificationServiceServer).UpdateTopics(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NotificationService_UpdateTopics_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NotificationServiceServer).UpdateTopics(ctx, req.(*TopicsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // NotificationService_ServiceDesc is the grpc.ServiceDesc for NotificationService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -199,6 +337,18 @@ var NotificationService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "RemoveConnection",
 			Handler:    _NotificationService_RemoveConnection_Handler,
 		},
+		{
+			MethodName: "Publish",
+			Handler:    _NotificationService_Publish_Handler,
+		},
+		{
+			MethodName: "PublishBatch",
+			Handler:    _NotificationService_PublishBatch_Handler,
+		},
+		{
+			MethodName: "UpdateTopics",
+			Handler:    _NotificationService_UpdateTopics_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -206,6 +356,12 @@ var NotificationService_ServiceDesc = grpc.ServiceDesc{
 			Handler:       _NotificationService_StreamNotifications_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "Connect",
+			Handler:       _NotificationService_Connect_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
 	Metadata: "proto/notification.proto",
 }
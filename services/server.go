@@ -1,13 +1,20 @@
 package services
 
 import (
-	"log"
+	"context"
+	"crypto/tls"
+	"log/slog"
 	"net"
 
+	"grpcon/config"
 	"grpcon/handlers"
+	"grpcon/middleware"
+	"grpcon/models"
 	pb "grpcon/proto"
 
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 // Server wraps the gRPC server and notification handler
@@ -17,24 +24,90 @@ type Server struct {
 	listener           net.Listener
 }
 
-// NewServer creates a new gRPC server instance
-func NewServer(port string) (*Server, error) {
+// NewServer creates a new gRPC server instance using the in-memory connection store
+func NewServer(port string, cfg *config.Config) (*Server, error) {
+	return NewServerWithStore(port, models.NewConnectionManager(), cfg)
+}
+
+// NewServerWithStore creates a new gRPC server instance backed by the given connection store.
+// Callers are authenticated with the credentials of cfg, the defaults if it is nil.
+func NewServerWithStore(port string, store models.ConnectionStore, cfg *config.Config) (*Server, error) {
+	if cfg == nil {
+		cfg = config.Default()
+	}
+	keys, err := middleware.LoadKeyStore(cfg.Auth.APIKeysFile, cfg.Auth.APIKey)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := middleware.NewAuthenticator(AuthOptions(cfg, keys))
+	if err != nil {
+		return nil, err
+	}
+	return NewServerWithAuth(port, store, auth)
+}
+
+// AuthOptions are the credentials of cfg the gRPC authenticator accepts. Services use the API keys
+// of the gateway.
+func AuthOptions(cfg *config.Config, keys *middleware.KeyStore) middleware.AuthOptions {
+	return middleware.AuthOptions{
+		Disabled:          cfg.Auth.Disabled,
+		APIKeys:           keys,
+		ClientTokenSecret: cfg.Auth.ClientTokenSecret,
+		JWTSecret:         cfg.Auth.JWTSecret,
+		JWKSFile:          cfg.Auth.JWKSFile,
+		JWTIssuer:         cfg.Auth.JWTIssuer,
+		JWTAudience:       cfg.Auth.JWTAudience,
+		ClientCerts:       cfg.TLS.CertFile != "" && cfg.TLS.ClientCAFile != "",
+		ClientCertMap:     cfg.TLS.ClientCertMap,
+	}
+}
+
+// HeartbeatOptions converts the heartbeat settings of cfg to the connection handler's options
+func HeartbeatOptions(cfg config.Heartbeat) handlers.HeartbeatOptions {
+	return handlers.HeartbeatOptions{
+		Interval:        cfg.Interval,
+		MaxFailures:     cfg.MaxFailures,
+		StaleThreshold:  cfg.StaleThreshold,
+		MonitorInterval: cfg.MonitorInterval,
+	}
+}
+
+// NewServerWithAuth creates a new gRPC server instance whose unary and stream interceptors
+// authenticate every call with auth and bind the caller to the client_id it registers or streams.
+// A nil auth disables authentication.
+func NewServerWithAuth(port string, store models.ConnectionStore, auth middleware.Authenticator) (*Server, error) {
+	return NewServerWithTLS(port, store, auth, nil)
+}
+
+// NewServerWithTLS creates a new gRPC server instance like NewServerWithAuth that only accepts
+// TLS connections using tlsConfig. A nil tlsConfig serves plaintext. Every call is traced,
+// continuing the trace of the caller's traceparent metadata.
+func NewServerWithTLS(port string, store models.ConnectionStore, auth middleware.Authenticator, tlsConfig *tls.Config) (*Server, error) {
 	// Create listener
 	lis, err := net.Listen("tcp", port)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create gRPC server
-	grpcServer := grpc.NewServer()
+	// Create gRPC server, the otelgrpc stats handler sees every call so rejected ones are traced too
+	opts := []grpc.ServerOption{grpc.StatsHandler(otelgrpc.NewServerHandler())}
+	if auth != nil {
+		opts = append(opts,
+			grpc.ChainUnaryInterceptor(middleware.UnaryAuthInterceptor(auth)),
+			grpc.ChainStreamInterceptor(middleware.StreamAuthInterceptor(auth)))
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	grpcServer := grpc.NewServer(opts...)
 
 	// Create notification server handler
-	notificationServer := handlers.NewNotificationServer()
+	notificationServer := handlers.NewNotificationServerWithHandler(handlers.NewConnectionHandlerWithStore(store))
 
 	// Register the service
 	pb.RegisterNotificationServiceServer(grpcServer, notificationServer)
 
-	log.Printf("gRPC server initialized on %s", port)
+	slog.Info("gRPC server initialized", "addr", port)
 
 	return &Server{
 		grpcServer:         grpcServer,
@@ -45,16 +118,37 @@ func NewServer(port string) (*Server, error) {
 
 // Start begins serving gRPC requests
 func (s *Server) Start() error {
-	log.Printf("Starting gRPC server on %s", s.listener.Addr().String())
+	slog.Info("Starting gRPC server", "addr", s.listener.Addr().String())
 	return s.grpcServer.Serve(s.listener)
 }
 
 // Stop gracefully stops the gRPC server
 func (s *Server) Stop() {
-	log.Println("Stopping gRPC server...")
+	slog.Info("Stopping gRPC server")
 	s.grpcServer.GracefulStop()
 }
 
+// Shutdown gracefully stops the gRPC server, waiting for running calls and streams to finish.
+// If ctx is done first the remaining ones are cancelled and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	slog.Info("Stopping gRPC server")
+	stopped := make(chan struct{})
+	go func() {
+		s.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		slog.Warn("gRPC server did not stop in time, closing remaining calls")
+		s.grpcServer.Stop()
+		<-stopped
+		return ctx.Err()
+	}
+}
+
 // GetNotificationServer returns the notification server handler
 func (s *Server) GetNotificationServer() *handlers.NotificationServer {
 	return s.notificationServer
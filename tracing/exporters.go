@@ -0,0 +1,105 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// SpanRecord is the form of a finished span served by /traces
+type SpanRecord struct {
+	TraceID      string            `json:"trace_id"`
+	SpanID       string            `json:"span_id"`
+	ParentSpanID string            `json:"parent_span_id,omitempty"`
+	Name         string            `json:"name"`
+	Start        time.Time         `json:"start"`
+	DurationMS   float64           `json:"duration_ms"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// newSpanRecord converts a finished span to its served form
+func newSpanRecord(span tracetest.SpanStub) SpanRecord {
+	record := SpanRecord{
+		TraceID:    span.SpanContext.TraceID().String(),
+		SpanID:     span.SpanContext.SpanID().String(),
+		Name:       span.Name,
+		Start:      span.StartTime,
+		DurationMS: float64(span.EndTime.Sub(span.StartTime).Microseconds()) / 1000,
+		Error:      span.Status.Description,
+	}
+	if span.Parent.IsValid() {
+		record.ParentSpanID = span.Parent.SpanID().String()
+	}
+	if len(span.Attributes) > 0 {
+		record.Attributes = make(map[string]string, len(span.Attributes))
+		for _, attr := range span.Attributes {
+			record.Attributes[string(attr.Key)] = attr.Value.Emit()
+		}
+	}
+	return record
+}
+
+// MemoryExporter keeps the most recent spans in a tracetest in-memory exporter, for tests and
+// the /traces endpoint
+type MemoryExporter struct {
+	mu       sync.Mutex
+	spans    *tracetest.InMemoryExporter
+	count    int // spans held by spans
+	capacity int
+}
+
+// NewMemoryExporter creates an exporter keeping up to capacity spans
+func NewMemoryExporter(capacity int) *MemoryExporter {
+	if capacity <= 0 {
+		capacity = 1000
+	}
+	return &MemoryExporter{spans: tracetest.NewInMemoryExporter(), capacity: capacity}
+}
+
+// ExportSpans implements sdktrace.SpanExporter. Past twice the capacity the oldest spans are
+// dropped, so trimming is rare.
+func (e *MemoryExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.spans.ExportSpans(ctx, spans); err != nil {
+		return err
+	}
+	e.count += len(spans)
+	if e.count <= 2*e.capacity {
+		return nil
+	}
+
+	kept := e.spans.GetSpans()
+	kept = kept[len(kept)-e.capacity:]
+	e.spans.Reset()
+	e.count = len(kept)
+	return e.spans.ExportSpans(ctx, kept.Snapshots())
+}
+
+// Shutdown implements sdktrace.SpanExporter, the kept spans stay readable
+func (e *MemoryExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// Spans returns the kept spans, oldest first. If traceID is not empty only that trace's spans are returned.
+func (e *MemoryExporter) Spans(traceID string) []SpanRecord {
+	e.mu.Lock()
+	stubs := e.spans.GetSpans()
+	e.mu.Unlock()
+
+	if len(stubs) > e.capacity {
+		stubs = stubs[len(stubs)-e.capacity:]
+	}
+	records := make([]SpanRecord, 0, len(stubs))
+	for _, stub := range stubs {
+		if traceID == "" || stub.SpanContext.TraceID().String() == traceID {
+			records = append(records, newSpanRecord(stub))
+		}
+	}
+	return records
+}
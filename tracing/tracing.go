@@ -0,0 +1,149 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TraceparentHeader is the W3C trace context header, also used as gRPC metadata key
+const TraceparentHeader = "traceparent"
+
+// ServiceName is the service.name of every span
+const ServiceName = "grpcon"
+
+// propagator reads and writes W3C trace context, the only format the server speaks
+var propagator = propagation.TraceContext{}
+
+// Options configure where spans go and how many traces are sampled
+type Options struct {
+	Exporter     string  // none, stdout, memory or otlp
+	MemorySpans  int     // spans kept by the memory exporter
+	SampleRatio  float64 // share of new traces sampled, traces continued from a caller follow its decision
+	OTLPEndpoint string  // host:port of the OTLP gRPC collector, OTEL_EXPORTER_OTLP_ENDPOINT if empty
+	OTLPInsecure bool    // talk to the collector without TLS
+}
+
+// Provider is the tracer provider installed by Setup
+type Provider struct {
+	*sdktrace.TracerProvider
+	memory *MemoryExporter
+}
+
+// Memory returns the memory exporter, nil unless it is the configured one
+func (p *Provider) Memory() *MemoryExporter {
+	return p.memory
+}
+
+// Setup installs the global tracer provider and the W3C trace context propagator. Spans are sampled
+// by opts.SampleRatio unless their parent decided, and exported by opts.Exporter. With the none
+// exporter spans are still created so trace context is propagated. Shutdown the provider to flush
+// the last spans.
+func Setup(opts Options) (*Provider, error) {
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := &Provider{}
+	providerOpts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	}
+
+	switch opts.Exporter {
+	case "", "none":
+	case "stdout":
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, err
+		}
+		providerOpts = append(providerOpts, sdktrace.WithBatcher(exporter))
+	case "memory":
+		// Spans are kept as they end so /traces shows them right away
+		provider.memory = NewMemoryExporter(opts.MemorySpans)
+		providerOpts = append(providerOpts, sdktrace.WithSyncer(provider.memory))
+	case "otlp":
+		clientOpts := []otlptracegrpc.Option{}
+		if opts.OTLPEndpoint != "" {
+			clientOpts = append(clientOpts, otlptracegrpc.WithEndpoint(opts.OTLPEndpoint))
+		}
+		if opts.OTLPInsecure {
+			clientOpts = append(clientOpts, otlptracegrpc.WithInsecure())
+		}
+		// Connects lazily, spans are retried while the collector is unreachable
+		exporter, err := otlptracegrpc.New(context.Background(), clientOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+		}
+		providerOpts = append(providerOpts, sdktrace.WithBatcher(exporter))
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter: %s", opts.Exporter)
+	}
+
+	provider.TracerProvider = sdktrace.NewTracerProvider(providerOpts...)
+	otel.SetTracerProvider(provider.TracerProvider)
+	otel.SetTextMapPropagator(propagator)
+	return provider, nil
+}
+
+// Tracer returns the tracer of the server's own spans, from the global provider
+func Tracer() trace.Tracer {
+	return otel.Tracer("grpcon")
+}
+
+// ContextFromTraceparent returns a context whose spans continue the trace of a traceparent value,
+// a context without a parent if it is empty or invalid
+func ContextFromTraceparent(traceparent string) context.Context {
+	carrier := propagation.MapCarrier{TraceparentHeader: traceparent}
+	return propagator.Extract(context.Background(), carrier)
+}
+
+// TraceparentFromContext returns the traceparent of the span carried by ctx, empty if none
+func TraceparentFromContext(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier.Get(TraceparentHeader)
+}
+
+// StartFromTraceparent starts a child span of a traceparent value, the root of a new trace if it is
+// empty or invalid. The returned context carries the span.
+func StartFromTraceparent(traceparent, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return Tracer().Start(ContextFromTraceparent(traceparent), name, opts...)
+}
+
+// End records err on span, if any, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// HTTPHandler traces every request with otelhttp, continuing the trace of its traceparent header if
+// it has one. The response carries the traceparent of the request's span.
+func HTTPHandler(next http.Handler) http.Handler {
+	withTraceparent := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if traceparent := TraceparentFromContext(r.Context()); traceparent != "" {
+			w.Header().Set(TraceparentHeader, traceparent)
+		}
+		next.ServeHTTP(w, r)
+	})
+	return otelhttp.NewHandler(withTraceparent, "http_gateway",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return "HTTP " + r.Method + " " + r.URL.Path
+		}))
+}
@@ -0,0 +1,83 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func setup(t *testing.T, ratio float64, memorySpans int) *MemoryExporter {
+	t.Helper()
+	provider, err := Setup(Options{Exporter: "memory", MemorySpans: memorySpans, SampleRatio: ratio})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	return provider.Memory()
+}
+
+const (
+	sampledParent   = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	unsampledParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"
+)
+
+func TestSpansFollowTheParentSamplingDecision(t *testing.T) {
+	memory := setup(t, 0, 10)
+
+	ctx, span := StartFromTraceparent(sampledParent, "sampled")
+	span.End()
+	if got := TraceparentFromContext(ctx); got[:36] != sampledParent[:36] || got[len(got)-2:] != "01" {
+		t.Fatalf("traceparent of a sampled child = %s", got)
+	}
+	spans := memory.Spans("4bf92f3577b34da6a3ce929d0e0e4736")
+	if len(spans) != 1 || spans[0].ParentSpanID != "00f067aa0ba902b7" {
+		t.Fatalf("exported spans = %+v, want the child of the sampled parent", spans)
+	}
+
+	// Not sampled by the caller or by the ratio: the trace is still propagated but nothing is exported
+	ctx, span = StartFromTraceparent(unsampledParent, "unsampled")
+	span.End()
+	if got := TraceparentFromContext(ctx); got == "" || got[len(got)-2:] != "00" {
+		t.Fatalf("traceparent of an unsampled child = %q", got)
+	}
+	_, span = StartFromTraceparent("", "root")
+	span.End()
+	if got := len(memory.Spans("")); got != 1 {
+		t.Fatalf("%d spans exported, want only the sampled one", got)
+	}
+}
+
+func TestMemoryExporterKeepsTheLatestSpans(t *testing.T) {
+	memory := setup(t, 1, 3)
+
+	for _, name := range []string{"1", "2", "3", "4", "5", "6", "7"} {
+		_, span := StartFromTraceparent("", name)
+		span.End()
+	}
+	spans := memory.Spans("")
+	if len(spans) != 3 || spans[0].Name != "5" || spans[2].Name != "7" {
+		t.Fatalf("kept spans = %+v, want 5, 6 and 7", spans)
+	}
+}
+
+func TestHTTPHandlerContinuesTheCallersTrace(t *testing.T) {
+	memory := setup(t, 1, 10)
+
+	var inner string
+	handler := HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inner = TraceparentFromContext(r.Context())
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/send", nil)
+	req.Header.Set(TraceparentHeader, sampledParent)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get(TraceparentHeader); got == "" || got != inner {
+		t.Fatalf("response traceparent = %q, want the request span's %q", got, inner)
+	}
+	spans := memory.Spans("4bf92f3577b34da6a3ce929d0e0e4736")
+	if len(spans) != 1 || spans[0].Name != "HTTP POST /send" {
+		t.Fatalf("exported spans = %+v, want HTTP POST /send in the caller's trace", spans)
+	}
+}